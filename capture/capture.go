@@ -383,6 +383,7 @@ func (l *Listener) read() {
 			}
 
 			messageParser := tcp.NewMessageParser(l.messages, l.ports, hndl.ips, l.expiry, l.allowIncomplete)
+			messageParser.Iface = key
 
 			if l.protocol == tcp.ProtocolHTTP {
 				messageParser.Start = http1StartHint
@@ -0,0 +1,14 @@
+#!/usr/bin/env bash
+#
+# Binary protocol echo middleware, returns every message untouched.
+# Run gor with `--middleware-protocol auto` and the middleware will opt into
+# length-prefixed framing, so payloads do not have to be hex decoded and encoded.
+#
+# Frames are: 4 byte big-endian meta length, meta, 4 byte big-endian body length, body.
+#
+
+if [[ "$GOR_MIDDLEWARE_PROTOCOLS" == *binary* ]]; then
+    echo "GOR-BINARY-V1"
+fi
+
+exec cat
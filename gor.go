@@ -14,8 +14,10 @@ import (
 	httppptof "net/http/pprof"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
 	"runtime/pprof"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -83,10 +85,29 @@ func main() {
 		core.Debug(0, "Started example file server for current directory on address ", args[1])
 
 		log.Fatal(http.ListenAndServe(args[1], loggingMiddleware(args[1], http.FileServer(http.Dir(dir)))))
+	} else if len(args) > 0 && args[0] == "index" {
+		if len(args) < 2 {
+			log.Fatal("You should specify files to index. Example: `gor index 'requests_*.gor'`")
+		}
+		os.Exit(buildIndexes(args[1:]))
+	} else if len(args) > 0 && args[0] == "convert" {
+		os.Exit(convert(args[1:]))
 	} else {
 		flag.Parse()
-		core.CheckSettings()
-		plugins = core.NewPlugins()
+		if core.Settings.Config != "" {
+			settings, err := core.ParseSettings(os.Args[1:])
+			if err != nil {
+				log.Fatal("Can't read config: ", err)
+			}
+			core.Settings = *settings
+		}
+		if err := core.CheckSettings(); err != nil {
+			log.Fatal(err)
+		}
+		var err error
+		if plugins, err = core.NewPlugins(); err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	log.Printf("[PPID %d and PID %d] Version:%s\n", os.Getppid(), os.Getpid(), version.VERSION)
@@ -111,7 +132,29 @@ func main() {
 
 	closeCh := make(chan int)
 	emitter := core.NewEmitter()
-	go emitter.Start(plugins, core.Settings.Middleware)
+	if err := emitter.Start(plugins, core.Settings.Middleware...); err != nil {
+		log.Fatal(err)
+	}
+
+	if core.Settings.HTTPControl != "" {
+		api := core.NewControlAPI(emitter, func() error {
+			return reload(emitter)
+		})
+		api.SetToken(core.Settings.HTTPControlToken)
+		mux := http.NewServeMux()
+		mux.Handle("/control/", api)
+		go func() {
+			log.Println(http.ListenAndServe(core.Settings.HTTPControl, mux))
+		}()
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reload(emitter)
+		}
+	}()
+
 	if core.Settings.ExitAfter > 0 {
 		log.Printf("Running gor for a duration of %s\n", core.Settings.ExitAfter)
 
@@ -120,6 +163,12 @@ func main() {
 			close(closeCh)
 		})
 	}
+	// nil channel blocks forever if there is no load profile
+	var loadDone <-chan struct{}
+	if plugins.LoadTest != nil {
+		log.Printf("Running load profile %s for %s\n", &core.Settings.LoadTestConfig.Profile, core.Settings.LoadTestConfig.Profile.Duration())
+		loadDone = plugins.LoadTest.Done()
+	}
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	exit := 0
@@ -128,11 +177,119 @@ func main() {
 		exit = 1
 	case <-closeCh:
 		exit = 0
+	case <-loadDone:
+		exit = 0
+	case <-emitter.Failed():
+		log.Println(emitter.Err())
+		exit = 1
+	}
+
+	if core.Settings.ShutdownTimeout > 0 {
+		// A second signal stops immediately
+		go func() {
+			<-c
+			log.Println("Forced shutdown")
+			os.Exit(1)
+		}()
+
+		log.Printf("Shutting down, waiting up to %s for outputs to drain\n", core.Settings.ShutdownTimeout)
+		for name, n := range emitter.Shutdown(core.Settings.ShutdownTimeout) {
+			log.Printf("Shutdown timeout reached, %d messages discarded by %s\n", n, name)
+		}
+	} else {
+		emitter.Close()
+	}
+	if plugins.LoadTest != nil {
+		if err := plugins.LoadTest.Finish(); err != nil {
+			log.Println("Can't write load test report:", err)
+		}
+	}
+	if plugins.LatencyStats != nil {
+		if err := plugins.LatencyStats.Finish(); err != nil {
+			log.Println("Can't write latency stats:", err)
+		}
+	}
+	if plugins.LatencyRegression != nil {
+		if err := plugins.LatencyRegression.Finish(); err != nil {
+			log.Println("Can't write latency regression report:", err)
+		}
 	}
-	emitter.Close()
 	os.Exit(exit)
 }
 
+// buildIndexes writes time indexes of files matching the patterns, and returns the exit code
+func buildIndexes(patterns []string) int {
+	exit := 0
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err == nil && len(matches) == 0 {
+			err = fmt.Errorf("no files match %q", pattern)
+		}
+		if err != nil {
+			log.Println(err)
+			exit = 1
+			continue
+		}
+
+		for _, path := range matches {
+			if strings.HasSuffix(path, ".idx") {
+				continue
+			}
+			index, err := core.BuildTimeIndex(path)
+			if err != nil {
+				log.Println("Can't index", err)
+				exit = 1
+				continue
+			}
+			if len(index.Entries) == 0 {
+				log.Printf("%s: no records\n", path)
+				continue
+			}
+			log.Printf("%s: %d records in %d segments, from %s to %s\n", path, index.Records(), len(index.Entries),
+				time.Unix(0, index.First()).Format(time.RFC3339), time.Unix(0, index.Last()).Format(time.RFC3339))
+		}
+	}
+	return exit
+}
+
+// convert writes files matching the patterns to the output in another format, and returns the exit code
+func convert(args []string) int {
+	to := flag.String("to", "parquet", "Format of the output: parquet, jsonl, v1 or v2")
+	encrypt := flag.Bool("encrypt", false, "Encrypt the output by the first --file-encryption-key, other keys only decrypt the files")
+	flag.CommandLine.Parse(args)
+	if err := core.CheckSettings(); err != nil {
+		log.Println(err)
+		return 1
+	}
+	if flag.NArg() < 2 {
+		log.Println("You should specify files to convert and the output. Example: `gor convert --to parquet 'requests_*.gor' requests.parquet`")
+		return 1
+	}
+
+	patterns, output := flag.Args()[:flag.NArg()-1], flag.Arg(flag.NArg()-1)
+	n, err := core.Convert(patterns, output, *to, *encrypt)
+	if err != nil {
+		log.Println("Can't convert:", err)
+		return 1
+	}
+	log.Printf("%d messages converted to %s\n", n, output)
+	return 0
+}
+
+// reload reads the config again and applies filters, rewrites, rate limits and routes, keeping inputs running
+func reload(emitter *core.Emitter) error {
+	settings, err := core.ParseSettings(os.Args[1:])
+	if err == nil {
+		err = emitter.Reload(settings)
+	}
+	if err != nil {
+		log.Println("Can't reload config, keeping the current one:", err)
+		return err
+	}
+	log.Println("Config reloaded")
+	return nil
+}
+
 func profileCPU(cpuprofile string) {
 	if cpuprofile != "" {
 		f, err := os.Create(cpuprofile)
@@ -0,0 +1,25 @@
+package core
+
+import "time"
+
+// Clock is a source of time for plugins which replay recorded timing, like FileInput.
+// It allows to replace waiting with a deterministic clock in tests.
+type Clock interface {
+	Now() time.Time
+	// After is like time.After, stop releases the timer if it has not fired yet
+	After(d time.Duration) (c <-chan time.Time, stop func())
+}
+
+// RealClock is the Clock based on system time
+type RealClock struct{}
+
+// Now returns time.Now()
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+// After starts a timer firing after d
+func (RealClock) After(d time.Duration) (<-chan time.Time, func()) {
+	timer := time.NewTimer(d)
+	return timer.C, func() { timer.Stop() }
+}
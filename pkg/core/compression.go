@@ -0,0 +1,285 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+)
+
+// fileCompression is a compression of recorded files. It's chosen by extension of the file, or by
+// --output-file-compression, files without known extension are detected by the magic number.
+type fileCompression struct {
+	name      string
+	extension string
+	magic     []byte
+	// frames tells if flushes end the compressed frame, so the file can be read up to the last flush
+	// if the writer crashes
+	frames    bool
+	newWriter func(w io.Writer, level int) (compressedWriter, error)
+	newReader func(r io.Reader) (io.ReadCloser, error)
+	// readFrame reads the next compressed frame, nil for formats without frame sizes in headers
+	readFrame func(r *bufio.Reader) ([]byte, error)
+	// decodeFrame decompresses a frame returned by readFrame
+	decodeFrame func(frame []byte) ([]byte, error)
+}
+
+// compressedWriter is implemented by gzip, zstd and lz4 writers. Close ends the compressed frame,
+// and Reset starts a new one.
+type compressedWriter interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+var gzipCompression = &fileCompression{
+	name:      "gzip",
+	extension: ".gz",
+	magic:     []byte{0x1f, 0x8b},
+	newWriter: func(w io.Writer, level int) (compressedWriter, error) {
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	},
+	newReader: func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+}
+
+// zstd decoder used for independent frames, it's safe for concurrent use
+var zstdFrameDecoder, _ = zstd.NewReader(nil)
+
+var zstdCompression = &fileCompression{
+	name:      "zstd",
+	extension: ".zst",
+	magic:     []byte{0x28, 0xb5, 0x2f, 0xfd},
+	frames:    true,
+	newWriter: func(w io.Writer, level int) (compressedWriter, error) {
+		if level < 0 || level > 22 {
+			return nil, fmt.Errorf("zstd compression level should be from 1 to 22, got %d", level)
+		}
+		var options []zstd.EOption
+		if level > 0 {
+			options = append(options, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		return zstd.NewWriter(w, options...)
+	},
+	newReader: func(r io.Reader) (io.ReadCloser, error) {
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	},
+	readFrame: readZstdFrame,
+	decodeFrame: func(frame []byte) ([]byte, error) {
+		return zstdFrameDecoder.DecodeAll(frame, nil)
+	},
+}
+
+var lz4Compression = &fileCompression{
+	name:      "lz4",
+	extension: ".lz4",
+	magic:     []byte{0x04, 0x22, 0x4d, 0x18},
+	frames:    true,
+	newWriter: func(w io.Writer, level int) (compressedWriter, error) {
+		if level < 0 {
+			return nil, fmt.Errorf("lz4 compression level should be positive, got %d", level)
+		}
+		lw := lz4.NewWriter(w)
+		lw.Header.CompressionLevel = level
+		return lw, nil
+	},
+	newReader: func(r io.Reader) (io.ReadCloser, error) {
+		return ioutil.NopCloser(lz4.NewReader(r)), nil
+	},
+	readFrame: readLZ4Frame,
+	decodeFrame: func(frame []byte) ([]byte, error) {
+		return ioutil.ReadAll(lz4.NewReader(bytes.NewReader(frame)))
+	},
+}
+
+var fileCompressions = []*fileCompression{gzipCompression, zstdCompression, lz4Compression}
+
+// outputCompression returns the compression set by name, or by extension of the path if the name is empty.
+// It returns nil for uncompressed files.
+func outputCompression(path, name string) (*fileCompression, error) {
+	switch name {
+	case "":
+		return compressionByExtension(path), nil
+	case "none":
+		return nil, nil
+	}
+	for _, c := range fileCompressions {
+		if c.name == name {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown compression %q, expected gzip, zstd, lz4 or none", name)
+}
+
+func compressionByExtension(path string) *fileCompression {
+	for _, c := range fileCompressions {
+		if strings.HasSuffix(path, c.extension) {
+			return c
+		}
+	}
+	return nil
+}
+
+// detectCompression returns compression of the file by its extension, or by the magic number
+func detectCompression(path string, r *bufio.Reader) *fileCompression {
+	if c := compressionByExtension(path); c != nil {
+		return c
+	}
+	for _, c := range fileCompressions {
+		if magic, _ := r.Peek(len(c.magic)); bytes.Equal(magic, c.magic) {
+			return c
+		}
+	}
+	return nil
+}
+
+// frameReader reads exactly the bytes of a frame
+type frameReader struct {
+	r     *bufio.Reader
+	frame []byte
+	err   error
+}
+
+func (f *frameReader) read(n int) []byte {
+	if f.err != nil {
+		return nil
+	}
+	if n > fileFormatMaxRecord {
+		f.err = fmt.Errorf("invalid frame size %d", n)
+		return nil
+	}
+	start := len(f.frame)
+	f.frame = append(f.frame, make([]byte, n)...)
+	if _, err := io.ReadFull(f.r, f.frame[start:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		f.err = err
+		return nil
+	}
+	return f.frame[start:]
+}
+
+func (f *frameReader) readUint32() uint32 {
+	if b := f.read(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+// readSkippableFrame reads a skippable frame, which is the same in zstd and lz4 formats
+func (f *frameReader) readSkippableFrame() ([]byte, error) {
+	size := f.readUint32()
+	f.read(int(size))
+	return f.frame, f.err
+}
+
+func isSkippableFrame(magic uint32) bool {
+	return magic&0xfffffff0 == 0x184d2a50
+}
+
+// readZstdFrame reads the next zstd frame, it returns io.EOF if there are no more frames
+func readZstdFrame(r *bufio.Reader) ([]byte, error) {
+	if _, err := r.Peek(1); err == io.EOF {
+		return nil, io.EOF
+	}
+	f := &frameReader{r: r}
+	magic := f.readUint32()
+	if f.err == nil && isSkippableFrame(magic) {
+		return f.readSkippableFrame()
+	}
+	if f.err == nil && magic != 0xfd2fb528 {
+		return nil, fmt.Errorf("invalid zstd frame magic %x", magic)
+	}
+
+	var descriptor byte
+	if b := f.read(1); b != nil {
+		descriptor = b[0]
+	}
+	singleSegment := descriptor&0x20 != 0
+	if !singleSegment {
+		f.read(1) // window descriptor
+	}
+	f.read([]int{0, 1, 2, 4}[descriptor&3]) // dictionary id
+	contentSize := []int{0, 2, 4, 8}[descriptor>>6]
+	if contentSize == 0 && singleSegment {
+		contentSize = 1
+	}
+	f.read(contentSize)
+
+	for f.err == nil {
+		var header uint32
+		if b := f.read(3); b != nil {
+			header = uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+		}
+		size := int(header >> 3)
+		if blockType := header >> 1 & 3; blockType == 1 {
+			size = 1 // RLE block holds a single byte
+		}
+		f.read(size)
+		if header&1 != 0 {
+			break
+		}
+	}
+	if descriptor&0x04 != 0 {
+		f.read(4) // checksum
+	}
+	return f.frame, f.err
+}
+
+// readLZ4Frame reads the next lz4 frame, it returns io.EOF if there are no more frames
+func readLZ4Frame(r *bufio.Reader) ([]byte, error) {
+	if _, err := r.Peek(1); err == io.EOF {
+		return nil, io.EOF
+	}
+	f := &frameReader{r: r}
+	magic := f.readUint32()
+	if f.err == nil && isSkippableFrame(magic) {
+		return f.readSkippableFrame()
+	}
+	if f.err == nil && magic != 0x184d2204 {
+		return nil, fmt.Errorf("invalid lz4 frame magic %x", magic)
+	}
+
+	var flags byte
+	if b := f.read(2); b != nil {
+		flags = b[0]
+	}
+	if flags&0x08 != 0 {
+		f.read(8) // content size
+	}
+	if flags&0x01 != 0 {
+		f.read(4) // dictionary id
+	}
+	f.read(1) // header checksum
+
+	for f.err == nil {
+		size := f.readUint32() &^ (1 << 31) // the highest bit is set for uncompressed blocks
+		if size == 0 {
+			break
+		}
+		f.read(int(size))
+		if flags&0x10 != 0 {
+			f.read(4) // block checksum
+		}
+	}
+	if flags&0x04 != 0 {
+		f.read(4) // content checksum
+	}
+	return f.frame, f.err
+}
@@ -0,0 +1,72 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileOutputFrames(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor-compression")
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name, compression string
+		level             int
+	}{
+		{"requests.gor.zst", "", 0},
+		{"requests.gor.lz4", "", 9},
+		{"requests_zstd.gor", "zstd", 19},
+		{"requests_lz4.gor", "lz4", 0},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name)
+		output := newTestFileOutput(t, path, &FileOutputConfig{Append: true, Compression: tt.compression, CompressionLevel: tt.level, FlushInterval: time.Minute})
+		write := func(k int) {
+			output.PluginWrite(&Message{Meta: []byte(fmt.Sprintf("1 %d %d -1\n", k, k)), Data: []byte("GET / HTTP/1.1\r\n\r\n")})
+		}
+		for k := 0; k < 3; k++ {
+			write(k)
+		}
+		output.flush()
+		write(3)
+
+		// the file is readable up to the last flush if the writer crashes
+		data, _ := ioutil.ReadFile(path)
+		crashed := filepath.Join(dir, "crashed_"+tt.name)
+		ioutil.WriteFile(crashed, data, 0600)
+		if msgs, _ := readFileMessages(t, crashed); len(msgs) != 3 {
+			t.Errorf("%s: expected 3 flushed messages, got %d", tt.name, len(msgs))
+		}
+
+		output.Close()
+		if msgs, _ := readFileMessages(t, path); len(msgs) != 4 {
+			t.Errorf("%s: expected 4 messages, got %d", tt.name, len(msgs))
+		}
+	}
+}
+
+func TestOutputCompression(t *testing.T) {
+	tests := []struct {
+		path, name string
+		expected   *fileCompression
+	}{
+		{"requests.gor", "", nil},
+		{"requests.gor.gz", "", gzipCompression},
+		{"requests.gor.zst", "", zstdCompression},
+		{"requests.gor.lz4", "", lz4Compression},
+		{"requests.gor", "lz4", lz4Compression},
+		{"requests.gor.gz", "none", nil},
+	}
+	for _, tt := range tests {
+		if c, err := outputCompression(tt.path, tt.name); err != nil || c != tt.expected {
+			t.Errorf("%s %q: expected %v, got %v %v", tt.path, tt.name, tt.expected, c, err)
+		}
+	}
+	if _, err := outputCompression("requests.gor", "brotli"); err == nil {
+		t.Error("Expected error for unknown compression")
+	}
+}
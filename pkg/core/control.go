@@ -0,0 +1,285 @@
+package core
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PluginState describes a running plugin
+type PluginState struct {
+	Name     string            `json:"name"`
+	Kind     string            `json:"kind"` // input, middleware or output
+	Plugin   string            `json:"plugin"`
+	Limit    string            `json:"limit,omitempty"`
+	Disabled bool              `json:"disabled,omitempty"`
+	Queue    *OutputQueueStats `json:"queue,omitempty"`
+	QueueLen int               `json:"queue_len,omitempty"`
+	File     *FileInputState   `json:"file,omitempty"`
+	Adaptive *AdaptiveState    `json:"adaptive,omitempty"`
+}
+
+// State returns state of inputs, middleware and outputs
+func (e *Emitter) State() ([]PluginState, error) {
+	p, ok := e.pipeline.Load().(*pipeline)
+	if !ok {
+		return nil, errors.New("emitter is not started")
+	}
+
+	var states []PluginState
+	for _, in := range e.plugins.Inputs {
+		// Outputs reading responses are reported as outputs
+		if e.isOutput(in) {
+			continue
+		}
+		state := PluginState{Name: e.plugins.InputNames[in], Kind: "input"}
+		if m, ok := in.(*Middleware); ok {
+			state.Name, state.Kind = m.String(), "middleware"
+		}
+		state.describe(in)
+		if fi, ok := unwrapPlugin(in).(*FileInput); ok {
+			file := fi.State()
+			state.File = &file
+		}
+		states = append(states, state)
+	}
+
+	for _, out := range e.outputs {
+		state := PluginState{Name: e.names[out], Kind: "output", Disabled: p.disabled[out]}
+		if q, ok := out.(*OutputQueue); ok {
+			stats := q.Stats()
+			state.Queue, state.QueueLen = &stats, q.Len()
+			state.describe(q.output)
+		} else {
+			state.describe(out)
+		}
+		states = append(states, state)
+	}
+
+	return states, nil
+}
+
+func (s *PluginState) describe(plugin interface{}) {
+	if i, ok := plugin.(*loadTestInput); ok {
+		plugin = i.in
+	}
+	if l, ok := plugin.(*Limiter); ok {
+		s.Limit = l.Limit()
+		plugin = l.plugin
+	}
+	if o, ok := plugin.(*HTTPOutput); ok {
+		if state, ok := o.AdaptiveState(); ok {
+			s.Adaptive = &state
+		}
+	}
+	s.Plugin = fmt.Sprint(plugin)
+}
+
+// unwrapPlugin returns the plugin wrapped by a limiter or the load test
+func unwrapPlugin(plugin interface{}) interface{} {
+	for {
+		switch p := plugin.(type) {
+		case *Limiter:
+			plugin = p.plugin
+		case *loadTestInput:
+			plugin = p.in
+		default:
+			return plugin
+		}
+	}
+}
+
+// FileInputs returns file inputs registered with the path, or all of them if the path is empty
+func (e *Emitter) FileInputs(path string) ([]*FileInput, error) {
+	if e.pipeline.Load() == nil {
+		return nil, errors.New("emitter is not started")
+	}
+
+	var inputs []*FileInput
+	for _, in := range e.plugins.Inputs {
+		fi, ok := unwrapPlugin(in).(*FileInput)
+		if ok && (path == "" || e.plugins.InputNames[in] == path) {
+			inputs = append(inputs, fi)
+		}
+	}
+	if len(inputs) == 0 {
+		if path == "" {
+			return nil, errors.New("there are no file inputs")
+		}
+		return nil, fmt.Errorf("unknown file input %q", path)
+	}
+	return inputs, nil
+}
+
+// ControlAPI serves HTTP endpoints for changing replay at runtime, mounted at /control/:
+//
+//	GET  /control/plugins                           state of inputs and outputs
+//	POST /control/inputs/pause?name=requests.gor    pause file inputs, all of them if name is omitted
+//	POST /control/inputs/resume?name=requests.gor
+//	POST /control/inputs/speed?factor=2             change speed factor, like the `|200%` limit
+//	POST /control/inputs/skip?to=2021-06-01T10:00:00Z  skip forward, `to` is RFC3339 or unix nanoseconds
+//	POST /control/outputs/disable?name=http://staging.com
+//	POST /control/outputs/enable?name=http://staging.com
+//	POST /control/reload                            reload config, see Emitter.Reload
+//
+// POST endpoints respond with the state of plugins, errors are returned as {"error": "..."}.
+type ControlAPI struct {
+	emitter *Emitter
+	reload  func() error
+	token   string
+}
+
+// NewControlAPI creates control API of the emitter, reload is called on /control/reload and can be nil
+func NewControlAPI(emitter *Emitter, reload func() error) *ControlAPI {
+	return &ControlAPI{emitter: emitter, reload: reload}
+}
+
+// SetToken makes the API require the `Authorization: Bearer <token>` header, it should be called before serving
+func (c *ControlAPI) SetToken(token string) {
+	c.token = token
+}
+
+// controlAddress returns the address the control API listens on: addresses without host listen on localhost,
+// and other hosts than localhost require a token
+func controlAddress(address, token string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", fmt.Errorf("invalid control API address %q: %v", address, err)
+	}
+	if host == "" {
+		return net.JoinHostPort("127.0.0.1", port), nil
+	}
+	if ip := net.ParseIP(host); token == "" && host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return "", fmt.Errorf("control API on %s requires --http-control-token", address)
+	}
+	return address, nil
+}
+
+func (c *ControlAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if c.token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+c.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeControlError(w, http.StatusUnauthorized, errors.New("invalid or missing token"))
+		return
+	}
+
+	action := strings.TrimPrefix(r.URL.Path, "/control/")
+
+	if action == "plugins" {
+		if r.Method != http.MethodGet {
+			writeControlError(w, http.StatusMethodNotAllowed, errors.New("use GET"))
+			return
+		}
+		c.writeState(w)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		writeControlError(w, http.StatusMethodNotAllowed, errors.New("use POST"))
+		return
+	}
+
+	var err error
+	name := r.FormValue("name")
+
+	switch action {
+	case "inputs/pause":
+		err = c.eachFileInput(name, func(i *FileInput) error {
+			i.Pause()
+			return nil
+		})
+	case "inputs/resume":
+		err = c.eachFileInput(name, func(i *FileInput) error {
+			i.Resume()
+			return nil
+		})
+	case "inputs/speed":
+		var factor float64
+		if factor, err = strconv.ParseFloat(r.FormValue("factor"), 64); err != nil || factor <= 0 {
+			err = fmt.Errorf("factor should be a positive number, got %q", r.FormValue("factor"))
+			break
+		}
+		err = c.eachFileInput(name, func(i *FileInput) error {
+			i.SetSpeedFactor(factor)
+			return nil
+		})
+	case "inputs/skip":
+		var to int64
+		if to, err = parseControlTimestamp(r.FormValue("to")); err != nil {
+			break
+		}
+		err = c.eachFileInput(name, func(i *FileInput) error {
+			return i.Skip(to)
+		})
+	case "outputs/enable", "outputs/disable":
+		err = c.emitter.SetOutputEnabled(name, action == "outputs/enable")
+	case "reload":
+		if c.reload == nil {
+			err = errors.New("reload is not supported")
+			break
+		}
+		err = c.reload()
+	default:
+		writeControlError(w, http.StatusNotFound, fmt.Errorf("unknown endpoint %q", r.URL.Path))
+		return
+	}
+
+	if err != nil {
+		writeControlError(w, http.StatusBadRequest, err)
+		return
+	}
+	Debug(1, fmt.Sprintf("[CONTROL] %s %s", action, r.Form.Encode()))
+
+	c.writeState(w)
+}
+
+func (c *ControlAPI) eachFileInput(name string, fn func(*FileInput) error) error {
+	inputs, err := c.emitter.FileInputs(name)
+	if err != nil {
+		return err
+	}
+	for _, i := range inputs {
+		if err := fn(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *ControlAPI) writeState(w http.ResponseWriter) {
+	state, err := c.emitter.State()
+	if err != nil {
+		writeControlError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	writeControlJSON(w, http.StatusOK, state)
+}
+
+// parseControlTimestamp accepts RFC3339 time or unix time in nanoseconds
+func parseControlTimestamp(value string) (int64, error) {
+	if ts, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return ts, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return 0, fmt.Errorf("timestamp should be RFC3339 or unix nanoseconds, got %q", value)
+	}
+	return t.UnixNano(), nil
+}
+
+func writeControlError(w http.ResponseWriter, status int, err error) {
+	writeControlJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func writeControlJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
@@ -0,0 +1,226 @@
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/reoring/goreplay/pkg/protocol"
+)
+
+func controlRequest(t *testing.T, server *httptest.Server, method, path string, params url.Values) (int, []PluginState) {
+	req, _ := http.NewRequest(method, server.URL+path+"?"+params.Encode(), nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var state []PluginState
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode, state
+}
+
+func TestControlAPIFileInput(t *testing.T) {
+	f, err := ioutil.TempFile("", "gor-control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	// requests recorded an hour apart
+	start := time.Now().Add(-24 * time.Hour).UnixNano()
+	for i := 0; i < 3; i++ {
+		ts := start + int64(i)*int64(time.Hour)
+		f.Write(protocol.PayloadHeader(protocol.RequestPayload, protocol.Uuid(), ts, -1))
+		f.Write([]byte("GET /" + strconv.Itoa(i) + " HTTP/1.1\r\n\r\n"))
+		f.Write([]byte(protocol.PayloadSeparator))
+	}
+	f.Close()
+
+	received := make(chan *Message, 10)
+	plugins := new(InOutPlugins)
+	plugins.RegisterPlugin(NewFileInput, f.Name(), false, 100, time.Duration(0), false)
+	plugins.RegisterPlugin(func() PluginWriter {
+		return NewTestOutput(func(msg *Message) { received <- msg })
+	})
+
+	emitter := NewEmitter()
+	emitter.Start(plugins)
+	defer emitter.Close()
+
+	server := httptest.NewServer(NewControlAPI(emitter, nil))
+	defer server.Close()
+
+	next := func() string {
+		select {
+		case msg := <-received:
+			return string(msg.Data)
+		case <-time.After(time.Second):
+			return ""
+		}
+	}
+
+	if req := next(); req != "GET /0 HTTP/1.1\r\n\r\n" {
+		t.Fatalf("Should replay the first request, got %q", req)
+	}
+
+	status, state := controlRequest(t, server, "POST", "/control/inputs/pause", url.Values{"name": {f.Name()}})
+	if status != http.StatusOK || len(state) != 2 || state[0].File == nil || !state[0].File.Paused {
+		t.Fatal("Should pause the input", status, state)
+	}
+
+	status, state = controlRequest(t, server, "POST", "/control/inputs/speed", url.Values{"factor": {"2.5"}})
+	if status != http.StatusOK || state[0].File.SpeedFactor != 2.5 {
+		t.Error("Should change speed factor", status, state)
+	}
+	if status, _ = controlRequest(t, server, "POST", "/control/inputs/speed", url.Values{"factor": {"-1"}}); status != http.StatusBadRequest {
+		t.Error("Should reject invalid speed factor", status)
+	}
+
+	// Skip the second request, which otherwise would be replayed in an hour
+	to := time.Unix(0, start+2*int64(time.Hour)).UTC().Format(time.RFC3339Nano)
+	if status, _ = controlRequest(t, server, "POST", "/control/inputs/skip", url.Values{"to": {to}}); status != http.StatusOK {
+		t.Fatal("Should skip", status)
+	}
+	controlRequest(t, server, "POST", "/control/inputs/resume", nil)
+
+	if req := next(); req != "GET /2 HTTP/1.1\r\n\r\n" {
+		t.Fatalf("Should skip to the last request, got %q", req)
+	}
+
+	if status, _ = controlRequest(t, server, "POST", "/control/inputs/skip", url.Values{"to": {strconv.FormatInt(start, 10)}}); status != http.StatusBadRequest {
+		t.Error("Should not skip backwards", status)
+	}
+	if status, _ = controlRequest(t, server, "POST", "/control/inputs/pause", url.Values{"name": {"missing.gor"}}); status != http.StatusBadRequest {
+		t.Error("Should reject unknown inputs", status)
+	}
+	if status, _ = controlRequest(t, server, "GET", "/control/inputs/pause", nil); status != http.StatusMethodNotAllowed {
+		t.Error("Should accept only POST", status)
+	}
+}
+
+func TestControlAPIOutputs(t *testing.T) {
+	input := NewTestInput()
+	staging := make(chan *Message, 10)
+	dev := make(chan *Message, 10)
+
+	plugins := new(InOutPlugins)
+	plugins.RegisterPlugin(func() PluginReader { return input })
+	plugins.RegisterPlugin(func(string) PluginWriter {
+		return NewTestOutput(func(msg *Message) { staging <- msg })
+	}, "http://staging")
+	plugins.RegisterPlugin(func(string) PluginWriter {
+		return NewTestOutput(func(msg *Message) { dev <- msg })
+	}, "http://dev|50%")
+
+	emitter := NewEmitter()
+	emitter.Start(plugins)
+	defer emitter.Close()
+
+	server := httptest.NewServer(NewControlAPI(emitter, nil))
+	defer server.Close()
+
+	status, state := controlRequest(t, server, "POST", "/control/outputs/disable", url.Values{"name": {"http://staging"}})
+	if status != http.StatusOK {
+		t.Fatal("Should disable output", status)
+	}
+	for _, s := range state {
+		if s.Name == "http://staging" && !s.Disabled {
+			t.Error("Should report disabled output", s)
+		}
+		if s.Name == "http://dev" && s.Limit != "50%" {
+			t.Error("Should report output limit", s)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		input.EmitGET()
+	}
+	select {
+	case <-dev:
+	case <-time.After(time.Second):
+		t.Error("Enabled output should receive requests")
+	}
+	select {
+	case <-staging:
+		t.Error("Disabled output should not receive requests")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	controlRequest(t, server, "POST", "/control/outputs/enable", url.Values{"name": {"http://staging"}})
+	input.EmitGET()
+	select {
+	case <-staging:
+	case <-time.After(time.Second):
+		t.Error("Enabled output should receive requests")
+	}
+
+	if status, _ = controlRequest(t, server, "POST", "/control/outputs/disable", url.Values{"name": {"http://unknown"}}); status != http.StatusBadRequest {
+		t.Error("Should reject unknown outputs", status)
+	}
+	if status, _ = controlRequest(t, server, "POST", "/control/reload", nil); status != http.StatusBadRequest {
+		t.Error("Should reject reload if it's not supported", status)
+	}
+}
+
+func TestControlAPIToken(t *testing.T) {
+	plugins := &InOutPlugins{}
+	emitter := NewEmitter()
+	defer emitter.Close()
+	if err := emitter.Start(plugins); err != nil {
+		t.Fatal(err)
+	}
+
+	api := NewControlAPI(emitter, nil)
+	api.SetToken("secret")
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	if status, _ := controlRequest(t, server, "GET", "/control/plugins", nil); status != http.StatusUnauthorized {
+		t.Error("Should require the token", status)
+	}
+	for token, expected := range map[string]int{"Bearer secret": http.StatusOK, "Bearer other": http.StatusUnauthorized, "secret": http.StatusUnauthorized} {
+		req, _ := http.NewRequest("GET", server.URL+"/control/plugins", nil)
+		req.Header.Set("Authorization", token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Errorf("%q: expected %d, got %d", token, expected, resp.StatusCode)
+		}
+	}
+}
+
+func TestControlAddress(t *testing.T) {
+	tests := []struct {
+		address, token, expected string
+		valid                    bool
+	}{
+		{":8182", "", "127.0.0.1:8182", true},
+		{"localhost:8182", "", "localhost:8182", true},
+		{"[::1]:8182", "", "[::1]:8182", true},
+		{"0.0.0.0:8182", "", "", false},
+		{"example.com:8182", "", "", false},
+		{"0.0.0.0:8182", "secret", "0.0.0.0:8182", true},
+		{"8182", "", "", false},
+	}
+	for _, tt := range tests {
+		address, err := controlAddress(tt.address, tt.token)
+		if (err == nil) != tt.valid || address != tt.expected {
+			t.Errorf("%q: expected %q, got %q %v", tt.address, tt.expected, address, err)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Convert reads files matching the patterns, in any format --input-file reads, and writes their messages
+// to the output in the given format: parquet, jsonl, v1 or v2. Output settings are the ones of
+// --output-parquet and --output-file. Files encrypted by any of --file-encryption-key keys are decrypted,
+// the output is encrypted by the first key only if encrypt is set. It returns the number of converted
+// messages, and an error if a pattern matches no files or a file can't be read.
+func Convert(patterns []string, output, format string, encrypt bool) (int, error) {
+	// keys are needed to read encrypted files whatever the output is
+	var encryption *FileEncryption
+	if len(Settings.FileEncryptionKeys) > 0 {
+		var err error
+		if encryption, err = NewFileEncryption(Settings.FileEncryptionKeys, Settings.FileEncryptionDataKeys); err != nil {
+			return 0, err
+		}
+	}
+	if encrypt && encryption == nil {
+		return 0, errors.New("encrypting the output needs --file-encryption-key")
+	}
+
+	var out PluginWriter
+	switch format {
+	case "parquet":
+		if encrypt {
+			return 0, errors.New("parquet files can't be encrypted")
+		}
+		o, err := newParquetOutput(output, &Settings.OutputParquetConfig)
+		if err != nil {
+			return 0, err
+		}
+		out = o
+	case "jsonl", "v1", "v2":
+		config := Settings.OutputFileConfig
+		config.Format = format
+		config.Append = true
+		config.Encryption = nil
+		if encrypt {
+			config.Encryption = encryption
+		}
+		o, err := NewFileOutput(output, &config)
+		if err != nil {
+			return 0, err
+		}
+		out = o
+	default:
+		return 0, fmt.Errorf("unknown format %q, expected parquet, jsonl, v1 or v2", format)
+	}
+
+	n := 0
+	for _, pattern := range patterns {
+		// messages are read as fast as possible, without waiting between them
+		input := NewFileInputWithRange(pattern, false, 100, time.Nanosecond, false, RealClock{}, Settings.InputFileStartAt, Settings.InputFileEndAt)
+		for {
+			msg, err := input.PluginRead()
+			if err == io.EOF {
+				err = input.Err()
+				if err == nil {
+					break
+				}
+			}
+			if err == nil {
+				_, err = out.PluginWrite(msg)
+			}
+			if err != nil {
+				input.Close()
+				out.(io.Closer).Close()
+				return n, err
+			}
+			n++
+		}
+		input.Close()
+	}
+	return n, out.(io.Closer).Close()
+}
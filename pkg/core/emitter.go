@@ -1,6 +1,8 @@
 package core
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/reoring/goreplay/pkg/pro"
 	"github.com/reoring/goreplay/pkg/protocol"
@@ -8,6 +10,7 @@ import (
 	"io"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/reoring/goreplay/byteutils"
@@ -16,7 +19,49 @@ import (
 // Emitter represents an abject to manage plugins communication
 type Emitter struct {
 	sync.WaitGroup
-	plugins *InOutPlugins
+	plugins    *InOutPlugins
+	settings   *AppSettings
+	pipeline   atomic.Value // *pipeline, replaced on Reload
+	pipelineMu sync.Mutex   // serializes pipeline changes
+	outputs    []PluginWriter
+	names      map[PluginWriter]string
+	queues     []*OutputQueue
+	readers    sync.WaitGroup // copies from inputs and middleware, but not from outputs
+	closed     map[interface{}]bool
+
+	errMu  sync.Mutex
+	err    error         // first error which stopped copying from an input
+	failed chan struct{} // closed when err is set
+}
+
+// pipeline holds the parts of configuration applied to each message, which can be replaced at runtime
+type pipeline struct {
+	settings *AppSettings
+	modifier *HTTPModifier
+	redactor *Redactor
+	router   *Router
+	disabled map[PluginWriter]bool
+}
+
+// redactingReader redacts messages as the input reads them, before middleware, rewrites and filters
+// see them, with the redactor of the current pipeline
+type redactingReader struct {
+	PluginReader
+	pipeline *atomic.Value
+}
+
+func (r *redactingReader) PluginRead() (*Message, error) {
+	msg, err := r.PluginReader.PluginRead()
+	if msg != nil && len(msg.Data) > 0 {
+		if redactor := r.pipeline.Load().(*pipeline).redactor; redactor != nil {
+			msg.Data = redactor.Redact(msg.Data)
+		}
+	}
+	return msg, err
+}
+
+func (r *redactingReader) String() string {
+	return fmt.Sprint(r.PluginReader)
 }
 
 // NewEmitter creates and initializes new Emitter object.
@@ -24,48 +69,353 @@ func NewEmitter() *Emitter {
 	return &Emitter{}
 }
 
-// Start initialize loop for sending data from inputs to outputs
-func (e *Emitter) Start(plugins *InOutPlugins, middlewareCmd string) {
-	if Settings.CopyBufferSize < 1 {
-		Settings.CopyBufferSize = 5 << 20
+// NewEmitterWithSettings creates an emitter which uses the settings instead of the global ones
+func NewEmitterWithSettings(settings *AppSettings) *Emitter {
+	return &Emitter{settings: settings}
+}
+
+// Start initialize loop for sending data from inputs to outputs.
+// If several middleware commands are given they are chained in order,
+// each one reading the output of the previous one.
+// Nothing is started if the settings are invalid.
+func (e *Emitter) Start(plugins *InOutPlugins, middlewareCmds ...string) error {
+	if e.settings == nil {
+		e.settings = &Settings
+	}
+	if e.settings.CopyBufferSize < 1 {
+		e.settings.CopyBufferSize = 5 << 20
+	}
+	modifier, err := CreateHTTPModifier(&e.settings.ModifierConfig)
+	if err != nil {
+		return err
+	}
+	redactor, err := NewRedactor(&e.settings.Redact)
+	if err != nil {
+		return fmt.Errorf("can't redact: %v", err)
 	}
 	e.plugins = plugins
 
-	if middlewareCmd != "" {
-		middleware := NewMiddleware(middlewareCmd)
+	e.outputs, e.names = plugins.Outputs, plugins.OutputNames
+	if e.settings.OutputQueueConfig.Size > 0 {
+		e.outputs, e.names = e.queueOutputs(&e.settings.OutputQueueConfig)
+	}
+	router, err := NewRouter(e.settings.Routes, e.outputs, e.names)
+	if err != nil {
+		for _, q := range e.queues {
+			q.Close()
+		}
+		e.queues = nil
+		return err
+	}
 
-		for _, in := range plugins.Inputs {
+	// inputs read messages through the pipeline from now on
+	e.pipeline.Store(&pipeline{settings: e.settings, modifier: modifier, redactor: redactor, router: router})
+
+	var middleware *Middleware
+	sources := make([]PluginReader, len(plugins.Inputs))
+	for i, in := range plugins.Inputs {
+		sources[i] = &redactingReader{PluginReader: in, pipeline: &e.pipeline}
+	}
+	for _, cmd := range middlewareCmds {
+		if cmd == "" {
+			continue
+		}
+		config := e.settings.MiddlewareConfig
+		config.Prettify = e.settings.PrettifyHTTP
+		middleware = NewMiddleware(cmd, &config)
+
+		for _, in := range sources {
 			middleware.ReadFrom(in)
 		}
+		sources = []PluginReader{middleware}
 
 		e.plugins.Inputs = append(e.plugins.Inputs, middleware)
 		e.plugins.All = append(e.plugins.All, middleware)
+	}
+
+	if middleware != nil {
 		e.Add(1)
+		e.readers.Add(1)
 		go func() {
 			defer e.Done()
-			if err := CopyMulty(middleware, plugins.Outputs...); err != nil {
+			defer e.readers.Done()
+			if err := copyMulty(middleware, &e.pipeline, e.outputs...); err != nil {
 				Debug(2, fmt.Sprintf("[EMITTER] error during copy: %q", err))
+				e.fail(err)
 			}
 		}()
 	} else {
 		for _, in := range plugins.Inputs {
 			e.Add(1)
+			isReader := !e.isOutput(in)
+			if isReader {
+				e.readers.Add(1)
+			}
 			go func(in PluginReader) {
 				defer e.Done()
-				if err := CopyMulty(in, plugins.Outputs...); err != nil {
+				if isReader {
+					defer e.readers.Done()
+				}
+				if err := copyMulty(&redactingReader{PluginReader: in, pipeline: &e.pipeline}, &e.pipeline, e.outputs...); err != nil {
 					Debug(2, fmt.Sprintf("[EMITTER] error during copy: %q", err))
+					e.fail(err)
 				}
 			}(in)
 		}
 	}
+	return nil
+}
+
+// Reload replaces filters, rewrites, redaction, rate limits and routes with the ones from the settings, without
+// restarting inputs and outputs. Messages already read keep the configuration they were read with.
+func (e *Emitter) Reload(s *AppSettings) error {
+	if e.pipeline.Load() == nil {
+		return errors.New("emitter is not started")
+	}
+	e.pipelineMu.Lock()
+	defer e.pipelineMu.Unlock()
+
+	modifier, err := CreateHTTPModifier(&s.ModifierConfig)
+	if err != nil {
+		return err
+	}
+
+	redactor, err := NewRedactor(&s.Redact)
+	if err != nil {
+		return fmt.Errorf("can't redact: %v", err)
+	}
+
+	router, err := NewRouter(s.Routes, e.outputs, e.names)
+	if err != nil {
+		return err
+	}
+
+	if err := e.reloadLimiters(s); err != nil {
+		return err
+	}
+
+	current := e.pipeline.Load().(*pipeline)
+	settings := *current.settings
+	settings.ModifierConfig, settings.Routes, settings.Redact = s.ModifierConfig, s.Routes, s.Redact
+	e.pipeline.Store(&pipeline{settings: &settings, modifier: modifier, redactor: redactor, router: router, disabled: current.disabled})
+
+	Debug(1, "[EMITTER] configuration reloaded")
+	return nil
+}
+
+// SetOutputEnabled stops or resumes sending messages to the output, referenced by the address it was registered with
+func (e *Emitter) SetOutputEnabled(name string, enabled bool) error {
+	if e.pipeline.Load() == nil {
+		return errors.New("emitter is not started")
+	}
+	e.pipelineMu.Lock()
+	defer e.pipelineMu.Unlock()
+
+	current := e.pipeline.Load().(*pipeline)
+	next := *current
+	next.disabled = make(map[PluginWriter]bool)
+	for out := range current.disabled {
+		next.disabled[out] = true
+	}
+
+	found := false
+	for _, out := range e.outputs {
+		if e.names[out] != name {
+			continue
+		}
+		found = true
+		if enabled {
+			delete(next.disabled, out)
+		} else {
+			next.disabled[out] = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("unknown output %q", name)
+	}
+
+	e.pipeline.Store(&next)
+	Debug(1, fmt.Sprintf("[EMITTER] output %s enabled: %v", name, enabled))
+	return nil
+}
+
+// reloadLimiters applies new limits to plugins registered with a limit, if all of them are valid.
+// Plugins registered without a limit can't get one without a restart.
+func (e *Emitter) reloadLimiters(s *AppSettings) error {
+	limits := make(map[*Limiter]string)
+	for _, options := range s.pluginOptions() {
+		path, limit := extractLimitOptions(options)
+		l, ok := e.plugins.Limiters[path]
+		if !ok {
+			if limit != "" {
+				Debug(1, fmt.Sprintf("[EMITTER] %s was started without a limit, restart is required to apply %q", path, limit))
+			}
+			continue
+		}
+		if limit == "" {
+			limit = "100%"
+		}
+		if err := CheckLimit(l.plugin, limit); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		limits[l] = limit
+	}
+
+	for l, limit := range limits {
+		l.SetLimit(limit)
+	}
+	return nil
+}
+
+// queueOutputs wraps each output with its own queue, so a slow output does not block the others
+func (e *Emitter) queueOutputs(config *OutputQueueConfig) ([]PluginWriter, map[PluginWriter]string) {
+	outputs := make([]PluginWriter, len(e.plugins.Outputs))
+	names := make(map[PluginWriter]string, len(e.plugins.Outputs))
+
+	for i, out := range e.plugins.Outputs {
+		name := e.plugins.OutputNames[out]
+		q := NewOutputQueue(out, name, config)
+
+		outputs[i] = q
+		names[q] = name
+		e.queues = append(e.queues, q)
+	}
+
+	return outputs, names
+}
+
+// isOutput reports whether the plugin was registered as an output, like HTTP output which also reads responses
+func (e *Emitter) isOutput(plugin interface{}) bool {
+	for _, out := range e.plugins.Outputs {
+		if interface{}(out) == plugin {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *Emitter) closePlugin(plugin interface{}) {
+	if e.closed == nil {
+		e.closed = make(map[interface{}]bool)
+	}
+	if e.closed[plugin] {
+		return
+	}
+	e.closed[plugin] = true
+
+	if cp, ok := plugin.(io.Closer); ok {
+		cp.Close()
+	}
+}
+
+// Shutdown stops the emitter gracefully. Inputs are closed first, then middleware and outputs are given
+// until the timeout to write queued and in-flight messages, and finally everything is closed like Close does.
+// Returns number of discarded messages of each middleware and output which did not drain in time.
+func (e *Emitter) Shutdown(timeout time.Duration) map[string]int {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	discarded := make(map[string]int)
+
+	// Outputs producing messages, like HTTP output tracking responses, keep running until the end
+	var middlewares []*Middleware
+	for _, in := range e.plugins.Inputs {
+		if m, ok := in.(*Middleware); ok {
+			middlewares = append(middlewares, m)
+		} else if !e.isOutput(in) {
+			e.closePlugin(in)
+		}
+	}
+	for _, m := range middlewares {
+		if left := m.Drain(ctx); left > 0 {
+			discarded[m.String()] += left
+		}
+		e.closePlugin(m)
+	}
+
+	select {
+	case <-e.InputsFinished():
+	case <-ctx.Done():
+	}
+
+	if len(e.queues) > 0 {
+		for _, q := range e.queues {
+			if left := q.Drain(ctx); left > 0 {
+				discarded[q.String()] += left
+			}
+		}
+	} else {
+		for _, out := range e.plugins.Outputs {
+			if d, ok := out.(PluginDrainer); ok {
+				if left := d.Drain(ctx); left > 0 {
+					discarded[e.outputName(out)] += left
+				}
+			}
+		}
+	}
+
+	e.Close()
+
+	return discarded
+}
+
+// InputsFinished returns a channel which is closed when all inputs and middleware are exhausted or closed.
+// Outputs which also read responses are not waited for.
+func (e *Emitter) InputsFinished() <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		e.readers.Wait()
+		close(done)
+	}()
+	return done
+}
+
+// Failed returns a channel which is closed when copying from an input stops with an error, for example when an output cannot write.
+func (e *Emitter) Failed() <-chan struct{} {
+	e.errMu.Lock()
+	defer e.errMu.Unlock()
+	if e.failed == nil {
+		e.failed = make(chan struct{})
+	}
+	return e.failed
+}
+
+// Err returns the first error which stopped copying from an input, or nil.
+func (e *Emitter) Err() error {
+	e.errMu.Lock()
+	defer e.errMu.Unlock()
+	return e.err
+}
+
+func (e *Emitter) fail(err error) {
+	e.errMu.Lock()
+	defer e.errMu.Unlock()
+	if e.err != nil {
+		return
+	}
+	e.err = err
+	if e.failed == nil {
+		e.failed = make(chan struct{})
+	}
+	close(e.failed)
+}
+
+func (e *Emitter) outputName(out PluginWriter) string {
+	if name := e.plugins.OutputNames[out]; name != "" {
+		return name
+	}
+	return fmt.Sprint(out)
 }
 
 // Close closes all the goroutine and waits for it to finish.
 func (e *Emitter) Close() {
+	// Queues are stopped first, so nothing is written to already closed outputs
+	for _, q := range e.queues {
+		q.Close()
+	}
+	e.queues = nil
 	for _, p := range e.plugins.All {
-		if cp, ok := p.(io.Closer); ok {
-			cp.Close()
-		}
+		e.closePlugin(p)
 	}
 	if len(e.plugins.All) > 0 {
 		// wait for everything to stop
@@ -74,10 +424,36 @@ func (e *Emitter) Close() {
 	e.plugins.All = nil // avoid Close to make changes again
 }
 
+func enabledOutputs(outputs []PluginWriter, disabled map[PluginWriter]bool) []PluginWriter {
+	enabled := make([]PluginWriter, 0, len(outputs))
+	for _, out := range outputs {
+		if !disabled[out] {
+			enabled = append(enabled, out)
+		}
+	}
+	return enabled
+}
+
 // CopyMulty copies from 1 reader to multiple writers
 func CopyMulty(src PluginReader, writers ...PluginWriter) error {
+	modifier, err := CreateHTTPModifier(&Settings.ModifierConfig)
+	if err != nil {
+		return err
+	}
+	redactor, err := NewRedactor(&Settings.Redact)
+	if err != nil {
+		return err
+	}
+	var state atomic.Value
+	state.Store(&pipeline{settings: &Settings, modifier: modifier, redactor: redactor})
+	return copyMulty(&redactingReader{PluginReader: src, pipeline: &state}, &state, writers...)
+}
+
+// copyMulty is CopyMulty which takes modifier and router from the pipeline, picking up its changes
+func copyMulty(src PluginReader, state *atomic.Value, writers ...PluginWriter) error {
 	wIndex := 0
-	modifier := NewHTTPModifier(&Settings.ModifierConfig)
+	var current *pipeline
+	var modifier *HTTPModifier
 	filteredRequests := make(map[string]int64)
 	filteredRequestsLastCleanTime := time.Now().UnixNano()
 	filteredCount := 0
@@ -91,14 +467,24 @@ func CopyMulty(src PluginReader, writers ...PluginWriter) error {
 			return err
 		}
 		if msg != nil && len(msg.Data) > 0 {
-			if len(msg.Data) > int(Settings.CopyBufferSize) {
-				msg.Data = msg.Data[:Settings.CopyBufferSize]
+			if p := state.Load().(*pipeline); p != current {
+				current = p
+				modifier = p.modifier
+			}
+			if len(msg.Data) > int(current.settings.CopyBufferSize) {
+				msg.Data = msg.Data[:current.settings.CopyBufferSize]
 			}
 			meta := protocol.PayloadMeta(msg.Meta)
 			if len(meta) < 3 {
 				Debug(2, fmt.Sprintf("[EMITTER] Found malformed record %q from %q", msg.Meta, src))
 				continue
 			}
+			if fields := current.settings.MetaFields; len(fields) > 0 {
+				for _, f := range fields {
+					msg.Meta = protocol.SetMetaField(msg.Meta, f[0], f[1])
+				}
+				meta = protocol.PayloadMeta(msg.Meta)
+			}
 			requestID := byteutils.SliceToString(meta[1])
 			// start a subroutine only when necessary
 			if Settings.Verbose >= 3 {
@@ -107,7 +493,7 @@ func CopyMulty(src PluginReader, writers ...PluginWriter) error {
 			if modifier != nil {
 				Debug(3, "[EMITTER] modifier:", requestID, "from:", src)
 				if protocol.IsRequestPayload(msg.Meta) {
-					msg.Data = modifier.Rewrite(msg.Data)
+					msg.Data = modifier.RewriteMessage(meta, msg.Data)
 					// If modifier tells to skip request
 					if len(msg.Data) == 0 {
 						filteredRequests[requestID] = time.Now().UnixNano()
@@ -122,38 +508,53 @@ func CopyMulty(src PluginReader, writers ...PluginWriter) error {
 						filteredCount--
 						continue
 					}
+					if !modifier.AllowResponse(meta, msg.Data) {
+						continue
+					}
 				}
 			}
 
-			if Settings.PrettifyHTTP {
+			if current.settings.PrettifyHTTP {
 				msg.Data = PrettifyHTTP(msg.Data)
 				if len(msg.Data) == 0 {
 					continue
 				}
 			}
 
-			if Settings.SplitOutput {
-				if Settings.RecognizeTCPSessions {
+			targets := writers
+			if current.router != nil {
+				targets = current.router.Route(meta, msg.Data)
+			}
+			if len(current.disabled) > 0 {
+				targets = enabledOutputs(targets, current.disabled)
+			}
+			if len(targets) == 0 {
+				continue
+			}
+
+			if current.settings.SplitOutput {
+				if current.settings.RecognizeTCPSessions {
 					if !pro.PRO {
 						log.Fatal("Detailed TCP sessions work only with PRO license")
 					}
 					hasher := fnv.New32a()
 					hasher.Write(meta[1])
 
-					wIndex = int(hasher.Sum32()) % len(writers)
-					if _, err := writers[wIndex].PluginWrite(msg); err != nil {
+					wIndex = int(hasher.Sum32()) % len(targets)
+					if _, err := targets[wIndex].PluginWrite(msg); err != nil {
 						return err
 					}
 				} else {
 					// Simple round robin
-					if _, err := writers[wIndex].PluginWrite(msg); err != nil {
+					wIndex = wIndex % len(targets)
+					if _, err := targets[wIndex].PluginWrite(msg); err != nil {
 						return err
 					}
 
-					wIndex = (wIndex + 1) % len(writers)
+					wIndex = (wIndex + 1) % len(targets)
 				}
 			} else {
-				for _, dst := range writers {
+				for _, dst := range targets {
 					if _, err := dst.PluginWrite(msg); err != nil && err != io.ErrClosedPipe {
 						return err
 					}
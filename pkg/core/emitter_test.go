@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"github.com/reoring/goreplay/pkg/pro"
 	"github.com/reoring/goreplay/pkg/protocol"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"sync"
 	"sync/atomic"
@@ -32,7 +34,7 @@ func TestEmitter(t *testing.T) {
 	plugins.All = append(plugins.All, input, output)
 
 	emitter := NewEmitter()
-	go emitter.Start(plugins, Settings.Middleware)
+	go emitter.Start(plugins, Settings.Middleware...)
 
 	for i := 0; i < 1000; i++ {
 		wg.Add(1)
@@ -118,7 +120,7 @@ func TestEmitterSplitRoundRobin(t *testing.T) {
 	Settings.SplitOutput = true
 
 	emitter := NewEmitter()
-	go emitter.Start(plugins, Settings.Middleware)
+	go emitter.Start(plugins, Settings.Middleware...)
 
 	for i := 0; i < 1000; i++ {
 		wg.Add(1)
@@ -162,7 +164,7 @@ func TestEmitterRoundRobin(t *testing.T) {
 	Settings.SplitOutput = true
 
 	emitter := NewEmitter()
-	go emitter.Start(plugins, Settings.Middleware)
+	go emitter.Start(plugins, Settings.Middleware...)
 
 	for i := 0; i < 1000; i++ {
 		wg.Add(1)
@@ -211,7 +213,7 @@ func TestEmitterSplitSession(t *testing.T) {
 	Settings.RecognizeTCPSessions = true
 
 	emitter := NewEmitter()
-	go emitter.Start(plugins, Settings.Middleware)
+	go emitter.Start(plugins, Settings.Middleware...)
 
 	for i := 0; i < 200; i++ {
 		// Keep session but randomize
@@ -251,7 +253,7 @@ func BenchmarkEmitter(b *testing.B) {
 	plugins.All = append(plugins.All, input, output)
 
 	emitter := NewEmitter()
-	go emitter.Start(plugins, Settings.Middleware)
+	go emitter.Start(plugins, Settings.Middleware...)
 
 	b.ResetTimer()
 
@@ -263,3 +265,105 @@ func BenchmarkEmitter(b *testing.B) {
 	wg.Wait()
 	emitter.Close()
 }
+
+func testShutdownEmitter(t *testing.T, handler http.HandlerFunc) (*Emitter, *TestInput, string) {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	input := NewTestInput()
+	httpOutput := NewHTTPOutput(server.URL, &HTTPOutputConfig{WorkersMax: 1})
+
+	plugins := &InOutPlugins{
+		Inputs:      []PluginReader{input},
+		Outputs:     []PluginWriter{httpOutput},
+		OutputNames: map[PluginWriter]string{httpOutput: server.URL},
+	}
+	plugins.All = append(plugins.All, input, httpOutput)
+
+	emitter := NewEmitter()
+	emitter.Start(plugins, Settings.Middleware...)
+
+	for i := 0; i < 20; i++ {
+		input.EmitGET()
+	}
+	// make sure everything was read before shutting down
+	for len(input.data) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	return emitter, input, server.URL
+}
+
+func TestEmitterShutdown(t *testing.T) {
+	// with and without output queues
+	for _, queueSize := range []int{1000, 0} {
+		Settings.OutputQueueConfig.Size = queueSize
+
+		var served int32
+		emitter, _, _ := testShutdownEmitter(t, func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&served, 1)
+		})
+
+		if discarded := emitter.Shutdown(5 * time.Second); len(discarded) != 0 {
+			t.Error("Nothing should be discarded", discarded)
+		}
+		if served != 20 {
+			t.Errorf("All requests should be sent before shutdown, got %d", served)
+		}
+	}
+	Settings.OutputQueueConfig.Size = 0
+}
+
+func TestEmitterShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	emitter, _, url := testShutdownEmitter(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+	defer close(release)
+
+	discarded := emitter.Shutdown(50 * time.Millisecond)
+	if len(discarded) != 1 || discarded[url] == 0 {
+		t.Error("Queued requests should be reported as discarded", discarded)
+	}
+}
+
+func TestEmitterMetaFields(t *testing.T) {
+	wg := new(sync.WaitGroup)
+	input := NewTestInput()
+	input.SetSkipHeader(true)
+	var received []byte
+	output := NewTestOutput(func(msg *Message) {
+		received = msg.Meta
+		wg.Done()
+	})
+
+	plugins := &InOutPlugins{
+		Inputs:  []PluginReader{input},
+		Outputs: []PluginWriter{output},
+	}
+	plugins.All = append(plugins.All, input, output)
+
+	settings := Settings
+	settings.MetaFields = nil
+	settings.MetaFields.Set("env=prod eu")
+	settings.MetaFields.Set("dc=1")
+	emitter := NewEmitterWithSettings(&settings)
+	go emitter.Start(plugins)
+
+	wg.Add(1)
+	header := protocol.AppendMetaField(protocol.PayloadHeader(protocol.RequestPayload, []byte("abc"), 1, -1), "env", "dev")
+	input.EmitBytes(append(header, "GET / HTTP/1.1\r\n\r\n"...))
+	wg.Wait()
+	emitter.Close()
+
+	if string(received) != "1 abc 1 -1 env=prod%20eu dc=1\n" {
+		t.Errorf("Meta fields should be set, got %q", received)
+	}
+	if env, _ := protocol.MetaField(protocol.PayloadMeta(received), "env"); env != "prod eu" {
+		t.Errorf("Value should be unescaped, got %q", env)
+	}
+	if err := settings.MetaFields.Set("no value"); err == nil {
+		t.Error("Expected error for a field without =")
+	}
+}
@@ -0,0 +1,380 @@
+package core
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Encrypted files are split in chunks sealed with AES-256-GCM. Encryption is applied after compression,
+// so the file starts with:
+//
+//	magic     "GORenc1\n"
+//	key id    8 bytes, SHA-256 prefix of the master key
+//	file id   16 random bytes
+//	wrapped   1 byte length, then nonce and the per-file data key sealed by the master key, empty if
+//	          chunks are sealed by the master key
+//
+// followed by chunks. Each chunk is:
+//
+//	length    uint32, big endian, of sealed data
+//	sequence  uint64, big endian, number of the chunk
+//	flags     1 byte, chunkFinal for the last chunk of the file
+//	nonce     12 bytes
+//	sealed    ciphertext and tag
+//
+// File id, sequence and flags are authenticated with each chunk, so tampered, reordered, dropped and
+// truncated chunks are detected.
+const encryptionMagic = "GORenc1\n"
+
+const (
+	// chunks are sealed when they reach the size, on flush and at the start of time index segments
+	encryptionChunkSize   = 64 << 10
+	encryptionChunkHeader = 4 + 8 + 1 + 12
+	encryptionKeyIDSize   = 8
+	encryptionFileIDSize  = 16
+	chunkFinal            = 1
+)
+
+// errTamperedChunk is returned for chunks which fail authentication, reading stops at them
+var errTamperedChunk = errors.New("encrypted chunk is tampered")
+
+// FileKey is an AES-256 key of recorded files
+type FileKey struct {
+	key []byte
+	id  [encryptionKeyIDSize]byte
+}
+
+// NewFileKey accepts a 32 byte key as 64 hex characters, base64 or raw bytes
+func NewFileKey(data []byte) (*FileKey, error) {
+	text := strings.TrimSpace(string(data))
+	key, err := hex.DecodeString(text)
+	if err != nil || len(key) != 32 {
+		key, err = base64.StdEncoding.DecodeString(text)
+	}
+	if err != nil || len(key) != 32 {
+		key = data
+	}
+	if len(key) != 32 {
+		return nil, errors.New("encryption key should be 32 bytes, as 64 hex characters, base64 or raw bytes")
+	}
+
+	k := &FileKey{key: key}
+	sum := sha256.Sum256(key)
+	copy(k.id[:], sum[:])
+	return k, nil
+}
+
+// LoadFileKey reads the key from the file, or from the environment variable if the source is `env:NAME`
+func LoadFileKey(source string) (*FileKey, error) {
+	data, err := readSecret(source)
+	if err != nil {
+		return nil, err
+	}
+	k, err := NewFileKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", source, err)
+	}
+	return k, nil
+}
+
+// readSecret reads the file, or the environment variable if the source is `env:NAME`
+func readSecret(source string) ([]byte, error) {
+	if strings.HasPrefix(source, "env:") {
+		name := strings.TrimPrefix(source, "env:")
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("variable %s is not set", name)
+		}
+		return []byte(value), nil
+	}
+	return ioutil.ReadFile(source)
+}
+
+// ID returns the hex key id, which is stored in headers of encrypted files
+func (k *FileKey) ID() string {
+	return hex.EncodeToString(k.id[:])
+}
+
+var fileKeys = struct {
+	sync.RWMutex
+	keys map[[encryptionKeyIDSize]byte]*FileKey
+}{keys: make(map[[encryptionKeyIDSize]byte]*FileKey)}
+
+// AddFileKey makes the key available for decrypting files, files are matched with keys by the key id
+func AddFileKey(k *FileKey) {
+	fileKeys.Lock()
+	fileKeys.keys[k.id] = k
+	fileKeys.Unlock()
+}
+
+func findFileKey(id []byte) *FileKey {
+	var kid [encryptionKeyIDSize]byte
+	copy(kid[:], id)
+	fileKeys.RLock()
+	defer fileKeys.RUnlock()
+	return fileKeys.keys[kid]
+}
+
+// FileEncryption tells how output files are encrypted
+type FileEncryption struct {
+	Key *FileKey
+	// DataKeys encrypts each file by a random data key, which is stored in the file wrapped by Key
+	DataKeys bool
+}
+
+// NewFileEncryption loads the keys and makes them available for decrypting files, output files are
+// encrypted by the first key
+func NewFileEncryption(sources []string, dataKeys bool) (*FileEncryption, error) {
+	e := &FileEncryption{DataKeys: dataKeys}
+	for _, source := range sources {
+		k, err := LoadFileKey(source)
+		if err != nil {
+			return nil, err
+		}
+		AddFileKey(k)
+		if e.Key == nil {
+			e.Key = k
+		}
+	}
+	return e, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptWriter seals written data in chunks
+type encryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	fileID []byte
+	seq    uint64
+	buf    []byte // data of the current chunk
+	chunk  []byte // sealed chunk
+	err    error
+}
+
+// newEncryptWriter writes the header of encrypted file to w
+func newEncryptWriter(w io.Writer, e *FileEncryption) (*encryptWriter, error) {
+	master, err := newGCM(e.Key.key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := append([]byte(encryptionMagic), e.Key.id[:]...)
+	fileID := make([]byte, encryptionFileIDSize)
+	if _, err = rand.Read(fileID); err != nil {
+		return nil, err
+	}
+	header = append(header, fileID...)
+
+	aead := master
+	if e.DataKeys {
+		dataKey := make([]byte, 32)
+		nonce := make([]byte, master.NonceSize())
+		if _, err = rand.Read(dataKey); err != nil {
+			return nil, err
+		}
+		if _, err = rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		wrapped := master.Seal(nonce, nonce, dataKey, fileID)
+		header = append(header, byte(len(wrapped)))
+		header = append(header, wrapped...)
+		if aead, err = newGCM(dataKey); err != nil {
+			return nil, err
+		}
+	} else {
+		header = append(header, 0)
+	}
+
+	if _, err = w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, fileID: fileID}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	e.buf = append(e.buf, p...)
+	for len(e.buf) >= encryptionChunkSize && e.err == nil {
+		e.seal(e.buf[:encryptionChunkSize], 0)
+		e.buf = e.buf[:copy(e.buf, e.buf[encryptionChunkSize:])]
+	}
+	return len(p), e.err
+}
+
+// Flush seals the buffered data, so the next chunk starts at the current position
+func (e *encryptWriter) Flush() error {
+	if len(e.buf) > 0 && e.err == nil {
+		e.seal(e.buf, 0)
+		e.buf = e.buf[:0]
+	}
+	return e.err
+}
+
+// Close seals the final chunk, files without it are reported as truncated
+func (e *encryptWriter) Close() error {
+	if e.err == nil {
+		e.seal(e.buf, chunkFinal)
+		e.buf = e.buf[:0]
+	}
+	return e.err
+}
+
+func (e *encryptWriter) seal(data []byte, flags byte) {
+	e.chunk = append(e.chunk[:0], make([]byte, encryptionChunkHeader)...)
+	binary.BigEndian.PutUint64(e.chunk[4:], e.seq)
+	e.chunk[12] = flags
+	nonce := e.chunk[13:encryptionChunkHeader]
+	if _, e.err = rand.Read(nonce); e.err != nil {
+		return
+	}
+	e.chunk = e.aead.Seal(e.chunk, nonce, data, chunkAAD(e.fileID, e.chunk[4:13]))
+	binary.BigEndian.PutUint32(e.chunk, uint32(len(e.chunk)-encryptionChunkHeader))
+	_, e.err = e.w.Write(e.chunk)
+	e.seq++
+}
+
+// chunkAAD authenticates the chunk as a part of the file at its position
+func chunkAAD(fileID, seqAndFlags []byte) []byte {
+	return append(append([]byte{}, fileID...), seqAndFlags...)
+}
+
+// isEncrypted tells if the reader is at the start of an encrypted file
+func isEncrypted(r *bufio.Reader) bool {
+	magic, _ := r.Peek(len(encryptionMagic))
+	return string(magic) == encryptionMagic
+}
+
+// fileCipher decrypts chunks of a file, it's read from the header
+type fileCipher struct {
+	aead   cipher.AEAD
+	fileID []byte
+}
+
+func readEncryptionHeader(r *bufio.Reader) (*fileCipher, error) {
+	header := make([]byte, len(encryptionMagic)+encryptionKeyIDSize+encryptionFileIDSize+1)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("encryption header: %w", errTruncatedFile)
+	}
+	keyID := header[len(encryptionMagic) : len(encryptionMagic)+encryptionKeyIDSize]
+	fileID := header[len(encryptionMagic)+encryptionKeyIDSize : len(header)-1]
+	wrapped := make([]byte, header[len(header)-1])
+	if _, err := io.ReadFull(r, wrapped); err != nil {
+		return nil, fmt.Errorf("encryption header: %w", errTruncatedFile)
+	}
+
+	key := findFileKey(keyID)
+	if key == nil {
+		return nil, fmt.Errorf("file is encrypted with unknown key %x, see --file-encryption-key", keyID)
+	}
+	aead, err := newGCM(key.key)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) > 0 {
+		if len(wrapped) < aead.NonceSize() {
+			return nil, fmt.Errorf("%w: invalid data key", errTamperedChunk)
+		}
+		dataKey, err := aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], fileID)
+		if err != nil {
+			return nil, fmt.Errorf("%w: can't unwrap data key", errTamperedChunk)
+		}
+		if aead, err = newGCM(dataKey); err != nil {
+			return nil, err
+		}
+	}
+	return &fileCipher{aead: aead, fileID: fileID}, nil
+}
+
+// decryptReader returns data of authenticated chunks. Reading from the middle of the file starts at any
+// chunk, and partial reads up to a limit don't need the final chunk.
+type decryptReader struct {
+	r       *bufio.Reader
+	c       *fileCipher
+	seq     uint64
+	started bool // set if reading starts from the first chunk, or once a chunk is read
+	partial bool
+	final   bool
+	header  [encryptionChunkHeader]byte
+	data    []byte
+	buf     []byte
+	plain   []byte // unread data of the current chunk
+	err     error
+}
+
+func newDecryptReader(r *bufio.Reader, c *fileCipher, fromStart, partial bool) *decryptReader {
+	return &decryptReader{r: r, c: c, started: fromStart, partial: partial}
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		d.err = d.next()
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptReader) next() error {
+	n, err := io.ReadFull(d.r, d.header[:])
+	if n == 0 && err == io.EOF {
+		if d.final || d.partial {
+			return io.EOF
+		}
+		return fmt.Errorf("%w: encrypted file ends before the final chunk", errTruncatedFile)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: chunk %d is incomplete", errTruncatedFile, d.seq)
+	}
+	if d.final {
+		return fmt.Errorf("%w: data after the final chunk", errTamperedChunk)
+	}
+
+	length := binary.BigEndian.Uint32(d.header[:])
+	seq := binary.BigEndian.Uint64(d.header[4:])
+	if length > encryptionChunkSize+uint32(d.c.aead.Overhead()) {
+		return fmt.Errorf("%w: invalid length %d of chunk %d", errTamperedChunk, length, seq)
+	}
+	if d.started && seq != d.seq {
+		return fmt.Errorf("%w: chunk %d is found instead of %d", errTamperedChunk, seq, d.seq)
+	}
+
+	d.data = append(d.data[:0], make([]byte, length)...)
+	if _, err = io.ReadFull(d.r, d.data); err != nil {
+		return fmt.Errorf("%w: chunk %d is incomplete", errTruncatedFile, seq)
+	}
+	d.buf, err = d.c.aead.Open(d.buf[:0], d.header[13:], d.data, chunkAAD(d.c.fileID, d.header[4:13]))
+	if err != nil {
+		return fmt.Errorf("%w: chunk %d", errTamperedChunk, seq)
+	}
+	d.plain = d.buf
+
+	d.started = true
+	d.seq = seq + 1
+	d.final = d.header[12]&chunkFinal != 0
+	return nil
+}
@@ -0,0 +1,182 @@
+package core
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testFileEncryption(t *testing.T, dataKeys bool) *FileEncryption {
+	key, err := NewFileKey(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	AddFileKey(key)
+	return &FileEncryption{Key: key, DataKeys: dataKeys}
+}
+
+func readFileInput(t *testing.T, input *FileInput) (ids []string) {
+	for {
+		msg, err := input.PluginRead()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, strings.Fields(string(msg.Meta))[1])
+	}
+	input.Close()
+	return ids
+}
+
+func TestFileEncryption(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor-encryption")
+	defer os.RemoveAll(dir)
+
+	start := time.Date(2021, 6, 1, 14, 0, 0, 0, time.UTC).UnixNano()
+	for _, name := range []string{"v1.gor", "v2.gor", "v1.gor.gz", "v2.gor.zst", "v1.gor.lz4"} {
+		for _, dataKeys := range []bool{false, true} {
+			path := filepath.Join(dir, fmt.Sprintf("%v-%s", dataKeys, name))
+			output := newTestFileOutput(t, path, &FileOutputConfig{Format: name[:2], Append: true, Index: true, FlushInterval: time.Minute, Encryption: testFileEncryption(t, dataKeys)})
+			for k := 0; k < 20; k++ {
+				ts := start + int64(k)*int64(300*time.Millisecond)
+				output.PluginWrite(&Message{Meta: []byte(fmt.Sprintf("1 %d %d -1\n", k, ts)), Data: []byte("GET /secret HTTP/1.1\r\n\r\n")})
+			}
+			output.Close()
+
+			if data, _ := ioutil.ReadFile(path); bytes.Contains(data, []byte("secret")) {
+				t.Errorf("%s: data isn't encrypted", path)
+			}
+
+			input := NewFileInputWithRange(path, false, 100, time.Millisecond, false, RealClock{}, FileTime{}, FileTime{})
+			if ids := readFileInput(t, input); len(ids) != 20 {
+				t.Errorf("%s: expected all requests, got %q", path, ids)
+			}
+
+			var from, to FileTime
+			from.Set("+2s")
+			to.Set("2021-06-01T14:00:04Z")
+			input = NewFileInputWithRange(path, false, 100, time.Millisecond, false, RealClock{}, from, to)
+			if ids := readFileInput(t, input); !reflect.DeepEqual(ids, []string{"7", "8", "9", "10", "11", "12", "13"}) {
+				t.Errorf("%s: expected requests from 2s to 4s, got %q", path, ids)
+			}
+			if input.stats.Get("seek_bytes").(*expvar.Int).Value() == 0 {
+				t.Errorf("%s: should seek using the index", path)
+			}
+			input.stats.Init()
+		}
+	}
+}
+
+func TestFileEncryptionInvalid(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor-encryption")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "requests.gor")
+	output := newTestFileOutput(t, path, &FileOutputConfig{Append: true, FlushInterval: time.Minute, Encryption: testFileEncryption(t, true)})
+	body := bytes.Repeat([]byte("a"), 30000)
+	for k := 0; k < 10; k++ {
+		output.PluginWrite(&Message{Meta: []byte(fmt.Sprintf("1 %d %d -1\n", k, time.Now().UnixNano())), Data: body})
+	}
+	output.Close()
+	data, _ := ioutil.ReadFile(path)
+
+	tests := []struct {
+		name   string
+		modify func([]byte) []byte
+		stat   string
+	}{
+		// the second chunk holds requests 2-4
+		{"tampered", func(d []byte) []byte {
+			d[100000] ^= 1
+			return d
+		}, "tampered_chunks"},
+		{"truncated", func(d []byte) []byte {
+			return d[:len(d)-20]
+		}, "truncated_files"},
+		{"wrong key", func(d []byte) []byte {
+			d[len(encryptionMagic)] ^= 1
+			return d
+		}, ""},
+	}
+	for _, tt := range tests {
+		modified := tt.modify(append([]byte{}, data...))
+		ioutil.WriteFile(path, modified, 0660)
+
+		input := NewFileInputWithRange(path, false, 100, time.Millisecond, false, RealClock{}, FileTime{}, FileTime{})
+		ids := readFileInput(t, input)
+		if tt.stat == "" {
+			if len(ids) != 0 {
+				t.Errorf("%s: expected no requests, got %q", tt.name, ids)
+			}
+			continue
+		}
+		if len(ids) == 0 || len(ids) == 10 {
+			t.Errorf("%s: expected requests before the invalid chunk, got %q", tt.name, ids)
+		}
+		if stat, ok := input.stats.Get(tt.stat).(*expvar.Int); !ok || stat.Value() != 1 {
+			t.Errorf("%s: expected %s to be reported", tt.name, tt.stat)
+		}
+		input.stats.Init()
+	}
+}
+
+func TestFileKey(t *testing.T) {
+	raw := bytes.Repeat([]byte{1, 2, 3, 4}, 8)
+	expected, _ := NewFileKey(raw)
+
+	os.Setenv("GOR_TEST_KEY", base64.StdEncoding.EncodeToString(raw))
+	defer os.Unsetenv("GOR_TEST_KEY")
+	file, _ := ioutil.TempFile("", "gor-key")
+	file.WriteString(hex.EncodeToString(raw) + "\n")
+	file.Close()
+	defer os.Remove(file.Name())
+
+	for _, source := range []string{"env:GOR_TEST_KEY", file.Name()} {
+		k, err := LoadFileKey(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(k, expected) {
+			t.Errorf("%s: expected %s key, got %s", source, expected.ID(), k.ID())
+		}
+	}
+
+	for _, source := range []string{"env:GOR_TEST_MISSING", filepath.Join(os.TempDir(), "gor-missing-key")} {
+		if _, err := LoadFileKey(source); err == nil {
+			t.Errorf("%s: expected error", source)
+		}
+	}
+	if _, err := NewFileKey([]byte("short")); err == nil {
+		t.Error("Expected error for a short key")
+	}
+	if _, err := NewFileEncryption([]string{file.Name(), "env:GOR_TEST_MISSING"}, false); err == nil {
+		t.Error("Expected error for a missing key")
+	}
+}
+
+func TestFileEncryptionFailure(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor-encryption")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "requests.gor")
+	output := newTestFileOutput(t, path, &FileOutputConfig{Append: true, FlushInterval: time.Minute, Encryption: &FileEncryption{Key: &FileKey{key: []byte("short")}}})
+	defer output.Close()
+	if _, err := output.PluginWrite(&Message{Meta: []byte("1 a 1 -1\n"), Data: []byte("GET / HTTP/1.1\r\n\r\n")}); err == nil {
+		t.Error("Expected encryption error")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("Shouldn't leave the file", err)
+	}
+}
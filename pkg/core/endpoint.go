@@ -0,0 +1,110 @@
+package core
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// EndpointNormalizer groups request paths into routes like `/users/{id}`. Paths matching one of the patterns
+// take its route, other paths have segments which look like ids replaced by `{id}`, and when a segment has
+// too many distinct values under the same prefix, new values are grouped as `{id}` too.
+type EndpointNormalizer struct {
+	mu       sync.Mutex
+	patterns [][]string
+	root     *routeNode
+}
+
+type routeNode struct {
+	children map[string]*routeNode // `{id}` holds ids and values above the limit
+}
+
+// maximum number of distinct values of a path segment, after which new values are grouped as a parameter
+const endpointMaxLiterals = 50
+
+var (
+	numberSegment = regexp.MustCompile(`^\d+$`)
+	uuidSegment   = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	tokenSegment  = regexp.MustCompile(`^[A-Za-z0-9_-]{16,}$`)
+	digitsSegment = regexp.MustCompile(`\d`)
+)
+
+// looksLikeID tells if the path segment is a number, an uuid, or a long token with digits like a hash
+func looksLikeID(segment string) bool {
+	return numberSegment.MatchString(segment) || uuidSegment.MatchString(segment) ||
+		tokenSegment.MatchString(segment) && digitsSegment.MatchString(segment)
+}
+
+// NewEndpointNormalizer constructor for EndpointNormalizer, patterns are routes like `/users/{id}/orders`
+func NewEndpointNormalizer(patterns []string) *EndpointNormalizer {
+	n := &EndpointNormalizer{root: new(routeNode)}
+	for _, p := range patterns {
+		n.patterns = append(n.patterns, pathSegments(p))
+	}
+	return n
+}
+
+func pathSegments(path string) []string {
+	if i := strings.IndexAny(path, "?#"); i != -1 {
+		path = path[:i]
+	}
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+func isRouteParam(segment string) bool {
+	return strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+}
+
+// Normalize returns the route of the path
+func (n *EndpointNormalizer) Normalize(path string) string {
+	segments := pathSegments(path)
+
+	for _, p := range n.patterns {
+		if matchRoute(p, segments) {
+			return "/" + strings.Join(p, "/")
+		}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	node := n.root
+	route := make([]string, len(segments))
+	for i, s := range segments {
+		if looksLikeID(s) {
+			s = "{id}"
+		}
+		if node.children == nil {
+			node.children = make(map[string]*routeNode)
+		}
+
+		child, ok := node.children[s]
+		if !ok && len(node.children) >= endpointMaxLiterals {
+			s = "{id}"
+			child, ok = node.children[s]
+		}
+		if !ok {
+			child = new(routeNode)
+			node.children[s] = child
+		}
+		route[i] = s
+		node = child
+	}
+	return "/" + strings.Join(route, "/")
+}
+
+func matchRoute(pattern, segments []string) bool {
+	if len(pattern) != len(segments) {
+		return false
+	}
+	for i, p := range pattern {
+		if p != segments[i] && !isRouteParam(p) {
+			return false
+		}
+	}
+	return true
+}
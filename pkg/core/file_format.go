@@ -0,0 +1,370 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/reoring/goreplay/pkg/protocol"
+)
+
+// Version 2 of the file format frames each record by its length, so payloads can contain anything,
+// and checks them with CRC32-C, so corrupted and truncated files are detected. The file starts with:
+//
+//	magic     "GORv2\n"
+//	header    frame of FileHeader as JSON
+//
+// followed by frames of records. Each frame is:
+//
+//	length    uint32, big endian
+//	checksum  uint32, big endian, CRC32-C of data
+//	data      length bytes
+//
+// Records are type byte, uvarint length and id, varint timestamp and latency, uvarint number of
+// extra meta fields, each as uvarint length and value, and the payload.
+//
+// Version 1 files are payloads with text meta, separated by `\n🐵🙈🙉\n`.
+const fileFormatMagic = "GORv2\n"
+
+// maximum size of a header or a record, larger lengths mean the file is corrupted
+const fileFormatMaxRecord = 64 << 20
+
+// buffer size of file readers, frames up to this size are checked before they are read, and reading
+// resyncs at them after corrupted frames
+const fileReaderSize = 1 << 20
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	// errCorruptedRecord is returned for records with wrong checksum, reading can continue with the next record
+	errCorruptedRecord = errors.New("corrupted record")
+	// errTruncatedFile is returned when the file ends in the middle of a record
+	errTruncatedFile = errors.New("file is truncated")
+)
+
+// corruptedFrameError is errCorruptedRecord for frames with invalid length or wrong checksum, which are
+// skipped up to the next valid frame
+type corruptedFrameError struct {
+	reason  string
+	skipped int // number of skipped bytes
+}
+
+func (e *corruptedFrameError) Error() string {
+	return fmt.Sprintf("%v: %s, skipped %d bytes", errCorruptedRecord, e.reason, e.skipped)
+}
+
+func (e *corruptedFrameError) Unwrap() error {
+	return errCorruptedRecord
+}
+
+// FileHeader describes where and how a version 2 file was recorded
+type FileHeader struct {
+	Version    int               `json:"version"`
+	Host       string            `json:"host,omitempty"`
+	Created    time.Time         `json:"created"`
+	GorVersion string            `json:"gor_version,omitempty"`
+	Config     map[string]string `json:"config,omitempty"` // capture options, like input-raw
+}
+
+// isFileFormatV2 tells if the reader is at the start of a version 2 file
+func isFileFormatV2(r *bufio.Reader) bool {
+	magic, _ := r.Peek(len(fileFormatMagic))
+	return string(magic) == fileFormatMagic
+}
+
+// fileFormat is the format of a recorded file, detected by its first bytes
+type fileFormat int
+
+const (
+	fileFormatV1 fileFormat = iota
+	fileFormatV2
+	fileFormatJSONL
+)
+
+func detectFileFormat(r *bufio.Reader) fileFormat {
+	switch {
+	case isFileFormatV2(r):
+		return fileFormatV2
+	case isFileFormatJSONL(r):
+		return fileFormatJSONL
+	}
+	return fileFormatV1
+}
+
+func writeFileHeader(w io.Writer, h FileHeader) (int, error) {
+	h.Version = 2
+	data, err := json.Marshal(h)
+	if err != nil {
+		return 0, err
+	}
+	buf := append([]byte(fileFormatMagic), 0, 0, 0, 0, 0, 0, 0, 0)
+	buf = append(buf, data...)
+	setFrameHeader(buf[len(fileFormatMagic):])
+	return w.Write(buf)
+}
+
+func readFileHeader(r *bufio.Reader) (h FileHeader, err error) {
+	if _, err = r.Discard(len(fileFormatMagic)); err != nil {
+		return h, errTruncatedFile
+	}
+	data, err := readFrame(r)
+	if err == io.EOF {
+		err = errTruncatedFile
+	}
+	if err != nil {
+		return h, fmt.Errorf("file header: %w", err)
+	}
+	if err = json.Unmarshal(data, &h); err != nil {
+		return h, fmt.Errorf("file header: %v", err)
+	}
+	return h, nil
+}
+
+// setFrameHeader fills length and checksum of the frame, data follows 8 reserved bytes
+func setFrameHeader(frame []byte) {
+	data := frame[8:]
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	binary.BigEndian.PutUint32(frame[4:], crc32.Checksum(data, crc32c))
+}
+
+// readFrame returns data of the next frame, io.EOF if there are no more frames. Frames which fit in the buffer
+// of the reader are checked before they are read: if the length is invalid or the checksum is wrong, the
+// length can't be trusted, so the reader resyncs at the next valid frame and *corruptedFrameError is
+// returned. Data of larger frames with wrong checksum is returned with errCorruptedRecord. Tampered
+// encrypted chunks return errTamperedChunk.
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	header, err := r.Peek(8)
+	if len(header) < 8 {
+		if len(header) == 0 && err == io.EOF {
+			return nil, io.EOF
+		}
+		if errors.Is(err, errTamperedChunk) {
+			return nil, err
+		}
+		return nil, errTruncatedFile
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length > fileFormatMaxRecord {
+		return nil, resyncFrame(r, fmt.Sprintf("invalid record length %d", length))
+	}
+
+	if 8+int(length) <= r.Size() {
+		frame, err := r.Peek(8 + int(length))
+		if errors.Is(err, errTamperedChunk) {
+			return nil, err
+		}
+		if err != nil {
+			// the length can be corrupted as well
+			err := resyncFrame(r, "record beyond the end of file")
+			var corrupted *corruptedFrameError
+			if errors.As(err, &corrupted) && corrupted.skipped >= len(frame) {
+				return nil, errTruncatedFile
+			}
+			return nil, err
+		}
+		if !validFrame(frame) {
+			return nil, resyncFrame(r, "checksum mismatch")
+		}
+		data := append([]byte(nil), frame[8:]...)
+		r.Discard(len(frame))
+		return data, nil
+	}
+
+	r.Discard(8)
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if errors.Is(err, errTamperedChunk) {
+			return nil, err
+		}
+		return nil, errTruncatedFile
+	}
+	if crc32.Checksum(data, crc32c) != binary.BigEndian.Uint32(header[4:]) {
+		return data, fmt.Errorf("%w: checksum mismatch", errCorruptedRecord)
+	}
+	return data, nil
+}
+
+// validFrame tells if the frame has a valid length and checksum, frame holds at least the whole frame
+func validFrame(frame []byte) bool {
+	length := binary.BigEndian.Uint32(frame)
+	return len(frame) >= 8+int(length) && crc32.Checksum(frame[8:8+length], crc32c) == binary.BigEndian.Uint32(frame[4:])
+}
+
+// resyncFrame skips bytes of the corrupted frame the reader is at, up to the next valid frame which fits in
+// the buffer of the reader, or up to the end of data. It returns *corruptedFrameError, or errTamperedChunk
+// if the reader fails meanwhile.
+func resyncFrame(r *bufio.Reader, reason string) error {
+	e := &corruptedFrameError{reason: reason}
+	for {
+		n, err := r.Discard(1)
+		e.skipped += n
+		if errors.Is(err, errTamperedChunk) {
+			return err
+		}
+		if n == 0 {
+			return e
+		}
+		header, err := r.Peek(8)
+		if errors.Is(err, errTamperedChunk) {
+			return err
+		}
+		if len(header) < 8 {
+			continue
+		}
+		// frames are never empty, and zeros would look like valid empty frames
+		length := binary.BigEndian.Uint32(header)
+		if length == 0 || 8+int64(length) > int64(r.Size()) {
+			continue
+		}
+		frame, err := r.Peek(8 + int(length))
+		if errors.Is(err, errTamperedChunk) {
+			return err
+		}
+		if err == nil && validFrame(frame) {
+			return e
+		}
+	}
+}
+
+// encodeRecord appends the framed record of the message
+func encodeRecord(buf []byte, meta, data []byte) []byte {
+	fields := bytes.Fields(meta)
+
+	var payloadType byte = protocol.RequestPayload
+	var id []byte
+	var timestamp, latency int64
+	if len(fields) > 0 && len(fields[0]) > 0 {
+		payloadType = fields[0][0]
+	}
+	if len(fields) > 1 {
+		id = fields[1]
+	}
+	if len(fields) > 2 {
+		timestamp, _ = strconv.ParseInt(string(fields[2]), 10, 64)
+	}
+	if len(fields) > 3 {
+		latency, _ = strconv.ParseInt(string(fields[3]), 10, 64)
+	}
+	var extra [][]byte
+	if len(fields) > 4 {
+		extra = fields[4:]
+	}
+
+	start := len(buf)
+	buf = append(buf, 0, 0, 0, 0, 0, 0, 0, 0) // length and checksum
+	buf = append(buf, payloadType)
+	buf = appendUvarint(buf, uint64(len(id)))
+	buf = append(buf, id...)
+	buf = appendVarint(buf, timestamp)
+	buf = appendVarint(buf, latency)
+	buf = appendUvarint(buf, uint64(len(extra)))
+	for _, f := range extra {
+		buf = appendUvarint(buf, uint64(len(f)))
+		buf = append(buf, f...)
+	}
+	buf = append(buf, data...)
+
+	setFrameHeader(buf[start:])
+	return buf
+}
+
+// readRecord reads the next record, and returns it in the version 1 form: text meta followed by the payload
+func readRecord(r *bufio.Reader) (payload []byte, timestamp int64, err error) {
+	record, err := readFrame(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	return decodeRecord(record)
+}
+
+func decodeRecord(record []byte) (payload []byte, timestamp int64, err error) {
+	invalid := fmt.Errorf("%w: invalid record", errCorruptedRecord)
+	if len(record) == 0 {
+		return nil, 0, invalid
+	}
+	payloadType, rest := record[0], record[1:]
+
+	idLen, n := binary.Uvarint(rest)
+	if n <= 0 || uint64(len(rest)-n) < idLen {
+		return nil, 0, invalid
+	}
+	id, rest := rest[n:n+int(idLen)], rest[n+int(idLen):]
+	timestamp, n = binary.Varint(rest)
+	if n <= 0 {
+		return nil, 0, invalid
+	}
+	rest = rest[n:]
+	latency, n := binary.Varint(rest)
+	if n <= 0 {
+		return nil, 0, invalid
+	}
+	rest = rest[n:]
+	count, n := binary.Uvarint(rest)
+	if n <= 0 || count > uint64(len(rest)) {
+		return nil, 0, invalid
+	}
+	rest = rest[n:]
+
+	meta := []byte(fmt.Sprintf("%c %s %d %d", payloadType, id, timestamp, latency))
+	for ; count > 0; count-- {
+		l, n := binary.Uvarint(rest)
+		if n <= 0 || uint64(len(rest)-n) < l {
+			return nil, 0, invalid
+		}
+		meta = append(meta, ' ')
+		meta = append(meta, rest[n:n+int(l)]...)
+		rest = rest[n+int(l):]
+	}
+
+	payload = make([]byte, 0, len(meta)+1+len(rest))
+	payload = append(payload, meta...)
+	payload = append(payload, '\n')
+	payload = append(payload, rest...)
+	return payload, timestamp, nil
+}
+
+// captureConfig returns options describing how traffic is captured, which are stored in version 2 file headers
+func captureConfig(s *AppSettings) map[string]string {
+	config := make(map[string]string)
+	inputs := map[string][]string{
+		"input-raw":  s.InputRAW,
+		"input-tcp":  s.InputTCP,
+		"input-file": s.InputFile,
+		"input-http": s.InputHTTP,
+	}
+	for name, addresses := range inputs {
+		if len(addresses) > 0 {
+			config[name] = strings.Join(addresses, ",")
+		}
+	}
+	if len(s.InputRAW) > 0 {
+		config["input-raw-engine"] = s.Engine.String()
+		config["input-raw-protocol"] = s.Protocol.String()
+		config["input-raw-track-response"] = strconv.FormatBool(s.TrackResponse)
+		if s.BPFFilter != "" {
+			config["input-raw-bpf-filter"] = s.BPFFilter
+		}
+	}
+	if s.InputKafkaConfig.Topic != "" {
+		config["input-kafka-topic"] = s.InputKafkaConfig.Topic
+	}
+	return config
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutUvarint(b[:], v)]...)
+}
+
+func appendVarint(buf []byte, v int64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutVarint(b[:], v)]...)
+}
@@ -0,0 +1,190 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func v2Messages() []*Message {
+	return []*Message{
+		{Meta: []byte("1 a1 100 -1\n"), Data: []byte("POST / HTTP/1.1\r\nContent-Length: 13\r\n\r\n\n🐵🙈🙉\nbody")},
+		{Meta: []byte("2 a1 101 5000\n"), Data: []byte("HTTP/1.1 200 OK\r\n\r\n")},
+		{Meta: []byte("1 b2 102 -1 tenant=x\n"), Data: []byte("GET / HTTP/1.1\r\n\r\n")},
+	}
+}
+
+func writeV2File(t *testing.T, path string, msgs []*Message) {
+	output := newTestFileOutput(t, path, &FileOutputConfig{Format: "v2", Append: true, FlushInterval: time.Minute, Capture: map[string]string{"input-raw": ":80"}})
+	for _, msg := range msgs {
+		if _, err := output.PluginWrite(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	output.Close()
+}
+
+func readFileMessages(t *testing.T, path string) (msgs []*Message, input *FileInput) {
+	input = NewFileInput(path, false, 100, time.Millisecond, false)
+	defer input.Close()
+	for {
+		msg, err := input.PluginRead()
+		if err == io.EOF {
+			return msgs, input
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+	}
+}
+
+func TestFileFormatV2(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor-v2")
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"requests.gor", "requests.gor.gz"} {
+		path := filepath.Join(dir, name)
+		writeV2File(t, path, v2Messages())
+
+		msgs, _ := readFileMessages(t, path)
+		expected := v2Messages()
+		if len(msgs) != len(expected) {
+			t.Fatalf("%s: expected %d messages, got %d", name, len(expected), len(msgs))
+		}
+		for i, msg := range msgs {
+			if !bytes.Equal(msg.Meta, expected[i].Meta) || !bytes.Equal(msg.Data, expected[i].Data) {
+				t.Errorf("%s: expected %q %q, got %q %q", name, expected[i].Meta, expected[i].Data, msg.Meta, msg.Data)
+			}
+		}
+	}
+
+	r, _ := newFileInputReader(filepath.Join(dir, "requests.gor"), 100, new(expvar.Map).Init(), 0, -1, nil, nil)
+	if r.header == nil || r.header.Version != 2 || r.header.Config["input-raw"] != ":80" || r.header.Created.IsZero() {
+		t.Errorf("Should read the file header, got %+v", r.header)
+	}
+}
+
+func TestFileFormatV2Corruption(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor-v2")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "requests.gor")
+	writeV2File(t, path, v2Messages())
+	data, _ := ioutil.ReadFile(path)
+
+	// corrupt the body of the first request
+	corrupted := append([]byte(nil), data...)
+	corrupted[bytes.Index(corrupted, []byte("body"))] = 'B'
+	ioutil.WriteFile(path, corrupted, 0644)
+
+	msgs, input := readFileMessages(t, path)
+	if len(msgs) != 2 || !bytes.HasPrefix(msgs[0].Meta, []byte("2 a1")) {
+		t.Errorf("Should skip the corrupted record, got %d messages", len(msgs))
+	}
+	if n := input.stats.Get("corrupted_records"); n == nil || n.String() != "1" {
+		t.Error("Should count corrupted records", n)
+	}
+
+	// corrupt the length of the first request
+	corrupted = append([]byte(nil), data...)
+	corrupted[len(fileFormatMagic)+8+int(binary.BigEndian.Uint32(data[len(fileFormatMagic):]))] = 0xff
+	ioutil.WriteFile(path, corrupted, 0644)
+
+	msgs, input = readFileMessages(t, path)
+	if len(msgs) != 2 || !bytes.HasPrefix(msgs[0].Meta, []byte("2 a1")) {
+		t.Errorf("Should resync at the next record, got %d messages", len(msgs))
+	}
+	// stats are shared by inputs of the same path
+	if n := input.stats.Get("corrupted_records"); n == nil || n.String() != "2" {
+		t.Error("Should count corrupted records", n)
+	}
+
+	// cut the last record
+	ioutil.WriteFile(path, data[:len(data)-3], 0644)
+	msgs, input = readFileMessages(t, path)
+	if len(msgs) != 2 || !bytes.HasPrefix(msgs[1].Meta, []byte("2 a1")) {
+		t.Errorf("Should read records before the truncated one, got %d messages", len(msgs))
+	}
+	if n := input.stats.Get("truncated_files"); n == nil || n.String() != "1" {
+		t.Error("Should count truncated files", n)
+	}
+}
+
+func TestFileFormatRecord(t *testing.T) {
+	record := encodeRecord(nil, []byte("3 abc 1600000000000000000 1234 k=v x\n"), []byte("HTTP/1.1 200 OK\r\n\r\n"))
+	payload, timestamp, err := readRecord(bufio.NewReader(bytes.NewReader(record)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timestamp != 1600000000000000000 || string(payload) != "3 abc 1600000000000000000 1234 k=v x\nHTTP/1.1 200 OK\r\n\r\n" {
+		t.Errorf("Should decode the record, got %d %q", timestamp, payload)
+	}
+
+	if _, _, err := readRecord(bufio.NewReader(bytes.NewReader(nil))); err != io.EOF {
+		t.Error("Should return EOF at the end", err)
+	}
+	if _, _, err := readRecord(bufio.NewReader(bytes.NewReader(record[:5]))); err != errTruncatedFile {
+		t.Error("Should detect truncated records", err)
+	}
+}
+
+func TestFileFormatResync(t *testing.T) {
+	var records [][]byte
+	var file []byte
+	for i, msg := range v2Messages() {
+		records = append(records, encodeRecord(nil, msg.Meta, msg.Data))
+		if i == 1 {
+			// junk between records
+			file = append(file, 0, 0, 0, 3, 'x')
+		}
+		file = append(file, records[i]...)
+	}
+	valid := append([]byte(nil), file...)
+	v2 := fileFormatV2
+
+	for name, corrupt := range map[string]func([]byte){
+		"length":   func(b []byte) { b[0] = 0x7f },
+		"checksum": func(b []byte) { b[4]++ },
+		"short":    func(b []byte) { b[3] = 1 },
+	} {
+		corrupt(file)
+		r := bufio.NewReader(bytes.NewReader(file))
+		var corrupted *corruptedFrameError
+		if _, err := readFrame(r); !errors.As(err, &corrupted) || corrupted.skipped != len(records[0])+5 {
+			t.Errorf("%s: should skip the corrupted frame and the junk, got %v", name, err)
+		}
+		for _, record := range records[1:] {
+			if data, err := readFrame(r); err != nil || !bytes.Equal(data, record[8:]) {
+				t.Errorf("%s: should read the next frames, got %q %v", name, data, err)
+			}
+		}
+		if _, err := readFrame(r); err != io.EOF {
+			t.Errorf("%s: expected EOF, got %v", name, err)
+		}
+
+		// offsets of the next records don't change
+		var offsets []int64
+		scanRecords(bufio.NewReader(bytes.NewReader(file)), &v2, 0, func(offset, _ int64) bool {
+			offsets = append(offsets, offset)
+			return true
+		})
+		if expected := int64(len(records[0]) + 5); len(offsets) != 2 || offsets[0] != expected || offsets[1] != expected+int64(len(records[1])) {
+			t.Errorf("%s: wrong offsets %v", name, offsets)
+		}
+		copy(file, valid)
+	}
+
+	// nothing valid after the corrupted frame
+	file[0] = 0x7f
+	if _, err := readFrame(bufio.NewReader(bytes.NewReader(file[:len(records[0])]))); !errors.Is(err, errCorruptedRecord) {
+		t.Error("Should report the corrupted frame", err)
+	}
+}
@@ -0,0 +1,267 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/reoring/goreplay/pkg/protocol"
+	"github.com/reoring/goreplay/proto"
+)
+
+// JSONL files hold a JSON object per line for each message, so captures can be processed by jq and
+// loaded into data tools:
+//
+//	{"type":"request","id":"a1b2","timestamp":1622556000000000000,"time":"2021-06-01T14:00:00Z","latency":-1,
+//	 "meta":{"src":"10.0.0.1:5432"},"method":"POST","url":"/orders","proto":"HTTP/1.1",
+//	 "headers":[["Host","example.com"],["Content-Length","2"]],"body":"{}"}
+//
+// Bodies which aren't valid UTF-8 are base64 encoded, with "body_encoding":"base64". Files are read back
+// to exactly the same messages: if the meta line or the payload can't be built from the fields, like
+// payloads which aren't HTTP, they are stored base64 encoded in "raw_meta" and "raw".
+
+// jsonlRecord is a line of JSONL files
+type jsonlRecord struct {
+	Type         string      `json:"type"`
+	ID           string      `json:"id"`
+	Timestamp    int64       `json:"timestamp"`
+	Time         string      `json:"time,omitempty"` // timestamp as RFC3339, ignored when reading
+	Latency      int64       `json:"latency"`
+	Meta         jsonlMeta   `json:"meta,omitempty"`
+	Method       string      `json:"method,omitempty"`
+	URL          string      `json:"url,omitempty"`
+	Proto        string      `json:"proto,omitempty"`
+	Status       int         `json:"status,omitempty"`
+	Reason       string      `json:"reason,omitempty"`
+	Headers      [][2]string `json:"headers,omitempty"`
+	Body         string      `json:"body,omitempty"`
+	BodyEncoding string      `json:"body_encoding,omitempty"` // base64 if the body isn't UTF-8
+	RawMeta      string      `json:"raw_meta,omitempty"`      // base64 meta line which can't be built from fields
+	Raw          string      `json:"raw,omitempty"`           // base64 payload which can't be built from fields
+}
+
+// jsonlMeta holds meta fields as a JSON object, keeping their order
+type jsonlMeta [][2]string
+
+func (m jsonlMeta) MarshalJSON() ([]byte, error) {
+	buf := []byte{'{'}
+	for i, f := range m {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		key, _ := json.Marshal(f[0])
+		value, _ := json.Marshal(f[1])
+		buf = append(buf, key...)
+		buf = append(buf, ':')
+		buf = append(buf, value...)
+	}
+	return append(buf, '}'), nil
+}
+
+func (m *jsonlMeta) UnmarshalJSON(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if t, err := decoder.Token(); err != nil || t != json.Delim('{') {
+		return fmt.Errorf("meta should be an object")
+	}
+	for decoder.More() {
+		t, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		var value string
+		if err = decoder.Decode(&value); err != nil {
+			return err
+		}
+		*m = append(*m, [2]string{t.(string), value})
+	}
+	return nil
+}
+
+// isFileFormatJSONL tells if the reader is at the start of a JSONL file
+func isFileFormatJSONL(r *bufio.Reader) bool {
+	first, _ := r.Peek(1)
+	return len(first) == 1 && first[0] == '{'
+}
+
+// isJSONLPath tells if the file has .jsonl extension, followed by the extension of the compression if any
+func isJSONLPath(path string) bool {
+	if c := compressionByExtension(path); c != nil {
+		path = strings.TrimSuffix(path, c.extension)
+	}
+	return strings.HasSuffix(path, ".jsonl")
+}
+
+// appendJSONL appends the JSON line of the message
+func appendJSONL(buf []byte, meta, data []byte) ([]byte, error) {
+	header := bytes.TrimSuffix(meta, []byte{'\n'})
+	rec := jsonlRecord{}
+
+	fields := bytes.Split(header, []byte{' '})
+	if len(fields[0]) == 1 {
+		rec.Type = payloadTypes[fields[0][0]]
+	}
+	if len(fields) > 1 {
+		rec.ID = string(fields[1])
+	}
+	if len(fields) > 2 {
+		rec.Timestamp, _ = strconv.ParseInt(string(fields[2]), 10, 64)
+		rec.Time = time.Unix(0, rec.Timestamp).UTC().Format(time.RFC3339Nano)
+	}
+	if len(fields) > 3 {
+		rec.Latency, _ = strconv.ParseInt(string(fields[3]), 10, 64)
+	}
+	if len(fields) > 4 {
+		for _, f := range fields[4:] {
+			if i := bytes.IndexByte(f, '='); i > 0 {
+				key := string(f[:i])
+				value, _ := protocol.MetaField(fields, key)
+				rec.Meta = append(rec.Meta, [2]string{key, value})
+			}
+		}
+	}
+	if built, err := rec.header(); err != nil || !bytes.Equal(built, header) || !utf8.Valid(header) {
+		rec.RawMeta = base64.StdEncoding.EncodeToString(header)
+	}
+
+	rec.setHTTP(data)
+	if built, err := rec.payload(); err != nil || !bytes.Equal(built, data) {
+		rec = jsonlRecord{Type: rec.Type, ID: rec.ID, Timestamp: rec.Timestamp, Time: rec.Time, Latency: rec.Latency, Meta: rec.Meta, RawMeta: rec.RawMeta}
+		rec.Raw = base64.StdEncoding.EncodeToString(data)
+	}
+
+	w := bytes.NewBuffer(buf)
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(&rec)
+	return w.Bytes(), err
+}
+
+// setHTTP splits the HTTP message into fields, the caller checks if the message can be built from them
+func (rec *jsonlRecord) setHTTP(data []byte) {
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	if end < 0 || !utf8.Valid(data[:end]) {
+		return
+	}
+	lines := bytes.Split(data[:end], []byte("\r\n"))
+	title := bytes.SplitN(lines[0], []byte{' '}, 3)
+	if len(title) != 3 {
+		return
+	}
+	if proto.HasResponseTitle(data) {
+		rec.Proto = string(title[0])
+		rec.Status, _ = strconv.Atoi(string(title[1]))
+		rec.Reason = string(title[2])
+	} else {
+		rec.Method, rec.URL, rec.Proto = string(title[0]), string(title[1]), string(title[2])
+	}
+	for _, line := range lines[1:] {
+		i := bytes.IndexByte(line, ':')
+		if i < 0 {
+			return
+		}
+		rec.Headers = append(rec.Headers, [2]string{string(line[:i]), string(bytes.TrimLeft(line[i+1:], " "))})
+	}
+
+	body := data[end+4:]
+	if utf8.Valid(body) {
+		rec.Body = string(body)
+	} else {
+		rec.Body = base64.StdEncoding.EncodeToString(body)
+		rec.BodyEncoding = "base64"
+	}
+}
+
+// header returns the meta line without the trailing new line
+func (rec *jsonlRecord) header() ([]byte, error) {
+	if rec.RawMeta != "" {
+		return base64.StdEncoding.DecodeString(rec.RawMeta)
+	}
+	var payloadType byte
+	for t, name := range payloadTypes {
+		if name == rec.Type {
+			payloadType = t
+		}
+	}
+	if payloadType == 0 {
+		return nil, fmt.Errorf("unknown type %q", rec.Type)
+	}
+	header := protocol.PayloadHeader(payloadType, []byte(rec.ID), rec.Timestamp, rec.Latency)
+	for _, f := range rec.Meta {
+		header = protocol.AppendMetaField(header, f[0], f[1])
+	}
+	return header[:len(header)-1], nil
+}
+
+// payload returns the HTTP message
+func (rec *jsonlRecord) payload() ([]byte, error) {
+	if rec.Raw != "" {
+		return base64.StdEncoding.DecodeString(rec.Raw)
+	}
+	if rec.Proto == "" {
+		return nil, nil
+	}
+
+	var buf bytes.Buffer
+	if rec.Method != "" {
+		fmt.Fprintf(&buf, "%s %s %s\r\n", rec.Method, rec.URL, rec.Proto)
+	} else {
+		fmt.Fprintf(&buf, "%s %03d %s\r\n", rec.Proto, rec.Status, rec.Reason)
+	}
+	for _, h := range rec.Headers {
+		fmt.Fprintf(&buf, "%s: %s\r\n", h[0], h[1])
+	}
+	buf.WriteString("\r\n")
+
+	switch rec.BodyEncoding {
+	case "":
+		buf.WriteString(rec.Body)
+	case "base64":
+		body, err := base64.StdEncoding.DecodeString(rec.Body)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(body)
+	default:
+		return nil, fmt.Errorf("unknown body encoding %q", rec.BodyEncoding)
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeJSONL returns the message of the JSON line in the version 1 form: text meta followed by the payload
+func decodeJSONL(line []byte) (payload []byte, timestamp int64, err error) {
+	var rec jsonlRecord
+	if err = json.Unmarshal(line, &rec); err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", errCorruptedRecord, err)
+	}
+	header, err := rec.header()
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", errCorruptedRecord, err)
+	}
+	data, err := rec.payload()
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", errCorruptedRecord, err)
+	}
+
+	payload = make([]byte, 0, len(header)+1+len(data))
+	payload = append(payload, header...)
+	payload = append(payload, '\n')
+	payload = append(payload, data...)
+	return payload, rec.Timestamp, nil
+}
+
+// jsonlTimestamp returns the timestamp of a JSON line
+func jsonlTimestamp(line []byte) (int64, bool) {
+	var rec struct {
+		Timestamp *int64 `json:"timestamp"`
+	}
+	if err := json.Unmarshal(line, &rec); err != nil || rec.Timestamp == nil {
+		return 0, false
+	}
+	return *rec.Timestamp, true
+}
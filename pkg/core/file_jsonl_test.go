@@ -0,0 +1,101 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func jsonlMessages() []*Message {
+	return append(v2Messages(), []*Message{
+		{Meta: []byte("1 c3 103 -1 src=10.0.0.1:5432 env=prod%20eu\n"), Data: []byte("POST /orders?id=1 HTTP/1.1\r\nHost: example.com\r\nContent-Type: application/json\r\nContent-Length: 9\r\n\r\n{\"a\":\"<\"}")},
+		{Meta: []byte("2 c3 104 1000\n"), Data: []byte("HTTP/1.1 200 OK\r\nContent-Encoding: gzip\r\n\r\n\x1f\x8b\x08\x00\xff")},
+		{Meta: []byte("3 c3 105 2000 flag\n"), Data: []byte("HTTP/1.1 200 \r\nHost:no-space\r\n\r\n")},
+		{Meta: []byte("1 d4 106 -1 k=\xff\n"), Data: []byte("\x00binary")},
+		{Meta: []byte("1 e5 107 -1\n"), Data: []byte("GET /\xff HTTP/1.1\r\n\r\n")},
+	}...)
+}
+
+func TestFileFormatJSONL(t *testing.T) {
+	for _, msg := range jsonlMessages() {
+		line, err := appendJSONL(nil, msg.Meta, msg.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.IndexByte(line, '\n') != len(line)-1 {
+			t.Errorf("Should be a single line, got %q", line)
+		}
+		payload, _, err := decodeJSONL(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := append(append([]byte{}, msg.Meta...), msg.Data...); !bytes.Equal(payload, expected) {
+			t.Errorf("Expected %q, got %q from %s", expected, payload, line)
+		}
+	}
+
+	msgs := jsonlMessages()
+	line, _ := appendJSONL(nil, msgs[3].Meta, msgs[3].Data)
+	var rec map[string]interface{}
+	json.Unmarshal(line, &rec)
+	meta, _ := rec["meta"].(map[string]interface{})
+	if rec["type"] != "request" || rec["method"] != "POST" || rec["url"] != "/orders?id=1" || rec["body"] != `{"a":"<"}` || meta["env"] != "prod eu" || rec["raw"] != nil || rec["raw_meta"] != nil {
+		t.Errorf("Request should be split into fields, got %s", line)
+	}
+	line, _ = appendJSONL(nil, msgs[4].Meta, msgs[4].Data)
+	if !bytes.Contains(line, []byte(`"status":200`)) || !bytes.Contains(line, []byte(`"body_encoding":"base64"`)) {
+		t.Errorf("Response with binary body should be split into fields, got %s", line)
+	}
+
+	if _, _, err := decodeJSONL([]byte(`{"type":"request","id":`)); err == nil {
+		t.Error("Should detect invalid lines")
+	}
+}
+
+func TestFileFormatJSONLFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor-jsonl")
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"requests.jsonl", "requests.jsonl.zst"} {
+		path := filepath.Join(dir, name)
+		output := newTestFileOutput(t, path, &FileOutputConfig{Append: true, FlushInterval: time.Minute})
+		for _, msg := range jsonlMessages() {
+			if _, err := output.PluginWrite(msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+		output.Close()
+
+		msgs, _ := readFileMessages(t, path)
+		expected := jsonlMessages()
+		if len(msgs) != len(expected) {
+			t.Fatalf("%s: expected %d messages, got %d", name, len(expected), len(msgs))
+		}
+		for i, msg := range msgs {
+			if !bytes.Equal(msg.Meta, expected[i].Meta) || !bytes.Equal(msg.Data, expected[i].Data) {
+				t.Errorf("%s: expected %q %q, got %q %q", name, expected[i].Meta, expected[i].Data, msg.Meta, msg.Data)
+			}
+		}
+	}
+
+	// a corrupted line is skipped, and the incomplete last line is reported
+	path := filepath.Join(dir, "requests.jsonl")
+	data, _ := ioutil.ReadFile(path)
+	data = bytes.Replace(data, []byte(`"id":"a1"`), []byte(`"id":a1`), 1)
+	ioutil.WriteFile(path, data[:len(data)-3], 0644)
+
+	msgs, input := readFileMessages(t, path)
+	if len(msgs) != len(jsonlMessages())-2 || !bytes.HasPrefix(msgs[0].Meta, []byte("2 a1")) {
+		t.Errorf("Should skip invalid lines, got %d messages", len(msgs))
+	}
+	if n := input.stats.Get("corrupted_records"); n == nil || n.String() != "1" {
+		t.Error("Should count corrupted records", n)
+	}
+	if n := input.stats.Get("truncated_files"); n == nil || n.String() != "1" {
+		t.Error("Should count truncated files", n)
+	}
+}
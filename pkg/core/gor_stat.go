@@ -1,11 +1,26 @@
 package core
 
 import (
+	"expvar"
 	"runtime"
 	"strconv"
+	"sync"
 	"time"
 )
 
+var expvarMu sync.Mutex
+
+// expvarMap returns the map published at /debug/vars with the name, creating it on first use. Plugins
+// created again with the same name, like on restart or in several pipelines, share the map.
+func expvarMap(name string) *expvar.Map {
+	expvarMu.Lock()
+	defer expvarMu.Unlock()
+	if m, ok := expvar.Get(name).(*expvar.Map); ok {
+		return m
+	}
+	return expvar.NewMap(name)
+}
+
 type GorStat struct {
 	statName string
 	rateMs   int
@@ -0,0 +1,171 @@
+package core
+
+import (
+	"math"
+	"math/bits"
+)
+
+// Histogram is a High Dynamic Range histogram: values are counted in buckets whose width grows with
+// the value, keeping the relative error of recorded values within the configured significant digits
+// with fixed memory. It's not safe for concurrent use.
+type Histogram struct {
+	highest int64 // values above are recorded as highest
+	digits  int
+
+	subBucketHalfCountMagnitude uint
+	subBucketHalfCount          int64
+	subBucketMask               int64
+
+	counts []int64
+	total  int64
+	min    int64
+	max    int64
+	sum    float64
+}
+
+// NewHistogram returns a histogram of values from 1 to highest, with the number of significant digits from 1 to 5
+func NewHistogram(highest int64, digits int) *Histogram {
+	if digits < 1 {
+		digits = 1
+	} else if digits > 5 {
+		digits = 5
+	}
+	if highest < 2 {
+		highest = 2
+	}
+
+	// sub buckets hold values with the required precision: 2 * 10^digits rounded up to a power of 2
+	largestSingleUnit := 2 * int64(math.Pow10(digits))
+	subBucketCountMagnitude := uint(bits.Len64(uint64(largestSingleUnit - 1)))
+	subBucketCount := int64(1) << subBucketCountMagnitude
+
+	h := &Histogram{
+		highest:                     highest,
+		digits:                      digits,
+		subBucketHalfCountMagnitude: subBucketCountMagnitude - 1,
+		subBucketHalfCount:          subBucketCount / 2,
+		subBucketMask:               subBucketCount - 1,
+	}
+
+	// each bucket covers values twice as large as the previous one
+	buckets := 1
+	for smallestUntrackable := subBucketCount; smallestUntrackable <= highest; smallestUntrackable <<= 1 {
+		buckets++
+	}
+	h.counts = make([]int64, int64(buckets+1)*h.subBucketHalfCount)
+	h.Reset()
+	return h
+}
+
+func (h *Histogram) countsIndex(v int64) int {
+	bucket := int64(bits.Len64(uint64(v|h.subBucketMask))) - int64(h.subBucketHalfCountMagnitude) - 1
+	subBucket := v >> uint(bucket)
+	return int((bucket+1)<<h.subBucketHalfCountMagnitude + subBucket - h.subBucketHalfCount)
+}
+
+// highestEquivalentValue returns the largest value counted at the index
+func (h *Histogram) highestEquivalentValue(index int) int64 {
+	bucket := int64(index>>h.subBucketHalfCountMagnitude) - 1
+	subBucket := int64(index)&(h.subBucketHalfCount-1) + h.subBucketHalfCount
+	if bucket < 0 {
+		subBucket -= h.subBucketHalfCount
+		bucket = 0
+	}
+	return (subBucket+1)<<uint(bucket) - 1
+}
+
+// Record counts the value, values below 0 are counted as 0 and above the highest value as the highest value
+func (h *Histogram) Record(v int64) {
+	if v < 0 {
+		v = 0
+	} else if v > h.highest {
+		v = h.highest
+	}
+	h.counts[h.countsIndex(v)]++
+	h.total++
+	h.sum += float64(v)
+	if v < h.min {
+		h.min = v
+	}
+	if v > h.max {
+		h.max = v
+	}
+}
+
+// Merge adds values of the histogram, which should have the same range and precision
+func (h *Histogram) Merge(other *Histogram) {
+	if other.total == 0 {
+		return
+	}
+	for i, c := range other.counts {
+		h.counts[i] += c
+	}
+	h.total += other.total
+	h.sum += other.sum
+	if other.min < h.min {
+		h.min = other.min
+	}
+	if other.max > h.max {
+		h.max = other.max
+	}
+}
+
+// Reset removes all values
+func (h *Histogram) Reset() {
+	for i := range h.counts {
+		h.counts[i] = 0
+	}
+	h.total, h.sum = 0, 0
+	h.min, h.max = math.MaxInt64, 0
+}
+
+// Count returns the number of recorded values
+func (h *Histogram) Count() int64 {
+	return h.total
+}
+
+// Min returns the smallest recorded value, 0 if empty
+func (h *Histogram) Min() int64 {
+	if h.total == 0 {
+		return 0
+	}
+	return h.min
+}
+
+// Max returns the largest recorded value
+func (h *Histogram) Max() int64 {
+	return h.max
+}
+
+// Mean returns the average of recorded values
+func (h *Histogram) Mean() float64 {
+	if h.total == 0 {
+		return 0
+	}
+	return h.sum / float64(h.total)
+}
+
+// ValueAtPercentile returns the value below or equal to which the percentile (0-100) of values fall,
+// within the precision of the histogram
+func (h *Histogram) ValueAtPercentile(p float64) int64 {
+	if h.total == 0 {
+		return 0
+	}
+	count := int64(p/100*float64(h.total) + 0.5)
+	if count < 1 {
+		count = 1
+	}
+
+	var seen int64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= count {
+			v := h.highestEquivalentValue(i)
+			if v > h.max {
+				return h.max
+			}
+			return v
+		}
+	}
+	return h.max
+}
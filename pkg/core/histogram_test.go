@@ -0,0 +1,57 @@
+package core
+
+import (
+	"math"
+	"testing"
+)
+
+func TestHistogramPercentiles(t *testing.T) {
+	h := NewHistogram(3600000000, 2)
+	for v := int64(1); v <= 100000; v++ {
+		h.Record(v)
+	}
+
+	if h.Count() != 100000 || h.Min() != 1 || h.Max() != 100000 || h.Mean() != 50000.5 {
+		t.Errorf("Should count values, got count %d, min %d, max %d, mean %f", h.Count(), h.Min(), h.Max(), h.Mean())
+	}
+	for _, p := range []float64{50, 90, 99, 99.9} {
+		expected := p * 1000
+		if v := float64(h.ValueAtPercentile(p)); math.Abs(v-expected)/expected > 0.01 {
+			t.Errorf("p%v: expected %v within 1%%, got %v", p, expected, v)
+		}
+	}
+	if h.ValueAtPercentile(100) != 100000 {
+		t.Error("Should not exceed the maximum", h.ValueAtPercentile(100))
+	}
+
+	// small values are exact
+	small := NewHistogram(1000, 3)
+	for _, v := range []int64{3, 1, 2, 5, 4} {
+		small.Record(v)
+	}
+	if small.ValueAtPercentile(50) != 3 || small.ValueAtPercentile(0) != 1 {
+		t.Error("Should keep small values exact", small.ValueAtPercentile(50), small.ValueAtPercentile(0))
+	}
+
+	small.Record(1 << 40)
+	if small.Max() != 1000 {
+		t.Error("Should clamp values to the highest one", small.Max())
+	}
+}
+
+func TestHistogramMerge(t *testing.T) {
+	a, b := NewHistogram(1000000, 2), NewHistogram(1000000, 2)
+	a.Record(10)
+	b.Record(1000)
+	b.Record(2000)
+
+	a.Merge(b)
+	if a.Count() != 3 || a.Min() != 10 || a.Max() != 2000 || a.ValueAtPercentile(50) < 990 || a.ValueAtPercentile(50) > 1010 {
+		t.Errorf("Should merge values, got count %d, min %d, max %d, p50 %d", a.Count(), a.Min(), a.Max(), a.ValueAtPercentile(50))
+	}
+
+	a.Reset()
+	if a.Count() != 0 || a.Min() != 0 || a.Max() != 0 || a.ValueAtPercentile(99) != 0 {
+		t.Error("Should remove values")
+	}
+}
@@ -0,0 +1,267 @@
+package core
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+
+	"github.com/reoring/goreplay/pkg/expr"
+	"github.com/reoring/goreplay/pkg/protocol"
+	"github.com/reoring/goreplay/proto"
+)
+
+// payloadTypes maps payload type from the meta line to the value of `type` filter variable
+var payloadTypes = map[byte]string{
+	protocol.RequestPayload:          "request",
+	protocol.ResponsePayload:         "response",
+	protocol.ReplayedResponsePayload: "replayed_response",
+}
+
+// messageEnv exposes HTTP message fields to filter expressions:
+//
+//	method, url (path with query), path, query["name"], host, headers["Name"], header("name"),
+//	body, json.field, basic_auth, status, type, id, timestamp, latency, meta["key"]
+type messageEnv struct {
+	meta    [][]byte
+	payload []byte
+
+	body       []byte
+	bodyParsed bool
+	json       interface{}
+	jsonParsed bool
+}
+
+func newMessageEnv(meta [][]byte, payload []byte) *messageEnv {
+	return &messageEnv{meta: meta, payload: payload}
+}
+
+// Lookup implements expr.Env
+func (e *messageEnv) Lookup(name string) (interface{}, bool) {
+	switch name {
+	case "method":
+		if !proto.HasRequestTitle(e.payload) {
+			return "", true
+		}
+		return string(proto.Method(e.payload)), true
+	case "url":
+		if !proto.HasRequestTitle(e.payload) {
+			return "", true
+		}
+		return string(proto.Path(e.payload)), true
+	case "path":
+		if !proto.HasRequestTitle(e.payload) {
+			return "", true
+		}
+		path := proto.Path(e.payload)
+		if i := bytes.IndexByte(path, '?'); i != -1 {
+			path = path[:i]
+		}
+		return string(path), true
+	case "query":
+		return queryMap(e.payload), true
+	case "host":
+		return string(proto.Header(e.payload, []byte("Host"))), true
+	case "headers":
+		return headersMap(e.payload), true
+	case "header":
+		return expr.Func(e.header), true
+	case "body":
+		return string(e.decodedBody()), true
+	case "json":
+		return e.decodedJSON(), true
+	case "basic_auth":
+		value := proto.Header(e.payload, []byte("Authorization"))
+		if !bytes.HasPrefix(value, []byte("Basic ")) {
+			return "", true
+		}
+		decoded, _ := base64.StdEncoding.DecodeString(string(value[len("Basic "):]))
+		return string(decoded), true
+	case "status":
+		if proto.HasRequestTitle(e.payload) {
+			return nil, true
+		}
+		status, err := strconv.Atoi(string(proto.Status(e.payload)))
+		if err != nil {
+			return nil, true
+		}
+		return float64(status), true
+	case "type":
+		if len(e.meta) == 0 || len(e.meta[0]) == 0 {
+			return payloadTypes[protocol.RequestPayload], true
+		}
+		return payloadTypes[e.meta[0][0]], true
+	case "id":
+		return e.metaString(1), true
+	case "timestamp":
+		return e.metaNumber(2), true
+	case "latency":
+		return e.metaNumber(3), true
+	case "meta":
+		return metaMap(e.meta), true
+	}
+	return nil, false
+}
+
+func (e *messageEnv) header(args ...interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("header expects 1 argument")
+	}
+	name, ok := args[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("header expects a string, got %T", args[0])
+	}
+	return string(proto.Header(e.payload, []byte(name))), nil
+}
+
+func (e *messageEnv) metaString(i int) string {
+	if len(e.meta) <= i {
+		return ""
+	}
+	return string(e.meta[i])
+}
+
+func (e *messageEnv) metaNumber(i int) interface{} {
+	if len(e.meta) <= i {
+		return nil
+	}
+	n, err := strconv.ParseInt(string(e.meta[i]), 10, 64)
+	if err != nil {
+		return nil
+	}
+	return float64(n)
+}
+
+func (e *messageEnv) decodedBody() []byte {
+	if e.bodyParsed {
+		return e.body
+	}
+	e.bodyParsed = true
+	e.body = proto.Body(e.payload)
+
+	if bytes.Contains(bytes.ToLower(proto.Header(e.payload, []byte("Transfer-Encoding"))), []byte("chunked")) {
+		if body, err := ioutil.ReadAll(httputil.NewChunkedReader(bytes.NewReader(e.body))); err == nil {
+			e.body = body
+		}
+	}
+	return e.body
+}
+
+func (e *messageEnv) decodedJSON() interface{} {
+	if e.jsonParsed {
+		return e.json
+	}
+	e.jsonParsed = true
+	if body := e.decodedBody(); len(body) > 0 {
+		json.Unmarshal(body, &e.json)
+	}
+	return e.json
+}
+
+// headersMap resolves `headers["Name"]`, header names are case insensitive
+type headersMap []byte
+
+func (h headersMap) Get(key string) (interface{}, bool) {
+	value := proto.Header(h, []byte(key))
+	return string(value), len(value) > 0
+}
+
+// queryMap resolves `query["name"]` and `"name" in query`
+type queryMap []byte
+
+func (q queryMap) Get(key string) (interface{}, bool) {
+	if !proto.HasRequestTitle(q) {
+		return nil, false
+	}
+	value, start, _ := proto.PathParam(q, []byte(key))
+	if start == -1 {
+		return nil, false
+	}
+	return string(value), true
+}
+
+// metaMap resolves `meta["key"]` and `"key" in meta` from key=value fields of the meta line
+type metaMap [][]byte
+
+func (m metaMap) Get(key string) (interface{}, bool) {
+	value, ok := protocol.MetaField(m, key)
+	if !ok {
+		return nil, false
+	}
+	return value, true
+}
+
+// filterExpression compiles the legacy allow/deny options and the `--filter` expressions into a single expression.
+// Options are applied in the same order as before: method, url, headers, basic auth, hash limiters, filters.
+func (config *HTTPModifierConfig) filterExpression() string {
+	var rules []string
+
+	if len(config.Methods) > 0 {
+		methods := make([]string, len(config.Methods))
+		for i, m := range config.Methods {
+			methods[i] = expr.Quote(string(m))
+		}
+		rules = append(rules, fmt.Sprintf("method in [%s]", strings.Join(methods, ", ")))
+	}
+
+	if len(config.URLRegexp) > 0 {
+		urls := make([]string, len(config.URLRegexp))
+		for i, f := range config.URLRegexp {
+			urls[i] = fmt.Sprintf("url.matches(%s)", expr.Quote(f.regexp.String()))
+		}
+		rules = append(rules, strings.Join(urls, " || "))
+	}
+
+	for _, f := range config.URLNegativeRegexp {
+		rules = append(rules, fmt.Sprintf("!url.matches(%s)", expr.Quote(f.regexp.String())))
+	}
+
+	for _, f := range config.HeaderFilters {
+		name := expr.Quote(string(f.name))
+		rules = append(rules, fmt.Sprintf("header(%s) != \"\" && header(%s).matches(%s)", name, name, expr.Quote(f.regexp.String())))
+	}
+
+	for _, f := range config.HeaderNegativeFilters {
+		name := expr.Quote(string(f.name))
+		rules = append(rules, fmt.Sprintf("header(%s) == \"\" || !header(%s).matches(%s)", name, name, expr.Quote(f.regexp.String())))
+	}
+
+	for _, f := range config.HeaderBasicAuthFilters {
+		rules = append(rules, fmt.Sprintf("!header(\"Authorization\").startsWith(\"Basic \") || basic_auth.matches(%s)", expr.Quote(f.regexp.String())))
+	}
+
+	for _, f := range config.HeaderHashFilters {
+		name := expr.Quote(string(f.name))
+		rules = append(rules, fmt.Sprintf("header(%s) == \"\" || hash(header(%s)) %% 100 < %d", name, name, f.percent))
+	}
+
+	for _, f := range config.ParamHashFilters {
+		name := expr.Quote(string(f.name))
+		rules = append(rules, fmt.Sprintf("!(%s in query) || hash(query[%s]) %% 100 < %d", name, name, f.percent))
+	}
+
+	for _, f := range config.Filters {
+		rules = append(rules, f.String())
+	}
+
+	if len(rules) == 1 {
+		return rules[0]
+	}
+	for i, r := range rules {
+		rules[i] = "(" + r + ")"
+	}
+	return strings.Join(rules, " && ")
+}
+
+// responseFilterExpression combines `--filter-response` expressions
+func (config *HTTPModifierConfig) responseFilterExpression() string {
+	rules := make([]string, len(config.ResponseFilters))
+	for i, f := range config.ResponseFilters {
+		rules[i] = "(" + f.String() + ")"
+	}
+	return strings.Join(rules, " && ")
+}
@@ -0,0 +1,138 @@
+package core
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/reoring/goreplay/pkg/protocol"
+)
+
+func TestHTTPModifierFilterExpression(t *testing.T) {
+	filters := HTTPFilters{}
+	if err := filters.Set(`method == "POST" && path == "/orders" && header("X-Tenant") != "" && size(body) > 1kb || method == "DELETE"`); err != nil {
+		t.Fatal(err)
+	}
+
+	modifier := NewHTTPModifier(&HTTPModifierConfig{
+		Filters: filters,
+	})
+
+	largeBody := strings.Repeat("a", 2000)
+	tests := []struct {
+		payload string
+		pass    bool
+	}{
+		{"POST /orders?debug=1 HTTP/1.1\r\nX-Tenant: acme\r\nContent-Length: 2000\r\n\r\n" + largeBody, true},
+		{"POST /orders HTTP/1.1\r\nContent-Length: 2000\r\n\r\n" + largeBody, false},
+		{"POST /orders HTTP/1.1\r\nX-Tenant: acme\r\nContent-Length: 3\r\n\r\nabc", false},
+		{"POST /users HTTP/1.1\r\nX-Tenant: acme\r\nContent-Length: 2000\r\n\r\n" + largeBody, false},
+		{"DELETE /users/1 HTTP/1.1\r\n\r\n", true},
+		{"GET /orders HTTP/1.1\r\n\r\n", false},
+	}
+
+	for _, tc := range tests {
+		if pass := len(modifier.Rewrite([]byte(tc.payload))) != 0; pass != tc.pass {
+			t.Errorf("Expected pass=%v for %q", tc.pass, tc.payload[:30])
+		}
+	}
+}
+
+func TestHTTPModifierFilterJSON(t *testing.T) {
+	filters := HTTPFilters{}
+	filters.Set(`json.order.total >= 100 && "vip" in json.tags`)
+
+	modifier := NewHTTPModifier(&HTTPModifierConfig{
+		Filters: filters,
+	})
+
+	payload := []byte("POST /orders HTTP/1.1\r\nContent-Type: application/json\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"26\r\n{\"order\":{\"total\":150},\"tags\":[\"vip\"]}\r\n0\r\n\r\n")
+	if len(modifier.Rewrite(payload)) == 0 {
+		t.Error("Request should pass filters")
+	}
+
+	payload = []byte("POST /orders HTTP/1.1\r\nContent-Type: application/json\r\nContent-Length: 33\r\n\r\n{\"order\":{\"total\":150},\"tags\":[]}")
+	if len(modifier.Rewrite(payload)) != 0 {
+		t.Error("Request should not pass filters")
+	}
+}
+
+func TestHTTPModifierLegacyFilterExpression(t *testing.T) {
+	config := HTTPModifierConfig{}
+	config.Methods.Set("GET")
+	config.Methods.Set("OPTIONS")
+	config.URLRegexp.Set("^/api")
+	config.HeaderFilters.Set(`api-version:^1\.0\d`)
+	config.HeaderHashFilters.Set("user-id:25%")
+	config.ParamHashFilters.Set("user_id:50%")
+	config.Filters.Set(`type == "request"`)
+
+	expected := `(method in ["GET", "OPTIONS"]) && (url.matches("^/api")) && ` +
+		`(header("api-version") != "" && header("api-version").matches("^1\\.0\\d")) && ` +
+		`(header("user-id") == "" || hash(header("user-id")) % 100 < 25) && ` +
+		`(!("user_id" in query) || hash(query["user_id"]) % 100 < 50) && ` +
+		`(type == "request")`
+	if src := config.filterExpression(); src != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, src)
+	}
+
+	modifier := NewHTTPModifier(&config)
+	payload := []byte("GET /api/users?user_id=1 HTTP/1.1\r\napi-version: 1.01\r\n\r\n")
+	if !bytes.Equal(modifier.Rewrite(payload), payload) {
+		t.Error("Request should pass filters")
+	}
+}
+
+func TestHTTPModifierResponseFilter(t *testing.T) {
+	filters := HTTPFilters{}
+	filters.Set(`status >= 500 || latency > 1s`)
+
+	modifier := NewHTTPModifier(&HTTPModifierConfig{
+		ResponseFilters: filters,
+	})
+
+	tests := []struct {
+		meta    []byte
+		payload string
+		pass    bool
+	}{
+		{protocol.PayloadHeader(protocol.ResponsePayload, protocol.Uuid(), 1, 1000), "HTTP/1.1 503 Service Unavailable\r\n\r\n", true},
+		{protocol.PayloadHeader(protocol.ResponsePayload, protocol.Uuid(), 1, 2e9), "HTTP/1.1 200 OK\r\n\r\n", true},
+		{protocol.PayloadHeader(protocol.ReplayedResponsePayload, protocol.Uuid(), 1, 1000), "HTTP/1.1 200 OK\r\n\r\n", false},
+	}
+
+	for _, tc := range tests {
+		if pass := modifier.AllowResponse(protocol.PayloadMeta(tc.meta), []byte(tc.payload)); pass != tc.pass {
+			t.Errorf("Expected pass=%v for %q %q", tc.pass, tc.meta, tc.payload)
+		}
+	}
+}
+
+func TestHTTPModifierFilterMeta(t *testing.T) {
+	filters := HTTPFilters{}
+	if err := filters.Set(`meta["src"].startsWith("10.0.3.") && !("canary" in meta)`); err != nil {
+		t.Fatal(err)
+	}
+	modifier := NewHTTPModifier(&HTTPModifierConfig{
+		Filters: filters,
+	})
+
+	payload := []byte("GET / HTTP/1.1\r\n\r\n")
+	header := protocol.PayloadHeader(protocol.RequestPayload, protocol.Uuid(), 1, -1)
+	tests := []struct {
+		meta []byte
+		pass bool
+	}{
+		{protocol.AppendMetaField(header, "src", "10.0.3.7:5000"), true},
+		{protocol.AppendMetaField(header, "src", "10.0.4.7:5000"), false},
+		{protocol.AppendMetaField(protocol.AppendMetaField(header, "src", "10.0.3.7:5000"), "canary", "1"), false},
+		{header, false},
+	}
+
+	for _, tc := range tests {
+		if pass := len(modifier.RewriteMessage(protocol.PayloadMeta(tc.meta), payload)) != 0; pass != tc.pass {
+			t.Errorf("Expected pass=%v for %q", tc.pass, tc.meta)
+		}
+	}
+}
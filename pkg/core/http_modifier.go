@@ -1,19 +1,30 @@
 package core
 
 import (
-	"bytes"
-	"encoding/base64"
-	"hash/fnv"
-	"strings"
+	"fmt"
+	"log"
 
+	"github.com/reoring/goreplay/pkg/expr"
 	"github.com/reoring/goreplay/proto"
 )
 
 type HTTPModifier struct {
-	config *HTTPModifierConfig
+	config         *HTTPModifierConfig
+	filter         *expr.Program
+	responseFilter *expr.Program
 }
 
+// NewHTTPModifier returns nil if there are no rules in the config, it exits if filters can't be compiled
 func NewHTTPModifier(config *HTTPModifierConfig) *HTTPModifier {
+	m, err := CreateHTTPModifier(config)
+	if err != nil {
+		log.Fatal("[HTTP-MODIFIER] ", err)
+	}
+	return m
+}
+
+// CreateHTTPModifier is like NewHTTPModifier, but returns an error if filters can't be compiled
+func CreateHTTPModifier(config *HTTPModifierConfig) (*HTTPModifier, error) {
 	// Optimization to skip modifier completely if we do not need it
 	if len(config.URLRegexp) == 0 &&
 		len(config.URLNegativeRegexp) == 0 &&
@@ -26,33 +37,43 @@ func NewHTTPModifier(config *HTTPModifierConfig) *HTTPModifier {
 		len(config.ParamHashFilters) == 0 &&
 		len(config.Params) == 0 &&
 		len(config.Headers) == 0 &&
-		len(config.Methods) == 0 {
-		return nil
+		len(config.Methods) == 0 &&
+		len(config.Filters) == 0 &&
+		len(config.ResponseFilters) == 0 &&
+		!config.hasBodyRules() {
+		return nil, nil
 	}
 
-	return &HTTPModifier{config: config}
-}
+	m := &HTTPModifier{config: config}
 
-func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
-	if !proto.HasRequestTitle(payload) {
-		return payload
+	// All allow/deny options are compiled down to a single filter expression
+	var err error
+	if src := config.filterExpression(); src != "" {
+		if m.filter, err = expr.Compile(src); err != nil {
+			return nil, fmt.Errorf("can't compile filter: %v", err)
+		}
+		Debug(1, fmt.Sprintf("[HTTP-MODIFIER] request filter: %s", src))
+	}
+	if src := config.responseFilterExpression(); src != "" {
+		if m.responseFilter, err = expr.Compile(src); err != nil {
+			return nil, fmt.Errorf("can't compile response filter: %v", err)
+		}
+		Debug(1, fmt.Sprintf("[HTTP-MODIFIER] response filter: %s", src))
 	}
 
-	if len(m.config.Methods) > 0 {
-		method := proto.Method(payload)
-
-		matched := false
+	return m, nil
+}
 
-		for _, m := range m.config.Methods {
-			if bytes.Equal(method, m) {
-				matched = true
-				break
-			}
-		}
+// Rewrite applies filters and modifications to the request payload.
+// Empty result means that request was filtered out.
+func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
+	return m.RewriteMessage(nil, payload)
+}
 
-		if !matched {
-			return
-		}
+// RewriteMessage is like Rewrite, but also makes message meta (type, id, timestamp and latency) available to filters
+func (m *HTTPModifier) RewriteMessage(meta [][]byte, payload []byte) (response []byte) {
+	if !proto.HasRequestTitle(payload) {
+		return payload
 	}
 
 	if len(m.config.Headers) > 0 {
@@ -67,102 +88,8 @@ func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
 		}
 	}
 
-	if len(m.config.URLRegexp) > 0 {
-		path := proto.Path(payload)
-
-		matched := false
-
-		for _, f := range m.config.URLRegexp {
-			if f.regexp.Match(path) {
-				matched = true
-				break
-			}
-		}
-
-		if !matched {
-			return
-		}
-	}
-
-	if len(m.config.URLNegativeRegexp) > 0 {
-		path := proto.Path(payload)
-
-		for _, f := range m.config.URLNegativeRegexp {
-			if f.regexp.Match(path) {
-				return
-			}
-		}
-	}
-
-	if len(m.config.HeaderFilters) > 0 {
-		for _, f := range m.config.HeaderFilters {
-			value := proto.Header(payload, f.name)
-
-			if len(value) == 0 {
-				return
-			}
-
-			if !f.regexp.Match(value) {
-				return
-			}
-		}
-	}
-
-	if len(m.config.HeaderNegativeFilters) > 0 {
-		for _, f := range m.config.HeaderNegativeFilters {
-			value := proto.Header(payload, f.name)
-
-			if len(value) > 0 && f.regexp.Match(value) {
-				return
-			}
-		}
-	}
-
-	if len(m.config.HeaderBasicAuthFilters) > 0 {
-		for _, f := range m.config.HeaderBasicAuthFilters {
-			value := proto.Header(payload, []byte("Authorization"))
-
-			if len(value) > 0 {
-				valueString := string(value)
-				trimmedBasicAuthEncoded := strings.TrimPrefix(valueString, "Basic ")
-				if strings.Compare(valueString, trimmedBasicAuthEncoded) != 0 {
-					decodedAuth, _ := base64.StdEncoding.DecodeString(trimmedBasicAuthEncoded)
-					if !f.regexp.Match(decodedAuth) {
-						return
-					}
-				}
-			}
-		}
-	}
-
-	if len(m.config.HeaderHashFilters) > 0 {
-		for _, f := range m.config.HeaderHashFilters {
-			value := proto.Header(payload, f.name)
-
-			if len(value) > 0 {
-				hasher := fnv.New32a()
-				hasher.Write(value)
-
-				if (hasher.Sum32() % 100) >= f.percent {
-					return
-				}
-			}
-		}
-	}
-
-	if len(m.config.ParamHashFilters) > 0 {
-		for _, f := range m.config.ParamHashFilters {
-			value, s, _ := proto.PathParam(payload, f.name)
-
-			if s != -1 {
-				hasher := fnv.New32a()
-				hasher.Write(value)
-
-				if (hasher.Sum32() % 100) >= f.percent {
-					return
-				}
-			}
-		}
+	if m.filter != nil && !m.filter.Match(newMessageEnv(meta, payload)) {
+		return
 	}
 
 	if len(m.config.URLRewrite) > 0 {
@@ -192,5 +119,14 @@ func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
 		}
 	}
 
+	if m.config.hasBodyRules() {
+		payload = m.rewriteBody(payload)
+	}
+
 	return payload
 }
+
+// AllowResponse reports whether response or replayed response passes `--filter-response` expressions
+func (m *HTTPModifier) AllowResponse(meta [][]byte, payload []byte) bool {
+	return m.responseFilter == nil || m.responseFilter.Match(newMessageEnv(meta, payload))
+}
@@ -0,0 +1,617 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/reoring/goreplay/proto"
+)
+
+func (config *HTTPModifierConfig) hasBodyRules() bool {
+	return len(config.JSONSet) > 0 ||
+		len(config.JSONDelete) > 0 ||
+		len(config.FormSet) > 0 ||
+		len(config.FormDelete) > 0 ||
+		len(config.XMLSet) > 0 ||
+		len(config.XMLDelete) > 0
+}
+
+// rewriteBody applies body rules matching the request Content-Type.
+// Chunked bodies are decoded and sent with Content-Length instead, which is always updated.
+func (m *HTTPModifier) rewriteBody(payload []byte) []byte {
+	headersEnd := proto.MIMEHeadersEndPos(payload)
+	if headersEnd < 0 || headersEnd >= len(payload) {
+		return payload
+	}
+
+	contentType := bytes.ToLower(proto.Header(payload, []byte("Content-Type")))
+	var rewrite func([]byte) ([]byte, bool)
+	switch {
+	case bytes.Contains(contentType, []byte("json")):
+		if len(m.config.JSONSet) == 0 && len(m.config.JSONDelete) == 0 {
+			return payload
+		}
+		rewrite = m.rewriteJSON
+	case bytes.Contains(contentType, []byte("application/x-www-form-urlencoded")):
+		if len(m.config.FormSet) == 0 && len(m.config.FormDelete) == 0 {
+			return payload
+		}
+		rewrite = m.rewriteForm
+	case bytes.Contains(contentType, []byte("xml")):
+		if len(m.config.XMLSet) == 0 && len(m.config.XMLDelete) == 0 {
+			return payload
+		}
+		rewrite = m.rewriteXML
+	default:
+		return payload
+	}
+
+	return rewriteHTTPBody(payload, rewrite)
+}
+
+// rewriteHTTPBody replaces the body of the payload with the rewritten one. Bodies with Content-Encoding
+// are left as is, chunked bodies are decoded and sent with Content-Length instead.
+func rewriteHTTPBody(payload []byte, rewrite func([]byte) ([]byte, bool)) []byte {
+	headersEnd := proto.MIMEHeadersEndPos(payload)
+	if headersEnd < 0 || headersEnd >= len(payload) {
+		return payload
+	}
+
+	if enc := proto.Header(payload, []byte("Content-Encoding")); len(enc) > 0 && !bytes.EqualFold(enc, []byte("identity")) {
+		Debug(2, fmt.Sprintf("[HTTP-MODIFIER] can't rewrite body with Content-Encoding %q", enc))
+		return payload
+	}
+
+	headers := payload[:headersEnd:headersEnd]
+	body := payload[headersEnd:]
+	chunked := bytes.Contains(bytes.ToLower(proto.Header(payload, []byte("Transfer-Encoding"))), []byte("chunked"))
+	if chunked {
+		var err error
+		body, err = ioutil.ReadAll(httputil.NewChunkedReader(bytes.NewReader(body)))
+		if err != nil {
+			Debug(2, fmt.Sprintf("[HTTP-MODIFIER] can't decode chunked body: %q", err))
+			return payload
+		}
+	}
+
+	body, changed := rewrite(body)
+	if !changed {
+		return payload
+	}
+
+	if chunked {
+		headers = proto.DeleteHeader(headers, []byte("Transfer-Encoding"))
+	}
+	headers = proto.SetHeader(headers, []byte("Content-Length"), []byte(strconv.Itoa(len(body))))
+
+	return append(headers, body...)
+}
+
+//
+// JSON bodies, paths are dot separated keys or array indexes: `user.addresses.0.zip`, `*` matches any of them
+//
+
+func (m *HTTPModifier) rewriteJSON(body []byte) ([]byte, bool) {
+	changed := false
+	for _, rule := range m.config.JSONSet {
+		value := rule.value
+		if !json.Valid(value) {
+			value = jsonString(string(rule.value))
+		}
+		path := strings.Split(rule.path, ".")
+		var ok bool
+		if body, ok = editJSON(body, func(doc *jsonNode) []bodyEdit { return jsonSet(doc, path, value) }); ok {
+			changed = true
+		}
+	}
+	for _, rule := range m.config.JSONDelete {
+		path := strings.Split(rule.path, ".")
+		var ok bool
+		if body, ok = editJSON(body, func(doc *jsonNode) []bodyEdit { return jsonDelete(doc, path) }); ok {
+			changed = true
+		}
+	}
+	return body, changed
+}
+
+// jsonNode is a value of a JSON document with its position. Documents are edited in place, so everything
+// outside of edited values keeps its formatting, key order and number precision.
+type jsonNode struct {
+	start, end int
+	kind       json.Delim // '{' or '[', 0 for other values
+	null       bool
+	keys       []string // keys of object members
+	keyStarts  []int    // positions of object member keys
+	children   []*jsonNode
+}
+
+// editJSON applies edits returned for the parsed document
+func editJSON(body []byte, edit func(doc *jsonNode) []bodyEdit) ([]byte, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	doc, err := parseJSONNode(decoder, body)
+	if err != nil {
+		Debug(2, fmt.Sprintf("[HTTP-MODIFIER] can't decode JSON body: %q", err))
+		return body, false
+	}
+	edits := edit(doc)
+	if len(edits) == 0 {
+		return body, false
+	}
+	return applyBodyEdits(body, edits), true
+}
+
+func parseJSONNode(decoder *json.Decoder, body []byte) (*jsonNode, error) {
+	n := &jsonNode{start: skipJSONSeparators(body, int(decoder.InputOffset()))}
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	n.null = token == nil
+	if delim, ok := token.(json.Delim); ok {
+		n.kind = delim
+		for decoder.More() {
+			if delim == '{' {
+				keyStart := skipJSONSeparators(body, int(decoder.InputOffset()))
+				key, err := decoder.Token()
+				if err != nil {
+					return nil, err
+				}
+				n.keys = append(n.keys, key.(string))
+				n.keyStarts = append(n.keyStarts, keyStart)
+			}
+			child, err := parseJSONNode(decoder, body)
+			if err != nil {
+				return nil, err
+			}
+			n.children = append(n.children, child)
+		}
+		// closing delimiter
+		if _, err := decoder.Token(); err != nil {
+			return nil, err
+		}
+	}
+	n.end = int(decoder.InputOffset())
+
+	return n, nil
+}
+
+// skipJSONSeparators returns the position of the next token, offsets of the decoder are before separators
+func skipJSONSeparators(body []byte, pos int) int {
+	for pos < len(body) && strings.IndexByte(" \t\r\n,:", body[pos]) >= 0 {
+		pos++
+	}
+	return pos
+}
+
+// name returns the key of an object member, or the index of an array element
+func (n *jsonNode) name(i int) string {
+	if n.kind == '{' {
+		return n.keys[i]
+	}
+	return strconv.Itoa(i)
+}
+
+// memberStart returns the position of an object member, or of an array element
+func (n *jsonNode) memberStart(i int) int {
+	if n.kind == '{' {
+		return n.keyStarts[i]
+	}
+	return n.children[i].start
+}
+
+// jsonSet returns edits setting value at path, creating missing objects on the way
+func jsonSet(n *jsonNode, path []string, value []byte) []bodyEdit {
+	if len(path) == 0 {
+		return []bodyEdit{{start: n.start, end: n.end, replacement: value}}
+	}
+	key := path[0]
+
+	var edits []bodyEdit
+	found := false
+	for i, child := range n.children {
+		if key == "*" || key == n.name(i) {
+			edits = append(edits, jsonSet(child, path[1:], value)...)
+			found = true
+		}
+	}
+	if found || key == "*" {
+		return edits
+	}
+
+	member := jsonMember(key, path[1:], value)
+	switch {
+	case member == nil:
+	case n.kind == '{' && len(n.children) == 0:
+		edits = append(edits, bodyEdit{start: n.end - 1, end: n.end - 1, replacement: member})
+	case n.kind == '{':
+		edits = append(edits, bodyEdit{start: n.children[len(n.children)-1].end, end: n.children[len(n.children)-1].end, replacement: append([]byte(","), member...)})
+	case n.null:
+		edits = append(edits, bodyEdit{start: n.start, end: n.end, replacement: append(append([]byte("{"), member...), '}')})
+	}
+	return edits
+}
+
+// jsonMember returns the object member with value at path, nil if path has `*`
+func jsonMember(key string, path []string, value []byte) []byte {
+	for i := len(path) - 1; i >= 0; i-- {
+		if path[i] == "*" {
+			return nil
+		}
+		value = append(append([]byte("{"), jsonMember(path[i], nil, value)...), '}')
+	}
+	if key == "*" {
+		return nil
+	}
+	return append(append(jsonString(key), ':'), value...)
+}
+
+// jsonDelete returns edits removing values at path
+func jsonDelete(n *jsonNode, path []string) []bodyEdit {
+	if len(path) == 0 {
+		return nil
+	}
+	key := path[0]
+
+	var edits []bodyEdit
+	deleted := make([]bool, len(n.children))
+	for i, child := range n.children {
+		if key != "*" && key != n.name(i) {
+			continue
+		}
+		if len(path) == 1 {
+			deleted[i] = true
+		} else {
+			edits = append(edits, jsonDelete(child, path[1:])...)
+		}
+	}
+	return append(edits, n.removeMembers(deleted)...)
+}
+
+// removeMembers returns edits removing members of an object or array, with the commas separating them
+func (n *jsonNode) removeMembers(deleted []bool) []bodyEdit {
+	firstKept := -1
+	for i, d := range deleted {
+		if !d {
+			firstKept = i
+			break
+		}
+	}
+
+	var edits []bodyEdit
+	for i, d := range deleted {
+		if !d {
+			continue
+		}
+		start, end := n.memberStart(i), n.children[i].end
+		if i > 0 {
+			start = n.children[i-1].end
+		} else if firstKept > 0 {
+			end = n.memberStart(firstKept)
+		}
+		// removals of consecutive members overlap
+		if last := len(edits) - 1; last >= 0 && start <= edits[last].end {
+			if end > edits[last].end {
+				edits[last].end = end
+			}
+			continue
+		}
+		edits = append(edits, bodyEdit{start: start, end: end})
+	}
+	return edits
+}
+
+// jsonString returns s encoded as JSON string, without escaping of HTML characters
+func jsonString(s string) []byte {
+	buf := new(bytes.Buffer)
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(s)
+	return bytes.TrimSuffix(buf.Bytes(), []byte{'\n'})
+}
+
+//
+// Form encoded bodies, fields keep their order
+//
+
+func (m *HTTPModifier) rewriteForm(body []byte) ([]byte, bool) {
+	fields := strings.Split(string(body), "&")
+	changed := false
+
+	for _, rule := range m.config.FormSet {
+		field := url.QueryEscape(rule.path) + "=" + url.QueryEscape(string(rule.value))
+		found := false
+		for i, f := range fields {
+			if formFieldName(f) == rule.path {
+				fields[i] = field
+				found = true
+			}
+		}
+		if !found {
+			if len(fields) == 1 && fields[0] == "" {
+				fields = fields[:0]
+			}
+			fields = append(fields, field)
+		}
+		changed = true
+	}
+
+	for _, rule := range m.config.FormDelete {
+		kept := fields[:0]
+		for _, f := range fields {
+			if formFieldName(f) == rule.path {
+				changed = true
+				continue
+			}
+			kept = append(kept, f)
+		}
+		fields = kept
+	}
+	if !changed {
+		return body, false
+	}
+
+	return []byte(strings.Join(fields, "&")), true
+}
+
+func formFieldName(field string) string {
+	if i := strings.IndexByte(field, '='); i >= 0 {
+		field = field[:i]
+	}
+	name, err := url.QueryUnescape(field)
+	if err != nil {
+		return field
+	}
+	return name
+}
+
+//
+// XML bodies, selectors are a small subset of XPath: `/Envelope/Body/Login/user`, `//user`, `//Login/@tenant`.
+// Namespace prefixes are ignored and `*` matches any element.
+// The document is edited in place, so everything outside of matched elements keeps its formatting.
+//
+
+type xmlStep struct {
+	name       string
+	descendant bool
+}
+
+type xmlSelector struct {
+	steps []xmlStep
+	attr  string
+}
+
+func parseXMLSelector(path string) (sel xmlSelector) {
+	descendant := !strings.HasPrefix(path, "/")
+	for path != "" {
+		if strings.HasPrefix(path, "//") {
+			descendant = true
+			path = path[2:]
+			continue
+		}
+		if strings.HasPrefix(path, "/") {
+			path = path[1:]
+			continue
+		}
+		segment := path
+		if i := strings.IndexByte(path, '/'); i >= 0 {
+			segment, path = path[:i], path[i:]
+		} else {
+			path = ""
+		}
+		if strings.HasPrefix(segment, "@") {
+			sel.attr = localXMLName(segment[1:])
+			break
+		}
+		sel.steps = append(sel.steps, xmlStep{name: localXMLName(segment), descendant: descendant})
+		descendant = false
+	}
+
+	return
+}
+
+func localXMLName(name string) string {
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
+
+// match checks if the stack of open elements is selected
+func (sel xmlSelector) match(stack []string) bool {
+	return matchXMLSteps(sel.steps, stack)
+}
+
+func matchXMLSteps(steps []xmlStep, stack []string) bool {
+	if len(steps) == 0 {
+		return len(stack) == 0
+	}
+	if len(stack) == 0 {
+		return false
+	}
+	step := steps[0]
+	if !step.descendant {
+		return (step.name == "*" || step.name == stack[0]) && matchXMLSteps(steps[1:], stack[1:])
+	}
+	for i := range stack {
+		if (step.name == "*" || step.name == stack[i]) && matchXMLSteps(steps[1:], stack[i+1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// bodyEdit replaces body[start:end] with replacement
+type bodyEdit struct {
+	start, end  int
+	replacement []byte
+}
+
+type xmlFrame struct {
+	name        string
+	start       int
+	innerStart  int
+	selfClosing bool
+	rawName     string
+}
+
+func (m *HTTPModifier) rewriteXML(body []byte) ([]byte, bool) {
+	changed := false
+	for _, rule := range m.config.XMLSet {
+		var ok bool
+		if body, ok = rewriteXMLBody(body, parseXMLSelector(rule.path), rule.value, false); ok {
+			changed = true
+		}
+	}
+	for _, rule := range m.config.XMLDelete {
+		var ok bool
+		if body, ok = rewriteXMLBody(body, parseXMLSelector(rule.path), nil, true); ok {
+			changed = true
+		}
+	}
+	return body, changed
+}
+
+func rewriteXMLBody(body []byte, sel xmlSelector, value []byte, remove bool) ([]byte, bool) {
+	escaped := new(bytes.Buffer)
+	xml.EscapeText(escaped, value)
+
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	decoder.Strict = false
+
+	var edits []bodyEdit
+	var stack []string
+	var frames []xmlFrame
+	for {
+		start := int(decoder.InputOffset())
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			Debug(2, fmt.Sprintf("[HTTP-MODIFIER] can't decode XML body: %q", err))
+			return body, false
+		}
+		end := int(decoder.InputOffset())
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			frame := xmlFrame{
+				name:        t.Name.Local,
+				start:       start,
+				innerStart:  end,
+				selfClosing: end >= 2 && body[end-2] == '/',
+				rawName:     rawXMLName(t.Name),
+			}
+			frames = append(frames, frame)
+			stack = append(stack, frame.name)
+
+			if sel.attr != "" && sel.match(stack) {
+				if tag, ok := rewriteXMLAttr(t, frame, sel.attr, escaped.Bytes(), remove); ok {
+					edits = append(edits, bodyEdit{start: start, end: end, replacement: tag})
+				}
+			}
+		case xml.EndElement:
+			if len(frames) == 0 {
+				continue
+			}
+			frame := frames[len(frames)-1]
+			if sel.attr == "" && sel.match(stack) {
+				switch {
+				case remove:
+					edits = append(edits, bodyEdit{start: frame.start, end: end})
+				case frame.selfClosing:
+					replacement := append([]byte(">"), escaped.Bytes()...)
+					replacement = append(replacement, "</"+frame.rawName+">"...)
+					edits = append(edits, bodyEdit{start: frame.innerStart - 2, end: frame.innerStart, replacement: replacement})
+				default:
+					edits = append(edits, bodyEdit{start: frame.innerStart, end: start, replacement: escaped.Bytes()})
+				}
+			}
+			frames = frames[:len(frames)-1]
+			stack = stack[:len(stack)-1]
+		}
+	}
+	if len(edits) == 0 {
+		return body, false
+	}
+	return applyBodyEdits(body, edits), true
+}
+
+// applyBodyEdits returns the body with edits applied, edits of outer elements win over the ones nested inside them
+func applyBodyEdits(body []byte, edits []bodyEdit) []byte {
+	sort.SliceStable(edits, func(i, j int) bool {
+		if edits[i].start == edits[j].start {
+			return edits[i].end > edits[j].end
+		}
+		return edits[i].start < edits[j].start
+	})
+	result := make([]byte, 0, len(body))
+	last := 0
+	for _, e := range edits {
+		if e.start < last {
+			continue
+		}
+		result = append(result, body[last:e.start]...)
+		result = append(result, e.replacement...)
+		last = e.end
+	}
+	result = append(result, body[last:]...)
+
+	return result
+}
+
+func rawXMLName(name xml.Name) string {
+	if name.Space != "" {
+		return name.Space + ":" + name.Local
+	}
+	return name.Local
+}
+
+// rewriteXMLAttr renders the start tag with the attribute set or removed
+func rewriteXMLAttr(t xml.StartElement, frame xmlFrame, attr string, value []byte, remove bool) ([]byte, bool) {
+	tag := new(bytes.Buffer)
+	tag.WriteString("<" + frame.rawName)
+
+	found := false
+	for _, a := range t.Attr {
+		if a.Name.Local == attr {
+			found = true
+			if remove {
+				continue
+			}
+			tag.WriteString(" " + rawXMLName(a.Name) + `="`)
+			tag.Write(value)
+			tag.WriteString(`"`)
+			continue
+		}
+		tag.WriteString(" " + rawXMLName(a.Name) + `="`)
+		xml.EscapeText(tag, []byte(a.Value))
+		tag.WriteString(`"`)
+	}
+	if remove && !found {
+		return nil, false
+	}
+	if !found {
+		tag.WriteString(" " + attr + `="`)
+		tag.Write(value)
+		tag.WriteString(`"`)
+	}
+
+	if frame.selfClosing {
+		tag.WriteString("/>")
+	} else {
+		tag.WriteString(">")
+	}
+
+	return tag.Bytes(), true
+}
@@ -6,6 +6,8 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+
+	"github.com/reoring/goreplay/pkg/expr"
 )
 
 // HTTPModifierConfig holds configuration options for built-in traffic modifier
@@ -22,6 +24,14 @@ type HTTPModifierConfig struct {
 	Params                 HTTPParams                 `json:"http-set-param"`
 	Headers                HTTPHeaders                `json:"http-set-header"`
 	Methods                HTTPMethods                `json:"http-allow-method"`
+	JSONSet                HTTPBodyRules              `json:"http-set-json"`
+	JSONDelete             HTTPBodyDeletes            `json:"http-delete-json"`
+	FormSet                HTTPBodyRules              `json:"http-set-form"`
+	FormDelete             HTTPBodyDeletes            `json:"http-delete-form"`
+	XMLSet                 HTTPBodyRules              `json:"http-set-xml"`
+	XMLDelete              HTTPBodyDeletes            `json:"http-delete-xml"`
+	Filters                HTTPFilters                `json:"filter"`
+	ResponseFilters        HTTPFilters                `json:"filter-response"`
 }
 
 //
@@ -297,3 +307,73 @@ func (r *HTTPURLRegexp) Set(value string) error {
 
 	return err
 }
+
+//
+// Handling of --http-set-json, --http-set-form and --http-set-xml options
+//
+type bodyRule struct {
+	path  string
+	value []byte
+}
+
+// HTTPBodyRules holds body fields to set and their new values
+type HTTPBodyRules []bodyRule
+
+func (r *HTTPBodyRules) String() string {
+	return fmt.Sprint(*r)
+}
+
+// Set method to implement flags.Value
+func (r *HTTPBodyRules) Set(value string) error {
+	valArr := strings.SplitN(value, "=", 2)
+	if len(valArr) < 2 || strings.TrimSpace(valArr[0]) == "" {
+		return errors.New("need both field path and value, separated by `=` (ex. user.tenant=staging)")
+	}
+
+	*r = append(*r, bodyRule{path: strings.TrimSpace(valArr[0]), value: []byte(valArr[1])})
+	return nil
+}
+
+//
+// Handling of --http-delete-json, --http-delete-form and --http-delete-xml options
+//
+
+// HTTPBodyDeletes holds paths of body fields to remove
+type HTTPBodyDeletes []bodyRule
+
+func (r *HTTPBodyDeletes) String() string {
+	return fmt.Sprint(*r)
+}
+
+// Set method to implement flags.Value
+func (r *HTTPBodyDeletes) Set(value string) error {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return errors.New("need field path (ex. card.number)")
+	}
+
+	*r = append(*r, bodyRule{path: value})
+	return nil
+}
+
+//
+// Handling of --filter and --filter-response options
+//
+
+// HTTPFilters holds compiled filter expressions, message is passed only if all of them match
+type HTTPFilters []*expr.Program
+
+func (f *HTTPFilters) String() string {
+	return fmt.Sprint(*f)
+}
+
+// Set method to implement flags.Value
+func (f *HTTPFilters) Set(value string) error {
+	p, err := expr.Compile(value)
+	if err != nil {
+		return err
+	}
+
+	*f = append(*f, p)
+	return nil
+}
@@ -63,3 +63,36 @@ func TestUrlRewriteMap(t *testing.T) {
 		t.Error("Should not set mapping without :")
 	}
 }
+
+func TestHTTPBodyRules(t *testing.T) {
+	rules := HTTPBodyRules{}
+
+	if err := rules.Set("user.tenant=a=b"); err != nil {
+		t.Error("Should not error on user.tenant=a=b")
+	}
+	if rules[0].path != "user.tenant" || string(rules[0].value) != "a=b" {
+		t.Error("Should split on the first `=`", rules[0])
+	}
+
+	if err := rules.Set("user.tenant"); err == nil {
+		t.Error("Should error on missing value")
+	}
+
+	deletes := HTTPBodyDeletes{}
+	if err := deletes.Set(" "); err == nil {
+		t.Error("Should error on empty path")
+	}
+}
+
+func TestXMLSelector(t *testing.T) {
+	sel := parseXMLSelector("/soap:Envelope/Body//id/@type")
+	if sel.attr != "type" || len(sel.steps) != 3 || sel.steps[0].name != "Envelope" || !sel.steps[2].descendant {
+		t.Errorf("Wrong selector %+v", sel)
+	}
+	if !sel.match([]string{"Envelope", "Body", "User", "id"}) {
+		t.Error("Should match descendant")
+	}
+	if sel.match([]string{"Body", "id"}) {
+		t.Error("Should not match without root")
+	}
+}
@@ -2,6 +2,7 @@ package core
 
 import (
 	"bytes"
+	"strconv"
 	"testing"
 
 	"github.com/reoring/goreplay/proto"
@@ -318,3 +319,132 @@ func TestHTTPModifierSetParam(t *testing.T) {
 		t.Error("Should override param", string(payload))
 	}
 }
+
+func TestHTTPModifierJSONBody(t *testing.T) {
+	set := HTTPBodyRules{}
+	set.Set("user.tenant=staging")
+	set.Set("user.limits.max=10")
+	set.Set("items.*.price=0")
+	deletes := HTTPBodyDeletes{}
+	deletes.Set("card.number")
+	deletes.Set("items.1")
+
+	modifier := NewHTTPModifier(&HTTPModifierConfig{
+		JSONSet:    set,
+		JSONDelete: deletes,
+	})
+
+	payload := []byte("POST /orders HTTP/1.1\r\nContent-Type: application/json\r\nContent-Length: 99\r\nHost: www.w3.org\r\n\r\n" +
+		`{"user":{"tenant":"prod","name":"<a>"},"card":{"number":"4111","exp":"01/30"},"items":[{"price":5},{"price":7}]}`)
+	payloadAfter := []byte("POST /orders HTTP/1.1\r\nContent-Type: application/json\r\nContent-Length: 107\r\nHost: www.w3.org\r\n\r\n" +
+		`{"user":{"tenant":"staging","name":"<a>","limits":{"max":10}},"card":{"exp":"01/30"},"items":[{"price":0}]}`)
+
+	if payload = modifier.Rewrite(payload); !bytes.Equal(payloadAfter, payload) {
+		t.Errorf("Should rewrite JSON body, got %q", payload)
+	}
+
+	// untouched values keep their formatting, order and precision
+	payload = []byte("POST /orders HTTP/1.1\r\nContent-Type: application/json\r\nContent-Length: 100\r\n\r\n" +
+		"{\n  \"id\": 12345678901234567890,\n  \"card\" : null,\n  \"items\": [ {\"price\": 1.50}, 2, 3 ],\n  \"z\": 1e3\n}\n")
+	payloadAfter = []byte("POST /orders HTTP/1.1\r\nContent-Type: application/json\r\nContent-Length: 139\r\n\r\n" +
+		"{\n  \"id\": 12345678901234567890,\n  \"card\" : {\"exp\":\"01/30\"},\n  \"items\": [ 3 ],\n  \"z\": 1e3,\"user\":{\"tenant\":\"staging\",\"limits\":{\"max\":10}}\n}\n")
+	set.Set("card.exp=01/30")
+	set.Set("missing.*.a=1")
+	deletes = HTTPBodyDeletes{}
+	deletes.Set("items.0")
+	deletes.Set("items.0")
+	modifier = NewHTTPModifier(&HTTPModifierConfig{
+		JSONSet:    set,
+		JSONDelete: deletes,
+	})
+	if payload = modifier.Rewrite(payload); !bytes.Equal(payloadAfter, payload) {
+		t.Errorf("Should keep JSON formatting, got %q", payload)
+	}
+
+	// other content types are untouched
+	payload = []byte("POST /orders HTTP/1.1\r\nContent-Type: text/plain\r\nContent-Length: 9\r\n\r\n{\"a\":\"b\"}")
+	if after := modifier.Rewrite(payload); !bytes.Equal(after, payload) {
+		t.Errorf("Should not rewrite text body, got %q", after)
+	}
+}
+
+func TestHTTPModifierJSONChunkedBody(t *testing.T) {
+	set := HTTPBodyRules{}
+	set.Set(`user.tenant="staging"`)
+
+	modifier := NewHTTPModifier(&HTTPModifierConfig{
+		JSONSet: set,
+	})
+
+	payload := []byte("POST / HTTP/1.1\r\nContent-Type: application/json; charset=utf-8\r\nTransfer-Encoding: chunked\r\n\r\n7\r\n{\"user\"\r\n5\r\n:{}}\n\r\n0\r\n\r\n")
+	payloadAfter := []byte("POST / HTTP/1.1\r\nContent-Length: 30\r\nContent-Type: application/json; charset=utf-8\r\n\r\n{\"user\":{\"tenant\":\"staging\"}}\n")
+
+	if payload = modifier.Rewrite(payload); !bytes.Equal(payloadAfter, payload) {
+		t.Errorf("Should rewrite chunked JSON body, got %q", payload)
+	}
+}
+
+func TestHTTPModifierFormBody(t *testing.T) {
+	set := HTTPBodyRules{}
+	set.Set("tenant=staging env")
+	set.Set("new=1")
+	deletes := HTTPBodyDeletes{}
+	deletes.Set("password")
+
+	modifier := NewHTTPModifier(&HTTPModifierConfig{
+		FormSet:    set,
+		FormDelete: deletes,
+	})
+
+	payload := []byte("POST /login HTTP/1.1\r\nContent-Type: application/x-www-form-urlencoded\r\nContent-Length: 37\r\n\r\nuser=bob&password=secret&tenant=prod")
+	payloadAfter := []byte("POST /login HTTP/1.1\r\nContent-Type: application/x-www-form-urlencoded\r\nContent-Length: 33\r\n\r\nuser=bob&tenant=staging+env&new=1")
+
+	if payload = modifier.Rewrite(payload); !bytes.Equal(payloadAfter, payload) {
+		t.Errorf("Should rewrite form body, got %q", payload)
+	}
+}
+
+func TestHTTPModifierXMLBody(t *testing.T) {
+	set := HTTPBodyRules{}
+	set.Set("/Envelope/Body/Login/tenant=staging & co")
+	set.Set("//Login/@version=2")
+	set.Set("//empty=filled")
+	deletes := HTTPBodyDeletes{}
+	deletes.Set("//CardNumber")
+
+	modifier := NewHTTPModifier(&HTTPModifierConfig{
+		XMLSet:    set,
+		XMLDelete: deletes,
+	})
+
+	body := `<?xml version="1.0"?>
+<soap:Envelope xmlns:soap="http://www.w3.org/2003/05/soap-envelope">
+  <soap:Body>
+    <m:Login xmlns:m="urn:app" version="1">
+      <m:tenant>prod</m:tenant>
+      <m:CardNumber>4111</m:CardNumber>
+      <empty/>
+    </m:Login>
+  </soap:Body>
+</soap:Envelope>`
+	bodyAfter := `<?xml version="1.0"?>
+<soap:Envelope xmlns:soap="http://www.w3.org/2003/05/soap-envelope">
+  <soap:Body>
+    <m:Login xmlns:m="urn:app" version="2">
+      <m:tenant>staging &amp; co</m:tenant>
+      
+      <empty>filled</empty>
+    </m:Login>
+  </soap:Body>
+</soap:Envelope>`
+
+	payload := []byte("POST /soap HTTP/1.1\r\nContent-Type: application/soap+xml\r\nContent-Length: 1\r\n\r\n" + body)
+	payload = modifier.Rewrite(payload)
+
+	if !bytes.Equal(proto.Body(payload), []byte(bodyAfter)) {
+		t.Errorf("Should rewrite XML body, got %s", proto.Body(payload))
+	}
+	if l := proto.Header(payload, []byte("Content-Length")); string(l) != strconv.Itoa(len(bodyAfter)) {
+		t.Errorf("Should update Content-Length, got %s", l)
+	}
+}
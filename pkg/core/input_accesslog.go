@@ -0,0 +1,344 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/reoring/goreplay/pkg/protocol"
+)
+
+// AccessLogInputConfig ...
+type AccessLogInputConfig struct {
+	Format string `json:"input-accesslog-format"` // name of a built-in format, or a custom format with nginx variables
+}
+
+// accessLogFormats are the built-in formats, written with nginx variables like custom formats
+var accessLogFormats = map[string]string{
+	// nginx and Apache combined, and Apache common log format
+	"combined": `$remote_addr $remote_ident $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent"`,
+	"common":   `$remote_addr $remote_ident $remote_user [$time_local] "$request" $status $body_bytes_sent`,
+	// AWS Application Load Balancer and Classic Load Balancer, requests have absolute URLs
+	"alb": `$type $time_iso8601 $elb $remote_addr $target_addr $request_processing_time $target_processing_time $response_processing_time $status $target_status $bytes_received $body_bytes_sent "$request" "$http_user_agent" `,
+	"elb": `$time_iso8601 $elb $remote_addr $backend_addr $request_processing_time $backend_processing_time $response_processing_time $status $backend_status $bytes_received $body_bytes_sent "$request" "$http_user_agent"`,
+	// CloudFront standard logs, tab separated with URL encoded values
+	"cloudfront": "$date\t$time\t$edge_location\t$body_bytes_sent\t$remote_addr\t$request_method\t$distribution_host\t$uri\t$status\t$http_referer\t$http_user_agent\t$args\t$http_cookie\t$edge_result_type\t$edge_request_id\t$host\t$scheme\t",
+}
+
+var accessLogVariable = regexp.MustCompile(`\$[a-zA-Z0-9_]+`)
+
+var errInvalidLogLine = errors.New("line doesn't match the format")
+
+// accessLogFormat parses lines of access logs to requests
+type accessLogFormat struct {
+	re        *regexp.Regexp
+	variables []string // names of variables of each group of re, without $
+	urlEncode bool     // values are URL encoded, like in CloudFront logs
+}
+
+// newAccessLogFormat returns a built-in format by name, or parses a custom format. Variables of custom formats
+// match anything up to the text which follows them, values between quotes can have escaped quotes.
+func newAccessLogFormat(format string) (*accessLogFormat, error) {
+	f := &accessLogFormat{urlEncode: format == "cloudfront"}
+	if builtin, ok := accessLogFormats[format]; ok {
+		format = builtin
+	} else if !strings.Contains(format, "$") {
+		return nil, fmt.Errorf("unknown access log format %q, expected combined, common, alb, elb, cloudfront or a format with nginx variables like $request", format)
+	}
+
+	expr := "^"
+	last := 0
+	for _, loc := range accessLogVariable.FindAllStringIndex(format, -1) {
+		if loc[0] > 0 && loc[0] == last {
+			return nil, fmt.Errorf("variables of access log format should be separated, like $host $request_uri: %q", format)
+		}
+		expr += regexp.QuoteMeta(format[last:loc[0]])
+		switch {
+		case loc[0] > 0 && format[loc[0]-1] == '"' && loc[1] < len(format) && format[loc[1]] == '"':
+			expr += `((?:[^"\\]|\\.)*)`
+		case loc[1] == len(format):
+			expr += `(.*)`
+		default:
+			expr += `(.*?)`
+		}
+		f.variables = append(f.variables, format[loc[0]+1:loc[1]])
+		last = loc[1]
+	}
+	expr += regexp.QuoteMeta(format[last:])
+
+	var hasRequest, hasTime bool
+	for _, v := range f.variables {
+		switch v {
+		case "request", "request_uri", "uri":
+			hasRequest = true
+		case "time_local", "time_iso8601", "msec", "date":
+			hasTime = true
+		}
+	}
+	if !hasRequest || !hasTime {
+		return nil, fmt.Errorf("access log format should have $request, $request_uri or $uri, and $time_local, $time_iso8601, $msec or $date and $time")
+	}
+
+	var err error
+	f.re, err = regexp.Compile(expr)
+	return f, err
+}
+
+// accessLogRequest holds the fields of a logged request
+type accessLogRequest struct {
+	timestamp int64
+	method    string
+	uri       string
+	proto     string
+	host      string
+	headers   [][2]string
+	meta      [][2]string
+}
+
+// parse returns the request of the line. Lines starting with # are comments of CloudFront and W3C logs, and
+// are skipped with nil request.
+func (f *accessLogFormat) parse(line []byte) (*accessLogRequest, error) {
+	line = bytes.TrimRight(line, "\r\n")
+	if len(line) == 0 || line[0] == '#' {
+		return nil, nil
+	}
+	m := f.re.FindSubmatch(line)
+	if m == nil {
+		return nil, errInvalidLogLine
+	}
+
+	r := accessLogRequest{}
+	var date, clock, path, args string
+	for i, name := range f.variables {
+		value := f.unescape(name, m[i+1])
+		if value == "-" {
+			value = ""
+		}
+		switch name {
+		case "request":
+			parts := strings.Split(value, " ")
+			if len(parts) < 2 || len(parts) > 3 || parts[0] == "" {
+				return nil, fmt.Errorf("invalid request %q", value)
+			}
+			r.method, r.uri = parts[0], parts[1]
+			if len(parts) == 3 {
+				r.proto = parts[2]
+			}
+		case "request_method":
+			r.method = value
+		case "request_uri":
+			r.uri = value
+		case "uri":
+			path = value
+		case "args", "query_string":
+			args = value
+		case "server_protocol":
+			r.proto = value
+		case "host", "http_host":
+			if value != "" {
+				r.host = value
+			}
+		case "remote_addr":
+			if value != "" {
+				r.meta = append(r.meta, [2]string{"src", value})
+			}
+		case "status":
+			if value != "" {
+				r.meta = append(r.meta, [2]string{"status", value})
+			}
+		case "time_local":
+			t, err := time.Parse("02/Jan/2006:15:04:05 -0700", value)
+			if err != nil {
+				return nil, err
+			}
+			r.timestamp = t.UnixNano()
+		case "time_iso8601":
+			t, err := time.Parse(time.RFC3339Nano, value)
+			if err != nil {
+				return nil, err
+			}
+			r.timestamp = t.UnixNano()
+		case "msec":
+			sec, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, err
+			}
+			r.timestamp = int64(sec*1e3) * int64(time.Millisecond)
+		case "date":
+			date = value
+		case "time":
+			clock = value
+		default:
+			if strings.HasPrefix(name, "http_") && value != "" {
+				header := textproto.CanonicalMIMEHeaderKey(strings.Replace(name[5:], "_", "-", -1))
+				r.headers = append(r.headers, [2]string{header, value})
+			}
+		}
+	}
+	if date != "" {
+		t, err := time.Parse("2006-01-02 15:04:05", date+" "+clock)
+		if err != nil {
+			return nil, err
+		}
+		r.timestamp = t.UnixNano()
+	}
+	if r.uri == "" && path != "" {
+		r.uri = path
+		if args != "" {
+			r.uri += "?" + args
+		}
+	}
+	if r.uri == "" || r.timestamp == 0 {
+		return nil, errInvalidLogLine
+	}
+	return &r, nil
+}
+
+// unescape decodes headers of URL encoded logs, URLs are kept encoded, and \xHH, \" and \\ escapes of nginx
+// and Apache. New lines are removed, so they can't end headers of the request.
+func (f *accessLogFormat) unescape(name string, value []byte) string {
+	if f.urlEncode {
+		if v, err := url.PathUnescape(string(value)); err == nil && strings.HasPrefix(name, "http_") {
+			return strings.NewReplacer("\r", "", "\n", "").Replace(v)
+		}
+		return string(value)
+	}
+	if bytes.IndexByte(value, '\\') < 0 {
+		return string(value)
+	}
+	var buf []byte
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+1 < len(value) {
+			if value[i+1] == 'x' && i+3 < len(value) {
+				if b, err := strconv.ParseUint(string(value[i+2:i+4]), 16, 8); err == nil {
+					buf = append(buf, byte(b))
+					i += 3
+					continue
+				}
+			}
+			if value[i+1] == '"' || value[i+1] == '\\' {
+				buf = append(buf, value[i+1])
+				i++
+				continue
+			}
+		}
+		buf = append(buf, value[i])
+	}
+	return strings.NewReplacer("\r", "", "\n", "").Replace(string(buf))
+}
+
+// payload returns the meta line and the HTTP request. Absolute URLs of load balancer logs are split into the
+// Host header and the path, HTTP/2 requests are replayed as HTTP/1.1.
+func (r *accessLogRequest) payload() []byte {
+	if r.method == "" {
+		r.method = "GET"
+	}
+	if strings.HasPrefix(r.uri, "http://") || strings.HasPrefix(r.uri, "https://") {
+		if u, err := url.Parse(r.uri); err == nil {
+			host := u.Host
+			if port := u.Port(); (port == "80" && u.Scheme == "http") || (port == "443" && u.Scheme == "https") {
+				host = u.Hostname()
+			}
+			if r.host == "" {
+				r.host = host
+			}
+			r.uri = u.RequestURI()
+		}
+	}
+	if r.proto != "HTTP/1.0" {
+		r.proto = "HTTP/1.1"
+	}
+
+	header := protocol.PayloadHeader(protocol.RequestPayload, protocol.Uuid(), r.timestamp, -1)
+	for _, f := range r.meta {
+		header = protocol.AppendMetaField(header, f[0], f[1])
+	}
+	var buf bytes.Buffer
+	buf.Write(header)
+	fmt.Fprintf(&buf, "%s %s %s\r\n", r.method, r.uri, r.proto)
+	if r.host != "" {
+		fmt.Fprintf(&buf, "Host: %s\r\n", r.host)
+	}
+	for _, h := range r.headers {
+		fmt.Fprintf(&buf, "%s: %s\r\n", h[0], h[1])
+	}
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+// firstTimestamp returns the timestamp of the first valid line of the log
+func (f *accessLogFormat) firstTimestamp(path string) (int64, error) {
+	file, decoder, reader, err := openRecordedFile(path, 0, -1)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	if decoder != nil {
+		defer decoder.Close()
+	}
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if r, perr := f.parse(line); perr == nil && r != nil {
+			return r.timestamp, nil
+		}
+		if err != nil {
+			return 0, errors.New("no requests")
+		}
+	}
+}
+
+// NewAccessLogInput reads requests from access logs matching the path, like FileInput reads recorded files:
+// requests are replayed with the timing of the log, and can be sped up, looped and limited to a time range.
+func NewAccessLogInput(path string, config *AccessLogInputConfig, loop bool, readDepth int, maxWait time.Duration, dryRun bool, clock Clock, startAt, endAt FileTime) (*FileInput, error) {
+	format, err := newAccessLogFormat(config.Format)
+	if err != nil {
+		return nil, err
+	}
+	return newFileInput(path, loop, readDepth, maxWait, dryRun, clock, startAt, endAt, format), nil
+}
+
+// parseAccessLog reads requests of the access log, skipping lines which don't match the format
+func (f *fileInputReader) parseAccessLog(init chan struct{}) error {
+	var initialized bool
+	defer func() {
+		f.Close()
+		if !initialized {
+			close(init)
+		}
+	}()
+
+	// logs have timestamps in seconds or milliseconds, requests of the same time keep their order by
+	// timestamps a nanosecond apart
+	var logged, last int64
+	for {
+		line, err := f.reader.ReadBytes('\n')
+		if r, parseErr := f.accessLog.parse(line); parseErr != nil {
+			Debug(1, fmt.Sprintf("[INPUT-ACCESSLOG] %s: skipping %v: %q", f.path, parseErr, line))
+			f.stats.Add("invalid_lines", 1)
+		} else if r != nil {
+			if r.timestamp == logged {
+				logged, r.timestamp = r.timestamp, last+1
+			} else {
+				logged = r.timestamp
+			}
+			last = r.timestamp
+			f.push(r.payload(), r.timestamp, init, &initialized)
+		}
+		if err != nil {
+			if err != io.EOF && atomic.LoadInt32(&f.closed) == 0 && !f.reportInvalid(err) {
+				Debug(0, fmt.Sprintf("[INPUT-ACCESSLOG] %s: %v", f.path, err))
+			}
+			f.failed(err)
+			return err
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package core
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/reoring/goreplay/pkg/protocol"
+)
+
+func TestAccessLogFormats(t *testing.T) {
+	tests := []struct {
+		format   string
+		line     string
+		time     string
+		request  string
+		metaSrc  string
+		metaCode string
+	}{
+		{
+			"combined",
+			`127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif?a=1 HTTP/1.0" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08 \"x\" \x22y\x22"`,
+			"2000-10-10T20:55:36Z",
+			"GET /apache_pb.gif?a=1 HTTP/1.0\r\nReferer: http://www.example.com/start.html\r\nUser-Agent: Mozilla/4.08 \"x\" \"y\"\r\n\r\n",
+			"127.0.0.1", "200",
+		},
+		{
+			"combined",
+			`10.0.0.2 - - [10/Oct/2000:13:55:37 +0000] "HEAD / HTTP/2.0" 304 0 "-" "-" "extra nginx field"`,
+			"2000-10-10T13:55:37Z",
+			"HEAD / HTTP/1.1\r\n\r\n",
+			"10.0.0.2", "304",
+		},
+		{
+			"common",
+			`127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "POST /form HTTP/1.1" 201 2326`,
+			"2000-10-10T20:55:36Z",
+			"POST /form HTTP/1.1\r\n\r\n",
+			"127.0.0.1", "201",
+		},
+		{
+			"alb",
+			`https 2018-07-02T22:23:00.186641Z app/my-loadbalancer/50dc6c495c0c9188 192.168.131.39:2817 10.0.0.1:80 0.086 0.048 0.037 200 200 0 57 "GET https://www.example.com:443/p?x=1 HTTP/1.1" "curl/7.46.0" ECDHE-RSA-AES128-GCM-SHA256 TLSv1.2 arn:aws:elasticloadbalancing:us-east-2:123456789012:targetgroup/my-targets/73e2d6bc24d8a067 "Root=1-58337281-1d84f3d73c47ec4e58577259" "www.example.com" "-" 0 2018-07-02T22:22:48.364000Z "forward" "-" "-" "10.0.0.1:80" "200" "-" "-"`,
+			"2018-07-02T22:23:00.186641Z",
+			"GET /p?x=1 HTTP/1.1\r\nHost: www.example.com\r\nUser-Agent: curl/7.46.0\r\n\r\n",
+			"192.168.131.39:2817", "200",
+		},
+		{
+			"elb",
+			`2015-05-13T23:39:43.945958Z my-loadbalancer 192.168.131.39:2817 10.0.0.1:80 0.000073 0.001048 0.000057 200 200 0 29 "HEAD http://www.example.com:8080/ HTTP/1.1" "curl/7.38.0" - -`,
+			"2015-05-13T23:39:43.945958Z",
+			"HEAD / HTTP/1.1\r\nHost: www.example.com:8080\r\nUser-Agent: curl/7.38.0\r\n\r\n",
+			"192.168.131.39:2817", "200",
+		},
+		{
+			"cloudfront",
+			"2019-12-04\t21:02:31\tLAX1\t392\t192.0.2.100\tGET\td111111abcdef8.cloudfront.net\t/a%20b.html\t200\t-\tMozilla/5.0%20(Windows%20NT%2010.0)\tq=%2F1\t-\tHit\tSOX4xwn4XV6Q4rgb7XiVGOHms_BGlTAC4KyHmureZmBNrjGdRLiNIQ==\tshop.example.com\thttps\t23\t0.001\t-\tTLSv1.2\tECDHE-RSA-AES128-GCM-SHA256\tHit\tHTTP/2.0\t-\t-\t11040\t0.001\tHit\ttext/html\t78\t-\t-",
+			"2019-12-04T21:02:31Z",
+			"GET /a%20b.html?q=%2F1 HTTP/1.1\r\nHost: shop.example.com\r\nUser-Agent: Mozilla/5.0 (Windows NT 10.0)\r\n\r\n",
+			"192.0.2.100", "200",
+		},
+		{
+			`$msec $request_method $host $request_uri $status "$http_x_api_key"`,
+			`1622556000.123 DELETE api.example.com /users/1 204 "secret"`,
+			"2021-06-01T14:00:00.123Z",
+			"DELETE /users/1 HTTP/1.1\r\nHost: api.example.com\r\nX-Api-Key: secret\r\n\r\n",
+			"", "204",
+		},
+	}
+
+	for _, tt := range tests {
+		f, err := newAccessLogFormat(tt.format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := f.parse([]byte(tt.line + "\n"))
+		if err != nil {
+			t.Errorf("%s: %v", tt.format, err)
+			continue
+		}
+		payload, timestamp := r.payload(), r.timestamp
+		expected, _ := time.Parse(time.RFC3339Nano, tt.time)
+		if timestamp != expected.UnixNano() {
+			t.Errorf("%s: expected time %s, got %s", tt.format, expected, time.Unix(0, timestamp).UTC())
+		}
+		meta, data := protocol.PayloadMetaWithBody(payload)
+		if string(data) != tt.request {
+			t.Errorf("%s: expected request %q, got %q", tt.format, tt.request, data)
+		}
+		fields := protocol.PayloadMeta(meta)
+		if fields[0][0] != protocol.RequestPayload || string(fields[2]) != string(protocol.PayloadMeta(payload)[2]) {
+			t.Errorf("%s: unexpected meta %q", tt.format, meta)
+		}
+		if src, _ := protocol.MetaField(fields, "src"); src != tt.metaSrc {
+			t.Errorf("%s: expected src %q, got %q", tt.format, tt.metaSrc, src)
+		}
+		if status, _ := protocol.MetaField(fields, "status"); status != tt.metaCode {
+			t.Errorf("%s: expected status %q, got %q", tt.format, tt.metaCode, status)
+		}
+	}
+
+	f, _ := newAccessLogFormat("combined")
+	for _, line := range []string{
+		"#Version: 1.0",
+		"",
+	} {
+		if r, err := f.parse([]byte(line)); r != nil || err != nil {
+			t.Errorf("Should skip %q", line)
+		}
+	}
+	for _, line := range []string{
+		`127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "\x16\x03\x01" 400 0 "-" "-"`,
+		`127.0.0.1 - - [yesterday] "GET / HTTP/1.1" 200 0 "-" "-"`,
+		`not a log line`,
+		`127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET / HTTP/1.1" 200 0 "-" "a\r\nX-Injected: 1"`,
+	} {
+		r, err := f.parse([]byte(line))
+		if err == nil && bytes.Contains(r.payload(), []byte("\r\nX-Injected")) {
+			t.Errorf("Should not inject headers from %q", line)
+		} else if err == nil && !bytes.Contains([]byte(line), []byte("X-Injected")) {
+			t.Errorf("Should reject %q", line)
+		}
+	}
+
+	for _, format := range []string{"apache", `$remote_addr "$request"`, `[$time_local] $status`, `$msec $host$request_uri`} {
+		if _, err := newAccessLogFormat(format); err == nil {
+			t.Errorf("Should reject format %q", format)
+		}
+	}
+}
+
+// sleepClock is a manualClock which sums waited durations
+type sleepClock struct {
+	manualClock
+	slept time.Duration
+}
+
+func (c *sleepClock) After(d time.Duration) (<-chan time.Time, func()) {
+	c.slept += d
+	return c.manualClock.After(d)
+}
+
+func TestAccessLogInput(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor-accesslog")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "access.log")
+	ioutil.WriteFile(path, []byte(
+		`10.0.0.1 - - [10/Oct/2000:13:55:36 +0000] "GET /1 HTTP/1.1" 200 1 "-" "curl"
+10.0.0.1 - - [10/Oct/2000:13:55:38 +0000] "GET /3 HTTP/1.1" 200 1 "-" "curl"
+garbage
+10.0.0.1 - - [10/Oct/2000:13:55:37 +0000] "GET /2 HTTP/1.1" 200 1 "-" "curl"
+10.0.0.1 - - [10/Oct/2000:13:55:46 +0000] "GET /4 HTTP/1.1" 200 1 "-" "curl"
+10.0.0.1 - - [10/Oct/2000:13:55:46 +0000] "GET /5 HTTP/1.1" 200 1 "-" "curl"
+10.0.0.1 - - [10/Oct/2000:13:55:46 +0000] "GET /6 HTTP/1.1" 200 1 "-" "curl"
+`), 0644)
+
+	clock := &sleepClock{}
+	input, err := NewAccessLogInput(path, &AccessLogInputConfig{Format: "combined"}, false, 100, 0, false, clock, FileTime{}, FileTime{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer input.Close()
+
+	var paths []string
+	for {
+		msg, err := input.PluginRead()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, string(msg.Data[4:6]))
+	}
+	if strings.Join(paths, ",") != "/1,/2,/3,/4,/5,/6" {
+		t.Errorf("Requests should be replayed in order of time, and of the log for the same time, got %v", paths)
+	}
+	// 10 seconds of log, and a nanosecond between requests of the same time
+	if clock.slept != 10*time.Second+2 {
+		t.Errorf("Expected replay to take 10s, took %s", clock.slept)
+	}
+	if n := input.stats.Get("invalid_lines"); n == nil || n.String() != "1" {
+		t.Error("Should count invalid lines", n)
+	}
+
+	if _, err := NewAccessLogInput(path, &AccessLogInputConfig{Format: "apache"}, false, 100, 0, false, clock, FileTime{}, FileTime{}); err == nil {
+		t.Error("Should fail on unknown format")
+	}
+	if _, err := ParseSettings([]string{"--input-accesslog", path, "--input-accesslog-format", "apache"}); err == nil {
+		t.Error("Settings check should detect unknown format")
+	}
+}
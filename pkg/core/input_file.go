@@ -3,7 +3,6 @@ package core
 import (
 	"bufio"
 	"bytes"
-	"compress/gzip"
 	"container/heap"
 	"errors"
 	"expvar"
@@ -60,13 +59,32 @@ func (h payloadQueue) Idx(i int) *filePayload {
 type fileInputReader struct {
 	reader    *bufio.Reader
 	file      io.ReadCloser
+	decoder   io.Closer // decompressor, closed once parsing is over
+	path      string
 	closed    int32 // Value of 0 indicates that the file is still open.
 	s3        bool
 	queue     payloadQueue
 	readDepth int
+	header    *FileHeader // nil for version 1 and JSONL files
+	jsonl     bool
+	accessLog *accessLogFormat // nil if the file isn't an access log
+	stats     *expvar.Map
+	fail      func(error) // reports the error which stopped reading, can be nil
 }
 
 func (f *fileInputReader) parse(init chan struct{}) error {
+	defer f.closeDecoder()
+
+	if f.header != nil {
+		return f.parseV2(init)
+	}
+	if f.jsonl {
+		return f.parseJSONL(init)
+	}
+	if f.accessLog != nil {
+		return f.parseAccessLog(init)
+	}
+
 	payloadSeparatorAsBytes := []byte(protocol.PayloadSeparator)
 	var buffer bytes.Buffer
 	var initialized bool
@@ -75,9 +93,10 @@ func (f *fileInputReader) parse(init chan struct{}) error {
 		line, err := f.reader.ReadBytes('\n')
 
 		if err != nil {
-			if err != io.EOF {
+			if !f.reportInvalid(err) && err != io.EOF {
 				Debug(1, err)
 			}
+			f.failed(err)
 
 			f.Close()
 
@@ -96,31 +115,128 @@ func (f *fileInputReader) parse(init chan struct{}) error {
 			timestamp, _ := strconv.ParseInt(string(meta[2]), 10, 64)
 			data := asBytes[:len(asBytes)-1]
 
-			f.queue.Lock()
-			heap.Push(&f.queue, &filePayload{
-				timestamp: timestamp,
-				data:      data,
-			})
-			f.queue.Unlock()
+			f.push(data, timestamp, init, &initialized)
 
-			for {
-				if f.queue.Len() < f.readDepth {
-					break
-				}
+			buffer = bytes.Buffer{}
+			continue
+		}
 
-				if !initialized {
-					close(init)
-					initialized = true
-				}
+		buffer.Write(line)
+	}
+}
 
-				time.Sleep(100 * time.Millisecond)
-			}
+// parseV2 reads records of version 2 file, skipping corrupted ones
+func (f *fileInputReader) parseV2(init chan struct{}) error {
+	var initialized bool
+	defer func() {
+		f.Close()
+		if !initialized {
+			close(init)
+		}
+	}()
 
-			buffer = bytes.Buffer{}
+	for {
+		data, timestamp, err := readRecord(f.reader)
+		if err != nil && atomic.LoadInt32(&f.closed) == 1 {
+			return err
+		}
+		if errors.Is(err, errCorruptedRecord) {
+			Debug(1, fmt.Sprintf("[INPUT-FILE] %s: skipping %v", f.path, err))
+			f.stats.Add("corrupted_records", 1)
 			continue
 		}
+		if err != nil {
+			if !f.reportInvalid(err) && err != io.EOF {
+				Debug(0, fmt.Sprintf("[INPUT-FILE] %s: %v", f.path, err))
+			}
+			f.failed(err)
+			return err
+		}
 
-		buffer.Write(line)
+		f.push(data, timestamp, init, &initialized)
+	}
+}
+
+// parseJSONL reads messages of JSONL file, skipping invalid lines
+func (f *fileInputReader) parseJSONL(init chan struct{}) error {
+	var initialized bool
+	defer func() {
+		f.Close()
+		if !initialized {
+			close(init)
+		}
+	}()
+
+	for {
+		line, err := f.reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			data, timestamp, decodeErr := decodeJSONL(line)
+			switch {
+			case decodeErr == nil:
+				f.push(data, timestamp, init, &initialized)
+			case err == io.EOF:
+				// the last line is incomplete
+				err = errTruncatedFile
+			case err == nil:
+				Debug(1, fmt.Sprintf("[INPUT-FILE] %s: skipping %v", f.path, decodeErr))
+				f.stats.Add("corrupted_records", 1)
+			}
+		}
+		if err != nil && atomic.LoadInt32(&f.closed) == 1 {
+			return err
+		}
+		if err != nil {
+			if !f.reportInvalid(err) && err != io.EOF {
+				Debug(0, fmt.Sprintf("[INPUT-FILE] %s: %v", f.path, err))
+			}
+			f.failed(err)
+			return err
+		}
+	}
+}
+
+// failed reports the error which stopped reading, unless it's the end of file or the reader is closed
+func (f *fileInputReader) failed(err error) {
+	if err != io.EOF && f.fail != nil && atomic.LoadInt32(&f.closed) == 0 {
+		f.fail(fmt.Errorf("%s: %w", f.path, err))
+	}
+}
+
+// reportInvalid reports truncated files and tampered encrypted chunks, records after them are skipped
+func (f *fileInputReader) reportInvalid(err error) bool {
+	if errors.Is(err, errTamperedChunk) {
+		Debug(0, fmt.Sprintf("[INPUT-FILE] %s: %v, the rest of the file is skipped", f.path, err))
+		f.stats.Add("tampered_chunks", 1)
+		return true
+	}
+	if errors.Is(err, errTruncatedFile) {
+		Debug(0, fmt.Sprintf("[INPUT-FILE] %s: %v, the last record is skipped", f.path, err))
+		f.stats.Add("truncated_files", 1)
+		return true
+	}
+	return false
+}
+
+// push queues the payload, and waits while the queue is full. The init channel is closed once the queue is filled.
+func (f *fileInputReader) push(data []byte, timestamp int64, init chan struct{}, initialized *bool) {
+	f.queue.Lock()
+	heap.Push(&f.queue, &filePayload{
+		timestamp: timestamp,
+		data:      data,
+	})
+	f.queue.Unlock()
+
+	for {
+		if f.queue.Len() < f.readDepth {
+			break
+		}
+
+		if !*initialized {
+			close(init)
+			*initialized = true
+		}
+
+		time.Sleep(100 * time.Millisecond)
 	}
 }
 
@@ -140,6 +256,12 @@ func (f *fileInputReader) wait() {
 	return
 }
 
+func (f *fileInputReader) closeDecoder() {
+	if f.decoder != nil {
+		f.decoder.Close()
+	}
+}
+
 // Close closes this plugin
 func (f *fileInputReader) Close() error {
 	if atomic.LoadInt32(&f.closed) == 0 {
@@ -150,31 +272,102 @@ func (f *fileInputReader) Close() error {
 	return nil
 }
 
-func newFileInputReader(path string, readDepth int) *fileInputReader {
-	var file io.ReadCloser
-	var err error
+// openRecordedFile opens a local or S3 file, and decrypts and decompresses it if it's encrypted or compressed. Local files are read
+// from the offset, and up to the limit if it's not -1. Closing the file interrupts reading, the decoder
+// should be closed once reading is over if it's not nil.
+func openRecordedFile(path string, offset, limit int64) (file io.ReadCloser, decoder io.Closer, reader *bufio.Reader, err error) {
+	var src io.Reader
+	var c *fileCipher
 
 	if strings.HasPrefix(path, "s3://") {
 		file = NewS3ReadCloser(path)
+		src = file
 	} else {
-		file, err = os.Open(path)
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		file, src = f, f
+		if offset > 0 {
+			// the encryption header is at the start of the file
+			if c, err = readFileCipher(bufio.NewReader(f)); err == nil {
+				_, err = f.Seek(offset, io.SeekStart)
+			}
+			if err != nil {
+				f.Close()
+				return nil, nil, nil, err
+			}
+		}
+		if limit != -1 {
+			src = io.LimitReader(f, limit-offset)
+		}
 	}
 
+	reader = bufio.NewReaderSize(src, fileReaderSize)
+	if offset == 0 {
+		if c, err = readFileCipher(reader); err != nil {
+			file.Close()
+			return nil, nil, nil, err
+		}
+	}
+	if c != nil {
+		reader = bufio.NewReaderSize(newDecryptReader(reader, c, offset == 0, limit != -1), fileReaderSize)
+	}
+	if c := detectCompression(path, reader); c != nil {
+		d, err := c.newReader(reader)
+		if err != nil {
+			file.Close()
+			return nil, nil, nil, err
+		}
+		return file, d, bufio.NewReaderSize(d, fileReaderSize), nil
+	}
+	return file, nil, reader, nil
+}
+
+// readFileCipher reads the encryption header, it returns nil if the file isn't encrypted
+func readFileCipher(r *bufio.Reader) (*fileCipher, error) {
+	if !isEncrypted(r) {
+		return nil, nil
+	}
+	return readEncryptionHeader(r)
+}
+
+// newFileInputReader starts reading the file from the offset up to the limit, which are positions found in
+// the time index, -1 limit reads the whole file. Files are parsed as access logs if the format isn't nil.
+// Errors which stop reading later are reported to fail.
+func newFileInputReader(path string, readDepth int, stats *expvar.Map, offset, limit int64, accessLog *accessLogFormat, fail func(error)) (*fileInputReader, error) {
+	file, decoder, reader, err := openRecordedFile(path, 0, -1)
 	if err != nil {
 		Debug(0, fmt.Sprintf("[INPUT-FILE] err: %q", err))
-		return nil
+		return nil, err
 	}
 
-	r := &fileInputReader{file: file, closed: 0, readDepth: readDepth}
-	if strings.HasSuffix(path, ".gz") {
-		gzReader, err := gzip.NewReader(file)
+	r := &fileInputReader{file: file, decoder: decoder, reader: reader, path: path, closed: 0, readDepth: readDepth, accessLog: accessLog, stats: stats, fail: fail}
+	if accessLog != nil {
+		// access logs have no header
+	} else if isFileFormatV2(reader) {
+		header, err := readFileHeader(reader)
 		if err != nil {
-			Debug(0, fmt.Sprintf("[INPUT-FILE] err: %q", err))
-			return nil
+			Debug(0, fmt.Sprintf("[INPUT-FILE] %s: %v", path, err))
+			r.closeDecoder()
+			file.Close()
+			return nil, err
 		}
-		r.reader = bufio.NewReader(gzReader)
+		r.header = &header
+		Debug(1, fmt.Sprintf("[INPUT-FILE] %s: recorded at %s on %q with %v", path, header.Created.Format(time.RFC3339), header.Host, header.Config))
 	} else {
-		r.reader = bufio.NewReader(file)
+		r.jsonl = isFileFormatJSONL(reader)
+	}
+
+	if offset > 0 || limit != -1 {
+		// the header is at the start, records are read from the offset
+		r.closeDecoder()
+		file.Close()
+		if r.file, r.decoder, r.reader, err = openRecordedFile(path, offset, limit); err != nil {
+			Debug(0, fmt.Sprintf("[INPUT-FILE] err: %q", err))
+			return nil, err
+		}
+		stats.Add("seek_bytes", offset)
 	}
 
 	heap.Init(&r.queue)
@@ -183,34 +376,69 @@ func newFileInputReader(path string, readDepth int) *fileInputReader {
 	go r.parse(init)
 	<-init
 
-	return r
+	return r, nil
 }
 
 // FileInput can read requests generated by FileOutput
 type FileInput struct {
-	mu          sync.Mutex
-	data        chan []byte
-	exit        chan bool
-	path        string
-	readers     []*fileInputReader
-	speedFactor float64
-	loop        bool
-	readDepth   int
-	dryRun      bool
-	maxWait     time.Duration
+	speedFactor uint64 // math.Float64bits, keep 64-bit fields first, accessed atomically
+	skipTo      int64  // payloads older than this timestamp are skipped
+	position    int64  // timestamp of the last emitted payload
+
+	mu        sync.Mutex
+	data      chan []byte
+	exit      chan bool
+	done      chan struct{} // closed when all files are replayed
+	path      string
+	readers   []*fileInputReader
+	paused    chan struct{} // closed on resume, nil if not paused
+	pauseMu   sync.Mutex
+	wake      chan struct{}
+	clock     Clock
+	loop      bool
+	readDepth int
+	dryRun    bool
+	maxWait   time.Duration
+	startAt   FileTime
+	endAt     FileTime
+	accessLog *accessLogFormat // nil for recorded files
+	start     int64            // resolved startAt, math.MinInt64 if not set
+	end       int64            // resolved endAt, math.MaxInt64 if not set
+	resolved  bool
+
+	errMu sync.Mutex
+	err   error // the first error which stopped reading files
 
 	stats *expvar.Map
 }
 
 // NewFileInput constructor for FileInput. Accepts file path as argument.
 func NewFileInput(path string, loop bool, readDepth int, maxWait time.Duration, dryRun bool) (i *FileInput) {
+	return NewFileInputWithClock(path, loop, readDepth, maxWait, dryRun, RealClock{})
+}
+
+// NewFileInputWithClock is NewFileInput which waits between requests using the clock
+func NewFileInputWithClock(path string, loop bool, readDepth int, maxWait time.Duration, dryRun bool, clock Clock) (i *FileInput) {
+	return NewFileInputWithRange(path, loop, readDepth, maxWait, dryRun, clock, FileTime{}, FileTime{})
+}
+
+// NewFileInputWithRange is NewFileInputWithClock which replays requests recorded from startAt to endAt.
+// Files with time index are read from the position of startAt.
+func NewFileInputWithRange(path string, loop bool, readDepth int, maxWait time.Duration, dryRun bool, clock Clock, startAt, endAt FileTime) (i *FileInput) {
+	return newFileInput(path, loop, readDepth, maxWait, dryRun, clock, startAt, endAt, nil)
+}
+
+func newFileInput(path string, loop bool, readDepth int, maxWait time.Duration, dryRun bool, clock Clock, startAt, endAt FileTime, accessLog *accessLogFormat) (i *FileInput) {
 	expvarName := "file-" + path
 
 	i = new(FileInput)
 	i.data = make(chan []byte, 1000)
 	i.exit = make(chan bool)
+	i.done = make(chan struct{})
+	i.wake = make(chan struct{}, 1)
 	i.path = path
-	i.speedFactor = 1
+	i.SetSpeedFactor(1)
+	i.clock = clock
 	i.loop = loop
 	i.readDepth = readDepth
 
@@ -223,8 +451,15 @@ func NewFileInput(path string, loop bool, readDepth int, maxWait time.Duration,
 
 	i.dryRun = dryRun
 	i.maxWait = maxWait
+	i.startAt = startAt
+	i.endAt = endAt
+	i.accessLog = accessLog
+	i.start = math.MinInt64
+	i.end = math.MaxInt64
 
 	if err := i.init(); err != nil {
+		i.fail(err)
+		close(i.done)
 		return
 	}
 
@@ -266,13 +501,41 @@ func (i *FileInput) init() (err error) {
 
 	if len(matches) == 0 {
 		Debug(2, "[INPUT-FILE] No files match pattern: ", i.path)
-		return errors.New("no matching files")
+		return fmt.Errorf("no files match %q", i.path)
 	}
 
-	i.readers = make([]*fileInputReader, len(matches))
+	matches = withoutTimeIndexes(matches)
 
+	indexes := make([]*TimeIndex, len(matches))
+	if i.startAt.IsSet() || i.endAt.IsSet() {
+		for idx, p := range matches {
+			if !strings.HasPrefix(p, "s3://") {
+				indexes[idx], _ = readTimeIndex(p)
+			}
+		}
+		if !i.resolved {
+			if err = i.resolveRange(matches, indexes); err != nil {
+				Debug(0, fmt.Sprintf("[INPUT-FILE] %v", err))
+				return err
+			}
+		}
+	}
+
+	i.readers = nil
 	for idx, p := range matches {
-		i.readers[idx] = newFileInputReader(p, i.readDepth)
+		offset, limit := int64(0), int64(-1)
+		if index := indexes[idx]; index != nil {
+			var ok bool
+			if offset, limit, ok = index.seek(i.start, i.end); !ok {
+				Debug(1, fmt.Sprintf("[INPUT-FILE] %s: no requests in the time range", p))
+				continue
+			}
+		}
+		if r, err := newFileInputReader(p, i.readDepth, i.stats, offset, limit, i.accessLog, i.fail); err != nil {
+			i.fail(fmt.Errorf("%s: %w", p, err))
+		} else {
+			i.readers = append(i.readers, r)
+		}
 	}
 
 	i.stats.Add("reader_count", int64(len(matches)))
@@ -280,8 +543,169 @@ func (i *FileInput) init() (err error) {
 	return nil
 }
 
+// resolveRange finds the first recorded request if startAt or endAt are relative to it, and converts them to timestamps
+func (i *FileInput) resolveRange(matches []string, indexes []*TimeIndex) error {
+	var origin int64 = math.MaxInt64
+	if i.startAt.relative() || i.endAt.relative() {
+		for idx, p := range matches {
+			first, err := int64(0), error(nil)
+			if indexes[idx] != nil && len(indexes[idx].Entries) > 0 {
+				first = indexes[idx].First()
+			} else if i.accessLog != nil {
+				first, err = i.accessLog.firstTimestamp(p)
+			} else {
+				first, err = firstTimestamp(p)
+			}
+			if err != nil {
+				Debug(1, fmt.Sprintf("[INPUT-FILE] %s: %v", p, err))
+				continue
+			}
+			if first < origin {
+				origin = first
+			}
+		}
+		if origin == math.MaxInt64 {
+			return errors.New("can't find the first recorded request")
+		}
+	}
+
+	if i.startAt.IsSet() {
+		i.start = i.startAt.resolve(origin)
+		atomic.StoreInt64(&i.skipTo, i.start)
+		Debug(1, fmt.Sprintf("[INPUT-FILE] replaying requests recorded from %s", time.Unix(0, i.start)))
+	}
+	if i.endAt.IsSet() {
+		i.end = i.endAt.resolve(origin)
+		Debug(1, fmt.Sprintf("[INPUT-FILE] replaying requests recorded until %s", time.Unix(0, i.end)))
+	}
+	i.resolved = true
+	return nil
+}
+
+// firstTimestamp returns the timestamp of the first record of the file
+func firstTimestamp(path string) (int64, error) {
+	file, decoder, reader, err := openRecordedFile(path, 0, -1)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	if decoder != nil {
+		defer decoder.Close()
+	}
+
+	var first int64
+	var found bool
+	_, err = scanRecords(reader, nil, 0, func(_, timestamp int64) bool {
+		first, found = timestamp, true
+		return false
+	})
+	if err == nil && !found {
+		err = errors.New("no records")
+	}
+	return first, err
+}
+
 func (i *FileInput) SetSpeedFactor(speedFactor float64) {
-	i.speedFactor = speedFactor
+	atomic.StoreUint64(&i.speedFactor, math.Float64bits(speedFactor))
+}
+
+func (i *FileInput) getSpeedFactor() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&i.speedFactor))
+}
+
+// Pause stops emitting requests until Resume is called
+func (i *FileInput) Pause() {
+	i.pauseMu.Lock()
+	defer i.pauseMu.Unlock()
+
+	if i.paused == nil {
+		i.paused = make(chan struct{})
+	}
+}
+
+// Resume continues emitting requests after Pause
+func (i *FileInput) Resume() {
+	i.pauseMu.Lock()
+	defer i.pauseMu.Unlock()
+
+	if i.paused != nil {
+		close(i.paused)
+		i.paused = nil
+	}
+}
+
+// Skip drops requests recorded before the timestamp, replay continues from the first request after it.
+// It's only possible to skip forward.
+func (i *FileInput) Skip(timestamp int64) error {
+	if position := atomic.LoadInt64(&i.position); timestamp < position {
+		return fmt.Errorf("can't skip back to %s, replay is at %s", time.Unix(0, timestamp), time.Unix(0, position))
+	}
+	atomic.StoreInt64(&i.skipTo, timestamp)
+
+	// interrupt waiting for the next request
+	select {
+	case i.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// FileInputState describes replay progress of the file input
+type FileInputState struct {
+	Path        string    `json:"path"`
+	Paused      bool      `json:"paused"`
+	SpeedFactor float64   `json:"speed_factor"`
+	Position    time.Time `json:"position"`
+}
+
+// State returns replay progress of the file input
+func (i *FileInput) State() FileInputState {
+	i.pauseMu.Lock()
+	paused := i.paused != nil
+	i.pauseMu.Unlock()
+
+	state := FileInputState{Path: i.path, Paused: paused, SpeedFactor: i.getSpeedFactor()}
+	if position := atomic.LoadInt64(&i.position); position > 0 {
+		state.Position = time.Unix(0, position)
+	}
+	return state
+}
+
+// waitResume blocks while the input is paused, returns false if the input was closed
+func (i *FileInput) waitResume() bool {
+	i.pauseMu.Lock()
+	paused := i.paused
+	i.pauseMu.Unlock()
+
+	if paused == nil {
+		return true
+	}
+	select {
+	case <-paused:
+		return true
+	case <-i.exit:
+		return false
+	}
+}
+
+// sleep waits for the duration, unless the input is closed or Skip is called
+func (i *FileInput) sleep(d time.Duration) {
+	c, stop := i.clock.After(d)
+	defer stop()
+
+	select {
+	case <-c:
+	case <-i.wake:
+	case <-i.exit:
+	}
+}
+
+func (i *FileInput) skipped(payload *filePayload) bool {
+	if payload.timestamp < atomic.LoadInt64(&i.skipTo) {
+		i.stats.Add("skipped", 1)
+		return true
+	}
+	return false
 }
 
 // PluginRead reads message from this plugin
@@ -294,6 +718,15 @@ func (i *FileInput) PluginRead() (*Message, error) {
 		i.stats.Add("read_from", 1)
 		msg.Meta, msg.Data = protocol.PayloadMetaWithBody(buf)
 		return &msg, nil
+	case <-i.done:
+		select {
+		case buf := <-i.data:
+			i.stats.Add("read_from", 1)
+			msg.Meta, msg.Data = protocol.PayloadMetaWithBody(buf)
+			return &msg, nil
+		default:
+			return nil, io.EOF
+		}
 	}
 }
 
@@ -301,6 +734,22 @@ func (i *FileInput) String() string {
 	return "File input: " + i.path
 }
 
+func (i *FileInput) fail(err error) {
+	i.errMu.Lock()
+	if i.err == nil {
+		i.err = err
+	}
+	i.errMu.Unlock()
+}
+
+// Err returns the first error which stopped reading files, like a pattern without files, a truncated file
+// or a tampered encrypted chunk, nil if all files were read. Corrupted records are skipped, they aren't errors.
+func (i *FileInput) Err() error {
+	i.errMu.Lock()
+	defer i.errMu.Unlock()
+	return i.err
+}
+
 // Find reader with smallest timestamp e.g next payload in row
 func (i *FileInput) nextReader() (next *fileInputReader) {
 	for _, r := range i.readers {
@@ -338,16 +787,21 @@ func (i *FileInput) emit() {
 		default:
 		}
 
+		if !i.waitResume() {
+			return
+		}
+
 		reader := i.nextReader()
 
 		if reader == nil {
 			if i.loop {
-				i.init()
-				lastTime = -1
-				continue
-			} else {
-				break
+				// stop if files match, but none has requests in the time range
+				if err := i.init(); err != nil || len(i.readers) > 0 {
+					lastTime = -1
+					continue
+				}
 			}
+			break
 		}
 
 		reader.queue.RLock()
@@ -356,6 +810,18 @@ func (i *FileInput) emit() {
 		i.stats.Add("total_bytes", int64(len(payload.data)))
 		reader.queue.RUnlock()
 
+		if i.skipped(payload) {
+			lastTime = -1
+			continue
+		}
+
+		if payload.timestamp > i.end {
+			// requests are read in order of time, so the rest of the file is after the end too
+			i.stats.Add("skipped", 1)
+			reader.Close()
+			continue
+		}
+
 		if lastTime != -1 {
 			diff := payload.timestamp - lastTime
 
@@ -363,8 +829,8 @@ func (i *FileInput) emit() {
 				firstWait = diff
 			}
 
-			if i.speedFactor != 1 {
-				diff = int64(float64(diff) / i.speedFactor)
+			if speedFactor := i.getSpeedFactor(); speedFactor != 1 {
+				diff = int64(float64(diff) / speedFactor)
 			}
 
 			if i.maxWait > 0 && diff > int64(i.maxWait) {
@@ -375,7 +841,11 @@ func (i *FileInput) emit() {
 				lastTime = payload.timestamp
 
 				if !i.dryRun {
-					time.Sleep(time.Duration(diff))
+					i.sleep(time.Duration(diff))
+					if i.skipped(payload) {
+						lastTime = -1
+						continue
+					}
 				}
 
 				i.stats.Add("total_wait", diff)
@@ -402,6 +872,7 @@ func (i *FileInput) emit() {
 			if !i.dryRun {
 				i.data <- payload.data
 			}
+			atomic.StoreInt64(&i.position, payload.timestamp)
 		}
 	}
 
@@ -410,6 +881,7 @@ func (i *FileInput) emit() {
 	i.stats.Set("min_wait", time.Duration(minWait))
 
 	Debug(2, fmt.Sprintf("[INPUT-FILE] FileInput: end of file '%s'\n", i.path))
+	close(i.done)
 
 	if i.dryRun {
 		fmt.Printf("Records found: %v\nFiles processed: %v\nBytes processed: %v\nMax wait: %v\nMin wait: %v\nFirst wait: %v\nIt will take `%v` to replay at current speed.\nFound %v records with out of order timestamp\n",
@@ -274,7 +274,10 @@ func CreateCaptureFile(requestGenerator *RequestGenerator) *CaptureFile {
 		requestGenerator.wg.Done()
 	})
 
-	outputFile := NewFileOutput(f.Name(), &FileOutputConfig{FlushInterval: time.Second, Append: true})
+	outputFile, err := NewFileOutput(f.Name(), &FileOutputConfig{FlushInterval: time.Second, Append: true})
+	if err != nil {
+		panic(err)
+	}
 
 	plugins := &InOutPlugins{
 		Inputs:  requestGenerator.inputs,
@@ -286,7 +289,7 @@ func CreateCaptureFile(requestGenerator *RequestGenerator) *CaptureFile {
 	plugins.All = append(plugins.All, output, outputFile)
 
 	emitter := NewEmitter()
-	go emitter.Start(plugins, Settings.Middleware)
+	go emitter.Start(plugins, Settings.Middleware...)
 
 	requestGenerator.emit()
 	requestGenerator.wg.Wait()
@@ -315,7 +318,7 @@ func ReadFromCaptureFile(captureFile *os.File, count int, callback writeCallback
 
 	wg.Add(count)
 	emitter := NewEmitter()
-	go emitter.Start(plugins, Settings.Middleware)
+	go emitter.Start(plugins, Settings.Middleware...)
 
 	done := make(chan int, 1)
 	go func() {
@@ -25,7 +25,7 @@ func TestHTTPInput(t *testing.T) {
 	plugins.All = append(plugins.All, input, output)
 
 	emitter := NewEmitter()
-	go emitter.Start(plugins, Settings.Middleware)
+	go emitter.Start(plugins, Settings.Middleware...)
 
 	address := strings.Replace(input.address, "[::]", "127.0.0.1", -1)
 
@@ -60,7 +60,7 @@ func TestInputHTTPLargePayload(t *testing.T) {
 
 	emitter := NewEmitter()
 	defer emitter.Close()
-	go emitter.Start(plugins, Settings.Middleware)
+	go emitter.Start(plugins, Settings.Middleware...)
 
 	address := strings.Replace(input.address, "[::]", "127.0.0.1", -1)
 	var req *http.Request
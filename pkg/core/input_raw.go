@@ -28,6 +28,7 @@ type RAWInputConfig struct {
 	RealIPHeader    string             `json:"input-raw-realip-header"`
 	Stats           bool               `json:"input-raw-stats"`
 	AllowIncomplete bool               `json:"input-raw-allow-incomplete"`
+	Meta            bool               `json:"input-raw-meta"` // add addresses, connection and interface to meta
 	quit            chan bool          // Channel used only to indicate goroutine should shutdown
 	host            string
 	ports           []uint16
@@ -46,13 +47,22 @@ type RAWInput struct {
 
 // NewRAWInput constructor for RAWInput. Accepts raw input config as arguments.
 func NewRAWInput(address string, config RAWInputConfig) (i *RAWInput) {
-	i = new(RAWInput)
+	i, err := CreateRAWInput(address, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return i
+}
+
+// CreateRAWInput is like NewRAWInput, but returns an error if the address is invalid or capturing can't be started
+func CreateRAWInput(address string, config RAWInputConfig) (*RAWInput, error) {
+	i := new(RAWInput)
 	i.RAWInputConfig = config
 	i.quit = make(chan bool)
 
 	host, _ports, err := net.SplitHostPort(address)
 	if err != nil {
-		log.Fatalf("input-raw: error while parsing address: %s", err)
+		return nil, fmt.Errorf("input-raw: error while parsing address: %s", err)
 	}
 
 	var ports []uint16
@@ -62,7 +72,7 @@ func NewRAWInput(address string, config RAWInputConfig) (i *RAWInput) {
 		for _, portStr := range portsStr {
 			port, err := strconv.Atoi(strings.TrimSpace(portStr))
 			if err != nil {
-				log.Fatalf("parsing port error: %v", err)
+				return nil, fmt.Errorf("parsing port error: %v", err)
 			}
 			ports = append(ports, uint16(port))
 
@@ -72,9 +82,11 @@ func NewRAWInput(address string, config RAWInputConfig) (i *RAWInput) {
 	i.host = host
 	i.ports = ports
 
-	i.listen(address)
+	if err := i.listen(address); err != nil {
+		return nil, err
+	}
 
-	return
+	return i, nil
 }
 
 // PluginRead reads meassage from this plugin
@@ -96,6 +108,9 @@ func (i *RAWInput) PluginRead() (*Message, error) {
 		}
 	}
 	msg.Meta = protocol.PayloadHeader(msgType, msgTCP.UUID(), msgTCP.Start.UnixNano(), msgTCP.End.UnixNano()-msgTCP.Start.UnixNano())
+	if i.Meta {
+		msg.Meta = rawMetaFields(msg.Meta, msgTCP)
+	}
 
 	// to be removed....
 	if msgTCP.Truncated {
@@ -113,16 +128,44 @@ func (i *RAWInput) PluginRead() (*Message, error) {
 	return &msg, nil
 }
 
-func (i *RAWInput) listen(address string) {
+// rawMetaFields adds addresses, connection and interface of the TCP message to the payload header, and
+// flags of incomplete messages. Connection is the same for requests and responses.
+func rawMetaFields(header []byte, m *tcp.Message) []byte {
+	src := net.JoinHostPort(m.SrcAddr, strconv.Itoa(int(m.SrcPort)))
+	dst := net.JoinHostPort(m.DstAddr, strconv.Itoa(int(m.DstPort)))
+	conn := src + "-" + dst
+	if m.Direction != tcp.DirIncoming {
+		conn = dst + "-" + src
+	}
+
+	header = protocol.AppendMetaField(header, "src", src)
+	header = protocol.AppendMetaField(header, "dst", dst)
+	header = protocol.AppendMetaField(header, "conn", conn)
+	if m.Iface != "" {
+		header = protocol.AppendMetaField(header, "iface", m.Iface)
+	}
+	if m.LostData > 0 {
+		header = protocol.AppendMetaField(header, "lost", strconv.Itoa(m.LostData))
+	}
+	if m.Truncated {
+		header = protocol.AppendMetaField(header, "truncated", "1")
+	}
+	if m.TimedOut {
+		header = protocol.AppendMetaField(header, "timed_out", "1")
+	}
+	return header
+}
+
+func (i *RAWInput) listen(address string) error {
 	var err error
 	i.listener, err = capture.NewListener(i.host, i.ports, "", i.Engine, i.Protocol, i.TrackResponse, i.Expire, i.AllowIncomplete)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	i.listener.SetPcapOptions(i.PcapOptions)
 	err = i.listener.Activate()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	var ctx context.Context
@@ -134,6 +177,7 @@ func (i *RAWInput) listen(address string) {
 		<-errCh // the listener closed voluntarily
 		i.Close()
 	}()
+	return nil
 }
 
 func (i *RAWInput) String() string {
@@ -8,6 +8,7 @@ import (
 	"net/http/httptest"
 	"net/http/httputil"
 	"os/exec"
+	"reflect"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -15,6 +16,7 @@ import (
 	"time"
 
 	"github.com/reoring/goreplay/capture"
+	"github.com/reoring/goreplay/pkg/protocol"
 	"github.com/reoring/goreplay/proto"
 	"github.com/reoring/goreplay/tcp"
 )
@@ -72,7 +74,7 @@ func TestRAWInputIPv4(t *testing.T) {
 	addr := "http://127.0.0.1:" + port
 	emitter := NewEmitter()
 	defer emitter.Close()
-	go emitter.Start(plugins, Settings.Middleware)
+	go emitter.Start(plugins, Settings.Middleware...)
 
 	// time.Sleep(time.Second)
 	for i := 0; i < 1; i++ {
@@ -138,7 +140,7 @@ func TestRAWInputNoKeepAlive(t *testing.T) {
 	addr := "http://127.0.0.1:" + port
 
 	emitter := NewEmitter()
-	go emitter.Start(plugins, Settings.Middleware)
+	go emitter.Start(plugins, Settings.Middleware...)
 
 	for i := 0; i < 10; i++ {
 		// request + response
@@ -201,7 +203,7 @@ func TestRAWInputIPv6(t *testing.T) {
 
 	emitter := NewEmitter()
 	addr := "http://" + originAddr
-	go emitter.Start(plugins, Settings.Middleware)
+	go emitter.Start(plugins, Settings.Middleware...)
 	for i := 0; i < 10; i++ {
 		// request + response
 		wg.Add(2)
@@ -266,7 +268,7 @@ func TestInputRAWChunkedEncoding(t *testing.T) {
 
 	emitter := NewEmitter()
 	defer emitter.Close()
-	go emitter.Start(plugins, Settings.Middleware)
+	go emitter.Start(plugins, Settings.Middleware...)
 	wg.Add(2)
 
 	curl := exec.Command("curl", "http://"+originAddr, "--header", "Transfer-Encoding: chunked", "--header", "Expect:", "--data-binary", "@README.md")
@@ -338,7 +340,7 @@ func BenchmarkRAWInputWithReplay(b *testing.B) {
 	}
 
 	emitter := NewEmitter()
-	go emitter.Start(plugins, Settings.Middleware)
+	go emitter.Start(plugins, Settings.Middleware...)
 	addr := "http://" + originAddr
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -356,3 +358,17 @@ func BenchmarkRAWInputWithReplay(b *testing.B) {
 	b.ReportMetric(float64(replayCounter), "replayed")
 	emitter.Close()
 }
+
+func TestRAWInputMetaFields(t *testing.T) {
+	header := protocol.PayloadHeader(protocol.ResponsePayload, []byte("abc"), 1, 2)
+	msg := &tcp.Message{Stats: tcp.Stats{SrcAddr: "10.0.0.2", SrcPort: 80, DstAddr: "10.0.0.1", DstPort: 5432, Iface: "eth0", Direction: tcp.DirOutcoming, TimedOut: true}}
+	meta := protocol.PayloadMeta(rawMetaFields(header, msg))
+
+	expected := map[string]string{"src": "10.0.0.2:80", "dst": "10.0.0.1:5432", "conn": "10.0.0.1:5432-10.0.0.2:80", "iface": "eth0", "timed_out": "1"}
+	if fields := protocol.MetaFields(meta); !reflect.DeepEqual(fields, expected) {
+		t.Errorf("Expected %v, got %v", expected, fields)
+	}
+	if string(meta[1]) != "abc" || string(meta[3]) != "2" {
+		t.Errorf("Fixed fields should be kept, got %q", meta)
+	}
+}
@@ -29,15 +29,26 @@ type TCPInputConfig struct {
 
 // NewTCPInput constructor for TCPInput, accepts address with port
 func NewTCPInput(address string, config *TCPInputConfig) (i *TCPInput) {
-	i = new(TCPInput)
+	i, err := CreateTCPInput(address, config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return i
+}
+
+// CreateTCPInput is like NewTCPInput, but returns an error if it can't start listening
+func CreateTCPInput(address string, config *TCPInputConfig) (*TCPInput, error) {
+	i := new(TCPInput)
 	i.data = make(chan *Message, 1000)
 	i.address = address
 	i.config = config
 	i.stop = make(chan bool)
 
-	i.listen(address)
+	if err := i.listen(address); err != nil {
+		return nil, err
+	}
 
-	return
+	return i, nil
 }
 
 // PluginRead returns data and details read from plugin
@@ -58,23 +69,23 @@ func (i *TCPInput) Close() error {
 	return nil
 }
 
-func (i *TCPInput) listen(address string) {
+func (i *TCPInput) listen(address string) error {
 	if i.config.Secure {
 		cer, err := tls.LoadX509KeyPair(i.config.CertificatePath, i.config.KeyPath)
 		if err != nil {
-			log.Fatalln("error while loading --input-tcp TLS certificate:", err)
+			return fmt.Errorf("error while loading --input-tcp TLS certificate: %v", err)
 		}
 
 		config := &tls.Config{Certificates: []tls.Certificate{cer}}
 		listener, err := tls.Listen("tcp", address, config)
 		if err != nil {
-			log.Fatalln("[INPUT-TCP] failed to start INPUT-TCP listener:", err)
+			return fmt.Errorf("[INPUT-TCP] failed to start INPUT-TCP listener: %v", err)
 		}
 		i.listener = listener
 	} else {
 		listener, err := net.Listen("tcp", address)
 		if err != nil {
-			log.Fatalln("failed to start INPUT-TCP listener:", err)
+			return fmt.Errorf("failed to start INPUT-TCP listener: %v", err)
 		}
 		i.listener = listener
 	}
@@ -94,6 +105,7 @@ func (i *TCPInput) listen(address string) {
 			break
 		}
 	}()
+	return nil
 }
 
 var PayloadSeparatorAsBytes = []byte(protocol.PayloadSeparator)
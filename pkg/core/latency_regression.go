@@ -0,0 +1,332 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/reoring/goreplay/pkg/protocol"
+	"github.com/reoring/goreplay/proto"
+)
+
+// LatencyRegressionConfig holds configuration of the latency regression report
+type LatencyRegressionConfig struct {
+	Enabled   bool    `json:"latency-regression"`
+	Threshold float64 `json:"latency-regression-threshold"` // share by which replayed p95 can exceed the original one
+	MinCount  int     `json:"latency-regression-min-count"`
+	File      string  `json:"latency-regression-file"`
+}
+
+// LatencyRegression is an output which compares latency of original and replayed requests. Requests are joined
+// with original responses (type 2) and replayed responses (type 3) by id, and latency, deltas and ratios are
+// recorded by method and normalized route.
+type LatencyRegression struct {
+	config     LatencyRegressionConfig
+	clock      Clock
+	normalizer *EndpointNormalizer
+
+	mu          sync.Mutex
+	pending     map[string]*regressionPending
+	lastCleanup time.Time
+	endpoints   map[endpointKey]*endpointRegression
+	matched     int64
+	unmatched   int64
+}
+
+type regressionPending struct {
+	key      *endpointKey
+	original time.Duration // -1 until known
+	replayed time.Duration // -1 until known
+	added    time.Time
+}
+
+type endpointRegression struct {
+	original *Histogram // microseconds
+	replayed *Histogram // microseconds
+	ratio    *Histogram // thousandths
+	slower   *Histogram // positive deltas in microseconds
+	faster   *Histogram // negative deltas in microseconds
+}
+
+const (
+	// requests without both responses are discarded after this time
+	regressionPendingTimeout = 2 * time.Minute
+	// ratios are recorded in thousandths up to 10000x
+	regressionRatioHighest = 10000 * 1000
+)
+
+// LatencyPercentiles holds percentiles of latency in milliseconds, or of ratios
+type LatencyPercentiles struct {
+	P50 float64 `json:"p50"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+}
+
+// EndpointRegression compares latency of original and replayed requests of an endpoint
+type EndpointRegression struct {
+	Method    string             `json:"method"`
+	Route     string             `json:"route"`
+	Count     int64              `json:"count"`
+	Original  LatencyPercentiles `json:"original_ms"`
+	Replayed  LatencyPercentiles `json:"replayed_ms"`
+	Delta     LatencyPercentiles `json:"delta_ms"`
+	Ratio     LatencyPercentiles `json:"ratio"`
+	P95Ratio  float64            `json:"p95_ratio"` // replayed p95 divided by original p95
+	Regressed bool               `json:"regressed"`
+}
+
+// LatencyRegressionReport holds comparison of all endpoints, regressed ones first
+type LatencyRegressionReport struct {
+	Threshold float64              `json:"threshold"`
+	Matched   int64                `json:"matched"`
+	Unmatched int64                `json:"unmatched"`
+	Regressed int                  `json:"regressed"`
+	Endpoints []EndpointRegression `json:"endpoints"`
+}
+
+// NewLatencyRegression constructor for LatencyRegression, routes are the same as in --latency-route
+func NewLatencyRegression(config LatencyRegressionConfig, routes []string, clock Clock) *LatencyRegression {
+	if config.Threshold <= 0 {
+		config.Threshold = 0.2
+	}
+	return &LatencyRegression{
+		config:      config,
+		clock:       clock,
+		normalizer:  NewEndpointNormalizer(routes),
+		pending:     make(map[string]*regressionPending),
+		lastCleanup: clock.Now(),
+		endpoints:   make(map[endpointKey]*endpointRegression),
+	}
+}
+
+// PluginWrite records requests, original and replayed responses
+func (r *LatencyRegression) PluginWrite(msg *Message) (int, error) {
+	meta := protocol.PayloadMeta(msg.Meta)
+	if len(meta) < 3 {
+		return len(msg.Data), nil
+	}
+	id := string(meta[1])
+
+	var key *endpointKey
+	original, replayed := time.Duration(-1), time.Duration(-1)
+	switch msg.Meta[0] {
+	case protocol.RequestPayload:
+		key = &endpointKey{string(proto.Method(msg.Data)), r.normalizer.Normalize(string(proto.Path(msg.Data)))}
+	case protocol.ResponsePayload:
+		if len(meta) < 4 {
+			return len(msg.Data), nil
+		}
+		original = parseDuration(meta[3])
+	case protocol.ReplayedResponsePayload:
+		// round-trip time is the 3rd field, but binary output swaps it with the start time
+		replayed = parseDuration(meta[2])
+		if len(meta) > 3 {
+			if d := parseDuration(meta[3]); d >= 0 && (replayed < 0 || d < replayed) {
+				replayed = d
+			}
+		}
+	default:
+		return len(msg.Data), nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.clock.Now()
+	p, ok := r.pending[id]
+	if !ok {
+		p = &regressionPending{original: -1, replayed: -1, added: now}
+		r.pending[id] = p
+	}
+	if key != nil {
+		p.key = key
+	}
+	// the first replayed response is taken if there are several HTTP outputs
+	if original >= 0 && p.original < 0 {
+		p.original = original
+	}
+	if replayed >= 0 && p.replayed < 0 {
+		p.replayed = replayed
+	}
+
+	if p.key != nil && p.original >= 0 && p.replayed >= 0 {
+		r.record(*p.key, p.original, p.replayed)
+		delete(r.pending, id)
+	}
+
+	if now.Sub(r.lastCleanup) > regressionPendingTimeout {
+		for id, p := range r.pending {
+			if now.Sub(p.added) > regressionPendingTimeout {
+				delete(r.pending, id)
+				r.unmatched++
+			}
+		}
+		r.lastCleanup = now
+	}
+	return len(msg.Data), nil
+}
+
+func parseDuration(field []byte) time.Duration {
+	n, err := strconv.ParseInt(string(field), 10, 64)
+	if err != nil || n < 0 {
+		return -1
+	}
+	return time.Duration(n)
+}
+
+func (r *LatencyRegression) record(key endpointKey, original, replayed time.Duration) {
+	e, ok := r.endpoints[key]
+	if !ok {
+		if len(r.endpoints) >= latencyMaxEndpoints {
+			key.route = "*"
+			e, ok = r.endpoints[key]
+		}
+		if !ok {
+			e = &endpointRegression{
+				original: NewHistogram(latencyHighest, latencyDigits),
+				replayed: NewHistogram(latencyHighest, latencyDigits),
+				ratio:    NewHistogram(regressionRatioHighest, latencyDigits),
+				slower:   NewHistogram(latencyHighest, latencyDigits),
+				faster:   NewHistogram(latencyHighest, latencyDigits),
+			}
+			r.endpoints[key] = e
+		}
+	}
+
+	o, p := int64(original/time.Microsecond), int64(replayed/time.Microsecond)
+	e.original.Record(o)
+	e.replayed.Record(p)
+	if o > 0 {
+		e.ratio.Record(p * 1000 / o)
+	} else {
+		e.ratio.Record(regressionRatioHighest)
+	}
+	if p >= o {
+		e.slower.Record(p - o)
+	} else {
+		e.faster.Record(o - p)
+	}
+	r.matched++
+}
+
+// deltaAtPercentile returns the delta at the percentile, faster requests have negative deltas
+func (e *endpointRegression) deltaAtPercentile(p float64) int64 {
+	faster := e.faster.Count()
+	total := faster + e.slower.Count()
+	if total == 0 {
+		return 0
+	}
+	rank := int64(p/100*float64(total) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	if rank <= faster {
+		// the largest improvements come first
+		return -e.faster.ValueAtPercentile(float64(faster-rank+1) / float64(faster) * 100)
+	}
+	return e.slower.ValueAtPercentile(float64(rank-faster) / float64(e.slower.Count()) * 100)
+}
+
+// Report compares latency of endpoints
+func (r *LatencyRegression) Report() LatencyRegressionReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	report := LatencyRegressionReport{
+		Threshold: r.config.Threshold,
+		Matched:   r.matched,
+		Unmatched: r.unmatched + int64(len(r.pending)),
+		Endpoints: []EndpointRegression{},
+	}
+	ms := func(us int64) float64 {
+		return float64(us) / 1000
+	}
+	ratio := func(thousandths int64) float64 {
+		return float64(thousandths) / 1000
+	}
+	percentiles := func(value func(p float64) int64, scale func(int64) float64) LatencyPercentiles {
+		return LatencyPercentiles{P50: scale(value(50)), P95: scale(value(95)), P99: scale(value(99))}
+	}
+
+	for key, e := range r.endpoints {
+		er := EndpointRegression{
+			Method:   key.method,
+			Route:    key.route,
+			Count:    e.original.Count(),
+			Original: percentiles(e.original.ValueAtPercentile, ms),
+			Replayed: percentiles(e.replayed.ValueAtPercentile, ms),
+			Delta:    percentiles(e.deltaAtPercentile, ms),
+			Ratio:    percentiles(e.ratio.ValueAtPercentile, ratio),
+		}
+		if er.Original.P95 > 0 {
+			er.P95Ratio = er.Replayed.P95 / er.Original.P95
+		}
+		er.Regressed = er.Count >= int64(r.config.MinCount) && er.Replayed.P95 > er.Original.P95*(1+r.config.Threshold)
+		if er.Regressed {
+			report.Regressed++
+		}
+		report.Endpoints = append(report.Endpoints, er)
+	}
+
+	sort.Slice(report.Endpoints, func(i, j int) bool {
+		a, b := report.Endpoints[i], report.Endpoints[j]
+		if a.Regressed != b.Regressed {
+			return a.Regressed
+		}
+		if a.P95Ratio != b.P95Ratio {
+			return a.P95Ratio > b.P95Ratio
+		}
+		if a.Route != b.Route {
+			return a.Route < b.Route
+		}
+		return a.Method < b.Method
+	})
+	return report
+}
+
+// WriteReport writes comparison of endpoints as a table
+func (r *LatencyRegression) WriteReport(w io.Writer) error {
+	report := r.Report()
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "method\troute\tcount\toriginal p50\treplayed p50\toriginal p95\treplayed p95\tdelta p95\tp95 ratio\t\t")
+	for _, e := range report.Endpoints {
+		flag := ""
+		if e.Regressed {
+			flag = "REGRESSED"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%.1f\t%.1f\t%.1f\t%.1f\t%+.1f\t%.2f\t%s\t\n",
+			e.Method, e.Route, e.Count, e.Original.P50, e.Replayed.P50, e.Original.P95, e.Replayed.P95, e.Delta.P95, e.P95Ratio, flag)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%d requests compared, %d without original or replayed response. %d endpoints regressed by more than %.0f%% at p95 (latency in ms).\n",
+		report.Matched, report.Unmatched, report.Regressed, report.Threshold*100)
+	return err
+}
+
+// Finish prints the report, and writes it as JSON if --latency-regression-file is set
+func (r *LatencyRegression) Finish() error {
+	fmt.Println("Latency regression report:")
+	r.WriteReport(os.Stdout)
+
+	if r.config.File == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(r.Report(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(r.config.File, data, 0644)
+}
+
+func (r *LatencyRegression) String() string {
+	return "Latency regression report"
+}
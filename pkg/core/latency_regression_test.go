@@ -0,0 +1,82 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/reoring/goreplay/pkg/protocol"
+)
+
+func writeTimings(r *LatencyRegression, id, method, path string, original, replayed time.Duration) {
+	uuid := []byte(id)
+	r.PluginWrite(&Message{
+		Meta: protocol.PayloadHeader(protocol.RequestPayload, uuid, 1, -1),
+		Data: []byte(method + " " + path + " HTTP/1.1\r\n\r\n"),
+	})
+	if original >= 0 {
+		r.PluginWrite(&Message{Meta: protocol.PayloadHeader(protocol.ResponsePayload, uuid, 2, int64(original)), Data: []byte("HTTP/1.1 200 OK\r\n\r\n")})
+	}
+	if replayed >= 0 {
+		r.PluginWrite(&Message{Meta: protocol.PayloadHeader(protocol.ReplayedResponsePayload, uuid, int64(replayed), time.Now().UnixNano()), Data: []byte("HTTP/1.1 200 OK\r\n\r\n")})
+	}
+}
+
+func TestLatencyRegression(t *testing.T) {
+	clock := &manualClock{now: time.Unix(0, 0)}
+	r := NewLatencyRegression(LatencyRegressionConfig{Threshold: 0.5, MinCount: 20}, nil, clock)
+
+	for i := 0; i < 30; i++ {
+		writeTimings(r, fmt.Sprintf("a%d", i), "GET", fmt.Sprintf("/users/%d", i), 10*time.Millisecond, 20*time.Millisecond)
+		writeTimings(r, fmt.Sprintf("b%d", i), "POST", "/orders", 10*time.Millisecond, 9*time.Millisecond)
+	}
+	for i := 0; i < 10; i++ {
+		writeTimings(r, fmt.Sprintf("c%d", i), "GET", "/slow", time.Millisecond, 10*time.Millisecond)
+	}
+	writeTimings(r, "d", "GET", "/users/1", 10*time.Millisecond, -1)
+
+	// binary output writes the start time before round-trip time
+	uuid := []byte("e")
+	r.PluginWrite(&Message{Meta: protocol.PayloadHeader(protocol.ReplayedResponsePayload, uuid, time.Now().UnixNano(), int64(40*time.Millisecond))})
+	r.PluginWrite(&Message{Meta: protocol.PayloadHeader(protocol.ResponsePayload, uuid, 2, int64(10*time.Millisecond))})
+	r.PluginWrite(&Message{Meta: protocol.PayloadHeader(protocol.RequestPayload, uuid, 1, -1), Data: []byte("GET /users/12345 HTTP/1.1\r\n\r\n")})
+
+	report := r.Report()
+	if report.Matched != 71 || report.Unmatched != 1 || report.Regressed != 1 || len(report.Endpoints) != 3 {
+		t.Fatalf("Should join timings by id, got %+v", report)
+	}
+
+	users := report.Endpoints[0]
+	if users.Route != "/users/{id}" || !users.Regressed || users.Count != 31 {
+		t.Errorf("Should flag regressed endpoint first, got %+v", users)
+	}
+	if !within(users.Original.P95, 10) || !within(users.Replayed.P50, 20) || !within(users.Replayed.P99, 40) ||
+		!within(users.Delta.P50, 10) || !within(users.Ratio.P50, 2) || !within(users.P95Ratio, 2) {
+		t.Errorf("Should compute percentiles of latency, deltas and ratios, got %+v", users)
+	}
+
+	slow := report.Endpoints[1]
+	if slow.Route != "/slow" || slow.Regressed || !within(slow.P95Ratio, 10) {
+		t.Errorf("Should not flag endpoints with few requests, got %+v", slow)
+	}
+
+	orders := report.Endpoints[2]
+	if orders.Regressed || !within(orders.Delta.P50, -1) || !within(orders.Ratio.P50, 0.9) {
+		t.Errorf("Should report faster endpoints with negative deltas, got %+v", orders)
+	}
+
+	// requests without responses are discarded after a while
+	clock.now = clock.now.Add(regressionPendingTimeout + time.Second)
+	writeTimings(r, "f", "GET", "/", -1, -1)
+	if report := r.Report(); report.Unmatched != 2 || len(r.pending) != 1 {
+		t.Errorf("Should discard pending requests, got %+v", report)
+	}
+
+	var table bytes.Buffer
+	r.WriteReport(&table)
+	if !strings.Contains(table.String(), "REGRESSED") || !strings.Contains(table.String(), "1 endpoints regressed by more than 50%") {
+		t.Error("Should print the report", table.String())
+	}
+}
@@ -0,0 +1,282 @@
+package core
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// LatencyStatsConfig holds configuration of replay latency percentiles
+type LatencyStatsConfig struct {
+	Enabled  bool          `json:"latency-stats"`
+	Interval time.Duration `json:"latency-stats-interval"`
+	Routes   MultiOption   `json:"latency-route"`
+	File     string        `json:"latency-stats-file"`
+	Format   string        `json:"latency-stats-format"` // json or csv, by extension of the file by default
+}
+
+// LatencyStats collects latency of replayed requests in HDR histograms, grouped by method and normalized route.
+// It reports percentiles of the last interval periodically, and of the whole replay at the end.
+type LatencyStats struct {
+	config     LatencyStatsConfig
+	clock      Clock
+	normalizer *EndpointNormalizer
+
+	mu        sync.Mutex
+	endpoints map[endpointKey]*endpointLatency
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+type endpointKey struct {
+	method string
+	route  string
+}
+
+type endpointLatency struct {
+	interval       *Histogram
+	total          *Histogram
+	intervalErrors int64
+	totalErrors    int64
+}
+
+const (
+	// latencies are recorded in microseconds, up to an hour within 1%
+	latencyHighest = int64(time.Hour / time.Microsecond)
+	latencyDigits  = 2
+	// maximum number of endpoints, requests to other endpoints are grouped under the `*` route
+	latencyMaxEndpoints = 1000
+)
+
+// EndpointLatencyReport holds latency percentiles of an endpoint, in milliseconds
+type EndpointLatencyReport struct {
+	Method string  `json:"method"`
+	Route  string  `json:"route"`
+	Count  int64   `json:"count"`
+	Errors int64   `json:"errors"`
+	Min    float64 `json:"min_ms"`
+	Mean   float64 `json:"mean_ms"`
+	P50    float64 `json:"p50_ms"`
+	P90    float64 `json:"p90_ms"`
+	P99    float64 `json:"p99_ms"`
+	P999   float64 `json:"p99_9_ms"`
+	Max    float64 `json:"max_ms"`
+}
+
+func checkLatencyStatsFormat(format string) error {
+	switch format {
+	case "", "json", "csv":
+		return nil
+	}
+	return fmt.Errorf("unknown latency stats format %q, expected json or csv", format)
+}
+
+// NewLatencyStats constructor for LatencyStats, starts periodic reports if the interval is set
+func NewLatencyStats(config LatencyStatsConfig, clock Clock) (*LatencyStats, error) {
+	if err := checkLatencyStatsFormat(config.Format); err != nil {
+		return nil, err
+	}
+
+	s := &LatencyStats{
+		config:     config,
+		clock:      clock,
+		normalizer: NewEndpointNormalizer(config.Routes),
+		endpoints:  make(map[endpointKey]*endpointLatency),
+		stop:       make(chan struct{}),
+	}
+	if config.Interval > 0 {
+		go s.reportStats()
+	}
+	return s, nil
+}
+
+func (s *LatencyStats) reportStats() {
+	for {
+		tick, stop := s.clock.After(s.config.Interval)
+		select {
+		case <-tick:
+			var table strings.Builder
+			writeLatencyTable(&table, s.tick())
+			Debug(0, fmt.Sprintf("[LATENCY-STATS] last %s:\n%s", s.config.Interval, table.String()))
+		case <-s.stop:
+			stop()
+			return
+		}
+	}
+}
+
+// Record adds latency of a replayed request. Failed requests are counted as errors, responses with
+// 5xx status are counted both as errors and in latency percentiles.
+func (s *LatencyStats) Record(method, path string, latency time.Duration, status int, failed bool) {
+	key := endpointKey{method, s.normalizer.Normalize(path)}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.endpoints[key]
+	if !ok {
+		if len(s.endpoints) >= latencyMaxEndpoints {
+			key.route = "*"
+			e, ok = s.endpoints[key]
+		}
+		if !ok {
+			e = &endpointLatency{
+				interval: NewHistogram(latencyHighest, latencyDigits),
+				total:    NewHistogram(latencyHighest, latencyDigits),
+			}
+			s.endpoints[key] = e
+		}
+	}
+
+	if failed || status >= 500 {
+		e.intervalErrors++
+	}
+	if !failed {
+		e.interval.Record(int64(latency / time.Microsecond))
+	}
+}
+
+// tick returns report of the last interval, and starts a new one
+func (s *LatencyStats) tick() []EndpointLatencyReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var reports []EndpointLatencyReport
+	for key, e := range s.endpoints {
+		if e.interval.Count() > 0 || e.intervalErrors > 0 {
+			reports = append(reports, endpointReport(key, e.interval, e.intervalErrors))
+		}
+		e.total.Merge(e.interval)
+		e.totalErrors += e.intervalErrors
+		e.interval.Reset()
+		e.intervalErrors = 0
+	}
+	sortLatencyReports(reports)
+	return reports
+}
+
+// Report returns latency percentiles of endpoints since the start, the busiest first
+func (s *LatencyStats) Report() []EndpointLatencyReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var reports []EndpointLatencyReport
+	for key, e := range s.endpoints {
+		h := NewHistogram(latencyHighest, latencyDigits)
+		h.Merge(e.total)
+		h.Merge(e.interval)
+		reports = append(reports, endpointReport(key, h, e.totalErrors+e.intervalErrors))
+	}
+	sortLatencyReports(reports)
+	return reports
+}
+
+func endpointReport(key endpointKey, h *Histogram, errors int64) EndpointLatencyReport {
+	ms := func(us int64) float64 {
+		return float64(us) / 1000
+	}
+	return EndpointLatencyReport{
+		Method: key.method,
+		Route:  key.route,
+		Count:  h.Count(),
+		Errors: errors,
+		Min:    ms(h.Min()),
+		Mean:   h.Mean() / 1000,
+		P50:    ms(h.ValueAtPercentile(50)),
+		P90:    ms(h.ValueAtPercentile(90)),
+		P99:    ms(h.ValueAtPercentile(99)),
+		P999:   ms(h.ValueAtPercentile(99.9)),
+		Max:    ms(h.Max()),
+	}
+}
+
+func sortLatencyReports(reports []EndpointLatencyReport) {
+	sort.Slice(reports, func(i, j int) bool {
+		a, b := reports[i], reports[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if a.Route != b.Route {
+			return a.Route < b.Route
+		}
+		return a.Method < b.Method
+	})
+}
+
+func writeLatencyTable(w io.Writer, reports []EndpointLatencyReport) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "method\troute\tcount\terrors\tp50 ms\tp90 ms\tp99 ms\tp99.9 ms\tmax ms\t")
+	for _, r := range reports {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%.1f\t%.1f\t%.1f\t%.1f\t%.1f\t\n",
+			r.Method, r.Route, r.Count, r.Errors, r.P50, r.P90, r.P99, r.P999, r.Max)
+	}
+	return tw.Flush()
+}
+
+// Export writes latency percentiles of endpoints since the start as json or csv
+func (s *LatencyStats) Export(w io.Writer, format string) error {
+	reports := s.Report()
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if reports == nil {
+			reports = []EndpointLatencyReport{}
+		}
+		return enc.Encode(reports)
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"method", "route", "count", "errors", "min_ms", "mean_ms", "p50_ms", "p90_ms", "p99_ms", "p99_9_ms", "max_ms"})
+		for _, r := range reports {
+			row := []string{r.Method, r.Route, strconv.FormatInt(r.Count, 10), strconv.FormatInt(r.Errors, 10)}
+			for _, v := range []float64{r.Min, r.Mean, r.P50, r.P90, r.P99, r.P999, r.Max} {
+				row = append(row, strconv.FormatFloat(v, 'f', 3, 64))
+			}
+			cw.Write(row)
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	return fmt.Errorf("unknown latency stats format %q, expected json or csv", format)
+}
+
+// Finish stops periodic reports, prints latency percentiles since the start, and writes them to
+// --latency-stats-file if it's set
+func (s *LatencyStats) Finish() error {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+
+	fmt.Println("Replay latency:")
+	writeLatencyTable(os.Stdout, s.Report())
+
+	if s.config.File == "" {
+		return nil
+	}
+	format := s.config.Format
+	if format == "" {
+		format = "json"
+		if strings.EqualFold(filepath.Ext(s.config.File), ".csv") {
+			format = "csv"
+		}
+	}
+	f, err := os.Create(s.config.File)
+	if err != nil {
+		return err
+	}
+	if err := s.Export(f, format); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
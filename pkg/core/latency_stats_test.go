@@ -0,0 +1,109 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// within tells if v equals to expected within the precision of latency histograms: their significant digits,
+// and their unit of a microsecond, or a thousandth for ratios, for values close to 0
+func within(v, expected float64) bool {
+	return math.Abs(v-expected) <= math.Max(math.Abs(expected)*math.Pow10(-latencyDigits), 0.001)
+}
+
+func TestEndpointNormalizer(t *testing.T) {
+	n := NewEndpointNormalizer([]string{"/users/{user}/avatar", "/search/{query}"})
+
+	cases := map[string]string{
+		"/":                         "/",
+		"/users/42":                 "/users/{id}",
+		"/users/me?x=1":             "/users/me",
+		"/users/john/avatar":        "/users/{user}/avatar",
+		"/search/shoes":             "/search/{query}",
+		"/api/v1/orders/1234/items": "/api/v1/orders/{id}/items",
+		"/files/3f2b8c9e-4b1a-4f6e-9c2d-1a2b3c4d5e6f": "/files/{id}",
+		"/tokens/a8f5f167f44f4964e6c998dee827110c":    "/tokens/{id}",
+	}
+	for path, route := range cases {
+		if r := n.Normalize(path); r != route {
+			t.Errorf("%s: expected %s, got %s", path, route, r)
+		}
+	}
+
+	// too many distinct values of a segment
+	for i := 0; i < endpointMaxLiterals; i++ {
+		n.Normalize(fmt.Sprintf("/tags/tag%c%c", 'a'+i%26, 'a'+i/26))
+	}
+	if r := n.Normalize("/tags/golang"); r != "/tags/{id}" {
+		t.Error("Should group segments with many values", r)
+	}
+	if r := n.Normalize("/tags/tagaa"); r != "/tags/tagaa" {
+		t.Error("Should keep known values", r)
+	}
+}
+
+func TestLatencyStats(t *testing.T) {
+	s, err := NewLatencyStats(LatencyStatsConfig{}, &manualClock{now: time.Unix(0, 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 100; i++ {
+		s.Record("GET", fmt.Sprintf("/users/%d", i), time.Duration(i)*time.Millisecond, 200, false)
+	}
+	s.Record("POST", "/users", time.Second, 503, false)
+	s.Record("POST", "/users", 0, 0, true)
+
+	interval := s.tick()
+	if len(interval) != 2 || interval[0].Route != "/users/{id}" || interval[0].Count != 100 {
+		t.Fatalf("Should report the interval by endpoint, got %+v", interval)
+	}
+	if r := interval[0]; !within(r.P50, 50) || !within(r.P90, 90) || !within(r.P99, 99) || r.Max != 100 || r.Errors != 0 {
+		t.Errorf("Should report percentiles, got %+v", r)
+	}
+	if r := interval[1]; r.Method != "POST" || r.Count != 1 || r.Errors != 2 || !within(r.P50, 1000) {
+		t.Errorf("Should report errors, got %+v", r)
+	}
+	if len(s.tick()) != 0 {
+		t.Error("Should start a new interval")
+	}
+
+	s.Record("GET", "/users/7", 200*time.Millisecond, 200, false)
+	report := s.Report()
+	if r := report[0]; r.Count != 101 || !within(r.Max, 200) {
+		t.Errorf("Should report since the start, got %+v", r)
+	}
+
+	var out bytes.Buffer
+	if err := s.Export(&out, "json"); err != nil {
+		t.Fatal(err)
+	}
+	var exported []EndpointLatencyReport
+	if err := json.Unmarshal(out.Bytes(), &exported); err != nil || len(exported) != 2 || exported[0] != report[0] {
+		t.Error("Should export json", err, out.String())
+	}
+
+	out.Reset()
+	if err := s.Export(&out, "csv"); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "method,route,count") || !strings.HasPrefix(lines[2], "POST,/users,1,2,") {
+		t.Error("Should export csv", out.String())
+	}
+
+	if err := s.Export(&out, "xml"); err == nil {
+		t.Error("Should reject unknown formats")
+	}
+	if _, err := NewLatencyStats(LatencyStatsConfig{Format: "xml"}, &manualClock{}); err == nil {
+		t.Error("Should reject unknown file formats")
+	}
+	if _, err := ParseSettings([]string{"--latency-stats", "--latency-stats-format", "xml"}); err == nil {
+		t.Error("Settings should reject unknown file formats")
+	}
+}
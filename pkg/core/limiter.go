@@ -1,79 +1,384 @@
 package core
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"math"
 	"math/rand"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/reoring/goreplay/proto"
+	"github.com/reoring/goreplay/size"
 )
 
 // Limiter is a wrapper for input or output plugin which adds rate limiting
 type Limiter struct {
-	plugin    interface{}
+	mu     sync.Mutex
+	plugin interface{}
+	clock  Clock
+	output bool // limits writes of an output, reads of it are responses and pass unlimited
+	limitOptions
+
+	buckets     map[string]*limitBuckets // by key, "" if limits are not per key
+	lastCleanup time.Time
+}
+
+// limitOptions are parsed from the `|limit` suffix of plugin address: a number of requests per second
+// or a percentage, followed by comma separated options. For example `100,burst=200,key=host`.
+type limitOptions struct {
 	limit     int
 	isPercent bool
+	burst     int   // size of the token bucket, equals to the rate by default
+	bytes     int64 // bytes per second
+	inFlight  int   // maximum number of requests being sent at the same time
+	key       limitKey
+}
 
-	currentRPS  int
-	currentTime int64
+// limitKey defines how messages are grouped to be limited separately
+type limitKey struct {
+	kind   string // "", "host", "path" or "header"
+	header string
+	depth  int // number of leading path segments
 }
 
-func parseLimitOptions(options string) (limit int, isPercent bool) {
-	if n := strings.Index(options, "%"); n > 0 {
-		limit, _ = strconv.Atoi(options[:n])
-		isPercent = true
-	} else {
-		limit, _ = strconv.Atoi(options)
-		isPercent = false
+// limitBuckets hold tokens of a single key
+type limitBuckets struct {
+	requests *tokenBucket
+	bytes    *tokenBucket
+}
+
+// maximum number of keys after which buckets of idle keys are removed
+const limiterMaxKeys = 10000
+
+func parseLimitOptions(options string) (o limitOptions, err error) {
+	o.limit, o.isPercent = 100, true
+
+	for i, part := range strings.Split(options, ",") {
+		part = strings.TrimSpace(part)
+		eq := strings.Index(part, "=")
+		if eq == -1 {
+			if i != 0 {
+				return o, fmt.Errorf("limit %q: rate should be the first option", options)
+			}
+			o.isPercent = strings.HasSuffix(part, "%")
+			if o.limit, err = strconv.Atoi(strings.TrimSuffix(part, "%")); err != nil || o.limit < 0 {
+				return o, fmt.Errorf("limit %q: invalid rate %q", options, part)
+			}
+			continue
+		}
+
+		name, value := part[:eq], part[eq+1:]
+		switch name {
+		case "burst":
+			o.burst, err = strconv.Atoi(value)
+			if err == nil && o.burst <= 0 {
+				err = errors.New("should be positive")
+			}
+		case "inflight":
+			o.inFlight, err = strconv.Atoi(value)
+			if err == nil && o.inFlight <= 0 {
+				err = errors.New("should be positive")
+			}
+		case "bytes":
+			var s size.Size
+			err = s.Set(value)
+			if err == nil && s <= 0 {
+				err = errors.New("should be positive")
+			}
+			o.bytes = int64(s)
+		case "key":
+			o.key, err = parseLimitKey(value)
+		default:
+			err = errors.New("unknown option")
+		}
+		if err != nil {
+			return o, fmt.Errorf("limit %q: %s: %v", options, name, err)
+		}
 	}
 
-	return
+	if o.burst > 0 && o.isPercent {
+		return o, fmt.Errorf("limit %q: burst requires a number of requests per second", options)
+	}
+	if o.key.kind != "" && o.isPercent && o.bytes == 0 {
+		return o, fmt.Errorf("limit %q: key requires a number of requests or bytes per second", options)
+	}
+	return o, nil
+}
+
+func parseLimitKey(value string) (k limitKey, err error) {
+	kind, arg := value, ""
+	if i := strings.Index(value, ":"); i != -1 {
+		kind, arg = value[:i], value[i+1:]
+	}
+
+	switch kind {
+	case "host":
+		if arg != "" {
+			return k, errors.New("host key has no arguments")
+		}
+	case "path":
+		k.depth = 1
+		if arg != "" {
+			if k.depth, err = strconv.Atoi(arg); err != nil || k.depth <= 0 {
+				return k, fmt.Errorf("invalid path depth %q", arg)
+			}
+		}
+	case "header":
+		if arg == "" {
+			return k, errors.New("header name is required, like header:X-API-Key")
+		}
+		k.header = arg
+	default:
+		return k, fmt.Errorf("unknown key %q, expected host, path[:depth] or header:name", value)
+	}
+	k.kind = kind
+	return k, nil
+}
+
+func (o limitOptions) String() string {
+	parts := []string{strconv.Itoa(o.limit)}
+	if o.isPercent {
+		parts[0] += "%"
+	}
+	if o.burst > 0 {
+		parts = append(parts, "burst="+strconv.Itoa(o.burst))
+	}
+	if o.bytes > 0 {
+		parts = append(parts, "bytes="+strconv.FormatInt(o.bytes, 10))
+	}
+	if o.inFlight > 0 {
+		parts = append(parts, "inflight="+strconv.Itoa(o.inFlight))
+	}
+	switch o.key.kind {
+	case "host":
+		parts = append(parts, "key=host")
+	case "path":
+		parts = append(parts, "key=path:"+strconv.Itoa(o.key.depth))
+	case "header":
+		parts = append(parts, "key=header:"+o.key.header)
+	}
+	return strings.Join(parts, ",")
+}
+
+// inFlightLimiter is implemented by plugins which can limit the number of requests being sent at the same time
+type inFlightLimiter interface {
+	SetMaxInFlight(n int)
+}
+
+// CheckLimit validates limit options for the plugin, they are the same as in NewLimiter
+func CheckLimit(plugin interface{}, options string) error {
+	o, err := parseLimitOptions(options)
+	if err != nil {
+		return err
+	}
+	if _, ok := plugin.(inFlightLimiter); !ok && o.inFlight > 0 {
+		return fmt.Errorf("limit %q: inflight is supported only by HTTP output", options)
+	}
+	return nil
+}
+
+// checkLimits validates limits of plugin addresses in the settings
+func checkLimits(s *AppSettings) error {
+	check := func(plugin interface{}, addresses MultiOption) error {
+		for _, options := range addresses {
+			if path, limit := extractLimitOptions(options); limit != "" {
+				if err := CheckLimit(plugin, limit); err != nil {
+					return fmt.Errorf("%s: %v", path, err)
+				}
+			}
+		}
+		return nil
+	}
+	for _, addresses := range []MultiOption{s.InputDummy, s.InputRAW, s.InputTCP, s.InputFile, s.InputAccessLog, s.InputHTTP,
+		s.OutputTCP, s.OutputFile, s.OutputParquet, s.OutputBinary} {
+		if err := check(nil, addresses); err != nil {
+			return err
+		}
+	}
+	// only HTTP output supports all options
+	return check((*HTTPOutput)(nil), s.OutputHTTP)
 }
 
 // NewLimiter constructor for Limiter, accepts plugin and options
 // `options` allow specifying relative or absolute limiting
 func NewLimiter(plugin interface{}, options string) PluginReadWriter {
+	l, err := CreateLimiter(plugin, options)
+	if err != nil {
+		log.Fatal(fmt.Sprintf("[LIMITER] %s: %v", plugin, err))
+	}
+	return l
+}
+
+// CreateLimiter is NewLimiter which returns an error instead of exiting on invalid options
+func CreateLimiter(plugin interface{}, options string) (*Limiter, error) {
 	l := new(Limiter)
-	l.limit, l.isPercent = parseLimitOptions(options)
 	l.plugin = plugin
-	l.currentTime = time.Now().UnixNano()
+	l.clock = RealClock{}
+
+	if err := l.SetLimit(options); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// SetLimit changes the limit, options are the same as in NewLimiter
+func (l *Limiter) SetLimit(options string) error {
+	if err := CheckLimit(l.plugin, options); err != nil {
+		return err
+	}
+	o, _ := parseLimitOptions(options)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.limitOptions = o
+	l.buckets = nil
+	l.lastCleanup = l.clock.Now()
 
 	// FileInput have its own rate limiting. Unlike other inputs we're not just dropping requests, we can slow down or speed up request emitting.
-	if fi, ok := l.plugin.(*FileInput); ok && l.isPercent {
-		fi.SetSpeedFactor(float64(l.limit) / float64(100))
+	if fi, ok := l.plugin.(*FileInput); ok {
+		if l.isPercent {
+			fi.SetSpeedFactor(float64(l.limit) / float64(100))
+		} else {
+			fi.SetSpeedFactor(1)
+		}
+	}
+	if il, ok := l.plugin.(inFlightLimiter); ok {
+		il.SetMaxInFlight(l.inFlight)
 	}
+	return nil
+}
 
-	return l
+func (l *Limiter) isLimited(msg *Message) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.isPercent {
+		// File input have its own limiting algorithm
+		if _, ok := l.plugin.(*FileInput); !ok && l.limit <= rand.Intn(100) {
+			return true
+		}
+		if l.bytes == 0 {
+			return false
+		}
+	}
+
+	now := l.clock.Now()
+	b := l.keyBuckets(l.messageKey(msg), now)
+	size := float64(len(msg.Data))
+
+	if b.requests != nil && !b.requests.allows(1, now) {
+		return true
+	}
+	if b.bytes != nil && !b.bytes.allows(size, now) {
+		return true
+	}
+	if b.requests != nil {
+		b.requests.tokens--
+	}
+	if b.bytes != nil {
+		b.bytes.tokens -= size
+	}
+	return false
 }
 
-func (l *Limiter) isLimited() bool {
-	// File input have its own limiting algorithm
-	if _, ok := l.plugin.(*FileInput); ok && l.isPercent {
-		return false
+// messageKey returns the value messages are grouped by, "" if limits are not per key
+func (l *Limiter) messageKey(msg *Message) string {
+	switch l.key.kind {
+	case "host":
+		return string(proto.Header(msg.Data, []byte("Host")))
+	case "header":
+		return string(proto.Header(msg.Data, []byte(l.key.header)))
+	case "path":
+		path := string(proto.Path(msg.Data))
+		if i := strings.IndexAny(path, "?#"); i != -1 {
+			path = path[:i]
+		}
+		segments := strings.SplitN(strings.TrimPrefix(path, "/"), "/", l.key.depth+1)
+		if len(segments) > l.key.depth {
+			segments = segments[:l.key.depth]
+		}
+		return "/" + strings.Join(segments, "/")
 	}
+	return ""
+}
 
-	if l.isPercent {
-		return l.limit <= rand.Intn(100)
+func (l *Limiter) keyBuckets(key string, now time.Time) *limitBuckets {
+	if b, ok := l.buckets[key]; ok {
+		return b
 	}
 
-	if (time.Now().UnixNano() - l.currentTime) > time.Second.Nanoseconds() {
-		l.currentTime = time.Now().UnixNano()
-		l.currentRPS = 0
+	if l.buckets == nil {
+		l.buckets = make(map[string]*limitBuckets)
+	} else if len(l.buckets) >= limiterMaxKeys && now.Sub(l.lastCleanup) > time.Second {
+		// buckets which are full again belong to idle keys
+		for k, b := range l.buckets {
+			if b.full(now) {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastCleanup = now
 	}
 
-	if l.currentRPS >= l.limit {
-		return true
+	b := new(limitBuckets)
+	if !l.isPercent {
+		burst := l.burst
+		if burst == 0 {
+			burst = l.limit
+		}
+		b.requests = newTokenBucket(float64(l.limit), float64(burst), now)
+	}
+	if l.bytes > 0 {
+		b.bytes = newTokenBucket(float64(l.bytes), float64(l.bytes), now)
 	}
+	l.buckets[key] = b
+	return b
+}
 
-	l.currentRPS++
+func (b *limitBuckets) full(now time.Time) bool {
+	return (b.requests == nil || b.requests.full(now)) && (b.bytes == nil || b.bytes.full(now))
+}
 
-	return false
+// tokenBucket is refilled with rate tokens per second up to its burst size
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed.Seconds()*b.rate)
+		b.last = now
+	}
+}
+
+// allows tells if n tokens are available. Messages larger than the bucket pass once it is full,
+// and leave it in debt.
+func (b *tokenBucket) allows(n float64, now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= math.Min(n, b.burst) && b.tokens > 0
+}
+
+func (b *tokenBucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.burst
 }
 
 // PluginWrite writes message to this plugin
 func (l *Limiter) PluginWrite(msg *Message) (n int, err error) {
-	if l.isLimited() {
+	if l.isLimited(msg) {
 		return 0, nil
 	}
 	if w, ok := l.plugin.(PluginWriter); ok {
@@ -92,7 +397,10 @@ func (l *Limiter) PluginRead() (msg *Message, err error) {
 		return nil, io.ErrClosedPipe
 	}
 
-	if l.isLimited() {
+	if err != nil || msg == nil || l.output {
+		return
+	}
+	if l.isLimited(msg) {
 		return nil, nil
 	}
 
@@ -100,7 +408,24 @@ func (l *Limiter) PluginRead() (msg *Message, err error) {
 }
 
 func (l *Limiter) String() string {
-	return fmt.Sprintf("Limiting %s to: %d (isPercent: %v)", l.plugin, l.limit, l.isPercent)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return fmt.Sprintf("Limiting %s to: %s", l.plugin, l.limitOptions)
+}
+
+// Limit returns the current limit in the format of NewLimiter options
+func (l *Limiter) Limit() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limitOptions.String()
+}
+
+// Drain drains the limited plugin, if it buffers messages
+func (l *Limiter) Drain(ctx context.Context) int {
+	if d, ok := l.plugin.(PluginDrainer); ok {
+		return d.Drain(ctx)
+	}
+	return 0
 }
 
 // Close closes the resources.
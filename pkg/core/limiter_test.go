@@ -0,0 +1,211 @@
+package core
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// manualClock is a Clock which moves only when told to
+type manualClock struct {
+	now time.Time
+}
+
+func (c *manualClock) Now() time.Time {
+	return c.now
+}
+
+func (c *manualClock) After(d time.Duration) (<-chan time.Time, func()) {
+	ch := make(chan time.Time, 1)
+	ch <- c.now.Add(d)
+	return ch, func() {}
+}
+
+func newTestLimiter(t *testing.T, options string) (*Limiter, *manualClock) {
+	l, err := CreateLimiter(NewTestOutput(func(*Message) {}), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &manualClock{now: time.Unix(0, 0)}
+	l.clock = clock
+	return l, clock
+}
+
+func limiterRequest(host, path string) *Message {
+	return &Message{Data: []byte("GET " + path + " HTTP/1.1\r\nHost: " + host + "\r\nX-API-Key: " + host + "\r\n\r\n")}
+}
+
+func passed(l *Limiter, n int, msg *Message) (count int) {
+	for i := 0; i < n; i++ {
+		if !l.isLimited(msg) {
+			count++
+		}
+	}
+	return
+}
+
+func TestLimitOptions(t *testing.T) {
+	valid := map[string]string{
+		"10":                        "10",
+		"10%":                       "10%",
+		"100, burst=200":            "100,burst=200",
+		"bytes=1mb":                 "100%,bytes=1048576",
+		"50,key=host":               "50,key=host",
+		"50,key=path":               "50,key=path:1",
+		"50,key=path:2":             "50,key=path:2",
+		"50,key=header:X-API-Key":   "50,key=header:X-API-Key",
+		"bytes=1kb,key=host":        "100%,bytes=1024,key=host",
+		"10,burst=5,inflight=3":     "10,burst=5,inflight=3",
+		"20%,bytes=10kb,inflight=1": "20%,bytes=10240,inflight=1",
+	}
+	for options, expected := range valid {
+		o, err := parseLimitOptions(options)
+		if err != nil {
+			t.Errorf("%q: %v", options, err)
+			continue
+		}
+		if o.String() != expected {
+			t.Errorf("%q: expected %q, got %q", options, expected, o.String())
+		}
+		if again, _ := parseLimitOptions(o.String()); again != o {
+			t.Errorf("%q: should parse its own format", options)
+		}
+	}
+
+	invalid := []string{"abc", "-1", "10,20", "burst=5", "10%,burst=5", "10,burst=0", "10%,key=host",
+		"10,key=cookie", "10,key=header", "10,key=path:0", "10,bytes=1xb", "10,speed=2"}
+	for _, options := range invalid {
+		if _, err := parseLimitOptions(options); err == nil {
+			t.Errorf("%q should be invalid", options)
+		}
+	}
+
+	if err := CheckLimit(NewTestOutput(nil), "10,inflight=2"); err == nil {
+		t.Error("Should reject inflight for outputs not supporting it")
+	}
+
+	if _, err := ParseSettings([]string{"--output-http", "http://staging|10,inflight=2"}); err != nil {
+		t.Error(err)
+	}
+	for _, args := range [][]string{{"--output-http", "http://staging|fast"}, {"--input-file", "requests.gor|10,inflight=2"}} {
+		if _, err := ParseSettings(args); err == nil {
+			t.Errorf("Settings %q should be invalid", args)
+		}
+	}
+}
+
+func TestLimiterTokenBucket(t *testing.T) {
+	l, clock := newTestLimiter(t, "10,burst=5")
+	msg := limiterRequest("a", "/")
+
+	if n := passed(l, 10, msg); n != 5 {
+		t.Errorf("Should allow a burst of 5 requests, allowed %d", n)
+	}
+
+	clock.now = clock.now.Add(300 * time.Millisecond)
+	if n := passed(l, 10, msg); n != 3 {
+		t.Errorf("Should refill 3 tokens in 300ms, allowed %d", n)
+	}
+
+	// no burst at the boundary of a second, unlike a fixed window
+	clock.now = clock.now.Add(time.Second)
+	if n := passed(l, 20, msg); n != 5 {
+		t.Errorf("Should not refill more than burst, allowed %d", n)
+	}
+}
+
+func TestLimiterPerKey(t *testing.T) {
+	l, _ := newTestLimiter(t, "2,key=host")
+	if n := passed(l, 5, limiterRequest("a", "/")); n != 2 {
+		t.Error("Should limit host a", n)
+	}
+	if n := passed(l, 5, limiterRequest("b", "/")); n != 2 {
+		t.Error("Should limit host b separately", n)
+	}
+
+	l, _ = newTestLimiter(t, "1,key=path:2")
+	if n := passed(l, 2, limiterRequest("a", "/api/users/1?x=1")) + passed(l, 2, limiterRequest("a", "/api/users/2")); n != 1 {
+		t.Error("Should group by 2 path segments", n)
+	}
+	if n := passed(l, 2, limiterRequest("a", "/api/orders")); n != 1 {
+		t.Error("Should limit another prefix separately", n)
+	}
+
+	l, _ = newTestLimiter(t, "1,key=header:X-API-Key")
+	if n := passed(l, 2, limiterRequest("k1", "/")) + passed(l, 2, limiterRequest("k2", "/")); n != 2 {
+		t.Error("Should group by header", n)
+	}
+}
+
+func TestLimiterBytes(t *testing.T) {
+	msg := limiterRequest("a", "/")
+	size := len(msg.Data)
+
+	l, clock := newTestLimiter(t, "bytes="+strconv.Itoa(3*size))
+	if n := passed(l, 5, msg); n != 3 {
+		t.Error("Should allow 3 messages a second", n)
+	}
+	clock.now = clock.now.Add(time.Second/3 + time.Millisecond)
+	if n := passed(l, 5, msg); n != 1 {
+		t.Error("Should refill bytes", n)
+	}
+
+	// Messages larger than the limit pass once the bucket is full
+	l, clock = newTestLimiter(t, "bytes=10")
+	if n := passed(l, 2, msg); n != 1 {
+		t.Error("Should allow a large message once", n)
+	}
+	clock.now = clock.now.Add(time.Second)
+	if n := passed(l, 1, msg); n != 0 {
+		t.Error("Should wait for the debt to be paid", n)
+	}
+}
+
+func TestLimiterInFlight(t *testing.T) {
+	var current, max int32
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer wg.Done()
+		n := atomic.AddInt32(&current, 1)
+		for {
+			m := atomic.LoadInt32(&max)
+			if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+				break
+			}
+		}
+		<-release
+		atomic.AddInt32(&current, -1)
+	}))
+	defer server.Close()
+
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{WorkersMax: 10, Timeout: 5 * time.Second})
+	l, err := CreateLimiter(output, "100%,inflight=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	input := NewTestInput()
+	wg.Add(6)
+	for i := 0; i < 6; i++ {
+		input.EmitGET()
+		msg, _ := input.PluginRead()
+		l.PluginWrite(msg)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&current); n != 2 {
+		t.Error("Should send 2 requests at the same time", n)
+	}
+	close(release)
+	wg.Wait()
+
+	if m := atomic.LoadInt32(&max); m != 2 {
+		t.Error("Should never exceed 2 requests in flight", m)
+	}
+}
@@ -0,0 +1,452 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/reoring/goreplay/pkg/protocol"
+)
+
+// LoadPhase amplifies traffic by a factor changing linearly from From to To during the phase
+type LoadPhase struct {
+	From     float64
+	To       float64
+	Duration time.Duration
+}
+
+func (p LoadPhase) String() string {
+	factor := strconv.FormatFloat(p.From, 'f', -1, 64) + "x"
+	if p.To != p.From {
+		factor += "-" + strconv.FormatFloat(p.To, 'f', -1, 64) + "x"
+	}
+	return factor + ":" + p.Duration.String()
+}
+
+// LoadProfile is a sequence of load phases, like `1x:5m,1x-4x:10m,4x:10m,10x:30s`:
+// `Nx:duration` holds the factor, `Ax-Bx:duration` ramps it from A to B.
+type LoadProfile []LoadPhase
+
+// Set parses the profile
+func (p *LoadProfile) Set(value string) error {
+	var phases LoadProfile
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		i := strings.LastIndex(part, ":")
+		if i == -1 {
+			return fmt.Errorf("load phase %q: expected factor:duration, like 2x:5m", part)
+		}
+		duration, err := time.ParseDuration(part[i+1:])
+		if err != nil || duration <= 0 {
+			return fmt.Errorf("load phase %q: invalid duration", part)
+		}
+
+		var phase LoadPhase
+		phase.Duration = duration
+		factors := strings.Split(part[:i], "-")
+		if len(factors) > 2 {
+			return fmt.Errorf("load phase %q: expected Nx or Ax-Bx factor", part)
+		}
+		if phase.From, err = parseLoadFactor(factors[0]); err != nil {
+			return fmt.Errorf("load phase %q: %v", part, err)
+		}
+		phase.To = phase.From
+		if len(factors) == 2 {
+			if phase.To, err = parseLoadFactor(factors[1]); err != nil {
+				return fmt.Errorf("load phase %q: %v", part, err)
+			}
+		}
+		phases = append(phases, phase)
+	}
+	*p = phases
+	return nil
+}
+
+func parseLoadFactor(s string) (float64, error) {
+	f, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(s), "x"), 64)
+	if err != nil || f < 0 || !strings.HasSuffix(s, "x") {
+		return 0, fmt.Errorf("invalid factor %q, expected a number followed by x, like 1.5x", s)
+	}
+	return f, nil
+}
+
+func (p *LoadProfile) String() string {
+	if p == nil {
+		return ""
+	}
+	phases := make([]string, len(*p))
+	for i, phase := range *p {
+		phases[i] = phase.String()
+	}
+	return strings.Join(phases, ",")
+}
+
+// Duration returns total duration of the profile
+func (p LoadProfile) Duration() (d time.Duration) {
+	for _, phase := range p {
+		d += phase.Duration
+	}
+	return
+}
+
+// at returns the factor and index of the phase at the time since start, the index is len(p) once the profile is over
+func (p LoadProfile) at(elapsed time.Duration) (float64, int) {
+	for i, phase := range p {
+		if elapsed < phase.Duration {
+			progress := float64(elapsed) / float64(phase.Duration)
+			return phase.From + (phase.To-phase.From)*progress, i
+		}
+		elapsed -= phase.Duration
+	}
+	return 0, len(p)
+}
+
+// LoadTestConfig holds configuration of the load test mode
+type LoadTestConfig struct {
+	Profile LoadProfile `json:"load-profile"`
+	Amplify string      `json:"load-amplify"` // time or fanout
+	Report  string      `json:"load-report"`
+}
+
+// LoadTest amplifies recorded traffic following the load profile, and collects latency and errors of
+// replayed requests for each phase. Traffic is amplified either by compressing time of file inputs,
+// or by sending each request several times with unique ids.
+type LoadTest struct {
+	config LoadTestConfig
+	clock  Clock
+	fanout bool
+
+	mu       sync.Mutex
+	start    time.Time // zero until the first read
+	phases   []loadPhaseStats
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+type loadPhaseStats struct {
+	sent      int64
+	responses int64
+	errors    int64
+	latencies []time.Duration // reservoir sample
+	observed  int64
+}
+
+// maximum number of latencies kept per phase to compute percentiles
+const loadTestSampleSize = 10000
+
+// CreateLoadTest constructor for LoadTest, it returns an error on invalid configuration
+func CreateLoadTest(config LoadTestConfig, clock Clock) (*LoadTest, error) {
+	if len(config.Profile) == 0 {
+		return nil, errors.New("load profile is empty")
+	}
+	lt := &LoadTest{config: config, clock: clock, done: make(chan struct{})}
+	switch config.Amplify {
+	case "", "time":
+	case "fanout":
+		lt.fanout = true
+	default:
+		return nil, fmt.Errorf("unknown amplification %q, expected time or fanout", config.Amplify)
+	}
+	// files can't be replayed at speed 0, only fanout can pause traffic
+	for _, phase := range config.Profile {
+		if !lt.fanout && (phase.From <= 0 || phase.To <= 0) {
+			return nil, fmt.Errorf("load phase %s: time amplification requires factors above 0x, use --load-amplify fanout to pause traffic", phase)
+		}
+	}
+	lt.phases = make([]loadPhaseStats, len(config.Profile))
+	return lt, nil
+}
+
+// Done returns a channel which is closed once the profile is over
+func (lt *LoadTest) Done() <-chan struct{} {
+	return lt.done
+}
+
+// started starts the profile on the first call
+func (lt *LoadTest) started() {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	if !lt.start.IsZero() {
+		return
+	}
+	lt.start = lt.clock.Now()
+	Debug(1, fmt.Sprintf("[LOAD-TEST] phase 1 started: %s", lt.config.Profile[0]))
+
+	end, _ := lt.clock.After(lt.config.Profile.Duration())
+	go func() {
+		<-end
+		lt.finish()
+	}()
+}
+
+func (lt *LoadTest) finish() {
+	lt.doneOnce.Do(func() {
+		Debug(1, "[LOAD-TEST] load profile is over")
+		close(lt.done)
+	})
+}
+
+// current returns the factor and the phase
+func (lt *LoadTest) current() (float64, int) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	return lt.config.Profile.at(lt.clock.Now().Sub(lt.start))
+}
+
+func (lt *LoadTest) sent(phase int, n int) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	lt.phases[phase].sent += int64(n)
+}
+
+// observe records result of a replayed request. Transport errors, timeouts and 5xx responses are errors.
+func (lt *LoadTest) observe(latency time.Duration, status int, failed bool) {
+	_, phase := lt.current()
+
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	if lt.start.IsZero() {
+		return
+	}
+	if phase == len(lt.phases) {
+		// responses to requests of the last phase
+		phase--
+	}
+	p := &lt.phases[phase]
+	if failed || status >= 500 {
+		p.errors++
+	}
+	if !failed {
+		p.responses++
+	}
+	p.observed++
+	if len(p.latencies) < loadTestSampleSize {
+		p.latencies = append(p.latencies, latency)
+	} else if i := rand.Int63n(p.observed); i < loadTestSampleSize {
+		p.latencies[i] = latency
+	}
+}
+
+// LoadPhaseReport holds results of a load phase
+type LoadPhaseReport struct {
+	Phase     int     `json:"phase"`
+	Profile   string  `json:"profile"`
+	Sent      int64   `json:"sent"`
+	Responses int64   `json:"responses"`
+	Errors    int64   `json:"errors"`
+	ErrorRate float64 `json:"error_rate"`
+	RPS       float64 `json:"rps"`
+	P50       float64 `json:"p50_ms"`
+	P95       float64 `json:"p95_ms"`
+	P99       float64 `json:"p99_ms"`
+}
+
+// Report returns results of the phases
+func (lt *LoadTest) Report() []LoadPhaseReport {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	reports := make([]LoadPhaseReport, len(lt.phases))
+	for i, p := range lt.phases {
+		phase := lt.config.Profile[i]
+		r := LoadPhaseReport{
+			Phase:     i + 1,
+			Profile:   phase.String(),
+			Sent:      p.sent,
+			Responses: p.responses,
+			Errors:    p.errors,
+			RPS:       float64(p.sent) / phase.Duration.Seconds(),
+		}
+		if p.observed > 0 {
+			r.ErrorRate = float64(p.errors) / float64(p.observed)
+		}
+
+		latencies := append([]time.Duration(nil), p.latencies...)
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		r.P50, r.P95, r.P99 = percentileMs(latencies, 0.5), percentileMs(latencies, 0.95), percentileMs(latencies, 0.99)
+		reports[i] = r
+	}
+	return reports
+}
+
+func percentileMs(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(float64(len(sorted))*p)) - 1
+	if i < 0 {
+		i = 0
+	}
+	return float64(sorted[i]) / float64(time.Millisecond)
+}
+
+// WriteReport writes results of the phases as a table
+func (lt *LoadTest) WriteReport(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "phase\tprofile\tsent\trps\tresponses\terrors\terror rate\tp50 ms\tp95 ms\tp99 ms\t")
+	for _, r := range lt.Report() {
+		fmt.Fprintf(tw, "%d\t%s\t%d\t%.1f\t%d\t%d\t%.2f%%\t%.1f\t%.1f\t%.1f\t\n",
+			r.Phase, r.Profile, r.Sent, r.RPS, r.Responses, r.Errors, r.ErrorRate*100, r.P50, r.P95, r.P99)
+	}
+	return tw.Flush()
+}
+
+// Finish prints the report, and writes it as JSON if --load-report is set
+func (lt *LoadTest) Finish() error {
+	fmt.Println("Load test report:")
+	lt.WriteReport(os.Stdout)
+
+	if lt.config.Report == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(lt.Report(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(lt.config.Report, data, 0644)
+}
+
+// Wrap amplifies messages of the input, it returns io.EOF once the profile is over
+func (lt *LoadTest) Wrap(in PluginReader) PluginReader {
+	i := &loadTestInput{lt: lt, in: in}
+	if fi, ok := unwrapPlugin(in).(*FileInput); ok {
+		i.file, i.speed = fi, fi.getSpeedFactor()
+	}
+	return i
+}
+
+// loadTestInput amplifies messages of the input
+type loadTestInput struct {
+	lt    *LoadTest
+	in    PluginReader
+	file  *FileInput // nil if the input is not a file
+	speed float64    // speed factor of the file input without amplification
+
+	mu      sync.Mutex
+	pending []*Message      // copies of the last request
+	reading chan readResult // read in progress, which is interrupted once the profile is over
+}
+
+type readResult struct {
+	msg *Message
+	err error
+}
+
+func (i *loadTestInput) PluginRead() (*Message, error) {
+	i.lt.started()
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if len(i.pending) > 0 {
+		msg := i.pending[0]
+		i.pending = i.pending[1:]
+		return msg, nil
+	}
+
+	factor, phase := i.lt.current()
+	if phase == len(i.lt.phases) {
+		return nil, io.EOF
+	}
+	if !i.lt.fanout && i.file != nil {
+		i.file.SetSpeedFactor(i.speed * factor)
+	}
+
+	if i.reading == nil {
+		i.reading = make(chan readResult, 1)
+		go func(reading chan readResult) {
+			msg, err := i.in.PluginRead()
+			reading <- readResult{msg, err}
+		}(i.reading)
+	}
+	var r readResult
+	select {
+	case r = <-i.reading:
+		i.reading = nil
+	case <-i.lt.Done():
+		return nil, io.EOF
+	}
+
+	if r.err != nil || r.msg == nil || !protocol.IsRequestPayload(r.msg.Meta) {
+		return r.msg, r.err
+	}
+
+	// the phase could change while waiting
+	factor, phase = i.lt.current()
+	if phase == len(i.lt.phases) {
+		return nil, io.EOF
+	}
+
+	copies := 1
+	if i.lt.fanout {
+		copies = int(factor)
+		if rand.Float64() < factor-float64(copies) {
+			copies++
+		}
+	}
+	i.lt.sent(phase, copies)
+	if copies == 0 {
+		return nil, nil
+	}
+
+	// copies are rewritten in place by the modifier, so each has its own data
+	id := protocol.PayloadID(r.msg.Meta)
+	for n := 1; n < copies; n++ {
+		i.pending = append(i.pending, &Message{
+			Meta: bytes.Replace(r.msg.Meta, id, protocol.Uuid(), 1),
+			Data: append([]byte(nil), r.msg.Data...),
+		})
+	}
+	return r.msg, nil
+}
+
+func (i *loadTestInput) String() string {
+	return fmt.Sprint(i.in)
+}
+
+// Close closes the input
+func (i *loadTestInput) Close() error {
+	if c, ok := i.in.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// wrapLoadTest amplifies inputs of the plugins. Outputs reading responses are not amplified.
+func (plugins *InOutPlugins) wrapLoadTest(lt *LoadTest) error {
+	for i, in := range plugins.Inputs {
+		if w, ok := in.(PluginWriter); ok {
+			if _, isOutput := plugins.OutputNames[w]; isOutput {
+				continue
+			}
+		}
+		if _, ok := unwrapPlugin(in).(*FileInput); !ok && !lt.fanout {
+			return fmt.Errorf("%s: only file inputs can be amplified in time, use --load-amplify fanout", in)
+		}
+
+		wrapped := lt.Wrap(in)
+		plugins.Inputs[i] = wrapped
+		if plugins.InputNames != nil {
+			plugins.InputNames[wrapped] = plugins.InputNames[in]
+			delete(plugins.InputNames, in)
+		}
+		for j, p := range plugins.All {
+			if p == interface{}(in) {
+				plugins.All[j] = wrapped
+			}
+		}
+	}
+	return nil
+}
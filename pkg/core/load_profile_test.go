@@ -0,0 +1,182 @@
+package core
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/reoring/goreplay/pkg/protocol"
+)
+
+// timerClock is a manualClock whose timers fire only when told to
+type timerClock struct {
+	manualClock
+	timers []chan time.Time
+}
+
+func (c *timerClock) After(d time.Duration) (<-chan time.Time, func()) {
+	ch := make(chan time.Time, 1)
+	c.timers = append(c.timers, ch)
+	return ch, func() {}
+}
+
+func TestLoadProfile(t *testing.T) {
+	var p LoadProfile
+	if err := p.Set("1x:5m, 1x-4x:10m,0.5x:30s"); err != nil {
+		t.Fatal(err)
+	}
+	if p.String() != "1x:5m0s,1x-4x:10m0s,0.5x:30s" {
+		t.Error("Should format the profile", p.String())
+	}
+	if p.Duration() != 15*time.Minute+30*time.Second {
+		t.Error("Should sum durations of phases", p.Duration())
+	}
+
+	cases := []struct {
+		elapsed time.Duration
+		factor  float64
+		phase   int
+	}{
+		{0, 1, 0},
+		{5 * time.Minute, 1, 1},
+		{10 * time.Minute, 2.5, 1},
+		{15 * time.Minute, 0.5, 2},
+		{16 * time.Minute, 0, 3},
+	}
+	for _, c := range cases {
+		if factor, phase := p.at(c.elapsed); factor != c.factor || phase != c.phase {
+			t.Errorf("%v: expected %vx in phase %d, got %vx in phase %d", c.elapsed, c.factor, c.phase, factor, phase)
+		}
+	}
+
+	for _, invalid := range []string{"", "1x", "2:1m", "x:1m", "-1x:1m", "1x:0s", "1x-2x-3x:1m", "1x:abc"} {
+		if err := new(LoadProfile).Set(invalid); err == nil {
+			t.Errorf("%q should be invalid", invalid)
+		}
+	}
+}
+
+func TestLoadTestFanout(t *testing.T) {
+	var profile LoadProfile
+	profile.Set("3x:1m,0x:1m")
+	clock := &timerClock{manualClock: manualClock{now: time.Unix(0, 0)}}
+	lt, err := CreateLoadTest(LoadTestConfig{Profile: profile, Amplify: "fanout"}, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := NewTestInput()
+	in := lt.Wrap(input)
+	input.EmitGET()
+
+	ids := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		msg, err := in.PluginRead()
+		if err != nil || msg == nil {
+			t.Fatal("Should read a copy", err)
+		}
+		ids[string(protocol.PayloadID(msg.Meta))] = true
+		if !bytes.HasPrefix(msg.Data, []byte("GET")) {
+			t.Error("Should keep the request", string(msg.Data))
+		}
+	}
+	if len(ids) != 3 {
+		t.Error("Copies should have unique ids", ids)
+	}
+
+	clock.now = clock.now.Add(time.Minute)
+	input.EmitGET()
+	if msg, err := in.PluginRead(); msg != nil || err != nil {
+		t.Error("Should drop requests at 0x", msg, err)
+	}
+
+	close(clock.timers[0])
+	if _, err := in.PluginRead(); err != io.EOF {
+		t.Error("Should stop once the profile is over", err)
+	}
+
+	report := lt.Report()
+	if report[0].Sent != 3 || report[1].Sent != 0 || report[0].RPS != 0.05 {
+		t.Errorf("Should count sent requests, got %+v", report)
+	}
+}
+
+func TestLoadTestFanoutRewrite(t *testing.T) {
+	var profile LoadProfile
+	profile.Set("3x:1m")
+	clock := &timerClock{manualClock: manualClock{now: time.Unix(0, 0)}}
+	lt, err := CreateLoadTest(LoadTestConfig{Profile: profile, Amplify: "fanout"}, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewrites := URLRewriteMap{}
+	if err := rewrites.Set("/v1/user/ping:/p"); err != nil {
+		t.Fatal(err)
+	}
+	modifier := NewHTTPModifier(&HTTPModifierConfig{URLRewrite: rewrites})
+
+	input := NewTestInput()
+	in := lt.Wrap(input)
+	input.EmitBytes([]byte("GET /v1/user/ping HTTP/1.1\r\nHost: example.org\r\n\r\n"))
+
+	// copies are rewritten one by one in place, like in the emitter
+	var copies [][]byte
+	for i := 0; i < 3; i++ {
+		msg, err := in.PluginRead()
+		if err != nil || msg == nil {
+			t.Fatal("Should read a copy", err)
+		}
+		copies = append(copies, modifier.RewriteMessage(protocol.PayloadMeta(msg.Meta), msg.Data))
+	}
+	for i, data := range copies {
+		if string(data) != "GET /p HTTP/1.1\r\nHost: example.org\r\n\r\n" {
+			t.Errorf("Copy %d should be rewritten on its own: %q", i, data)
+		}
+	}
+}
+
+func TestLoadTestReport(t *testing.T) {
+	var profile LoadProfile
+	profile.Set("1x:10s,2x:10s")
+	clock := &timerClock{manualClock: manualClock{now: time.Unix(0, 0)}}
+	lt, _ := CreateLoadTest(LoadTestConfig{Profile: profile}, clock)
+	lt.started()
+
+	for i := 1; i <= 100; i++ {
+		lt.observe(time.Duration(i)*time.Millisecond, 200, false)
+	}
+	clock.now = clock.now.Add(15 * time.Second)
+	lt.observe(time.Second, 0, true)
+	lt.observe(time.Second, 503, false)
+
+	report := lt.Report()
+	if r := report[0]; r.Responses != 100 || r.Errors != 0 || r.P50 != 50 || r.P95 != 95 || r.P99 != 99 {
+		t.Errorf("Should report latency of the first phase, got %+v", r)
+	}
+	if r := report[1]; r.Responses != 1 || r.Errors != 2 || r.ErrorRate != 1 || r.P99 != 1000 {
+		t.Errorf("Should report errors of the second phase, got %+v", r)
+	}
+
+	var table bytes.Buffer
+	lt.WriteReport(&table)
+	if !bytes.Contains(table.Bytes(), []byte("2x:10s")) {
+		t.Error("Should print phases", table.String())
+	}
+
+	if _, err := CreateLoadTest(LoadTestConfig{Profile: profile, Amplify: "warp"}, clock); err == nil {
+		t.Error("Should reject unknown amplification")
+	}
+
+	var paused LoadProfile
+	paused.Set("1x:10s,0x:10s,0x-2x:10s")
+	if _, err := CreateLoadTest(LoadTestConfig{Profile: paused}, clock); err == nil {
+		t.Error("Should reject 0x steps in time amplification")
+	}
+	if _, err := CreateLoadTest(LoadTestConfig{Profile: paused, Amplify: "fanout"}, clock); err != nil {
+		t.Error("Fanout should pause traffic on 0x steps", err)
+	}
+	if _, err := ParseSettings([]string{"--input-file", "requests.gor", "--load-profile", "1x:10s,0x:10s"}); err == nil {
+		t.Error("Settings should reject 0x steps in time amplification")
+	}
+}
@@ -2,8 +2,11 @@ package core
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/hex"
+	"expvar"
 	"fmt"
 	"github.com/reoring/goreplay/pkg/protocol"
 	"io"
@@ -11,69 +14,262 @@ import (
 	"os/exec"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 )
 
+// Middleware communication protocols
+const (
+	// MiddlewareProtocolHex sends every message as a single hex encoded line
+	MiddlewareProtocolHex = "hex"
+	// MiddlewareProtocolBinary sends every message as length-prefixed meta followed by length-prefixed body
+	MiddlewareProtocolBinary = "binary"
+	// MiddlewareProtocolAuto lets the middleware choose the protocol during the handshake
+	MiddlewareProtocolAuto = "auto"
+)
+
+// What to do with a message the middleware did not answer in time
+const (
+	// MiddlewareTimeoutPass forwards the original, unmodified message. A middleware filtering
+	// messages should answer them with an empty payload, otherwise they are forwarded.
+	MiddlewareTimeoutPass = "pass"
+	// MiddlewareTimeoutDrop discards the message
+	MiddlewareTimeoutDrop = "drop"
+)
+
+// MiddlewareHandshake is the line a middleware should print first to switch to the binary protocol,
+// it is only expected when running with `--middleware-protocol auto`
+const MiddlewareHandshake = "GOR-BINARY-V1"
+
+// MiddlewareProtocolsEnv is the environment variable which tells the middleware what protocols gor understands
+const MiddlewareProtocolsEnv = "GOR_MIDDLEWARE_PROTOCOLS"
+
+// MiddlewareConfig holds middleware configuration
+type MiddlewareConfig struct {
+	Protocol          string        `json:"middleware-protocol"`
+	HandshakeTimeout  time.Duration `json:"middleware-handshake-timeout"`
+	QueueLen          int           `json:"middleware-queue-len"`
+	Timeout           time.Duration `json:"middleware-timeout"`
+	TimeoutAction     string        `json:"middleware-timeout-action"`
+	MaxRestarts       int           `json:"middleware-max-restarts"`
+	RestartBackoff    time.Duration `json:"middleware-restart-backoff"`
+	RestartMaxBackoff time.Duration `json:"middleware-restart-max-backoff"`
+	Prettify          bool          // decode messages before passing them, set by --prettify-http
+}
+
+// MiddlewareStats holds health counters of a middleware
+type MiddlewareStats struct {
+	InFlight      int64 `json:"in_flight"`
+	TimedOut      int64 `json:"timed_out"`
+	Dropped       int64 `json:"dropped"`
+	PassedThrough int64 `json:"passed_through"`
+	Filtered      int64 `json:"filtered"`
+	Restarts      int64 `json:"restarts"`
+}
+
+type pendingMessage struct {
+	msg      *Message
+	deadline time.Time
+}
+
 // Middleware represents a middleware object
 type Middleware struct {
+	// keep it first for 64-bit alignment of the counters
+	stats MiddlewareStats
+
 	command       string
+	config        MiddlewareConfig
 	data          chan *Message
 	Stdin         io.Writer
 	Stdout        io.Reader
 	commandCancel context.CancelFunc
-	stop          chan bool // Channel used only to indicate goroutine should shutdown
+	stop          chan bool     // Channel used only to indicate goroutine should shutdown
+	exited        chan struct{} // closed once the supervised process is gone for good
 	closed        bool
 	mu            sync.RWMutex
+
+	binary     bool
+	negotiated chan struct{} // closed once the protocol is known, nil if there is nothing to negotiate
+	writeMu    sync.Mutex    // serializes messages written by several ReadFrom workers
+
+	// messages waiting for an answer, only tracked when the config has a Timeout
+	pending   map[string]pendingMessage
+	expired   map[string]time.Time
+	pendingMu sync.Mutex
+	slots     chan struct{} // bounds the number of pending messages
 }
 
 // NewMiddleware returns new middleware
-func NewMiddleware(command string) *Middleware {
+func NewMiddleware(command string, config *MiddlewareConfig) *Middleware {
 	m := new(Middleware)
 	m.command = command
-	m.data = make(chan *Message, 1000)
+	m.config = *config
+	if m.config.QueueLen <= 0 {
+		m.config.QueueLen = 1000
+	}
+	if m.config.RestartBackoff <= 0 {
+		m.config.RestartBackoff = 100 * time.Millisecond
+	}
+	if m.config.RestartMaxBackoff < m.config.RestartBackoff {
+		m.config.RestartMaxBackoff = 30 * time.Second
+	}
+	m.data = make(chan *Message, m.config.QueueLen)
 	m.stop = make(chan bool)
+	m.exited = make(chan struct{})
+
+	switch m.config.Protocol {
+	case MiddlewareProtocolBinary:
+		m.binary = true
+	case MiddlewareProtocolAuto:
+		m.negotiated = make(chan struct{})
+	}
+
+	if m.config.Timeout > 0 {
+		m.pending = make(map[string]pendingMessage)
+		m.expired = make(map[string]time.Time)
+		m.slots = make(chan struct{}, m.config.QueueLen)
+		go m.expire()
+	}
+	m.publishStats()
 
-	commands := strings.Split(command, " ")
 	ctx, cancl := context.WithCancel(context.Background())
 	m.commandCancel = cancl
-	cmd := exec.CommandContext(ctx, commands[0], commands[1:]...)
+	cmd := m.spawn(ctx)
+
+	go m.supervise(ctx, cmd)
 
-	m.Stdout, _ = cmd.StdoutPipe()
-	m.Stdin, _ = cmd.StdinPipe()
+	return m
+}
 
+// spawn prepares a new middleware process and starts reading its output
+func (m *Middleware) spawn(ctx context.Context) *exec.Cmd {
+	commands := strings.Split(m.command, " ")
+	cmd := exec.CommandContext(ctx, commands[0], commands[1:]...)
+	if m.negotiated != nil {
+		cmd.Env = append(os.Environ(), MiddlewareProtocolsEnv+"="+MiddlewareProtocolHex+","+MiddlewareProtocolBinary)
+	}
+
+	stdout, _ := cmd.StdoutPipe()
+	stdin, _ := cmd.StdinPipe()
 	cmd.Stderr = os.Stderr
 
-	go m.read(m.Stdout)
+	m.mu.Lock()
+	m.Stdout = stdout
+	m.Stdin = stdin
+	m.mu.Unlock()
 
-	go func() {
-		defer m.Close()
+	go m.read(stdout)
+
+	return cmd
+}
+
+// supervise runs the middleware process and restarts it with exponential backoff if it exits,
+// until the plugin is closed or --middleware-max-restarts is reached
+func (m *Middleware) supervise(ctx context.Context, cmd *exec.Cmd) {
+	defer close(m.exited)
+	defer m.shutdown()
+	backoff := m.config.RestartBackoff
+	for restarts := 0; ; restarts++ {
+		started := time.Now()
 		var err error
 		if err = cmd.Start(); err == nil {
 			err = cmd.Wait()
 		}
+		if m.isClosed() || ctx.Err() != nil {
+			return
+		}
 		if err != nil {
 			if e, ok := err.(*exec.ExitError); ok {
 				status := e.Sys().(syscall.WaitStatus)
-				if status.Signal() == syscall.SIGKILL /*killed or context canceld */ {
-					return
+				if status.Signaled() {
+					err = fmt.Errorf("killed by %s", status.Signal())
 				}
 			}
-			Debug(0, fmt.Sprintf("[MIDDLEWARE] command[%q] error: %q", command, err.Error()))
+			Debug(0, fmt.Sprintf("[MIDDLEWARE] command[%q] error: %q", m.command, err.Error()))
+		} else {
+			Debug(0, fmt.Sprintf("[MIDDLEWARE] command[%q] exited", m.command))
 		}
-	}()
+		// nobody is left to answer the messages sent to the old process
+		m.failPending()
 
-	return m
+		if m.config.MaxRestarts >= 0 && restarts >= m.config.MaxRestarts {
+			Debug(0, fmt.Sprintf("[MIDDLEWARE] command[%q] is not restarted after %d restarts, stopping", m.command, restarts))
+			return
+		}
+		if time.Since(started) > m.config.RestartMaxBackoff {
+			backoff = m.config.RestartBackoff
+		}
+		Debug(0, fmt.Sprintf("[MIDDLEWARE] command[%q] restarting in %s", m.command, backoff))
+		select {
+		case <-m.stop:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > m.config.RestartMaxBackoff {
+			backoff = m.config.RestartMaxBackoff
+		}
+
+		atomic.AddInt64(&m.stats.Restarts, 1)
+		cmd = m.spawn(ctx)
+	}
 }
 
 // ReadFrom start a worker to read from this plugin
 func (m *Middleware) ReadFrom(plugin PluginReader) {
 	Debug(2, fmt.Sprintf("[MIDDLEWARE] command[%q] Starting reading from %q", m.command, plugin))
-	go m.copy(m.Stdin, plugin)
+	go m.copy(plugin)
+}
+
+// waitNegotiation blocks until the middleware picked a protocol, or the handshake timeout is reached
+func (m *Middleware) waitNegotiation() {
+	if m.negotiated == nil {
+		return
+	}
+	timeout := m.config.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	select {
+	case <-m.negotiated:
+	case <-m.stop:
+	case <-time.After(timeout):
+		m.negotiate(false)
+	}
 }
 
-func (m *Middleware) copy(to io.Writer, from PluginReader) {
+func (m *Middleware) negotiate(binary bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	select {
+	case <-m.negotiated:
+		if binary != m.binary {
+			Debug(0, fmt.Sprintf("[MIDDLEWARE] command[%q] changed protocol after the handshake, binary: %v", m.command, binary))
+		}
+		return
+	default:
+	}
+	m.binary = binary
+	close(m.negotiated)
+	Debug(2, fmt.Sprintf("[MIDDLEWARE] command[%q] using binary protocol: %v", m.command, binary))
+}
+
+func (m *Middleware) isBinary() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.binary
+}
+
+func (m *Middleware) stdin() io.Writer {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.Stdin
+}
+
+func (m *Middleware) copy(from PluginReader) {
 	var buf, dst []byte
 
+	m.waitNegotiation()
 	for {
 		msg, err := from.PluginRead()
 		if err != nil {
@@ -82,54 +278,334 @@ func (m *Middleware) copy(to io.Writer, from PluginReader) {
 		if msg == nil || len(msg.Data) == 0 {
 			continue
 		}
+		if !m.track(msg) {
+			return
+		}
 		buf = msg.Data
-		if Settings.PrettifyHTTP {
+		if m.config.Prettify {
 			buf = PrettifyHTTP(msg.Data)
 		}
-		dstLen := (len(buf)+len(msg.Meta))*2 + 1
-		// if enough space was previously allocated use it instead
-		if dstLen > len(dst) {
-			dst = make([]byte, dstLen)
+		if m.isBinary() {
+			dst = encodeBinaryFrame(dst, msg.Meta, buf)
+		} else {
+			dst = encodeHexFrame(dst, msg.Meta, buf)
 		}
-		n := hex.Encode(dst, msg.Meta)
-		n += hex.Encode(dst[n:], buf)
-		dst[n] = '\n'
 
-		n, err = to.Write(dst[:n+1])
+		m.writeMu.Lock()
+		_, err = m.stdin().Write(dst)
+		m.writeMu.Unlock()
 		if err == nil {
 			continue
 		}
 		if m.isClosed() {
 			return
 		}
+		// the process is gone or restarting
+		m.release(msg.Meta)
+		m.unanswered(msg)
+	}
+}
+
+func pendingKey(meta []byte) string {
+	return string(meta[:1]) + string(protocol.PayloadID(meta))
+}
+
+// track remembers a message sent to the middleware, so the configured timeout action
+// can be applied if it is never answered. It blocks while the pending queue is full.
+func (m *Middleware) track(msg *Message) bool {
+	if m.slots == nil || len(msg.Meta) == 0 {
+		return true
+	}
+	select {
+	case m.slots <- struct{}{}:
+	case <-m.stop:
+		return false
+	}
+	key := pendingKey(msg.Meta)
+
+	m.pendingMu.Lock()
+	if _, ok := m.pending[key]; ok {
+		<-m.slots
+	} else {
+		atomic.AddInt64(&m.stats.InFlight, 1)
+	}
+	m.pending[key] = pendingMessage{msg: msg, deadline: time.Now().Add(m.config.Timeout)}
+	m.pendingMu.Unlock()
+
+	return true
+}
+
+// release forgets a pending message, reports if it was pending
+func (m *Middleware) release(meta []byte) bool {
+	if m.slots == nil || len(meta) == 0 {
+		return false
+	}
+	key := pendingKey(meta)
+
+	m.pendingMu.Lock()
+	defer m.pendingMu.Unlock()
+	if _, ok := m.pending[key]; !ok {
+		return false
+	}
+	delete(m.pending, key)
+	<-m.slots
+	atomic.AddInt64(&m.stats.InFlight, -1)
+
+	return true
+}
+
+// answered reports if a message coming from the middleware should be emitted.
+// Late answers to messages which already had the timeout action applied are discarded.
+func (m *Middleware) answered(meta []byte) bool {
+	if m.slots == nil || len(meta) == 0 || m.release(meta) {
+		return true
+	}
+	key := pendingKey(meta)
+
+	m.pendingMu.Lock()
+	defer m.pendingMu.Unlock()
+	if _, ok := m.expired[key]; ok {
+		delete(m.expired, key)
+		return false
+	}
+	return true
+}
+
+// unanswered applies --middleware-timeout-action to a message
+func (m *Middleware) unanswered(msg *Message) {
+	if m.config.TimeoutAction == MiddlewareTimeoutPass {
+		atomic.AddInt64(&m.stats.PassedThrough, 1)
+		m.emit(msg)
+		return
+	}
+	atomic.AddInt64(&m.stats.Dropped, 1)
+}
+
+// expire applies the timeout action to messages pending longer than --middleware-timeout
+func (m *Middleware) expire() {
+	interval := m.config.Timeout / 2
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case now := <-ticker.C:
+			var expired []*Message
+			m.pendingMu.Lock()
+			for key, p := range m.pending {
+				if now.After(p.deadline) {
+					delete(m.pending, key)
+					<-m.slots
+					m.expired[key] = now
+					expired = append(expired, p.msg)
+				}
+			}
+			// forget about late answers which never came
+			for key, t := range m.expired {
+				if now.Sub(t) > 10*m.config.Timeout {
+					delete(m.expired, key)
+				}
+			}
+			m.pendingMu.Unlock()
+
+			for _, msg := range expired {
+				atomic.AddInt64(&m.stats.InFlight, -1)
+				atomic.AddInt64(&m.stats.TimedOut, 1)
+				Debug(3, fmt.Sprintf("[MIDDLEWARE] command[%q] message timed out: %q", m.command, msg.Meta))
+				m.unanswered(msg)
+			}
+		}
 	}
 }
 
+// failPending applies the timeout action to every pending message at once
+func (m *Middleware) failPending() {
+	if m.slots == nil {
+		return
+	}
+	var failed []*Message
+	m.pendingMu.Lock()
+	for key, p := range m.pending {
+		delete(m.pending, key)
+		<-m.slots
+		failed = append(failed, p.msg)
+	}
+	m.pendingMu.Unlock()
+
+	for _, msg := range failed {
+		atomic.AddInt64(&m.stats.InFlight, -1)
+		m.unanswered(msg)
+	}
+}
+
+// Stats returns a snapshot of the middleware health counters
+func (m *Middleware) Stats() MiddlewareStats {
+	return MiddlewareStats{
+		InFlight:      atomic.LoadInt64(&m.stats.InFlight),
+		TimedOut:      atomic.LoadInt64(&m.stats.TimedOut),
+		Dropped:       atomic.LoadInt64(&m.stats.Dropped),
+		PassedThrough: atomic.LoadInt64(&m.stats.PassedThrough),
+		Filtered:      atomic.LoadInt64(&m.stats.Filtered),
+		Restarts:      atomic.LoadInt64(&m.stats.Restarts),
+	}
+}
+
+// publishStats exposes health counters at /debug/vars
+func (m *Middleware) publishStats() {
+	stats := expvarMap("middleware-" + m.command)
+	stats.Set("in_flight", expvar.Func(func() interface{} { return atomic.LoadInt64(&m.stats.InFlight) }))
+	stats.Set("timed_out", expvar.Func(func() interface{} { return atomic.LoadInt64(&m.stats.TimedOut) }))
+	stats.Set("dropped", expvar.Func(func() interface{} { return atomic.LoadInt64(&m.stats.Dropped) }))
+	stats.Set("passed_through", expvar.Func(func() interface{} { return atomic.LoadInt64(&m.stats.PassedThrough) }))
+	stats.Set("filtered", expvar.Func(func() interface{} { return atomic.LoadInt64(&m.stats.Filtered) }))
+	stats.Set("restarts", expvar.Func(func() interface{} { return atomic.LoadInt64(&m.stats.Restarts) }))
+	stats.Set("queue_len", expvar.Func(func() interface{} { return len(m.data) }))
+}
+
+// encodeHexFrame writes meta and body as one hex encoded, newline terminated line into dst.
+// dst is reused if it has enough capacity.
+func encodeHexFrame(dst, meta, body []byte) []byte {
+	dstLen := (len(body)+len(meta))*2 + 1
+	// if enough space was previously allocated use it instead
+	if dstLen > cap(dst) {
+		dst = make([]byte, dstLen)
+	}
+	dst = dst[:dstLen]
+	n := hex.Encode(dst, meta)
+	n += hex.Encode(dst[n:], body)
+	dst[n] = '\n'
+
+	return dst
+}
+
+// encodeBinaryFrame writes meta (without its trailing newline) and body into dst,
+// each prefixed with its big-endian uint32 length. dst is reused if it has enough capacity.
+func encodeBinaryFrame(dst, meta, body []byte) []byte {
+	meta = bytes.TrimSuffix(meta, []byte{'\n'})
+	dstLen := 8 + len(meta) + len(body)
+	if dstLen > cap(dst) {
+		dst = make([]byte, dstLen)
+	}
+	dst = dst[:dstLen]
+	binary.BigEndian.PutUint32(dst, uint32(len(meta)))
+	n := 4 + copy(dst[4:], meta)
+	binary.BigEndian.PutUint32(dst[n:], uint32(len(body)))
+	copy(dst[n+4:], body)
+
+	return dst
+}
+
+// maximum length of meta or body of a binary frame, larger lengths come from a broken middleware
+const binaryFrameMaxSize = 64 << 20
+
+// readBinaryFrameSize reads the length prefix of meta or body of a binary frame
+func readBinaryFrameSize(reader *bufio.Reader) (int, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(reader, size[:]); err != nil {
+		return 0, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > binaryFrameMaxSize {
+		return 0, fmt.Errorf("invalid frame length %d", n)
+	}
+	return int(n), nil
+}
+
+// readBinaryFrame reads a single length-prefixed message produced by encodeBinaryFrame
+func readBinaryFrame(reader *bufio.Reader) (*Message, error) {
+	n, err := readBinaryFrameSize(reader)
+	if err != nil {
+		return nil, err
+	}
+	meta := make([]byte, n+1)
+	if _, err := io.ReadFull(reader, meta[:n]); err != nil {
+		return nil, err
+	}
+	meta[n] = '\n'
+	if n, err = readBinaryFrameSize(reader); err != nil {
+		return nil, err
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+
+	return &Message{Meta: meta, Data: body}, nil
+}
+
+// readHandshake checks whether the middleware output starts with the binary protocol handshake
+func (m *Middleware) readHandshake(reader *bufio.Reader) {
+	handshake := []byte(MiddlewareHandshake + "\n")
+	prefix, _ := reader.Peek(len(handshake))
+	if bytes.Equal(prefix, handshake) {
+		reader.Discard(len(handshake))
+		m.negotiate(true)
+		return
+	}
+	m.negotiate(false)
+}
+
+// read reads messages from the output of a single middleware process, until it exits
 func (m *Middleware) read(from io.Reader) {
 	reader := bufio.NewReader(from)
 	var line []byte
 	var e error
+	if m.negotiated != nil {
+		m.readHandshake(reader)
+	}
 	for {
-		if line, e = reader.ReadBytes('\n'); e != nil {
-			if m.isClosed() {
+		var msg *Message
+		if m.isBinary() {
+			if msg, e = readBinaryFrame(reader); e != nil {
+				if !m.isClosed() && e != io.EOF {
+					Debug(0, fmt.Sprintf("[MIDDLEWARE] command[%q] failed to read binary frame err: %q", m.command, e))
+				}
+				return
+			}
+		} else {
+			if line, e = reader.ReadBytes('\n'); e != nil {
 				return
 			}
+			buf := make([]byte, (len(line)-1)/2)
+			if _, err := hex.Decode(buf, line[:len(line)-1]); err != nil {
+				Debug(0, fmt.Sprintf("[MIDDLEWARE] command[%q] failed to decode err: %q", m.command, err))
+				continue
+			}
+			msg = new(Message)
+			msg.Meta, msg.Data = protocol.PayloadMetaWithBody(buf)
+			if msg.Meta == nil && bytes.IndexByte(buf, '\n') == len(buf)-1 {
+				// meta line without payload
+				msg.Meta, msg.Data = buf, nil
+			}
+		}
+		if !m.answered(msg.Meta) {
 			continue
 		}
-		buf := make([]byte, (len(line)-1)/2)
-		if _, err := hex.Decode(buf, line[:len(line)-1]); err != nil {
-			Debug(0, fmt.Sprintf("[MIDDLEWARE] command[%q] failed to decode err: %q", m.command, err))
+		// an answer without payload tells the message was filtered
+		if len(msg.Data) == 0 {
+			atomic.AddInt64(&m.stats.Filtered, 1)
 			continue
 		}
-		var msg Message
-		msg.Meta, msg.Data = protocol.PayloadMetaWithBody(buf)
-		select {
-		case <-m.stop:
+		if !m.emit(msg) {
 			return
-		case m.data <- &msg:
 		}
 	}
+}
 
+// emit passes a message received from the middleware to the readers of this plugin.
+// Returns false if the plugin was stopped.
+func (m *Middleware) emit(msg *Message) bool {
+	select {
+	case <-m.stop:
+		return false
+	case m.data <- msg:
+		return true
+	}
 }
 
 // PluginRead reads message from this plugin
@@ -143,6 +619,11 @@ func (m *Middleware) PluginRead() (msg *Message, err error) {
 	return
 }
 
+// Drain waits for answers to in-flight messages. They are tracked only if `--middleware-timeout` is set.
+func (m *Middleware) Drain(ctx context.Context) int {
+	return drainPending(ctx, func() int { return int(atomic.LoadInt64(&m.stats.InFlight)) })
+}
+
 func (m *Middleware) String() string {
 	return fmt.Sprintf("Modifying traffic using %q command", m.command)
 }
@@ -153,15 +634,25 @@ func (m *Middleware) isClosed() bool {
 	return m.closed
 }
 
-// Close closes this plugin
+// Close closes this plugin and waits for the middleware process to exit
 func (m *Middleware) Close() error {
+	m.shutdown()
+	if m.exited != nil {
+		<-m.exited
+	}
+	return nil
+}
+
+func (m *Middleware) shutdown() {
 	if m.isClosed() {
-		return nil
+		return
 	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	if m.closed {
+		return
+	}
 	m.commandCancel()
 	close(m.stop)
 	m.closed = true
-	return nil
 }
@@ -1,14 +1,20 @@
 package core
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"github.com/reoring/goreplay/pkg/protocol"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"testing"
+	"time"
 )
 
 const echoSh = "./examples/middleware/echo.sh"
@@ -150,3 +156,171 @@ func TestMiddlewareEarlyClose(t *testing.T) {
 //	midd.Close()
 //	Settings.PrettifyHTTP = false
 //}
+
+func TestMiddlewareBinaryFrame(t *testing.T) {
+	meta := protocol.PayloadHeader(protocol.RequestPayload, protocol.Uuid(), time.Now().UnixNano(), -1)
+	body := []byte("POST / HTTP/1.1\r\nContent-Length: 4\r\n\r\n\x00\n\xff\n")
+
+	frame := encodeBinaryFrame(nil, meta, body)
+	msg, err := readBinaryFrame(bufio.NewReader(bytes.NewReader(frame)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg.Meta, meta) {
+		t.Errorf("expected meta %q to equal %q", msg.Meta, meta)
+	}
+	if !bytes.Equal(msg.Data, body) {
+		t.Errorf("expected body %q to equal %q", msg.Data, body)
+	}
+
+	for _, frame := range [][]byte{
+		{0xff, 0xff, 0xff, 0xff},
+		append(encodeBinaryFrame(nil, meta, nil)[:len(meta)+3], 0xff, 0xff, 0xff, 0xff),
+	} {
+		if _, err := readBinaryFrame(bufio.NewReader(bytes.NewReader(frame))); err == nil || err == io.EOF {
+			t.Errorf("expected invalid length of %x to be rejected, got %v", frame, err)
+		}
+	}
+}
+
+func testMiddlewareEmitter(t *testing.T, config MiddlewareConfig, cmds ...string) {
+	Settings.MiddlewareConfig = config
+	defer func() { Settings.MiddlewareConfig = MiddlewareConfig{} }()
+
+	wg := new(sync.WaitGroup)
+	in := NewTestInput()
+	var body = []byte("POST / HTTP/1.1\r\nHost: example.org\r\nContent-Length: 5\r\n\r\na\nb\nc")
+	out := NewTestOutput(func(msg *Message) {
+		if !bytes.Equal(body, msg.Data) {
+			t.Errorf("expected %q to equal %q", body, msg.Data)
+		}
+		if !protocol.IsRequestPayload(msg.Meta) {
+			t.Errorf("expected request meta, got %q", msg.Meta)
+		}
+		wg.Done()
+	})
+	pl := &InOutPlugins{}
+	pl.Inputs = []PluginReader{in}
+	pl.Outputs = []PluginWriter{out}
+	pl.All = []interface{}{out, in}
+	e := NewEmitter()
+	e.Start(pl, cmds...)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		in.EmitBytes(body)
+	}
+	wg.Wait()
+	e.Close()
+}
+
+func TestMiddlewareBinaryProtocol(t *testing.T) {
+	testMiddlewareEmitter(t, MiddlewareConfig{Protocol: MiddlewareProtocolBinary}, "cat")
+}
+
+func TestMiddlewareNegotiatedBinaryProtocol(t *testing.T) {
+	testMiddlewareEmitter(t, MiddlewareConfig{Protocol: MiddlewareProtocolAuto}, "../../examples/middleware/echo_binary.sh")
+}
+
+func TestMiddlewareNegotiationFallback(t *testing.T) {
+	testMiddlewareEmitter(t, MiddlewareConfig{Protocol: MiddlewareProtocolAuto, HandshakeTimeout: 100 * time.Millisecond}, "cat")
+}
+
+func TestMiddlewareChain(t *testing.T) {
+	testMiddlewareEmitter(t, MiddlewareConfig{}, "cat", "cat", "cat")
+}
+
+// runMiddlewareEmitter emits count GET requests through the middleware,
+// Settings.MiddlewareConfig is in use until the returned middleware is closed
+func runMiddlewareEmitter(t *testing.T, config MiddlewareConfig, cmd string, count int, cb func(*Message)) *Middleware {
+	Settings.MiddlewareConfig = config
+
+	in := NewTestInput()
+	pl := &InOutPlugins{}
+	pl.Inputs = []PluginReader{in}
+	pl.Outputs = []PluginWriter{NewTestOutput(cb)}
+	pl.All = []interface{}{in}
+	e := NewEmitter()
+	e.Start(pl, cmd)
+	for i := 0; i < count; i++ {
+		in.EmitGET()
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	return pl.Inputs[len(pl.Inputs)-1].(*Middleware)
+}
+
+func TestMiddlewareTimeoutPass(t *testing.T) {
+	wg := new(sync.WaitGroup)
+	wg.Add(5)
+	m := runMiddlewareEmitter(t, MiddlewareConfig{Timeout: 50 * time.Millisecond, TimeoutAction: MiddlewareTimeoutPass}, "sleep 60", 5, func(*Message) {
+		wg.Done()
+	})
+	wg.Wait()
+	defer func() {
+		m.Close()
+		Settings.MiddlewareConfig = MiddlewareConfig{}
+	}()
+
+	if stats := m.Stats(); stats.TimedOut != 5 || stats.PassedThrough != 5 || stats.InFlight != 0 {
+		t.Errorf("expected 5 timed out and passed through messages, got %+v", stats)
+	}
+}
+
+func TestMiddlewareTimeoutDrop(t *testing.T) {
+	m := runMiddlewareEmitter(t, MiddlewareConfig{Timeout: 10 * time.Millisecond, TimeoutAction: MiddlewareTimeoutDrop}, "sleep 60", 5, func(msg *Message) {
+		t.Errorf("expected message to be dropped, got %q", msg.Meta)
+	})
+	defer func() {
+		m.Close()
+		Settings.MiddlewareConfig = MiddlewareConfig{}
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	if stats := m.Stats(); stats.TimedOut != 5 || stats.Dropped != 5 {
+		t.Errorf("expected 5 timed out and dropped messages, got %+v", stats)
+	}
+}
+
+func TestMiddlewareTimeoutPassFiltered(t *testing.T) {
+	// answers every message with its meta line only
+	script, _ := ioutil.TempFile("", "gor-middleware")
+	script.WriteString(`while read -r line; do echo "${line%%0a*}0a"; done`)
+	script.Close()
+	defer os.Remove(script.Name())
+
+	m := runMiddlewareEmitter(t, MiddlewareConfig{Timeout: 50 * time.Millisecond, TimeoutAction: MiddlewareTimeoutPass}, "sh "+script.Name(), 5, func(msg *Message) {
+		t.Errorf("expected filtered message to be dropped, got %q", msg.Meta)
+	})
+	defer func() {
+		m.Close()
+		Settings.MiddlewareConfig = MiddlewareConfig{}
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	if stats := m.Stats(); stats.Filtered != 5 || stats.PassedThrough != 0 || stats.InFlight != 0 {
+		t.Errorf("expected 5 filtered messages, got %+v", stats)
+	}
+}
+
+func TestMiddlewareRestart(t *testing.T) {
+	wg := new(sync.WaitGroup)
+	wg.Add(5)
+	// answers a single message and exits
+	m := runMiddlewareEmitter(t, MiddlewareConfig{
+		Timeout:        time.Second,
+		TimeoutAction:  MiddlewareTimeoutPass,
+		MaxRestarts:    -1,
+		RestartBackoff: time.Millisecond,
+	}, "head -n 1", 5, func(*Message) {
+		wg.Done()
+	})
+	wg.Wait()
+	defer func() {
+		m.Close()
+		Settings.MiddlewareConfig = MiddlewareConfig{}
+	}()
+
+	if stats := m.Stats(); stats.Restarts == 0 {
+		t.Errorf("expected middleware to be restarted, got %+v", stats)
+	}
+}
@@ -140,6 +140,7 @@ func (o *BinaryOutput) PluginRead() (*Message, error) {
 	}
 	msg.Data = resp.payload
 	msg.Meta = protocol.PayloadHeader(protocol.ReplayedResponsePayload, resp.uuid, resp.startedAt, resp.roundTripTime)
+	msg.Meta = protocol.CopyMetaFields(msg.Meta, resp.meta)
 
 	return &msg, nil
 }
@@ -160,7 +161,7 @@ func (o *BinaryOutput) sendRequest(client *TCPClient, msg *Message) {
 	}
 
 	if o.config.TrackResponses {
-		o.responses <- response{resp, uuid, start.UnixNano(), stop.UnixNano() - start.UnixNano()}
+		o.responses <- response{resp, uuid, start.UnixNano(), stop.UnixNano() - start.UnixNano(), msg.Meta}
 	}
 }
 
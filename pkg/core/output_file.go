@@ -2,12 +2,11 @@ package core
 
 import (
 	"bufio"
-	"compress/gzip"
 	"errors"
 	"fmt"
 	"github.com/reoring/goreplay/pkg/protocol"
 	"io"
-	"log"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
@@ -18,6 +17,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/reoring/goreplay/pkg/version"
 	"github.com/reoring/goreplay/size"
 )
 
@@ -51,12 +51,18 @@ var dateFileNameFuncs = map[string]func(*FileOutput) string{
 
 // FileOutputConfig ...
 type FileOutputConfig struct {
-	FlushInterval     time.Duration `json:"output-file-flush-interval"`
-	SizeLimit         size.Size     `json:"output-file-size-limit"`
-	OutputFileMaxSize size.Size     `json:"output-file-max-size-limit"`
-	QueueLimit        int           `json:"output-file-queue-limit"`
-	Append            bool          `json:"output-file-append"`
-	BufferPath        string        `json:"output-file-buffer"`
+	FlushInterval     time.Duration     `json:"output-file-flush-interval"`
+	SizeLimit         size.Size         `json:"output-file-size-limit"`
+	OutputFileMaxSize size.Size         `json:"output-file-max-size-limit"`
+	QueueLimit        int               `json:"output-file-queue-limit"`
+	Append            bool              `json:"output-file-append"`
+	BufferPath        string            `json:"output-file-buffer"`
+	Format            string            `json:"output-file-format"`      // v1, v2 or jsonl, jsonl by extension if empty
+	Capture           map[string]string `json:"-"`                       // capture options written to v2 file headers
+	Index             bool              `json:"output-file-index"`       // write time index next to files
+	Compression       string            `json:"output-file-compression"` // gzip, zstd, lz4 or none, by extension if empty
+	CompressionLevel  int               `json:"output-file-compression-level"`
+	Encryption        *FileEncryption   `json:"-"` // nil if files aren't encrypted
 	onClose           func(string)
 }
 
@@ -74,16 +80,54 @@ type FileOutput struct {
 	closed          bool
 	currentFileSize int
 	totalFileSize   size.Size
+	v2              bool
+	jsonl           bool
+	buf             []byte // encoded v2 record or JSON line
+	counter         *countingWriter
+	index           *timeIndexWriter
+	compression     *fileCompression // of the current file, nil if it isn't compressed
+	frameStart      int64            // offset of the current compressed frame
+	frameDirty      bool             // data was written to the current frame
+	encrypter       *encryptWriter   // nil if files aren't encrypted
+	sink            io.Writer        // compressed data is written to, the encrypter or the counter
 
 	config *FileOutputConfig
 }
 
-// NewFileOutput constructor for FileOutput, accepts path
-func NewFileOutput(pathTemplate string, config *FileOutputConfig) *FileOutput {
+// checkFileOutputConfig checks the format and the compression of files written to the path
+func checkFileOutputConfig(pathTemplate string, config *FileOutputConfig) error {
+	switch config.Format {
+	case "", "v1", "v2", "jsonl":
+	default:
+		return fmt.Errorf("unknown format %q, expected v1, v2 or jsonl", config.Format)
+	}
+
+	c, err := outputCompression(pathTemplate, config.Compression)
+	if err == nil && c != nil {
+		_, err = c.newWriter(ioutil.Discard, config.CompressionLevel)
+	}
+	return err
+}
+
+// NewFileOutput constructor for FileOutput, accepts path. It returns an error on invalid format or compression.
+func NewFileOutput(pathTemplate string, config *FileOutputConfig) (*FileOutput, error) {
+	if err := checkFileOutputConfig(pathTemplate, config); err != nil {
+		return nil, err
+	}
+
 	o := new(FileOutput)
 	o.pathTemplate = pathTemplate
 	o.config = config
 
+	switch config.Format {
+	case "":
+		o.jsonl = isJSONLPath(pathTemplate)
+	case "v2":
+		o.v2 = true
+	case "jsonl":
+		o.jsonl = true
+	}
+
 	if strings.Contains(pathTemplate, "%r") {
 		o.requestPerFile = true
 	}
@@ -102,7 +146,7 @@ func NewFileOutput(pathTemplate string, config *FileOutputConfig) *FileOutput {
 		}
 	}()
 
-	return o
+	return o, nil
 }
 
 func getFileIndex(name string) int {
@@ -181,6 +225,7 @@ func (o *FileOutput) filename() string {
 		withoutExt := strings.TrimSuffix(path, ext)
 
 		if matches, err := filepath.Glob(withoutExt + "*" + ext); err == nil {
+			matches = withoutTimeIndexes(matches)
 			if len(matches) == 0 {
 				return setFileIndex(path, 0)
 			}
@@ -229,39 +274,139 @@ func (o *FileOutput) PluginWrite(msg *Message) (n int, err error) {
 		o.closeLocked()
 
 		o.file, err = os.OpenFile(o.currentName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+		if err != nil {
+			Debug(0, fmt.Sprintf("[OUTPUT-FILE] can't open %q: %v", o.currentName, err))
+			o.file = nil
+			return 0, err
+		}
 		o.file.Sync()
 
-		if strings.HasSuffix(o.currentName, ".gz") {
-			o.writer = gzip.NewWriter(o.file)
+		o.counter = &countingWriter{w: o.file}
+		o.sink = o.counter
+		o.encrypter = nil
+		if o.config.Encryption != nil {
+			if o.encrypter, err = newEncryptWriter(o.counter, o.config.Encryption); err != nil {
+				// plain data must not be written instead
+				Debug(0, fmt.Sprintf("[OUTPUT-FILE] can't encrypt %q: %v", o.currentName, err))
+				o.file.Close()
+				os.Remove(o.currentName)
+				o.file = nil
+				return 0, err
+			}
+			o.sink = o.encrypter
+		}
+		o.frameStart = o.counter.n
+		o.compression, _ = outputCompression(o.currentName, o.config.Compression)
+		if o.compression != nil {
+			o.writer, _ = o.compression.newWriter(o.sink, o.config.CompressionLevel)
 		} else {
-			o.writer = bufio.NewWriter(o.file)
+			o.writer = bufio.NewWriter(o.sink)
 		}
 
-		if err != nil {
-			log.Fatal(o, "Cannot open file %q. Error: %s", o.currentName, err)
+		o.QueueLength = 0
+
+		if o.config.Index && !o.requestPerFile {
+			if o.index, err = createTimeIndexWriter(o.currentName); err != nil {
+				Debug(0, fmt.Sprintf("[OUTPUT-FILE] can't create time index of %q: %v", o.currentName, err))
+			}
 		}
 
-		o.QueueLength = 0
+		if o.v2 {
+			host, _ := os.Hostname()
+			n, err = writeFileHeader(o.writer, FileHeader{Host: host, Created: time.Now(), GorVersion: version.VERSION, Config: o.config.Capture})
+			o.currentFileSize += n
+			if err != nil {
+				return 0, err
+			}
+		}
 	}
 
-	var nn int
-	n, err = o.writer.Write(msg.Meta)
-	nn, err = o.writer.Write(msg.Data)
-	n += nn
-	nn, err = o.writer.Write(PayloadSeparatorAsBytes)
-	n += nn
+	if o.v2 {
+		o.buf = encodeRecord(o.buf[:0], msg.Meta, msg.Data)
+		if len(o.buf)-8 > fileFormatMaxRecord {
+			// it couldn't be read back
+			return 0, fmt.Errorf("record of %d bytes is larger than %d bytes", len(o.buf)-8, fileFormatMaxRecord)
+		}
+	}
+
+	if o.index != nil {
+		if timestamp, ok := metaTimestamp(msg.Meta); ok {
+			if o.index.full(timestamp) {
+				o.nextSegment()
+			}
+			o.index.add(o.position(), timestamp)
+		}
+	}
+
+	if o.v2 {
+		n, err = o.writer.Write(o.buf)
+	} else if o.jsonl {
+		if o.buf, err = appendJSONL(o.buf[:0], msg.Meta, msg.Data); err != nil {
+			return 0, err
+		}
+		n, err = o.writer.Write(o.buf)
+	} else {
+		var nn int
+		n, err = o.writer.Write(msg.Meta)
+		nn, err = o.writer.Write(msg.Data)
+		n += nn
+		nn, err = o.writer.Write(PayloadSeparatorAsBytes)
+		n += nn
+	}
 
 	o.totalFileSize += size.Size(n)
 	o.currentFileSize += n
 	o.QueueLength++
+	o.frameDirty = true
 
-	if Settings.OutputFileConfig.OutputFileMaxSize > 0 && o.totalFileSize >= Settings.OutputFileConfig.OutputFileMaxSize {
+	if o.config.OutputFileMaxSize > 0 && o.totalFileSize >= o.config.OutputFileMaxSize {
 		return n, errors.New("File output reached size limit")
 	}
 
 	return n, err
 }
 
+// position returns the offset of the next record in the file, or of the current frame of compressed
+// and encrypted files
+func (o *FileOutput) position() int64 {
+	if o.compression != nil || o.encrypter != nil {
+		return o.frameStart
+	}
+	return o.counter.n + int64(o.writer.(*bufio.Writer).Buffered())
+}
+
+// endFrame ends the compressed frame and the encrypted chunk, and starts a new one which can be
+// decompressed and decrypted on its own
+func (o *FileOutput) endFrame() {
+	if o.compression != nil {
+		w := o.writer.(compressedWriter)
+		if err := w.Close(); err != nil {
+			Debug(0, fmt.Sprintf("[OUTPUT-FILE] error writing %q: %v", o.currentName, err))
+		}
+		w.Reset(o.sink)
+	} else {
+		o.writer.(*bufio.Writer).Flush()
+	}
+	if o.encrypter != nil {
+		if err := o.encrypter.Flush(); err != nil {
+			Debug(0, fmt.Sprintf("[OUTPUT-FILE] error writing %q: %v", o.currentName, err))
+		}
+	}
+	o.frameStart = o.counter.n
+	o.frameDirty = false
+}
+
+// nextSegment finishes the time index segment, compressed and encrypted files start a new frame so
+// reading can start from it
+func (o *FileOutput) nextSegment() {
+	if o.compression != nil || o.encrypter != nil {
+		o.endFrame()
+	}
+	if err := o.index.finish(o.position()); err != nil {
+		Debug(0, fmt.Sprintf("[OUTPUT-FILE] can't write time index of %q: %v", o.currentName, err))
+	}
+}
+
 func (o *FileOutput) flush() {
 	// Don't exit on panic
 	defer func() {
@@ -274,11 +419,19 @@ func (o *FileOutput) flush() {
 	defer o.Unlock()
 
 	if o.file != nil {
-		if strings.HasSuffix(o.currentName, ".gz") {
-			o.writer.(*gzip.Writer).Flush()
+		if o.compression != nil && o.compression.frames {
+			// a frame per flush keeps the file readable if the writer crashes
+			if o.frameDirty {
+				o.endFrame()
+			}
+		} else if o.compression != nil {
+			o.writer.(compressedWriter).Flush()
 		} else {
 			o.writer.(*bufio.Writer).Flush()
 		}
+		if o.encrypter != nil {
+			o.encrypter.Flush()
+		}
 
 		if stat, err := o.file.Stat(); err == nil {
 			o.currentFileSize = int(stat.Size())
@@ -289,16 +442,30 @@ func (o *FileOutput) flush() {
 }
 
 func (o *FileOutput) String() string {
+	if o.file == nil {
+		return "File output: " + o.pathTemplate
+	}
 	return "File output: " + o.file.Name()
 }
 
 func (o *FileOutput) closeLocked() error {
 	if o.file != nil {
-		if strings.HasSuffix(o.currentName, ".gz") {
-			o.writer.(*gzip.Writer).Close()
+		if o.compression != nil {
+			o.writer.(compressedWriter).Close()
 		} else {
 			o.writer.(*bufio.Writer).Flush()
 		}
+		if o.encrypter != nil {
+			if err := o.encrypter.Close(); err != nil {
+				Debug(0, fmt.Sprintf("[OUTPUT-FILE] error writing %q: %v", o.file.Name(), err))
+			}
+		}
+		if o.index != nil {
+			if err := o.index.Close(o.counter.n); err != nil {
+				Debug(0, fmt.Sprintf("[OUTPUT-FILE] can't write time index of %q: %v", o.file.Name(), err))
+			}
+			o.index = nil
+		}
 		o.file.Close()
 
 		if o.config.onClose != nil {
@@ -15,11 +15,19 @@ import (
 	"github.com/reoring/goreplay/size"
 )
 
+func newTestFileOutput(t *testing.T, pathTemplate string, config *FileOutputConfig) *FileOutput {
+	output, err := NewFileOutput(pathTemplate, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return output
+}
+
 func TestFileOutput(t *testing.T) {
 	wg := new(sync.WaitGroup)
 
 	input := NewTestInput()
-	output := NewFileOutput("/tmp/test_requests.gor", &FileOutputConfig{FlushInterval: time.Minute, Append: true})
+	output := newTestFileOutput(t, "/tmp/test_requests.gor", &FileOutputConfig{FlushInterval: time.Minute, Append: true})
 
 	plugins := &InOutPlugins{
 		Inputs:  []PluginReader{input},
@@ -28,7 +36,7 @@ func TestFileOutput(t *testing.T) {
 	plugins.All = append(plugins.All, input, output)
 
 	emitter := NewEmitter()
-	go emitter.Start(plugins, Settings.Middleware)
+	go emitter.Start(plugins, Settings.Middleware...)
 
 	for i := 0; i < 100; i++ {
 		wg.Add(2)
@@ -53,7 +61,7 @@ func TestFileOutput(t *testing.T) {
 	plugins2.All = append(plugins2.All, input2, output2)
 
 	emitter2 := NewEmitter()
-	go emitter2.Start(plugins2, Settings.Middleware)
+	go emitter2.Start(plugins2, Settings.Middleware...)
 
 	wg.Wait()
 	emitter2.Close()
@@ -82,8 +90,20 @@ func TestFileOutputPathTemplate(t *testing.T) {
 	}
 }
 
+func TestFileOutputOpenError(t *testing.T) {
+	output := newTestFileOutput(t, "/nonexistent/requests.gor", &FileOutputConfig{Append: true, FlushInterval: time.Minute})
+	defer output.Close()
+
+	if _, err := output.PluginWrite(&Message{Meta: []byte("1 1 1\n"), Data: []byte("test")}); err == nil {
+		t.Error("Should fail to open file")
+	}
+	if output.String() != "File output: /nonexistent/requests.gor" {
+		t.Error("Should describe output without file", output.String())
+	}
+}
+
 func TestFileOutputMultipleFiles(t *testing.T) {
-	output := NewFileOutput("/tmp/log-%Y-%m-%d-%S", &FileOutputConfig{Append: true, FlushInterval: time.Minute})
+	output := newTestFileOutput(t, "/tmp/log-%Y-%m-%d-%S", &FileOutputConfig{Append: true, FlushInterval: time.Minute})
 
 	if output.file != nil {
 		t.Error("Should not initialize file if no writes")
@@ -114,7 +134,7 @@ func TestFileOutputMultipleFiles(t *testing.T) {
 }
 
 func TestFileOutputFilePerRequest(t *testing.T) {
-	output := NewFileOutput("/tmp/log-%Y-%m-%d-%S-%r", &FileOutputConfig{Append: true})
+	output := newTestFileOutput(t, "/tmp/log-%Y-%m-%d-%S-%r", &FileOutputConfig{Append: true})
 
 	if output.file != nil {
 		t.Error("Should not initialize file if no writes")
@@ -142,7 +162,7 @@ func TestFileOutputFilePerRequest(t *testing.T) {
 }
 
 func TestFileOutputCompression(t *testing.T) {
-	output := NewFileOutput("/tmp/log-%Y-%m-%d-%S.gz", &FileOutputConfig{Append: true, FlushInterval: time.Minute})
+	output := newTestFileOutput(t, "/tmp/log-%Y-%m-%d-%S.gz", &FileOutputConfig{Append: true, FlushInterval: time.Minute})
 
 	if output.file != nil {
 		t.Error("Should not initialize file if no writes")
@@ -206,7 +226,7 @@ func TestFileOutputAppendQueueLimitOverflow(t *testing.T) {
 	rnd := rand.Int63()
 	name := fmt.Sprintf("/tmp/%d", rnd)
 
-	output := NewFileOutput(name, &FileOutputConfig{Append: false, FlushInterval: time.Minute, QueueLimit: 2})
+	output := newTestFileOutput(t, name, &FileOutputConfig{Append: false, FlushInterval: time.Minute, QueueLimit: 2})
 
 	output.PluginWrite(&Message{Meta: []byte("1 1 1\r\n"), Data: []byte("test")})
 	name1 := output.file.Name()
@@ -235,7 +255,7 @@ func TestFileOutputAppendQueueLimitNoOverflow(t *testing.T) {
 	rnd := rand.Int63()
 	name := fmt.Sprintf("/tmp/%d", rnd)
 
-	output := NewFileOutput(name, &FileOutputConfig{Append: false, FlushInterval: time.Minute, QueueLimit: 3})
+	output := newTestFileOutput(t, name, &FileOutputConfig{Append: false, FlushInterval: time.Minute, QueueLimit: 3})
 
 	output.PluginWrite(&Message{Meta: []byte("1 1 1\r\n"), Data: []byte("test")})
 	name1 := output.file.Name()
@@ -264,7 +284,7 @@ func TestFileOutputAppendQueueLimitGzips(t *testing.T) {
 	rnd := rand.Int63()
 	name := fmt.Sprintf("/tmp/%d.gz", rnd)
 
-	output := NewFileOutput(name, &FileOutputConfig{Append: false, FlushInterval: time.Minute, QueueLimit: 2})
+	output := newTestFileOutput(t, name, &FileOutputConfig{Append: false, FlushInterval: time.Minute, QueueLimit: 2})
 
 	output.PluginWrite(&Message{Meta: []byte("1 1 1\r\n"), Data: []byte("test")})
 	name1 := output.file.Name()
@@ -307,7 +327,7 @@ func TestFileOutputAppendSizeLimitOverflow(t *testing.T) {
 
 	messageSize := len(message) + len(protocol.PayloadSeparator)
 
-	output := NewFileOutput(name, &FileOutputConfig{Append: false, FlushInterval: time.Minute, SizeLimit: size.Size(2 * messageSize)})
+	output := newTestFileOutput(t, name, &FileOutputConfig{Append: false, FlushInterval: time.Minute, SizeLimit: size.Size(2 * messageSize)})
 
 	output.PluginWrite(&Message{Meta: []byte("1 1 1\r\n"), Data: []byte("test")})
 	name1 := output.file.Name()
@@ -3,18 +3,24 @@ package core
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/kr/pretty"
 	"github.com/reoring/goreplay/pkg/protocol"
 	"log"
 	"math"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/reoring/goreplay/proto"
 	"github.com/reoring/goreplay/size"
 )
 
@@ -29,6 +35,7 @@ type response struct {
 	uuid          []byte
 	roundTripTime int64
 	startedAt     int64
+	meta          []byte // header of the request, its meta fields are copied to the response
 }
 
 // HTTPOutputConfig struct for holding http output configuration
@@ -48,6 +55,9 @@ type HTTPOutputConfig struct {
 	SkipVerify     bool          `json:"output-http-skip-verify"`
 	Host           string        `json:"output-http-host"`
 	Headers        map[string]string `json:"output-http-headers"`
+	Adaptive       AdaptiveConfig
+	LoadTest       *LoadTest `json:"-"` // collects results of replayed requests in load test mode
+	LatencyStats   *LatencyStats `json:"-"`
 	rawURL         string
 	url            *url.URL
 }
@@ -56,6 +66,7 @@ type HTTPOutputConfig struct {
 // By default workers pool is dynamic and starts with 1 worker or workerMin workers
 // You can specify maximum number of workers using `--output-http-workers`
 type HTTPOutput struct {
+	pending       int64 // queued and in-flight requests, keep first for atomic alignment
 	activeWorkers int32
 	config        *HTTPOutputConfig
 	queueStats    *GorStat
@@ -65,19 +76,55 @@ type HTTPOutput struct {
 	queue         chan *Message
 	responses     chan *response
 	stop          chan bool // Channel used only to indicate goroutine should shutdown
+
+	inFlightMu   sync.Mutex
+	inFlightCond *sync.Cond
+	inFlight     int
+	maxInFlight  int // 0 if not limited
+
+	adaptive *adaptiveController // nil if adaptive rate is disabled
 }
 
 // NewHTTPOutput constructor for HTTPOutput
 // Initialize workers
 func NewHTTPOutput(address string, config *HTTPOutputConfig) PluginReadWriter {
-	o := new(HTTPOutput)
-	var err error
-	config.url, err = url.Parse(address)
+	o, err := CreateHTTPOutput(address, config)
 	if err != nil {
 		log.Fatal(fmt.Sprintf("[OUTPUT-HTTP] parse HTTP output URL error[%q]", err))
 	}
-	if config.url.Scheme == "" {
-		config.url.Scheme = "http"
+	return o
+}
+
+// parseHTTPOutputURL parses the address of HTTP output, addresses without scheme use http
+func parseHTTPOutputURL(address string) (*url.URL, error) {
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("%s: unsupported scheme %q", address, u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("%s: missing host", address)
+	}
+	if u.Port() != "" {
+		if _, _, err := net.SplitHostPort(u.Host); err != nil {
+			return nil, fmt.Errorf("%s: %v", address, err)
+		}
+	}
+	return u, nil
+}
+
+// CreateHTTPOutput is NewHTTPOutput which returns an error instead of exiting on invalid address
+func CreateHTTPOutput(address string, config *HTTPOutputConfig) (*HTTPOutput, error) {
+	o := new(HTTPOutput)
+	var err error
+	config.url, err = parseHTTPOutputURL(address)
+	if err != nil {
+		return nil, err
 	}
 	config.rawURL = config.url.String()
 	if config.BufferSize <= 0 {
@@ -106,6 +153,7 @@ func NewHTTPOutput(address string, config *HTTPOutputConfig) PluginReadWriter {
 	}
 	o.config = config
 	o.stop = make(chan bool)
+	o.inFlightCond = sync.NewCond(&o.inFlightMu)
 	if o.config.Stats {
 		o.queueStats = NewGorStat("output_http", o.config.StatsMs)
 	}
@@ -121,35 +169,38 @@ func NewHTTPOutput(address string, config *HTTPOutputConfig) PluginReadWriter {
 		o.elasticSearch = new(ESPlugin)
 		o.elasticSearch.Init(o.config.ElasticSearch)
 	}
+	if o.config.Adaptive.Enabled {
+		o.adaptive = newAdaptiveController(address, o.config.Adaptive, RealClock{})
+	}
 	o.client = NewHTTPClient(o.config)
 	o.activeWorkers += int32(o.config.WorkersMin)
 	for i := 0; i < o.config.WorkersMin; i++ {
 		go o.startWorker()
 	}
 	go o.workerMaster()
-	return o
+	return o, nil
 }
 
 func (o *HTTPOutput) workerMaster() {
 	var timer = time.NewTimer(o.config.WorkerTimeout)
-	defer func() {
-		// recover from panics caused by trying to send in
-		// a closed chan(o.stopWorker)
-		recover()
-	}()
 	defer timer.Stop()
+	// only the master sends to stopWorker, so it closes it once stopped to stop all workers
+	defer close(o.stopWorker)
 	for {
 		select {
 		case <-o.stop:
 			return
-		default:
-			<-timer.C
+		case <-timer.C:
 		}
 		// rollback workers
 	rollback:
 		if atomic.LoadInt32(&o.activeWorkers) > int32(o.config.WorkersMin) && len(o.queue) < 1 {
 			// close one worker
-			o.stopWorker <- struct{}{}
+			select {
+			case <-o.stop:
+				return
+			case o.stopWorker <- struct{}{}:
+			}
 			atomic.AddInt32(&o.activeWorkers, -1)
 			goto rollback
 		}
@@ -164,6 +215,7 @@ func (o *HTTPOutput) startWorker() {
 			return
 		case msg := <-o.queue:
 			o.sendRequest(o.client, msg)
+			atomic.AddInt64(&o.pending, -1)
 		}
 	}
 }
@@ -173,9 +225,14 @@ func (o *HTTPOutput) PluginWrite(msg *Message) (n int, err error) {
 	if !protocol.IsRequestPayload(msg.Meta) {
 		return len(msg.Data), nil
 	}
+	if o.adaptive != nil && !o.adaptive.admit() {
+		return len(msg.Data) + len(msg.Meta), nil
+	}
 
+	atomic.AddInt64(&o.pending, 1)
 	select {
 	case <-o.stop:
+		atomic.AddInt64(&o.pending, -1)
 		return 0, ErrorStopped
 	case o.queue <- msg:
 	}
@@ -208,6 +265,7 @@ func (o *HTTPOutput) PluginRead() (*Message, error) {
 	}
 
 	msg.Meta = protocol.PayloadHeader(protocol.ReplayedResponsePayload, resp.uuid, resp.roundTripTime, resp.startedAt)
+	msg.Meta = protocol.CopyMetaFields(msg.Meta, resp.meta)
 
 	return &msg, nil
 }
@@ -217,10 +275,26 @@ func (o *HTTPOutput) sendRequest(client *HTTPClient, msg *Message) {
 		return
 	}
 
+	o.acquireInFlight()
 	uuid := protocol.PayloadID(msg.Meta)
 	start := time.Now()
-	resp, err := client.Send(msg.Data)
+	status, resp, err := client.send(msg.Data)
 	stop := time.Now()
+	o.releaseInFlight()
+
+	// errors of the client are *url.Error, others mean the request was not sent
+	var urlErr *url.Error
+	if failed := errors.As(err, &urlErr); failed || status != 0 {
+		if o.adaptive != nil {
+			o.adaptive.observe(stop.Sub(start), status, failed)
+		}
+		if o.config.LoadTest != nil {
+			o.config.LoadTest.observe(stop.Sub(start), status, failed)
+		}
+		if o.config.LatencyStats != nil {
+			o.config.LatencyStats.Record(string(proto.Method(msg.Data)), string(proto.Path(msg.Data)), stop.Sub(start), status, failed)
+		}
+	}
 
 	if err != nil {
 		Debug(1, fmt.Sprintf("[HTTP-OUTPUT] error when sending: %q", err))
@@ -231,7 +305,7 @@ func (o *HTTPOutput) sendRequest(client *HTTPClient, msg *Message) {
 	}
 
 	if o.config.TrackResponses {
-		o.responses <- &response{resp, uuid, start.UnixNano(), stop.UnixNano() - start.UnixNano()}
+		o.responses <- &response{resp, uuid, start.UnixNano(), stop.UnixNano() - start.UnixNano(), msg.Meta}
 	}
 
 	if o.elasticSearch != nil {
@@ -239,14 +313,51 @@ func (o *HTTPOutput) sendRequest(client *HTTPClient, msg *Message) {
 	}
 }
 
+// SetMaxInFlight limits the number of requests being sent at the same time, 0 removes the limit.
+// Workers wait for running requests to finish, so the queue is filled up instead.
+func (o *HTTPOutput) SetMaxInFlight(n int) {
+	o.inFlightMu.Lock()
+	defer o.inFlightMu.Unlock()
+	o.maxInFlight = n
+	o.inFlightCond.Broadcast()
+}
+
+func (o *HTTPOutput) acquireInFlight() {
+	o.inFlightMu.Lock()
+	defer o.inFlightMu.Unlock()
+	for o.maxInFlight > 0 && o.inFlight >= o.maxInFlight {
+		o.inFlightCond.Wait()
+	}
+	o.inFlight++
+}
+
+func (o *HTTPOutput) releaseInFlight() {
+	o.inFlightMu.Lock()
+	defer o.inFlightMu.Unlock()
+	o.inFlight--
+	o.inFlightCond.Signal()
+}
+
+// AdaptiveState returns state of the adaptive rate, false if it's disabled
+func (o *HTTPOutput) AdaptiveState() (AdaptiveState, bool) {
+	if o.adaptive == nil {
+		return AdaptiveState{}, false
+	}
+	return o.adaptive.State(), true
+}
+
 func (o *HTTPOutput) String() string {
 	return "HTTP output: " + o.config.rawURL
 }
 
+// Drain waits until queued and in-flight requests are sent
+func (o *HTTPOutput) Drain(ctx context.Context) int {
+	return drainPending(ctx, func() int { return int(atomic.LoadInt64(&o.pending)) })
+}
+
 // Close closes the data channel so that data
 func (o *HTTPOutput) Close() error {
 	close(o.stop)
-	close(o.stopWorker)
 	return nil
 }
 
@@ -286,17 +397,23 @@ func NewHTTPClient(config *HTTPOutputConfig) *HTTPClient {
 
 // Send sends a http request using client create by NewHTTPClient
 func (c *HTTPClient) Send(data []byte) ([]byte, error) {
+	_, resp, err := c.send(data)
+	return resp, err
+}
+
+// send is Send which also returns status code of the response, 0 if there is no response
+func (c *HTTPClient) send(data []byte) (int, []byte, error) {
 	var req *http.Request
 	var resp *http.Response
 	var err error
 
 	req, err = http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
 	if err != nil {
-		return nil, err
+		return 0, nil, err
 	}
 	// we don't send CONNECT or OPTIONS request
 	if req.Method == http.MethodConnect {
-		return nil, nil
+		return 0, nil, nil
 	}
 
 	req.Host = c.config.Host
@@ -318,17 +435,24 @@ func (c *HTTPClient) Send(data []byte) ([]byte, error) {
 	// it's an error if this is not equal to empty string
 	req.RequestURI = ""
 
-	log.Printf("%# v", pretty.Formatter(req))
+	verbose := Settings.Verbose >= 3
+	if verbose {
+		Debug(3, fmt.Sprintf("[HTTP-OUTPUT] request: %# v", pretty.Formatter(req)))
+	}
 
 	resp, err = c.Client.Do(req)
 	if err != nil {
-		log.Printf("%# v", pretty.Formatter(err))
-		return nil, err
+		Debug(3, fmt.Sprintf("[HTTP-OUTPUT] error: %v", err))
+		return 0, nil, err
+	}
+	// the response is read by the transport meanwhile, only its status and headers are printed
+	if verbose {
+		Debug(3, fmt.Sprintf("[HTTP-OUTPUT] response: %s %# v", resp.Status, pretty.Formatter(resp.Header)))
 	}
-	log.Printf("%# v", pretty.Formatter(resp))
 	if c.config.TrackResponses {
-		return httputil.DumpResponse(resp, true)
+		dump, err := httputil.DumpResponse(resp, true)
+		return resp.StatusCode, dump, err
 	}
 	_ = resp.Body.Close()
-	return nil, nil
+	return resp.StatusCode, nil, nil
 }
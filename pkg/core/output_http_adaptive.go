@@ -0,0 +1,210 @@
+package core
+
+import (
+	"expvar"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// AdaptiveConfig holds configuration of the adaptive rate of HTTP output.
+// Zero values are replaced by defaults of the corresponding command line options.
+type AdaptiveConfig struct {
+	Enabled      bool          `json:"output-http-adaptive"`
+	MaxLatency   time.Duration `json:"output-http-adaptive-max-latency"`
+	MaxErrorRate float64       `json:"output-http-adaptive-max-error-rate"`
+	MinRate      int           `json:"output-http-adaptive-min-rate"`
+	MaxRate      int           `json:"output-http-adaptive-max-rate"`
+	Step         int           `json:"output-http-adaptive-step"`
+	Interval     time.Duration `json:"output-http-adaptive-interval"`
+}
+
+// AdaptiveState describes the adaptive rate of HTTP output
+type AdaptiveState struct {
+	Rate       int     `json:"rate"` // admitted requests per second, 0 if not limited
+	Healthy    bool    `json:"healthy"`
+	LatencyP95 float64 `json:"latency_p95_ms"` // of the last interval
+	ErrorRate  float64 `json:"error_rate"`     // of the last interval
+	Admitted   int64   `json:"admitted"`
+	Dropped    int64   `json:"dropped"`
+}
+
+// adaptiveController admits requests at a rate which keeps the target within latency and error bounds.
+// The rate is halved when the target is unhealthy, and raised by a step each healthy interval (AIMD).
+type adaptiveController struct {
+	mu     sync.Mutex
+	config AdaptiveConfig
+	clock  Clock
+	name   string
+
+	rate   float64 // 0 if not limited
+	bucket *tokenBucket
+
+	windowStart time.Time
+	arrivals    int
+	errors      int
+	latencies   []time.Duration
+
+	state AdaptiveState
+	stats *expvar.Map
+}
+
+func newAdaptiveController(name string, config AdaptiveConfig, clock Clock) *adaptiveController {
+	if config.MaxLatency <= 0 {
+		config.MaxLatency = time.Second
+	}
+	if config.MaxErrorRate <= 0 {
+		config.MaxErrorRate = 0.05
+	}
+	if config.MinRate <= 0 {
+		config.MinRate = 1
+	}
+	if config.Step <= 0 {
+		config.Step = 10
+	}
+	if config.Interval <= 0 {
+		config.Interval = time.Second
+	}
+
+	c := &adaptiveController{config: config, clock: clock, name: name}
+	c.windowStart = clock.Now()
+	c.state.Healthy = true
+	c.setRate(float64(config.MaxRate), c.windowStart)
+
+	c.stats = expvarMap("http-adaptive-" + name)
+	c.report()
+	return c
+}
+
+// admit tells if a request can be sent
+func (c *adaptiveController) admit() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.clock.Now()
+	c.evaluate(now)
+	c.arrivals++
+
+	if c.bucket != nil && !c.bucket.allows(1, now) {
+		c.state.Dropped++
+		return false
+	}
+	if c.bucket != nil {
+		c.bucket.tokens--
+	}
+	c.state.Admitted++
+	return true
+}
+
+// observe records result of a sent request. Transport errors, timeouts and 5xx responses are errors.
+func (c *adaptiveController) observe(latency time.Duration, status int, failed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.latencies = append(c.latencies, latency)
+	if failed || status >= 500 {
+		c.errors++
+	}
+	c.evaluate(c.clock.Now())
+}
+
+// evaluate adjusts the rate once the interval is over
+func (c *adaptiveController) evaluate(now time.Time) {
+	elapsed := now.Sub(c.windowStart)
+	if elapsed < c.config.Interval {
+		return
+	}
+	completed := len(c.latencies)
+	arrivals := c.arrivals
+	defer func() {
+		c.windowStart, c.arrivals, c.errors, c.latencies = now, 0, 0, c.latencies[:0]
+		c.report()
+	}()
+
+	// nothing completed, responses of slow requests will be seen later
+	if completed == 0 {
+		return
+	}
+
+	sort.Slice(c.latencies, func(i, j int) bool { return c.latencies[i] < c.latencies[j] })
+	p95 := c.latencies[int(math.Ceil(float64(completed)*0.95))-1]
+	errorRate := float64(c.errors) / float64(completed)
+
+	c.state.LatencyP95 = float64(p95) / float64(time.Millisecond)
+	c.state.ErrorRate = errorRate
+	c.state.Healthy = p95 <= c.config.MaxLatency && errorRate <= c.config.MaxErrorRate
+
+	rate := c.rate
+	if !c.state.Healthy {
+		if rate == 0 {
+			rate = float64(completed) / elapsed.Seconds()
+		}
+		rate = math.Max(float64(c.config.MinRate), rate/2)
+	} else if rate > 0 {
+		rate += float64(c.config.Step)
+		if c.config.MaxRate > 0 {
+			rate = math.Min(rate, float64(c.config.MaxRate))
+		} else if rate >= 2*float64(arrivals)/elapsed.Seconds() {
+			// well above the incoming rate, the limit is not needed anymore
+			rate = 0
+		}
+	}
+
+	if rate != c.rate {
+		Debug(1, fmt.Sprintf("[HTTP-OUTPUT] %s: adaptive rate changed from %s to %s (latency p95: %v, error rate: %.3f)",
+			c.name, formatRate(c.rate), formatRate(rate), p95, errorRate))
+		c.setRate(rate, now)
+	}
+}
+
+func (c *adaptiveController) setRate(rate float64, now time.Time) {
+	c.rate = rate
+	if rate == 0 {
+		c.bucket = nil
+		return
+	}
+	burst := math.Max(1, rate)
+	tokens := burst
+	if c.bucket != nil {
+		c.bucket.refill(now)
+		tokens = math.Min(c.bucket.tokens, burst)
+	}
+	c.bucket = newTokenBucket(rate, burst, now)
+	c.bucket.tokens = tokens
+}
+
+func (c *adaptiveController) report() {
+	c.state.Rate = int(math.Round(c.rate))
+
+	rate := new(expvar.Int)
+	rate.Set(int64(c.state.Rate))
+	c.stats.Set("rate", rate)
+	p95 := new(expvar.Float)
+	p95.Set(c.state.LatencyP95)
+	c.stats.Set("latency_p95_ms", p95)
+	errorRate := new(expvar.Float)
+	errorRate.Set(c.state.ErrorRate)
+	c.stats.Set("error_rate", errorRate)
+	admitted := new(expvar.Int)
+	admitted.Set(c.state.Admitted)
+	c.stats.Set("admitted", admitted)
+	dropped := new(expvar.Int)
+	dropped.Set(c.state.Dropped)
+	c.stats.Set("dropped", dropped)
+}
+
+// State returns the current rate and health of the target
+func (c *adaptiveController) State() AdaptiveState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+func formatRate(rate float64) string {
+	if rate == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%.0f/s", rate)
+}
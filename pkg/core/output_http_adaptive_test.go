@@ -0,0 +1,142 @@
+package core
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func admitted(c *adaptiveController, n int) (count int) {
+	for i := 0; i < n; i++ {
+		if c.admit() {
+			count++
+		}
+	}
+	return
+}
+
+func TestAdaptiveControllerAIMD(t *testing.T) {
+	clock := &manualClock{now: time.Unix(0, 0)}
+	c := newAdaptiveController("test-aimd", AdaptiveConfig{MaxLatency: 100 * time.Millisecond, Step: 5}, clock)
+
+	if n := admitted(c, 100); n != 100 {
+		t.Fatal("Should not limit a healthy target", n)
+	}
+
+	// 40 requests completed in a second, but too slow
+	for i := 0; i < 40; i++ {
+		c.observe(200*time.Millisecond, 200, false)
+	}
+	clock.now = clock.now.Add(time.Second)
+	c.admit()
+
+	state := c.State()
+	if state.Healthy || state.Rate != 20 || state.LatencyP95 != 200 {
+		t.Fatalf("Should halve the observed rate, got %+v", state)
+	}
+
+	clock.now = clock.now.Add(time.Second)
+	if n := admitted(c, 100); n != 20 {
+		t.Error("Should admit requests at the lowered rate", n)
+	}
+	for i := 0; i < 20; i++ {
+		c.observe(10*time.Millisecond, 200, false)
+	}
+
+	clock.now = clock.now.Add(time.Second)
+	c.admit()
+	if state := c.State(); !state.Healthy || state.Rate != 25 {
+		t.Errorf("Should raise the rate by a step, got %+v", state)
+	}
+
+	// the incoming rate is low, so the limit is removed
+	c.observe(10*time.Millisecond, 200, false)
+	clock.now = clock.now.Add(time.Second)
+	c.admit()
+	if state := c.State(); state.Rate != 0 || state.Dropped != 80 {
+		t.Errorf("Should remove the limit, got %+v", state)
+	}
+}
+
+func TestAdaptiveControllerErrors(t *testing.T) {
+	clock := &manualClock{now: time.Unix(0, 0)}
+	c := newAdaptiveController("test-errors", AdaptiveConfig{MaxRate: 8, MinRate: 3, MaxErrorRate: 0.1}, clock)
+
+	if n := admitted(c, 20); n != 8 {
+		t.Error("Should start at the maximum rate", n)
+	}
+	for i := 0; i < 8; i++ {
+		c.observe(time.Millisecond, 200, i == 0) // a timeout
+	}
+	clock.now = clock.now.Add(time.Second)
+	c.admit()
+	if state := c.State(); state.Healthy || state.Rate != 4 || state.ErrorRate != 0.125 {
+		t.Errorf("Should halve the rate, got %+v", state)
+	}
+
+	for i := 0; i < 4; i++ {
+		c.observe(time.Millisecond, 503, false)
+	}
+	clock.now = clock.now.Add(time.Second)
+	c.admit()
+	if state := c.State(); state.Rate != 3 {
+		t.Errorf("Should not go below the minimum rate, got %+v", state)
+	}
+
+	for i := 0; i < 3; i++ {
+		c.observe(time.Millisecond, 404, false)
+	}
+	clock.now = clock.now.Add(time.Second)
+	c.admit()
+	if state := c.State(); !state.Healthy || state.Rate != 8 {
+		t.Errorf("Should not go above the maximum rate, got %+v", state)
+	}
+}
+
+func TestAdaptiveControllerSameName(t *testing.T) {
+	// outputs with the same address share stats, even when created at the same time
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			newAdaptiveController("test-same-name", AdaptiveConfig{MaxRate: 8}, RealClock{})
+		}()
+	}
+	wg.Wait()
+	if v := expvarMap("http-adaptive-test-same-name").Get("rate"); v == nil || v.String() != "8" {
+		t.Error("Should publish the rate", v)
+	}
+}
+
+func TestHTTPOutputAdaptive(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{
+		Timeout:  time.Second,
+		Adaptive: AdaptiveConfig{Enabled: true, Interval: 50 * time.Millisecond},
+	}).(*HTTPOutput)
+	defer output.Close()
+
+	input := NewTestInput()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		input.EmitGET()
+		msg, _ := input.PluginRead()
+		output.PluginWrite(msg)
+		time.Sleep(time.Millisecond)
+
+		if state, _ := output.AdaptiveState(); state.Dropped > 0 {
+			if state.Healthy || state.Rate == 0 || state.ErrorRate != 1 {
+				t.Errorf("Should report unhealthy target, got %+v", state)
+			}
+			return
+		}
+	}
+	t.Error("Should drop requests to an unhealthy target")
+}
@@ -53,7 +53,7 @@ func TestHTTPOutput(t *testing.T) {
 	plugins.All = append(plugins.All, input, output, httpOutput)
 
 	emitter := NewEmitter()
-	go emitter.Start(plugins, Settings.Middleware)
+	go emitter.Start(plugins, Settings.Middleware...)
 
 	for i := 0; i < 10; i++ {
 		// 2 http-output, 2 - test output request
@@ -95,7 +95,7 @@ func TestHTTPOutputKeepOriginalHost(t *testing.T) {
 	plugins.All = append(plugins.All, input, output)
 
 	emitter := NewEmitter()
-	go emitter.Start(plugins, Settings.Middleware)
+	go emitter.Start(plugins, Settings.Middleware...)
 
 	wg.Add(1)
 	input.EmitGET()
@@ -123,7 +123,7 @@ func TestHTTPOutputSSL(t *testing.T) {
 	plugins.All = append(plugins.All, input, output)
 
 	emitter := NewEmitter()
-	go emitter.Start(plugins, Settings.Middleware)
+	go emitter.Start(plugins, Settings.Middleware...)
 
 	wg.Add(2)
 
@@ -155,7 +155,7 @@ func TestHTTPOutputSessions(t *testing.T) {
 	}
 	plugins.All = append(plugins.All, input, output)
 	emitter := NewEmitter()
-	go emitter.Start(plugins, Settings.Middleware)
+	go emitter.Start(plugins, Settings.Middleware...)
 
 	uuid1 := []byte("1234567890123456789a0000")
 	uuid2 := []byte("1234567890123456789d0000")
@@ -198,7 +198,7 @@ func BenchmarkHTTPOutput(b *testing.B) {
 	plugins.All = append(plugins.All, input, output)
 
 	emitter := NewEmitter()
-	go emitter.Start(plugins, Settings.Middleware)
+	go emitter.Start(plugins, Settings.Middleware...)
 
 	for i := 0; i < b.N; i++ {
 		wg.Add(1)
@@ -227,7 +227,7 @@ func BenchmarkHTTPOutputTLS(b *testing.B) {
 	plugins.All = append(plugins.All, input, output)
 
 	emitter := NewEmitter()
-	go emitter.Start(plugins, Settings.Middleware)
+	go emitter.Start(plugins, Settings.Middleware...)
 
 	for i := 0; i < b.N; i++ {
 		wg.Add(1)
@@ -237,3 +237,22 @@ func BenchmarkHTTPOutputTLS(b *testing.B) {
 	wg.Wait()
 	emitter.Close()
 }
+
+func TestParseHTTPOutputURL(t *testing.T) {
+	for address, expected := range map[string]string{
+		"www.example.com|10":     "http://www.example.com",
+		"localhost:8080":         "http://localhost:8080",
+		"https://staging:443/v1": "https://staging:443/v1",
+		"[::1]:8080":             "http://[::1]:8080",
+	} {
+		path, _ := extractLimitOptions(address)
+		if u, err := parseHTTPOutputURL(path); err != nil || u.String() != expected {
+			t.Errorf("%q: expected %q, got %v %v", address, expected, u, err)
+		}
+	}
+	for _, address := range []string{"localhost:abc", "http://", ":8080", "ftp://staging", "http://staging:99999x"} {
+		if _, err := parseHTTPOutputURL(address); err == nil {
+			t.Errorf("Should reject %q", address)
+		}
+	}
+}
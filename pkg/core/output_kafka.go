@@ -88,6 +88,7 @@ func (o *KafkaOutput) PluginWrite(msg *Message) (n int, err error) {
 			ReqMethod:  byteutils.SliceToString(proto.Method(req)),
 			ReqBody:    byteutils.SliceToString(proto.Body(req)),
 			ReqHeaders: header,
+			ReqMeta:    protocol.MetaFields(meta),
 		}
 		jsonMessage, _ := json.Marshal(&kafkaMessage)
 		message = sarama.StringEncoder(byteutils.SliceToString(jsonMessage))
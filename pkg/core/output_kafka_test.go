@@ -1,6 +1,8 @@
 package core
 
 import (
+	"bytes"
+	"encoding/json"
 	"github.com/reoring/goreplay/pkg/kafka"
 	"testing"
 
@@ -53,3 +55,33 @@ func TestOutputKafkaJSON(t *testing.T) {
 		t.Error("Message not properly encoded: ", string(data))
 	}
 }
+
+func TestOutputKafkaJSONMeta(t *testing.T) {
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+	producer := mocks.NewAsyncProducer(t, config)
+	producer.ExpectInputAndSucceed()
+
+	output := NewKafkaOutput("", &kafka.OutputKafkaConfig{
+		Producer: producer,
+		Topic:    "test",
+		UseJSON:  true,
+	}, nil)
+
+	output.PluginWrite(&Message{Meta: []byte("1 2 3 -1 src=10.0.0.1:80 env=prod%20eu\n"), Data: []byte("GET / HTTP1.1\r\n\r\n")})
+
+	resp := <-producer.Successes()
+
+	data, _ := resp.Value.Encode()
+
+	if string(data) != `{"Req_URL":"","Req_Type":"1","Req_ID":"2","Req_Ts":"3","Req_Method":"GET","Req_Meta":{"env":"prod eu","src":"10.0.0.1:80"}}` {
+		t.Error("Message not properly encoded: ", string(data))
+	}
+
+	var message kafka.KafkaMessage
+	json.Unmarshal(data, &message)
+	dump, _ := message.Dump()
+	if !bytes.HasPrefix(dump, []byte("1 2 3 -1 env=prod%20eu src=10.0.0.1:80\n")) {
+		t.Errorf("Meta fields should be kept, got %q", dump)
+	}
+}
@@ -0,0 +1,387 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"expvar"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/reoring/goreplay/pkg/parquet"
+	"github.com/reoring/goreplay/pkg/protocol"
+	"github.com/reoring/goreplay/proto"
+	"github.com/reoring/goreplay/size"
+)
+
+// ParquetOutputConfig ...
+type ParquetOutputConfig struct {
+	Headers         MultiOption   `json:"output-parquet-header"`          // request headers stored as columns
+	ResponseHeaders MultiOption   `json:"output-parquet-response-header"` // response headers stored as columns
+	Bodies          bool          `json:"output-parquet-bodies"`
+	Compression     string        `json:"output-parquet-compression"` // snappy, gzip, zstd or none
+	SizeLimit       size.Size     `json:"output-parquet-size-limit"`
+	RowGroupSize    int           `json:"output-parquet-row-group-size"`
+	ResponseTimeout time.Duration `json:"output-parquet-response-timeout"`
+}
+
+// pending rows are written without waiting for their responses above this limit
+const parquetMaxPendingRows = 100000
+
+// row groups are written once their buffered values reach this size, even if they have fewer rows
+const parquetMaxRowGroupBytes = 64 << 20
+
+// columns of the parquet schema, followed by header and body columns
+const (
+	parquetID = iota
+	parquetTimestamp
+	parquetMethod
+	parquetHost
+	parquetPath
+	parquetQuery
+	parquetRequestSize
+	parquetStatus
+	parquetLatency
+	parquetResponseSize
+	parquetReplayedStatus
+	parquetReplayedLatency
+	parquetReplayedResponseSize
+)
+
+var parquetColumns = []parquet.Column{
+	{Name: "id", Type: parquet.String},
+	{Name: "timestamp", Type: parquet.Timestamp},
+	{Name: "method", Type: parquet.String, Optional: true},
+	{Name: "host", Type: parquet.String, Optional: true},
+	{Name: "path", Type: parquet.String, Optional: true},
+	{Name: "query", Type: parquet.String, Optional: true},
+	{Name: "request_size", Type: parquet.Int64, Optional: true},
+	{Name: "status", Type: parquet.Int32, Optional: true},
+	{Name: "latency_ns", Type: parquet.Int64, Optional: true},
+	{Name: "response_size", Type: parquet.Int64, Optional: true},
+	{Name: "replayed_status", Type: parquet.Int32, Optional: true},
+	{Name: "replayed_latency_ns", Type: parquet.Int64, Optional: true},
+	{Name: "replayed_response_size", Type: parquet.Int64, Optional: true},
+}
+
+// parquetRow is a request waiting for its responses
+type parquetRow struct {
+	id        string
+	timestamp int64
+	values    []interface{}
+}
+
+// ParquetOutput writes a row per request to parquet files, with fields of the request, its response and the
+// replayed response. Files are rolled when the name template changes, like %Y-%m-%d-%H, or by size.
+type ParquetOutput struct {
+	sync.Mutex
+	pathTemplate string
+	config       *ParquetOutputConfig
+	codec        parquet.Codec
+	columns      []parquet.Column
+	headers      int // index of the first request header column
+	bodies       int // index of the request body column
+
+	pending  map[string]*parquetRow
+	order    []*parquetRow // pending rows in order of arrival
+	latest   int64         // latest timestamp of messages
+	latestAt time.Time     // when the latest timestamp was seen
+
+	templateName string // current file name before the index
+	index        int
+	file         *os.File
+	buf          *bufio.Writer
+	writer       *parquet.Writer
+	groupStart   int64 // size of the file when the current row group started
+
+	stats  *expvar.Map
+	closed bool
+	done   chan struct{}
+}
+
+// NewParquetOutput constructor for ParquetOutput, accepts path
+func NewParquetOutput(pathTemplate string, config *ParquetOutputConfig) (*ParquetOutput, error) {
+	o, err := newParquetOutput(pathTemplate, config)
+	if err != nil {
+		return nil, err
+	}
+	go o.expireLoop()
+	return o, nil
+}
+
+func newParquetOutput(pathTemplate string, config *ParquetOutputConfig) (*ParquetOutput, error) {
+	codec, err := parquet.ParseCodec(config.Compression)
+	if err != nil {
+		return nil, err
+	}
+	if config.RowGroupSize <= 0 {
+		config.RowGroupSize = 10000
+	}
+	if config.ResponseTimeout <= 0 {
+		config.ResponseTimeout = 5 * time.Second
+	}
+
+	o := &ParquetOutput{pathTemplate: pathTemplate, config: config, codec: codec, pending: make(map[string]*parquetRow), done: make(chan struct{})}
+	o.columns = append(o.columns, parquetColumns...)
+	o.headers = len(o.columns)
+	names := make(map[string]bool)
+	for _, c := range o.columns {
+		names[c.Name] = true
+	}
+	for _, h := range config.Headers {
+		o.columns = append(o.columns, parquet.Column{Name: parquetColumnName("request_header_", h), Type: parquet.String, Optional: true})
+	}
+	for _, h := range config.ResponseHeaders {
+		o.columns = append(o.columns, parquet.Column{Name: parquetColumnName("response_header_", h), Type: parquet.String, Optional: true})
+	}
+	o.bodies = len(o.columns)
+	if config.Bodies {
+		o.columns = append(o.columns,
+			parquet.Column{Name: "request_body", Type: parquet.Bytes, Optional: true},
+			parquet.Column{Name: "response_body", Type: parquet.Bytes, Optional: true},
+		)
+	}
+	for _, c := range o.columns[o.headers:] {
+		if names[c.Name] {
+			return nil, fmt.Errorf("duplicate column %s", c.Name)
+		}
+		names[c.Name] = true
+	}
+
+	o.stats = expvarMap("output_parquet")
+	return o, nil
+}
+
+// parquetColumnName returns the column name of a header: lower case, with anything but letters and digits
+// replaced by _
+func parquetColumnName(prefix, header string) string {
+	name := []byte(strings.ToLower(header))
+	for i, c := range name {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') {
+			name[i] = '_'
+		}
+	}
+	return prefix + string(name)
+}
+
+// PluginWrite adds the message to the row of its request
+func (o *ParquetOutput) PluginWrite(msg *Message) (int, error) {
+	meta := protocol.PayloadMeta(msg.Meta)
+	if len(meta) < 3 || len(meta[0]) != 1 {
+		return 0, nil
+	}
+	timestamp, _ := strconv.ParseInt(string(meta[2]), 10, 64)
+
+	o.Lock()
+	defer o.Unlock()
+	if o.closed {
+		return 0, ErrorStopped
+	}
+
+	id := string(meta[1])
+	row, ok := o.pending[id]
+	if !ok {
+		row = &parquetRow{id: id, timestamp: timestamp, values: make([]interface{}, len(o.columns))}
+		o.pending[id] = row
+		o.order = append(o.order, row)
+	}
+	if timestamp > o.latest {
+		o.latest = timestamp
+		o.latestAt = time.Now()
+	}
+
+	switch meta[0][0] {
+	case protocol.RequestPayload:
+		row.timestamp = timestamp
+		o.setRequest(row.values, msg.Data)
+	case protocol.ResponsePayload:
+		o.setResponse(row.values, meta, msg.Data, parquetStatus)
+	case protocol.ReplayedResponsePayload:
+		o.setResponse(row.values, meta, msg.Data, parquetReplayedStatus)
+	}
+
+	if err := o.expire(false); err != nil {
+		return 0, err
+	}
+	return len(msg.Data), nil
+}
+
+func (o *ParquetOutput) setRequest(values []interface{}, data []byte) {
+	values[parquetMethod] = string(proto.Method(data))
+	if host := proto.Header(data, []byte("Host")); len(host) > 0 {
+		values[parquetHost] = string(host)
+	}
+	path := proto.Path(data)
+	if i := bytes.IndexByte(path, '?'); i >= 0 {
+		values[parquetQuery] = string(path[i+1:])
+		path = path[:i]
+	}
+	values[parquetPath] = string(path)
+	values[parquetRequestSize] = int64(len(data))
+
+	for i, h := range o.config.Headers {
+		if v := proto.Header(data, []byte(h)); v != nil {
+			values[o.headers+i] = string(v)
+		}
+	}
+	if o.config.Bodies {
+		values[o.bodies] = append([]byte{}, proto.Body(data)...)
+	}
+}
+
+// setResponse sets the status, latency and size of the response or of the replayed response
+func (o *ParquetOutput) setResponse(values []interface{}, meta [][]byte, data []byte, status int) {
+	if s, err := strconv.Atoi(string(proto.Status(data))); err == nil {
+		values[status] = int32(s)
+	}
+	if len(meta) > 3 {
+		if latency, err := strconv.ParseInt(string(meta[3]), 10, 64); err == nil && latency >= 0 {
+			values[status+1] = latency
+		}
+	}
+	values[status+2] = int64(len(data))
+
+	// response headers and bodies are the ones of the original response
+	if status != parquetStatus {
+		return
+	}
+	for i, h := range o.config.ResponseHeaders {
+		if v := proto.Header(data, []byte(h)); v != nil {
+			values[o.headers+len(o.config.Headers)+i] = string(v)
+		}
+	}
+	if o.config.Bodies {
+		values[o.bodies+1] = append([]byte{}, proto.Body(data)...)
+	}
+}
+
+// expire writes rows which didn't get their responses within the timeout, in the time of messages, so
+// converting recorded files works the same way as capturing. If all is set, all pending rows are written.
+func (o *ParquetOutput) expire(all bool) error {
+	now := o.latest + int64(time.Since(o.latestAt))
+	for len(o.order) > 0 {
+		row := o.order[0]
+		if !all && row.timestamp > now-int64(o.config.ResponseTimeout) && len(o.pending) <= parquetMaxPendingRows {
+			break
+		}
+		o.order[0] = nil
+		o.order = o.order[1:]
+		delete(o.pending, row.id)
+		if err := o.writeRow(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *ParquetOutput) expireLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-o.done:
+			return
+		case <-ticker.C:
+			o.Lock()
+			if err := o.expire(false); err != nil {
+				Debug(0, fmt.Sprintf("[OUTPUT-PARQUET] error writing %q: %v", o.pathTemplate, err))
+			}
+			o.Unlock()
+		}
+	}
+}
+
+func (o *ParquetOutput) writeRow(row *parquetRow) error {
+	row.values[parquetID] = row.id
+	row.values[parquetTimestamp] = time.Unix(0, row.timestamp).UTC()
+
+	name := o.pathTemplate
+	for pattern, fn := range dateFileNameFuncs {
+		name = strings.Replace(name, pattern, fn(&FileOutput{}), -1)
+	}
+	if o.writer != nil && (name != o.templateName || (o.config.SizeLimit > 0 && o.writer.Size() >= int64(o.config.SizeLimit))) {
+		if err := o.closeFile(); err != nil {
+			return err
+		}
+	}
+	if o.writer == nil {
+		if err := o.openFile(name); err != nil {
+			return err
+		}
+	}
+
+	if err := o.writer.Write(row.values); err != nil {
+		return err
+	}
+	o.stats.Add("rows", 1)
+	if o.writer.Buffered() >= int64(o.config.RowGroupSize) || o.writer.Size()-o.groupStart >= parquetMaxRowGroupBytes {
+		err := o.writer.Flush()
+		o.groupStart = o.writer.Size()
+		return err
+	}
+	return nil
+}
+
+// openFile creates the next file of the template, files are numbered by their index: requests_0.parquet,
+// requests_1.parquet and so on
+func (o *ParquetOutput) openFile(name string) error {
+	if name != o.templateName {
+		o.templateName = name
+		o.index = 0
+	}
+	for {
+		path := setFileIndex(name, o.index)
+		o.index++
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+
+		var err error
+		if o.file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0660); err != nil {
+			return err
+		}
+		o.buf = bufio.NewWriter(o.file)
+		o.writer, err = parquet.NewWriter(o.buf, o.columns, o.codec)
+		o.groupStart = o.writer.Size()
+		o.stats.Add("files", 1)
+		return err
+	}
+}
+
+func (o *ParquetOutput) closeFile() error {
+	if o.writer == nil {
+		return nil
+	}
+	err := o.writer.Close()
+	if err == nil {
+		err = o.buf.Flush()
+	}
+	if cerr := o.file.Close(); err == nil {
+		err = cerr
+	}
+	o.writer = nil
+	return err
+}
+
+func (o *ParquetOutput) String() string {
+	return "Parquet output: " + o.pathTemplate
+}
+
+// Close writes pending rows and the footer of the current file
+func (o *ParquetOutput) Close() error {
+	o.Lock()
+	defer o.Unlock()
+	if o.closed {
+		return nil
+	}
+	o.closed = true
+	close(o.done)
+	err := o.expire(true)
+	if cerr := o.closeFile(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,215 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/reoring/goreplay/pkg/parquet"
+)
+
+func readParquetFile(t *testing.T, path string) *parquet.File {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := parquet.Read(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	return f
+}
+
+func parquetRowMap(f *parquet.File, row []interface{}) map[string]interface{} {
+	m := make(map[string]interface{})
+	for i, c := range f.Columns {
+		if row[i] != nil {
+			m[c.Name] = row[i]
+		}
+	}
+	return m
+}
+
+func TestParquetOutput(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor-parquet")
+	defer os.RemoveAll(dir)
+
+	config := &ParquetOutputConfig{Headers: MultiOption{"User-Agent"}, ResponseHeaders: MultiOption{"Content-Type"}, Bodies: true, Compression: "zstd"}
+	output, err := newParquetOutput(filepath.Join(dir, "requests.parquet"), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []*Message{
+		{Meta: []byte("1 a1 1000000000 0\n"), Data: []byte("POST /orders?id=1 HTTP/1.1\r\nHost: example.com\r\nUser-Agent: curl\r\nContent-Length: 2\r\n\r\n{}")},
+		{Meta: []byte("1 b2 2000000000 0\n"), Data: []byte("GET / HTTP/1.1\r\n\r\n")},
+		{Meta: []byte("2 a1 1000000100 3000\n"), Data: []byte("HTTP/1.1 201 Created\r\nContent-Type: application/json\r\n\r\n{\"id\":1}")},
+		{Meta: []byte("3 a1 1000000200 5000\n"), Data: []byte("HTTP/1.1 500 Internal Server Error\r\n\r\n")},
+		// the response timeout is reached in the time of messages
+		{Meta: []byte("1 c3 9000000000 0\n"), Data: []byte("GET /late HTTP/1.1\r\n\r\n")},
+		{Meta: []byte("2 a1 9000000001 7000\n"), Data: []byte("HTTP/1.1 200 OK\r\n\r\n")},
+	} {
+		if _, err := output.PluginWrite(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(output.pending) != 2 {
+		t.Errorf("Rows should be written after the response timeout, %d are pending", len(output.pending))
+	}
+	if err := output.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f := readParquetFile(t, filepath.Join(dir, "requests_0.parquet"))
+	if len(f.Rows) != 4 {
+		t.Fatalf("Expected 4 rows, got %d", len(f.Rows))
+	}
+	expected := map[string]interface{}{
+		"id":                           "a1",
+		"timestamp":                    time.Unix(1, 0).UTC(),
+		"method":                       "POST",
+		"host":                         "example.com",
+		"path":                         "/orders",
+		"query":                        "id=1",
+		"request_size":                 int64(88),
+		"status":                       int32(201),
+		"latency_ns":                   int64(3000),
+		"response_size":                int64(64),
+		"replayed_status":              int32(500),
+		"replayed_latency_ns":          int64(5000),
+		"replayed_response_size":       int64(38),
+		"request_header_user_agent":    "curl",
+		"response_header_content_type": "application/json",
+		"request_body":                 []byte("{}"),
+		"response_body":                []byte(`{"id":1}`),
+	}
+	if row := parquetRowMap(f, f.Rows[0]); !reflect.DeepEqual(row, expected) {
+		t.Errorf("Expected %v, got %v", expected, row)
+	}
+	if row := parquetRowMap(f, f.Rows[1]); row["id"] != "b2" || row["path"] != "/" || row["host"] != nil || row["status"] != nil {
+		t.Errorf("Request without response should have empty response fields, got %v", row)
+	}
+	// a response after the timeout gets a row of its own
+	if row := parquetRowMap(f, f.Rows[3]); row["id"] != "a1" || row["status"] != int32(200) || row["method"] != nil {
+		t.Errorf("Late response should have a row without request fields, got %v", row)
+	}
+
+	if _, err := newParquetOutput("requests.parquet", &ParquetOutputConfig{Headers: MultiOption{"X-A", "x_a"}}); err == nil {
+		t.Error("Should detect duplicate columns")
+	}
+	if _, err := newParquetOutput("requests.parquet", &ParquetOutputConfig{Compression: "lzo"}); err == nil {
+		t.Error("Should detect unknown compression")
+	}
+	if _, err := ParseSettings([]string{"--output-parquet", "requests.parquet", "--output-parquet-compression", "lzo"}); err == nil {
+		t.Error("Settings check should detect unknown compression")
+	}
+}
+
+func TestParquetOutputSizeLimit(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor-parquet")
+	defer os.RemoveAll(dir)
+
+	output, _ := newParquetOutput(filepath.Join(dir, "requests.parquet"), &ParquetOutputConfig{SizeLimit: 2000, RowGroupSize: 10, Compression: "none"})
+	for i := 0; i < 100; i++ {
+		msg := &Message{Meta: []byte("1 " + string(rune('a'+i%26)) + string(rune('a'+i/26)) + " 1000000000 0\n"), Data: []byte("GET /some/long/path/to/fill/files HTTP/1.1\r\n\r\n")}
+		output.PluginWrite(msg)
+	}
+	output.Close()
+
+	matches, _ := filepath.Glob(filepath.Join(dir, "requests_*.parquet"))
+	if len(matches) < 2 {
+		t.Fatalf("Files should be rolled by size, got %v", matches)
+	}
+	rows := 0
+	for _, path := range matches {
+		rows += len(readParquetFile(t, path).Rows)
+	}
+	if rows != 100 {
+		t.Errorf("Expected 100 rows, got %d", rows)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor-convert")
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "requests.gor")
+	writeV2File(t, input, v2Messages())
+
+	jsonl := filepath.Join(dir, "requests.jsonl")
+	if n, err := Convert([]string{input}, jsonl, "jsonl", false); err != nil || n != len(v2Messages()) {
+		t.Fatal(n, err)
+	}
+	msgs, _ := readFileMessages(t, jsonl)
+	if len(msgs) != len(v2Messages()) {
+		t.Errorf("Expected %d messages, got %d", len(v2Messages()), len(msgs))
+	}
+
+	if n, err := Convert([]string{jsonl}, filepath.Join(dir, "requests.parquet"), "parquet", false); err != nil || n != len(v2Messages()) {
+		t.Fatal(n, err)
+	}
+	if f := readParquetFile(t, filepath.Join(dir, "requests_0.parquet")); len(f.Rows) == 0 {
+		t.Error("Should write rows")
+	}
+
+	if _, err := Convert([]string{input}, filepath.Join(dir, "out"), "csv", false); err == nil {
+		t.Error("Should reject unknown formats")
+	}
+	if _, err := Convert([]string{filepath.Join(dir, "missing_*.gor")}, filepath.Join(dir, "out.jsonl"), "jsonl", false); err == nil {
+		t.Error("Should fail on patterns without files")
+	}
+	data, _ := ioutil.ReadFile(input)
+	truncated := filepath.Join(dir, "truncated.gor")
+	ioutil.WriteFile(truncated, data[:len(data)-3], 0644)
+	if _, err := Convert([]string{truncated}, filepath.Join(dir, "truncated.jsonl"), "jsonl", false); !errors.Is(err, errTruncatedFile) {
+		t.Error("Should fail on truncated files", err)
+	}
+}
+
+func TestConvertEncrypted(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor-convert")
+	defer os.RemoveAll(dir)
+
+	os.Setenv("GOR_TEST_CONVERT_KEY", strings.Repeat("ab", 32))
+	defer os.Unsetenv("GOR_TEST_CONVERT_KEY")
+	keys := Settings.FileEncryptionKeys
+	Settings.FileEncryptionKeys = MultiOption{"env:GOR_TEST_CONVERT_KEY"}
+	defer func() { Settings.FileEncryptionKeys = keys }()
+
+	e, err := NewFileEncryption(Settings.FileEncryptionKeys, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := filepath.Join(dir, "requests.gor")
+	output := newTestFileOutput(t, input, &FileOutputConfig{Format: "v2", Append: true, FlushInterval: time.Minute, Encryption: e})
+	for _, msg := range v2Messages() {
+		output.PluginWrite(msg)
+	}
+	output.Close()
+
+	for _, encrypt := range []bool{false, true} {
+		path := filepath.Join(dir, fmt.Sprintf("requests_%v.jsonl", encrypt))
+		if n, err := Convert([]string{input}, path, "jsonl", encrypt); err != nil || n != len(v2Messages()) {
+			t.Fatal(n, err)
+		}
+		f, _ := os.Open(path)
+		encrypted := isEncrypted(bufio.NewReader(f))
+		f.Close()
+		if encrypted != encrypt {
+			t.Errorf("Output should be encrypted only with encrypt, got %v", encrypted)
+		}
+	}
+	if n, err := Convert([]string{input}, filepath.Join(dir, "requests.parquet"), "parquet", false); err != nil || n != len(v2Messages()) {
+		t.Error("Should decrypt files converted to parquet", n, err)
+	}
+	if _, err := Convert([]string{input}, filepath.Join(dir, "encrypted.parquet"), "parquet", true); err == nil {
+		t.Error("Parquet files can't be encrypted")
+	}
+}
@@ -0,0 +1,375 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Policies of output queues, applied when the queue is full
+const (
+	QueuePolicyBlock      = "block"
+	QueuePolicyDropNewest = "drop-newest"
+	QueuePolicyDropOldest = "drop-oldest"
+	QueuePolicySpill      = "spill"
+)
+
+// OutputQueueConfig holds configuration of per-output queues
+type OutputQueueConfig struct {
+	Size     int                 `json:"output-queue-size"`
+	Policies OutputQueuePolicies `json:"output-queue-policy"`
+	SpillDir string              `json:"output-queue-spill-dir"`
+}
+
+// OutputQueuePolicies holds queue policy for each output address, empty address is the default one
+type OutputQueuePolicies map[string]string
+
+func (p *OutputQueuePolicies) String() string {
+	return fmt.Sprint(*p)
+}
+
+// Set method to implement flags.Value, value is either `policy` or `address=policy`
+func (p *OutputQueuePolicies) Set(value string) error {
+	var address, policy string
+	if i := strings.LastIndex(value, "="); i != -1 {
+		address, policy = strings.TrimSpace(value[:i]), strings.TrimSpace(value[i+1:])
+	} else {
+		policy = strings.TrimSpace(value)
+	}
+
+	switch policy {
+	case QueuePolicyBlock, QueuePolicyDropNewest, QueuePolicyDropOldest, QueuePolicySpill:
+	default:
+		return fmt.Errorf("unknown queue policy %q, expected one of: block, drop-newest, drop-oldest, spill", policy)
+	}
+
+	if *p == nil {
+		*p = make(OutputQueuePolicies)
+	}
+	(*p)[address] = policy
+	return nil
+}
+
+// policy returns queue policy of the output
+func (p OutputQueuePolicies) policy(address string) string {
+	if policy, ok := p[address]; ok {
+		return policy
+	}
+	if policy, ok := p[""]; ok {
+		return policy
+	}
+	return QueuePolicyBlock
+}
+
+// OutputQueueStats holds counters of an output queue
+type OutputQueueStats struct {
+	Written int64 `json:"written"`
+	Dropped int64 `json:"dropped"`
+	Spilled int64 `json:"spilled"`
+	Errors  int64 `json:"errors"`
+}
+
+// OutputQueue writes to the output from its own goroutine, so a slow output does not stall the others
+type OutputQueue struct {
+	stats   OutputQueueStats // keep first, accessed atomically
+	pending int64            // queued, spilled and in-flight messages
+
+	name   string
+	policy string
+	output PluginWriter
+	queue  chan *Message
+
+	mu    sync.Mutex // serializes producers for drop-oldest and spill policies
+	spill *spillFile
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewOutputQueue wraps the output with a bounded queue
+func NewOutputQueue(output PluginWriter, name string, config *OutputQueueConfig) *OutputQueue {
+	q := &OutputQueue{
+		name:   name,
+		policy: config.Policies.policy(name),
+		output: output,
+		queue:  make(chan *Message, config.Size),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	if q.policy == QueuePolicySpill {
+		spill, err := newSpillFile(config.SpillDir)
+		if err != nil {
+			Debug(1, fmt.Sprintf("[OUTPUT-QUEUE] %s: can't create spill file, dropping newest messages instead: %q", q, err))
+			q.policy = QueuePolicyDropNewest
+		} else {
+			q.spill = spill
+		}
+	}
+
+	q.publishStats()
+	go q.run()
+
+	return q
+}
+
+// PluginWrite enqueues the message, applying the queue policy if the queue is full
+func (q *OutputQueue) PluginWrite(msg *Message) (int, error) {
+	select {
+	case <-q.stop:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+
+	switch q.policy {
+	case QueuePolicyDropNewest:
+		select {
+		case q.queue <- msg:
+			atomic.AddInt64(&q.pending, 1)
+		default:
+			atomic.AddInt64(&q.stats.Dropped, 1)
+		}
+	case QueuePolicyDropOldest:
+		q.mu.Lock()
+		for enqueued := false; !enqueued; {
+			select {
+			case q.queue <- msg:
+				atomic.AddInt64(&q.pending, 1)
+				enqueued = true
+			default:
+				select {
+				case <-q.queue:
+					atomic.AddInt64(&q.pending, -1)
+					atomic.AddInt64(&q.stats.Dropped, 1)
+				default:
+				}
+			}
+		}
+		q.mu.Unlock()
+	case QueuePolicySpill:
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		// Once spilling started, messages go to disk until it's drained to keep them ordered
+		if q.spill.pending == 0 {
+			select {
+			case q.queue <- msg:
+				atomic.AddInt64(&q.pending, 1)
+				return len(msg.Data) + len(msg.Meta), nil
+			default:
+			}
+		}
+		if err := q.spill.push(msg); err != nil {
+			Debug(2, fmt.Sprintf("[OUTPUT-QUEUE] %s: can't spill message: %q", q, err))
+			atomic.AddInt64(&q.stats.Dropped, 1)
+		} else {
+			atomic.AddInt64(&q.pending, 1)
+			atomic.AddInt64(&q.stats.Spilled, 1)
+		}
+	default:
+		atomic.AddInt64(&q.pending, 1)
+		select {
+		case q.queue <- msg:
+		case <-q.stop:
+			atomic.AddInt64(&q.pending, -1)
+			return 0, io.ErrClosedPipe
+		}
+	}
+
+	return len(msg.Data) + len(msg.Meta), nil
+}
+
+func (q *OutputQueue) run() {
+	defer close(q.done)
+
+	for {
+		select {
+		case <-q.stop:
+			return
+		case msg := <-q.queue:
+			q.write(msg)
+			continue
+		default:
+		}
+
+		if q.spill != nil {
+			if msg := q.unspill(); msg != nil {
+				q.write(msg)
+				continue
+			}
+		}
+
+		select {
+		case <-q.stop:
+			return
+		case msg := <-q.queue:
+			q.write(msg)
+		}
+	}
+}
+
+func (q *OutputQueue) unspill() *Message {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	pending := q.spill.pending
+	msg, err := q.spill.pop()
+	if err != nil {
+		Debug(2, fmt.Sprintf("[OUTPUT-QUEUE] %s: can't read spilled message: %q", q, err))
+		// the rest of the spill file is lost
+		atomic.AddInt64(&q.pending, -int64(pending))
+		atomic.AddInt64(&q.stats.Dropped, int64(pending))
+	}
+	return msg
+}
+
+func (q *OutputQueue) write(msg *Message) {
+	defer atomic.AddInt64(&q.pending, -1)
+
+	if _, err := q.output.PluginWrite(msg); err != nil {
+		atomic.AddInt64(&q.stats.Errors, 1)
+		if err != io.ErrClosedPipe {
+			Debug(2, fmt.Sprintf("[OUTPUT-QUEUE] %s: write error: %q", q, err))
+		}
+		return
+	}
+	atomic.AddInt64(&q.stats.Written, 1)
+}
+
+// Len returns number of messages waiting in the queue, including spilled ones
+func (q *OutputQueue) Len() int {
+	n := len(q.queue)
+	if q.spill != nil {
+		q.mu.Lock()
+		n += q.spill.pending
+		q.mu.Unlock()
+	}
+	return n
+}
+
+// Stats returns a snapshot of the queue counters
+func (q *OutputQueue) Stats() OutputQueueStats {
+	return OutputQueueStats{
+		Written: atomic.LoadInt64(&q.stats.Written),
+		Dropped: atomic.LoadInt64(&q.stats.Dropped),
+		Spilled: atomic.LoadInt64(&q.stats.Spilled),
+		Errors:  atomic.LoadInt64(&q.stats.Errors),
+	}
+}
+
+// publishStats exposes queue counters at /debug/vars
+func (q *OutputQueue) publishStats() {
+	stats := expvarMap("output-queue-" + q.String())
+	stats.Set("written", expvar.Func(func() interface{} { return atomic.LoadInt64(&q.stats.Written) }))
+	stats.Set("dropped", expvar.Func(func() interface{} { return atomic.LoadInt64(&q.stats.Dropped) }))
+	stats.Set("spilled", expvar.Func(func() interface{} { return atomic.LoadInt64(&q.stats.Spilled) }))
+	stats.Set("errors", expvar.Func(func() interface{} { return atomic.LoadInt64(&q.stats.Errors) }))
+	stats.Set("queue_len", expvar.Func(func() interface{} { return q.Len() }))
+}
+
+// Drain waits until queued messages are written to the output, and the output drains its own buffers
+func (q *OutputQueue) Drain(ctx context.Context) int {
+	left := drainPending(ctx, func() int { return int(atomic.LoadInt64(&q.pending)) })
+	if d, ok := q.output.(PluginDrainer); ok {
+		left += d.Drain(ctx)
+	}
+	return left
+}
+
+// Close stops the queue, messages still in the queue are discarded. The wrapped output is not closed.
+func (q *OutputQueue) Close() error {
+	q.closeOnce.Do(func() {
+		close(q.stop)
+		<-q.done
+		if q.spill != nil {
+			q.mu.Lock()
+			q.spill.close()
+			q.mu.Unlock()
+		}
+	})
+	return nil
+}
+
+func (q *OutputQueue) String() string {
+	if q.name != "" {
+		return q.name
+	}
+	return fmt.Sprint(q.output)
+}
+
+// spillFile stores messages which do not fit into the queue, using middleware binary framing
+type spillFile struct {
+	writer  *os.File
+	reader  *os.File
+	buf     *bufio.Reader
+	frame   []byte
+	pending int
+}
+
+func newSpillFile(dir string) (*spillFile, error) {
+	writer, err := ioutil.TempFile(dir, "gor-spill-")
+	if err != nil {
+		return nil, err
+	}
+	reader, err := os.Open(writer.Name())
+	if err != nil {
+		writer.Close()
+		os.Remove(writer.Name())
+		return nil, err
+	}
+	return &spillFile{writer: writer, reader: reader, buf: bufio.NewReader(reader)}, nil
+}
+
+func (s *spillFile) push(msg *Message) error {
+	s.frame = encodeBinaryFrame(s.frame, msg.Meta, msg.Data)
+	if _, err := s.writer.Write(s.frame); err != nil {
+		return err
+	}
+	s.pending++
+	return nil
+}
+
+// pop returns the oldest spilled message, or nil if there are none
+func (s *spillFile) pop() (*Message, error) {
+	if s.pending == 0 {
+		return nil, nil
+	}
+	s.pending--
+	msg, err := readBinaryFrame(s.buf)
+
+	if s.pending == 0 || err != nil {
+		// Everything was read, start over to keep the file small
+		s.pending = 0
+		if terr := s.reset(); terr != nil && err == nil {
+			err = terr
+		}
+	}
+	return msg, err
+}
+
+func (s *spillFile) reset() error {
+	if err := s.writer.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := s.writer.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := s.reader.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	s.buf.Reset(s.reader)
+	return nil
+}
+
+func (s *spillFile) close() {
+	s.reader.Close()
+	s.writer.Close()
+	os.Remove(s.writer.Name())
+}
@@ -0,0 +1,176 @@
+package core
+
+import (
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/reoring/goreplay/pkg/protocol"
+)
+
+// blockingOutput records messages, each write waits until the gate is opened
+type blockingOutput struct {
+	gate chan struct{}
+
+	mu       sync.Mutex
+	received []string
+}
+
+func newBlockingOutput() *blockingOutput {
+	return &blockingOutput{gate: make(chan struct{})}
+}
+
+func (o *blockingOutput) PluginWrite(msg *Message) (int, error) {
+	<-o.gate
+	o.mu.Lock()
+	o.received = append(o.received, string(msg.Data))
+	o.mu.Unlock()
+	return len(msg.Data), nil
+}
+
+func (o *blockingOutput) messages(n int, t *testing.T) []string {
+	for i := 0; i < 100; i++ {
+		o.mu.Lock()
+		if len(o.received) >= n {
+			defer o.mu.Unlock()
+			return o.received
+		}
+		o.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected %d messages, got %v", n, o.received)
+	return nil
+}
+
+func queueMessage(i int) *Message {
+	return &Message{
+		Meta: protocol.PayloadHeader(protocol.RequestPayload, protocol.Uuid(), time.Now().UnixNano(), -1),
+		Data: []byte(strconv.Itoa(i)),
+	}
+}
+
+func testOutputQueue(t *testing.T, policy string, expected []string) *OutputQueue {
+	out := newBlockingOutput()
+	config := &OutputQueueConfig{Size: 2}
+	config.Policies.Set("test=" + policy)
+
+	q := NewOutputQueue(out, "test", config)
+
+	// first message is taken by the worker and blocks on the gate, the next ones fill the queue
+	q.PluginWrite(queueMessage(0))
+	time.Sleep(20 * time.Millisecond)
+	for i := 1; i <= 4; i++ {
+		q.PluginWrite(queueMessage(i))
+	}
+	close(out.gate)
+
+	received := out.messages(len(expected), t)
+	if len(received) != len(expected) {
+		t.Fatalf("%s: expected %v, got %v", policy, expected, received)
+	}
+	for i := range expected {
+		if received[i] != expected[i] {
+			t.Fatalf("%s: expected %v, got %v", policy, expected, received)
+		}
+	}
+	return q
+}
+
+func TestOutputQueueDropNewest(t *testing.T) {
+	q := testOutputQueue(t, QueuePolicyDropNewest, []string{"0", "1", "2"})
+	defer q.Close()
+	if stats := q.Stats(); stats.Dropped != 2 {
+		t.Errorf("Expected 2 dropped messages, got %d", stats.Dropped)
+	}
+}
+
+func TestOutputQueueDropOldest(t *testing.T) {
+	q := testOutputQueue(t, QueuePolicyDropOldest, []string{"0", "3", "4"})
+	defer q.Close()
+	if stats := q.Stats(); stats.Dropped != 2 {
+		t.Errorf("Expected 2 dropped messages, got %d", stats.Dropped)
+	}
+}
+
+func TestOutputQueueSpill(t *testing.T) {
+	q := testOutputQueue(t, QueuePolicySpill, []string{"0", "1", "2", "3", "4"})
+	if stats := q.Stats(); stats.Spilled != 2 || stats.Dropped != 0 {
+		t.Errorf("Expected 2 spilled messages, got %+v", stats)
+	}
+
+	// spill file is reused once drained
+	q.PluginWrite(queueMessage(5))
+	if fi, err := q.spill.writer.Stat(); err != nil || fi.Size() != 0 {
+		t.Error("Spill file should be truncated", err)
+	}
+
+	name := q.spill.writer.Name()
+	q.Close()
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Error("Spill file should be removed")
+	}
+}
+
+func TestOutputQueueBlock(t *testing.T) {
+	out := newBlockingOutput()
+	q := NewOutputQueue(out, "", &OutputQueueConfig{Size: 1})
+
+	written := make(chan struct{})
+	go func() {
+		for i := 0; i < 3; i++ {
+			q.PluginWrite(queueMessage(i))
+		}
+		close(written)
+	}()
+
+	select {
+	case <-written:
+		t.Fatal("Writes should block when the queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(out.gate)
+	<-written
+	out.messages(3, t)
+	q.Close()
+
+	if _, err := q.PluginWrite(queueMessage(4)); err == nil {
+		t.Error("Closed queue should reject writes")
+	}
+}
+
+func TestEmitterSlowOutput(t *testing.T) {
+	wg := new(sync.WaitGroup)
+
+	input := NewTestInput()
+	slow := newBlockingOutput()
+	fast := NewTestOutput(func(*Message) {
+		wg.Done()
+	})
+
+	plugins := &InOutPlugins{
+		Inputs:      []PluginReader{input},
+		Outputs:     []PluginWriter{slow, fast},
+		OutputNames: map[PluginWriter]string{slow: "slow", fast: "fast"},
+	}
+	plugins.All = append(plugins.All, input, fast)
+
+	Settings.OutputQueueConfig = OutputQueueConfig{Size: 10}
+	Settings.OutputQueueConfig.Policies.Set("slow=drop-newest")
+
+	emitter := NewEmitter()
+	go emitter.Start(plugins, Settings.Middleware...)
+
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		input.EmitGET()
+	}
+
+	// fast output gets everything while the slow one is stuck
+	wg.Wait()
+	close(slow.gate)
+	emitter.Close()
+
+	Settings.OutputQueueConfig = OutputQueueConfig{}
+}
@@ -28,10 +28,10 @@ type S3Output struct {
 }
 
 // NewS3Output constructor for FileOutput, accepts path
-func NewS3Output(pathTemplate string, config *FileOutputConfig) *S3Output {
+func NewS3Output(pathTemplate string, config *FileOutputConfig) (*S3Output, error) {
 	if !pro.PRO {
 		log.Fatal("Using S3 output and input requires PRO license")
-		return nil
+		return nil, nil
 	}
 
 	o := new(S3Output)
@@ -49,16 +49,19 @@ func NewS3Output(pathTemplate string, config *FileOutputConfig) *S3Output {
 	pathParts := strings.Split(pathTemplate, "/")
 	bufferName += pathParts[len(pathParts)-1]
 
-	if strings.HasSuffix(o.pathTemplate, ".gz") {
-		bufferName += ".gz"
+	if c := compressionByExtension(o.pathTemplate); c != nil {
+		bufferName += c.extension
 	}
 
 	bufferPath := filepath.Join(config.BufferPath, bufferName)
 
-	o.buffer = NewFileOutput(bufferPath, config)
+	var err error
+	if o.buffer, err = NewFileOutput(bufferPath, config); err != nil {
+		return nil, err
+	}
 	o.connect()
 
-	return o
+	return o, nil
 }
 
 func (o *S3Output) connect() {
@@ -115,6 +118,7 @@ func (o *S3Output) onBufferUpdate(path string) {
 		return
 	}
 	defer os.Remove(path)
+	defer os.Remove(path + timeIndexSuffix)
 
 	_, err = svc.PutObject(&s3.PutObjectInput{
 		Body:   file,
@@ -7,6 +7,7 @@ import (
 	"github.com/reoring/goreplay/pkg/protocol"
 	"hash/fnv"
 	"net"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,6 +15,7 @@ import (
 // Currently used for internal communication between listener and replay server
 // Can be used for transferring binary payloads like protocol buffers
 type TCPOutput struct {
+	pending     int64 // queued and in-flight messages, keep first for atomic alignment
 	address     string
 	limit       int
 	buf         []chan *Message
@@ -30,6 +32,7 @@ type TCPOutputConfig struct {
 	Sticky     bool `json:"output-tcp-sticky"`
 	SkipVerify bool `json:"output-tcp-skip-verify"`
 	Workers    int  `json:"output-tcp-workers"`
+	Stats      bool `json:"output-tcp-stats"`
 }
 
 // NewTCPOutput constructor for TCPOutput
@@ -40,7 +43,7 @@ func NewTCPOutput(address string, config *TCPOutputConfig) PluginWriter {
 	o.address = address
 	o.config = config
 
-	if Settings.OutputTCPStats {
+	if o.config.Stats {
 		o.bufStats = NewGorStat("output_tcp", 5000)
 	}
 
@@ -93,6 +96,7 @@ func (o *TCPOutput) worker(bufferIndex int) {
 			go o.worker(bufferIndex)
 			break
 		}
+		atomic.AddInt64(&o.pending, -1)
 	}
 }
 
@@ -114,9 +118,10 @@ func (o *TCPOutput) PluginWrite(msg *Message) (n int, err error) {
 	}
 
 	bufferIndex := o.getBufferIndex(msg)
+	atomic.AddInt64(&o.pending, 1)
 	o.buf[bufferIndex] <- msg
 
-	if Settings.OutputTCPStats {
+	if o.config.Stats {
 		o.bufStats.Write(len(o.buf[bufferIndex]))
 	}
 
@@ -144,6 +149,11 @@ func (o *TCPOutput) String() string {
 	return fmt.Sprintf("TCP output %s, limit: %d", o.address, o.limit)
 }
 
+// Drain waits until queued messages are sent
+func (o *TCPOutput) Drain(ctx context.Context) int {
+	return drainPending(ctx, func() int { return int(atomic.LoadInt64(&o.pending)) })
+}
+
 func (o *TCPOutput) Close() {
 	o.close = true
 }
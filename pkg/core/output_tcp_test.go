@@ -25,7 +25,7 @@ func TestTCPOutput(t *testing.T) {
 	}
 
 	emitter := NewEmitter()
-	go emitter.Start(plugins, Settings.Middleware)
+	go emitter.Start(plugins, Settings.Middleware...)
 
 	for i := 0; i < 10; i++ {
 		wg.Add(1)
@@ -85,7 +85,7 @@ func BenchmarkTCPOutput(b *testing.B) {
 	emitter := NewEmitter()
 	// avoid counting above initialization
 	b.ResetTimer()
-	go emitter.Start(plugins, Settings.Middleware)
+	go emitter.Start(plugins, Settings.Middleware...)
 
 	wg.Wait()
 	emitter.Close()
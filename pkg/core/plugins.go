@@ -1,8 +1,11 @@
 package core
 
 import (
+	"context"
+	"fmt"
 	"reflect"
 	"strings"
+	"time"
 )
 
 // Message represents data across plugins
@@ -27,11 +30,48 @@ type PluginReadWriter interface {
 	PluginWriter
 }
 
+// PluginDrainer is an interface for plugins which buffer messages.
+// Drain blocks until buffered and in-flight messages are written or ctx is done, and returns the number of messages left.
+type PluginDrainer interface {
+	Drain(ctx context.Context) int
+}
+
+// drainPending waits until pending returns 0 or ctx is done, and returns the last value of pending
+func drainPending(ctx context.Context, pending func() int) int {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		n := pending()
+		if n <= 0 {
+			return 0
+		}
+		select {
+		case <-ctx.Done():
+			return n
+		case <-ticker.C:
+		}
+	}
+}
+
 // InOutPlugins struct for holding references to plugins
 type InOutPlugins struct {
 	Inputs  []PluginReader
 	Outputs []PluginWriter
 	All     []interface{}
+
+	// OutputNames holds addresses outputs were registered with, used to refer to them in routing rules
+	OutputNames map[PluginWriter]string
+	// InputNames holds addresses inputs were registered with, used to refer to them in the control API
+	InputNames map[PluginReader]string
+	// Limiters holds limiters of plugins registered with a limit, by plugin address
+	Limiters map[string]*Limiter
+	// LoadTest amplifies inputs following the load profile, nil if it's not set
+	LoadTest *LoadTest
+	// LatencyStats collects latency of requests replayed by HTTP outputs, nil if it's not enabled
+	LatencyStats *LatencyStats
+	// LatencyRegression compares latency of original and replayed requests, nil if it's not enabled
+	LatencyRegression *LatencyRegression
 }
 
 // extractLimitOptions detects if plugin get called with limiter support
@@ -49,7 +89,8 @@ func extractLimitOptions(options string) (string, string) {
 // Automatically detects type of plugin and initialize it
 //
 // See this article if curious about reflect stuff below: http://blog.burntsushi.net/type-parametric-functions-golang
-func (plugins *InOutPlugins) RegisterPlugin(constructor interface{}, options ...interface{}) {
+// The constructor can return an error as its second result.
+func (plugins *InOutPlugins) RegisterPlugin(constructor interface{}, options ...interface{}) error {
 	var path, limit string
 	vc := reflect.ValueOf(constructor)
 
@@ -68,69 +109,207 @@ func (plugins *InOutPlugins) RegisterPlugin(constructor interface{}, options ...
 	}
 
 	// Calling our constructor with list of given options
-	plugin := vc.Call(vo)[0].Interface()
+	results := vc.Call(vo)
+	if len(results) > 1 && !results[1].IsNil() {
+		return results[1].Interface().(error)
+	}
+	plugin := results[0].Interface()
+	// plugins which write are outputs, some of them read responses as well
+	_, isWriter := plugin.(PluginWriter)
+	if err := plugins.add(plugin, path, limit, isWriter); err != nil {
+		return fmt.Errorf("%s: %v", plugin, err)
+	}
+	return nil
+}
+
+// AddInput adds an already created input. Address is used to refer to the input in the control API, and can
+// have a limit suffix like in command line options: `requests.gor|200%`.
+func (plugins *InOutPlugins) AddInput(plugin PluginReader, address string) error {
+	path, limit := extractLimitOptions(address)
+	return plugins.add(plugin, path, limit, false)
+}
+
+// AddOutput adds an already created output. Address is used to refer to the output in routing rules and the
+// control API, and can have a limit suffix: `staging.com|10%`. Outputs which are also readers return
+// responses, which are not limited.
+func (plugins *InOutPlugins) AddOutput(plugin PluginWriter, address string) error {
+	path, limit := extractLimitOptions(address)
+	return plugins.add(plugin, path, limit, true)
+}
 
+// add registers plugin as an output if output is set, and as an input otherwise
+func (plugins *InOutPlugins) add(plugin interface{}, path, limit string, output bool) error {
+	name := pluginName(plugin, path)
+	_, isReader := plugin.(PluginReader)
+	isWriter := output
+
+	// Limiter is both reader and writer, but only limits in the role of the limited plugin
 	if limit != "" {
-		plugin = NewLimiter(plugin, limit)
+		l, err := CreateLimiter(plugin, limit)
+		if err != nil {
+			return err
+		}
+		l.output = output
+		if plugins.Limiters == nil {
+			plugins.Limiters = make(map[string]*Limiter)
+		}
+		plugins.Limiters[path] = l
+		plugin = l
 	}
 
 	// Some of the output can be Readers as well because return responses
-	if r, ok := plugin.(PluginReader); ok {
+	if r, ok := plugin.(PluginReader); ok && isReader {
 		plugins.Inputs = append(plugins.Inputs, r)
+
+		if plugins.InputNames == nil {
+			plugins.InputNames = make(map[PluginReader]string)
+		}
+		plugins.InputNames[r] = name
 	}
 
-	if w, ok := plugin.(PluginWriter); ok {
+	if w, ok := plugin.(PluginWriter); ok && isWriter {
 		plugins.Outputs = append(plugins.Outputs, w)
+
+		if plugins.OutputNames == nil {
+			plugins.OutputNames = make(map[PluginWriter]string)
+		}
+		plugins.OutputNames[w] = name
 	}
 	plugins.All = append(plugins.All, plugin)
+	return nil
+}
+
+// pluginName returns the address plugin was registered with, or its kind for plugins without address
+func pluginName(plugin interface{}, path string) string {
+	if path != "" {
+		return path
+	}
+	switch plugin.(type) {
+	case *DummyOutput:
+		return "stdout"
+	case *NullOutput:
+		return "null"
+	case *KafkaOutput:
+		return "kafka"
+	case *LatencyRegression:
+		return "latency-regression"
+	}
+	return ""
 }
 
 // NewPlugins specify and initialize all available plugins
-func NewPlugins() *InOutPlugins {
+func NewPlugins() (*InOutPlugins, error) {
 	plugins := new(InOutPlugins)
 
+	if len(Settings.LoadTestConfig.Profile) > 0 {
+		lt, err := CreateLoadTest(Settings.LoadTestConfig, RealClock{})
+		if err != nil {
+			return nil, err
+		}
+		plugins.LoadTest = lt
+		Settings.OutputHTTPConfig.LoadTest = plugins.LoadTest
+	}
+	if Settings.LatencyStats.Enabled {
+		ls, err := NewLatencyStats(Settings.LatencyStats, RealClock{})
+		if err != nil {
+			return nil, err
+		}
+		plugins.LatencyStats = ls
+		Settings.OutputHTTPConfig.LatencyStats = plugins.LatencyStats
+	}
+	if Settings.LatencyRegression.Enabled {
+		plugins.LatencyRegression = NewLatencyRegression(Settings.LatencyRegression, Settings.LatencyStats.Routes, RealClock{})
+		// replayed responses carry the replayed latency
+		Settings.OutputHTTPConfig.TrackResponses = true
+	}
+
+	if len(Settings.FileEncryptionKeys) > 0 {
+		e, err := NewFileEncryption(Settings.FileEncryptionKeys, Settings.FileEncryptionDataKeys)
+		if err != nil {
+			return nil, err
+		}
+		Settings.OutputFileConfig.Encryption = e
+	}
+
 	for _, options := range Settings.InputDummy {
-		plugins.RegisterPlugin(NewDummyInput, options)
+		if err := plugins.RegisterPlugin(NewDummyInput, options); err != nil {
+			return nil, err
+		}
 	}
 
 	for range Settings.OutputDummy {
-		plugins.RegisterPlugin(NewDummyOutput)
+		if err := plugins.RegisterPlugin(NewDummyOutput); err != nil {
+			return nil, err
+		}
 	}
 
 	if Settings.OutputStdout {
-		plugins.RegisterPlugin(NewDummyOutput)
+		if err := plugins.RegisterPlugin(NewDummyOutput); err != nil {
+			return nil, err
+		}
 	}
 
 	if Settings.OutputNull {
-		plugins.RegisterPlugin(NewNullOutput)
+		if err := plugins.RegisterPlugin(NewNullOutput); err != nil {
+			return nil, err
+		}
 	}
 
 	for _, options := range Settings.InputRAW {
-		plugins.RegisterPlugin(NewRAWInput, options, Settings.RAWInputConfig)
+		if err := plugins.RegisterPlugin(NewRAWInput, options, Settings.RAWInputConfig); err != nil {
+			return nil, err
+		}
 	}
 
 	for _, options := range Settings.InputTCP {
-		plugins.RegisterPlugin(NewTCPInput, options, &Settings.InputTCPConfig)
+		if err := plugins.RegisterPlugin(NewTCPInput, options, &Settings.InputTCPConfig); err != nil {
+			return nil, err
+		}
 	}
 
 	for _, options := range Settings.OutputTCP {
-		plugins.RegisterPlugin(NewTCPOutput, options, &Settings.OutputTCPConfig)
+		if err := plugins.RegisterPlugin(NewTCPOutput, options, &Settings.OutputTCPConfig); err != nil {
+			return nil, err
+		}
 	}
 
 	for _, options := range Settings.InputFile {
-		plugins.RegisterPlugin(NewFileInput, options, Settings.InputFileLoop, Settings.InputFileReadDepth, Settings.InputFileMaxWait, Settings.InputFileDryRun)
+		if err := plugins.RegisterPlugin(NewFileInputWithRange, options, Settings.InputFileLoop, Settings.InputFileReadDepth, Settings.InputFileMaxWait, Settings.InputFileDryRun, RealClock{}, Settings.InputFileStartAt, Settings.InputFileEndAt); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, options := range Settings.InputAccessLog {
+		if err := plugins.RegisterPlugin(NewAccessLogInput, options, &Settings.InputAccessLogConfig, Settings.InputFileLoop, Settings.InputFileReadDepth, Settings.InputFileMaxWait, Settings.InputFileDryRun, RealClock{}, Settings.InputFileStartAt, Settings.InputFileEndAt); err != nil {
+			return nil, err
+		}
 	}
 
+	if len(Settings.OutputFile) > 0 {
+		Settings.OutputFileConfig.Capture = captureConfig(&Settings)
+	}
 	for _, path := range Settings.OutputFile {
 		if strings.HasPrefix(path, "s3://") {
-			plugins.RegisterPlugin(NewS3Output, path, &Settings.OutputFileConfig)
+			if err := plugins.RegisterPlugin(NewS3Output, path, &Settings.OutputFileConfig); err != nil {
+				return nil, err
+			}
 		} else {
-			plugins.RegisterPlugin(NewFileOutput, path, &Settings.OutputFileConfig)
+			if err := plugins.RegisterPlugin(NewFileOutput, path, &Settings.OutputFileConfig); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, path := range Settings.OutputParquet {
+		if err := plugins.RegisterPlugin(NewParquetOutput, path, &Settings.OutputParquetConfig); err != nil {
+			return nil, err
 		}
 	}
 
 	for _, options := range Settings.InputHTTP {
-		plugins.RegisterPlugin(NewHTTPInput, options)
+		if err := plugins.RegisterPlugin(NewHTTPInput, options); err != nil {
+			return nil, err
+		}
 	}
 
 	// If we explicitly set Host header http output should not rewrite it
@@ -143,20 +322,38 @@ func NewPlugins() *InOutPlugins {
 	}
 
 	for _, options := range Settings.OutputHTTP {
-		plugins.RegisterPlugin(NewHTTPOutput, options, &Settings.OutputHTTPConfig)
+		if err := plugins.RegisterPlugin(CreateHTTPOutput, options, &Settings.OutputHTTPConfig); err != nil {
+			return nil, err
+		}
 	}
 
 	for _, options := range Settings.OutputBinary {
-		plugins.RegisterPlugin(NewBinaryOutput, options, &Settings.OutputBinaryConfig)
+		if err := plugins.RegisterPlugin(NewBinaryOutput, options, &Settings.OutputBinaryConfig); err != nil {
+			return nil, err
+		}
 	}
 
 	if Settings.OutputKafkaConfig.Host != "" && Settings.OutputKafkaConfig.Topic != "" {
-		plugins.RegisterPlugin(NewKafkaOutput, "", &Settings.OutputKafkaConfig, &Settings.KafkaTLSConfig)
+		if err := plugins.RegisterPlugin(NewKafkaOutput, "", &Settings.OutputKafkaConfig, &Settings.KafkaTLSConfig); err != nil {
+			return nil, err
+		}
 	}
 
 	if Settings.InputKafkaConfig.Host != "" && Settings.InputKafkaConfig.Topic != "" {
-		plugins.RegisterPlugin(NewKafkaInput, "", &Settings.InputKafkaConfig, &Settings.KafkaTLSConfig)
+		if err := plugins.RegisterPlugin(NewKafkaInput, "", &Settings.InputKafkaConfig, &Settings.KafkaTLSConfig); err != nil {
+			return nil, err
+		}
+	}
+
+	if plugins.LatencyRegression != nil {
+		plugins.add(plugins.LatencyRegression, "", "", true)
+	}
+
+	if plugins.LoadTest != nil {
+		if err := plugins.wrapLoadTest(plugins.LoadTest); err != nil {
+			return nil, err
+		}
 	}
 
-	return plugins
+	return plugins, nil
 }
@@ -10,7 +10,10 @@ func TestPluginsRegistration(t *testing.T) {
 	Settings.OutputHTTP = MultiOption{"www.example.com|10"}
 	Settings.InputFile = MultiOption{"/dev/null"}
 
-	plugins := NewPlugins()
+	plugins, err := NewPlugins()
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	if len(plugins.Inputs) != 3 {
 		t.Errorf("Should be 3 inputs got %d", len(plugins.Inputs))
@@ -41,3 +44,43 @@ func TestPluginsRegistration(t *testing.T) {
 	}
 
 }
+
+func TestPluginsLimitedInput(t *testing.T) {
+	plugins := new(InOutPlugins)
+	if err := plugins.AddInput(NewTestInput(), "test|50%"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(plugins.Inputs) != 1 {
+		t.Errorf("Should be 1 input got %d", len(plugins.Inputs))
+	}
+	if len(plugins.Outputs) != 0 {
+		t.Errorf("Limited input should not be an output, got %d outputs", len(plugins.Outputs))
+	}
+}
+
+func TestPluginsLimitedOutput(t *testing.T) {
+	responses := NewTestInput()
+	output := struct {
+		PluginReader
+		PluginWriter
+	}{responses, NewTestOutput(func(*Message) {})}
+
+	plugins := new(InOutPlugins)
+	if err := plugins.AddOutput(output, "test|1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(plugins.Inputs) != 1 || len(plugins.Outputs) != 1 {
+		t.Fatalf("Output returning responses should be an input and an output, got %d inputs and %d outputs", len(plugins.Inputs), len(plugins.Outputs))
+	}
+	for i := 0; i < 5; i++ {
+		responses.EmitGET()
+		if msg, _ := plugins.Inputs[0].PluginRead(); msg == nil {
+			t.Fatal("Responses of limited output should not be limited")
+		}
+	}
+
+	if err := plugins.AddOutput(NewTestOutput(nil), "test|fast"); err == nil {
+		t.Error("Should reject invalid limit")
+	}
+}
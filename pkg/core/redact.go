@@ -0,0 +1,358 @@
+package core
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/reoring/goreplay/proto"
+)
+
+// RedactConfig holds options of scrubbing personal data from requests and responses
+type RedactConfig struct {
+	Patterns   RedactPatterns `json:"redact"`
+	Headers    MultiOption    `json:"redact-header"`
+	JSONFields MultiOption    `json:"redact-json"`
+	Mode       string         `json:"redact-mode"` // mask or hash
+	Key        string         `json:"redact-key"`  // file or env:NAME with the HMAC key of hash mode
+}
+
+func (c *RedactConfig) enabled() bool {
+	return len(c.Patterns) > 0 || len(c.Headers) > 0 || len(c.JSONFields) > 0
+}
+
+type redactPattern struct {
+	name   string
+	regexp *regexp.Regexp
+	valid  func([]byte) bool // checks a match, like the card number checksum
+}
+
+var builtinRedactPatterns = []redactPattern{
+	{"card", regexp.MustCompile(`\b[2-6](?:\d[ -]?){11,17}\d\b`), luhnValid},
+	{"email", regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`), nil},
+	{"phone", regexp.MustCompile(`(?:\+\d{1,3}[ .-]?)?(?:\(\d{3}\) ?|\b\d{3}[ .-])\d{3}[ .-]\d{4}\b|\+\d{10,14}\b`), nil},
+	{"jwt", regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`), nil},
+}
+
+// RedactPatterns holds names of built-in patterns and custom `name=regexp` patterns
+type RedactPatterns []redactPattern
+
+func (p *RedactPatterns) String() string {
+	names := make([]string, len(*p))
+	for i, pattern := range *p {
+		names[i] = pattern.name
+	}
+	return strings.Join(names, ",")
+}
+
+// Set method to implement flags.Value
+func (p *RedactPatterns) Set(value string) error {
+	if i := strings.Index(value, "="); i > 0 {
+		r, err := regexp.Compile(value[i+1:])
+		if err != nil {
+			return err
+		}
+		*p = append(*p, redactPattern{name: value[:i], regexp: r})
+		return nil
+	}
+	for _, pattern := range builtinRedactPatterns {
+		if pattern.name == value {
+			*p = append(*p, pattern)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown pattern %q, expected card, email, phone, jwt or name=regexp", value)
+}
+
+// luhnValid checks the card number checksum
+func luhnValid(number []byte) bool {
+	sum, n := 0, 0
+	for i := len(number) - 1; i >= 0; i-- {
+		c := number[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if n%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return sum%10 == 0
+}
+
+// Redactor replaces personal data in requests and responses with masks, or with pseudonyms derived from
+// the values by keyed HMAC, so the same value gets the same pseudonym in all messages. Both keep the
+// length of values and their punctuation, only letters and digits are replaced.
+type Redactor struct {
+	config  *RedactConfig
+	headers [][]byte
+	json    [][]string
+	key     []byte // nil in mask mode
+	stats   *expvar.Map
+}
+
+// NewRedactor returns nil if redaction isn't configured
+func NewRedactor(config *RedactConfig) (*Redactor, error) {
+	if !config.enabled() {
+		return nil, nil
+	}
+
+	r := &Redactor{config: config}
+	switch config.Mode {
+	case "", "mask":
+	case "hash":
+		if config.Key == "" {
+			return nil, errors.New("hash mode needs --redact-key")
+		}
+		key, err := readSecret(config.Key)
+		if err != nil {
+			return nil, err
+		}
+		if len(bytes.TrimSpace(key)) == 0 {
+			return nil, fmt.Errorf("%s: key is empty", config.Key)
+		}
+		r.key = key
+	default:
+		return nil, fmt.Errorf("unknown mode %q, expected mask or hash", config.Mode)
+	}
+
+	for _, h := range config.Headers {
+		r.headers = append(r.headers, []byte(h))
+	}
+	for _, path := range config.JSONFields {
+		r.json = append(r.json, strings.Split(path, "."))
+	}
+
+	r.stats = expvarMap("redact")
+	return r, nil
+}
+
+// Redact returns the payload with configured headers, JSON fields and pattern matches replaced. The
+// payload can be shared with other messages, so it's copied before anything is replaced.
+func (r *Redactor) Redact(payload []byte) []byte {
+	shared := true
+	for _, name := range r.headers {
+		if value := proto.Header(payload, name); len(value) > 0 {
+			if shared {
+				payload, shared = append([]byte(nil), payload...), false
+			}
+			payload = proto.SetHeader(payload, name, r.replace(value))
+			r.stats.Add("header", 1)
+		}
+	}
+
+	if len(r.json) > 0 && bytes.Contains(bytes.ToLower(proto.Header(payload, []byte("Content-Type"))), []byte("json")) {
+		// the Content-Length header can be rewritten in place
+		if shared {
+			payload, shared = append([]byte(nil), payload...), false
+		}
+		payload = rewriteHTTPBody(payload, r.redactJSON)
+	}
+
+	if len(r.config.Patterns) > 0 {
+		// encoded bodies can't be matched, only headers are
+		end := len(payload)
+		if enc := proto.Header(payload, []byte("Content-Encoding")); len(enc) > 0 && !bytes.EqualFold(enc, []byte("identity")) {
+			end = proto.MIMEHeadersEndPos(payload)
+		}
+		if end > 0 {
+			payload = r.redactPatterns(payload, end, shared)
+		}
+	}
+
+	return payload
+}
+
+// redactPatterns replaces matches before the end, patterns with a group replace only the first group.
+// Matches are replaced in place, the shared payload is copied first.
+func (r *Redactor) redactPatterns(payload []byte, end int, shared bool) []byte {
+	for _, p := range r.config.Patterns {
+		for _, m := range p.regexp.FindAllSubmatchIndex(payload[:end], -1) {
+			start, end := m[0], m[1]
+			if len(m) > 3 && m[2] >= 0 {
+				start, end = m[2], m[3]
+			}
+			if p.valid != nil && !p.valid(payload[start:end]) {
+				continue
+			}
+			if shared {
+				payload, shared = append([]byte(nil), payload...), false
+			}
+			copy(payload[start:end], r.replace(payload[start:end]))
+			r.stats.Add(p.name, 1)
+		}
+	}
+	return payload
+}
+
+func (r *Redactor) redactJSON(body []byte) ([]byte, bool) {
+	var doc interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		Debug(2, fmt.Sprintf("[REDACT] can't decode JSON body: %q", err))
+		return body, false
+	}
+
+	changed := false
+	for _, path := range r.json {
+		var ok bool
+		if doc, ok = r.redactJSONPath(doc, path); ok {
+			changed = true
+			r.stats.Add("json", 1)
+		}
+	}
+	if !changed {
+		return body, false
+	}
+
+	buf := new(bytes.Buffer)
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(doc); err != nil {
+		Debug(2, fmt.Sprintf("[REDACT] can't encode JSON body: %q", err))
+		return body, false
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte{'\n'}), true
+}
+
+// redactJSONPath replaces values at the path, which is the same as in --http-set-json
+func (r *Redactor) redactJSONPath(node interface{}, path []string) (interface{}, bool) {
+	if len(path) == 0 {
+		return r.redactJSONValue(node)
+	}
+	key := path[0]
+	changed := false
+
+	switch n := node.(type) {
+	case map[string]interface{}:
+		for k, v := range n {
+			if key != "*" && key != k {
+				continue
+			}
+			if nv, ok := r.redactJSONPath(v, path[1:]); ok {
+				n[k] = nv
+				changed = true
+			}
+		}
+	case []interface{}:
+		for i, v := range n {
+			if key != "*" && key != strconv.Itoa(i) {
+				continue
+			}
+			if nv, ok := r.redactJSONPath(v, path[1:]); ok {
+				n[i] = nv
+				changed = true
+			}
+		}
+	}
+	return node, changed
+}
+
+// redactJSONValue replaces strings and numbers, and all of them in objects and arrays
+func (r *Redactor) redactJSONValue(node interface{}) (interface{}, bool) {
+	switch n := node.(type) {
+	case string:
+		return string(r.replace([]byte(n))), true
+	case json.Number:
+		if r.key == nil {
+			return json.Number("0"), true
+		}
+		return json.Number(r.replaceNumber([]byte(n))), true
+	case map[string]interface{}:
+		changed := false
+		for k, v := range n {
+			var ok bool
+			if n[k], ok = r.redactJSONValue(v); ok {
+				changed = true
+			}
+		}
+		return n, changed
+	case []interface{}:
+		changed := false
+		for i, v := range n {
+			var ok bool
+			if n[i], ok = r.redactJSONValue(v); ok {
+				changed = true
+			}
+		}
+		return n, changed
+	}
+	return node, false
+}
+
+// replace returns the mask or the pseudonym of the value, letters and digits are replaced by `*` or by
+// letters and digits derived from HMAC of the value
+func (r *Redactor) replace(value []byte) []byte {
+	out := make([]byte, len(value))
+	var stream []byte
+	if r.key != nil {
+		stream = r.keyStream(value, len(value))
+	}
+	for i, c := range value {
+		switch {
+		case r.key == nil && isAlphanumeric(c):
+			c = '*'
+		case c >= '0' && c <= '9':
+			c = '0' + stream[i]%10
+		case c >= 'a' && c <= 'z':
+			c = 'a' + stream[i]%26
+		case c >= 'A' && c <= 'Z':
+			c = 'A' + stream[i]%26
+		}
+		out[i] = c
+	}
+	return out
+}
+
+// replaceNumber returns the pseudonym of a JSON number, keeping it a valid number
+func (r *Redactor) replaceNumber(value []byte) []byte {
+	out := make([]byte, len(value))
+	stream := r.keyStream(value, len(value))
+	leading := true
+	for i, c := range value {
+		if c >= '0' && c <= '9' {
+			next := i+1 < len(value) && value[i+1] >= '0' && value[i+1] <= '9'
+			if leading && next {
+				c = '1' + stream[i]%9 // numbers can't start with 0
+			} else {
+				c = '0' + stream[i]%10
+			}
+			leading = false
+		} else {
+			leading = c == '-'
+		}
+		out[i] = c
+	}
+	return out
+}
+
+// keyStream returns n bytes derived from HMAC of the value
+func (r *Redactor) keyStream(value []byte, n int) []byte {
+	stream := make([]byte, 0, n+sha256.Size)
+	var counter [4]byte
+	for block := uint32(0); len(stream) < n; block++ {
+		mac := hmac.New(sha256.New, r.key)
+		binary.BigEndian.PutUint32(counter[:], block)
+		mac.Write(counter[:])
+		mac.Write(value)
+		stream = mac.Sum(stream)
+	}
+	return stream
+}
+
+func isAlphanumeric(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
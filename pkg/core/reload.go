@@ -0,0 +1,135 @@
+package core
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ParseSettings parses command line arguments into new settings.
+// If --config is given, flags from the file are applied first, so command line flags take precedence.
+func ParseSettings(args []string) (*AppSettings, error) {
+	s, err := parseFlags(args)
+	if err != nil || s.Config == "" {
+		return s, err
+	}
+
+	fileArgs, err := readConfigFile(s.Config, newFlagSet(new(AppSettings)))
+	if err != nil {
+		return nil, err
+	}
+	return parseFlags(append(fileArgs, args...))
+}
+
+// newFlagSet returns flags of the settings
+func newFlagSet(s *AppSettings) *flag.FlagSet {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	registerFlags(fs, s)
+
+	// Flags defined outside of settings, like --cpuprofile, are accepted and ignored
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		if fs.Lookup(f.Name) == nil {
+			fs.Var(ignoredFlag{f.Value}, f.Name, f.Usage)
+		}
+	})
+	return fs
+}
+
+func parseFlags(args []string) (*AppSettings, error) {
+	s := new(AppSettings)
+	fs := newFlagSet(s)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	// parsing stops at the first argument which isn't a flag, flags after it would be ignored
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	if err := checkSettings(s); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+type ignoredFlag struct {
+	flag.Value
+}
+
+func (f ignoredFlag) Set(string) error {
+	return nil
+}
+
+func (f ignoredFlag) IsBoolFlag() bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// readConfigFile reads flags of the flag set from the file, one per line: `--name value`, `--name=value`, or
+// `--name` for booleans. Empty lines and lines starting with # are skipped, values can be quoted.
+func readConfigFile(path string, fs *flag.FlagSet) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var args []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.IndexAny(line, " \t")
+		if i == -1 || strings.Contains(line[:i], "=") {
+			args = append(args, line)
+			continue
+		}
+		name, value := line[:i], unquoteValue(strings.TrimSpace(line[i+1:]))
+		if isBoolFlag(fs, name) {
+			// boolean flags only take values after =
+			args = append(args, name+"="+value)
+			continue
+		}
+		args = append(args, name, value)
+	}
+
+	return args, nil
+}
+
+func isBoolFlag(fs *flag.FlagSet, name string) bool {
+	f := fs.Lookup(strings.TrimLeft(name, "-"))
+	if f == nil {
+		return false
+	}
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+func unquoteValue(value string) string {
+	if len(value) < 2 || value[0] != value[len(value)-1] {
+		return value
+	}
+	switch value[0] {
+	case '\'':
+		return value[1 : len(value)-1]
+	case '"':
+		if v, err := strconv.Unquote(value); err == nil {
+			return v
+		}
+	}
+	return value
+}
+
+// pluginOptions returns options of all plugins which support limits, like `staging.com|10`
+func (s *AppSettings) pluginOptions() []string {
+	var options []string
+	for _, opts := range []MultiOption{s.InputDummy, s.InputRAW, s.InputTCP, s.OutputTCP, s.InputFile, s.OutputFile, s.InputHTTP, s.OutputHTTP, s.OutputBinary} {
+		options = append(options, opts...)
+	}
+	return options
+}
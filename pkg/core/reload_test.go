@@ -0,0 +1,150 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/reoring/goreplay/proto"
+)
+
+func TestParseSettingsConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gor-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := filepath.Join(dir, "gor.conf")
+	ioutil.WriteFile(config, []byte(`
+# staging replay
+--output-http 'http://staging|50%'
+--http-allow-url /api
+--filter "method == \"GET\""
+--output-stdout
+`), 0644)
+
+	s, err := ParseSettings([]string{"--config", config, "--http-allow-url", "/v2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.OutputHTTP) != 1 || s.OutputHTTP[0] != "http://staging|50%" {
+		t.Error("Should read output from config", s.OutputHTTP)
+	}
+	if !s.OutputStdout {
+		t.Error("Should read boolean flags")
+	}
+	if len(s.ModifierConfig.URLRegexp) != 2 {
+		t.Error("Should apply config and command line flags", s.ModifierConfig.URLRegexp)
+	}
+	if len(s.ModifierConfig.Filters) != 1 || s.ModifierConfig.Filters[0].String() != `method == "GET"` {
+		t.Error("Should unquote values", s.ModifierConfig.Filters)
+	}
+
+	if _, err := ParseSettings([]string{"--config", filepath.Join(dir, "missing.conf")}); err == nil {
+		t.Error("Should fail on missing config")
+	}
+
+	// values of boolean flags don't stop parsing
+	ioutil.WriteFile(config, []byte("--input-raw-track-response true\n--output-stdout false\n--http-allow-url /api\n"), 0644)
+	s, err = ParseSettings([]string{"--config", config, "--output-http-track-response"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.TrackResponse || s.OutputStdout || len(s.ModifierConfig.URLRegexp) != 1 || !s.OutputHTTPConfig.TrackResponses {
+		t.Error("Should apply boolean values and all later flags", s.TrackResponse, s.OutputStdout, s.ModifierConfig.URLRegexp, s.OutputHTTPConfig.TrackResponses)
+	}
+
+	if _, err := ParseSettings([]string{"--output-stdout", "true", "--http-allow-url", "/api"}); err == nil {
+		t.Error("Should fail on arguments which aren't flags")
+	}
+
+	ioutil.WriteFile(config, []byte("--filter 'method =='\n"), 0644)
+	if _, err := ParseSettings([]string{"--config", config}); err == nil {
+		t.Error("Should fail on invalid filter")
+	}
+}
+
+func TestEmitterReload(t *testing.T) {
+	modifierConfig := Settings.ModifierConfig
+	Settings.ModifierConfig = HTTPModifierConfig{}
+	defer func() { Settings.ModifierConfig = modifierConfig }()
+
+	received := make(chan string, 10)
+	input := NewTestInput()
+	output := NewTestOutput(func(msg *Message) {
+		received <- string(proto.Method(msg.Data))
+	})
+
+	plugins := &InOutPlugins{
+		Inputs:  []PluginReader{input},
+		Outputs: []PluginWriter{output},
+	}
+	plugins.All = append(plugins.All, input, output)
+
+	emitter := NewEmitter()
+	emitter.Start(plugins)
+	defer emitter.Close()
+
+	next := func() string {
+		select {
+		case method := <-received:
+			return method
+		case <-time.After(time.Second):
+			return ""
+		}
+	}
+
+	input.EmitGET()
+	if m := next(); m != "GET" {
+		t.Fatal("Should pass everything before reload", m)
+	}
+
+	s, err := ParseSettings([]string{"--http-allow-method", "POST"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := emitter.Reload(s); err != nil {
+		t.Fatal(err)
+	}
+
+	input.EmitGET()
+	input.EmitPOST()
+	if m := next(); m != "POST" {
+		t.Error("Should apply reloaded filter", m)
+	}
+
+	s, _ = ParseSettings([]string{"--route", "true => unknown"})
+	if err := emitter.Reload(s); err == nil {
+		t.Error("Should reject routes to unknown outputs")
+	}
+
+	input.EmitGET()
+	input.EmitPOST()
+	if m := next(); m != "POST" {
+		t.Error("Should keep configuration after failed reload", m)
+	}
+}
+
+func TestEmitterReloadLimiters(t *testing.T) {
+	limiter := NewLimiter(NewTestOutput(func(*Message) {}), "10").(*Limiter)
+	emitter := &Emitter{plugins: &InOutPlugins{Limiters: map[string]*Limiter{"http://staging": limiter}}}
+
+	emitter.reloadLimiters(&AppSettings{OutputHTTP: MultiOption{"http://staging|20%"}})
+	if limiter.limit != 20 || !limiter.isPercent {
+		t.Error("Should change the limit", limiter)
+	}
+
+	emitter.reloadLimiters(&AppSettings{OutputHTTP: MultiOption{"http://staging"}})
+	if limiter.limit != 100 || !limiter.isPercent {
+		t.Error("Should remove the limit", limiter)
+	}
+
+	emitter.reloadLimiters(&AppSettings{})
+	if limiter.limit != 100 {
+		t.Error("Should keep limits of plugins not in the config", limiter)
+	}
+}
@@ -0,0 +1,187 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/reoring/goreplay/byteutils"
+	"github.com/reoring/goreplay/pkg/expr"
+	"github.com/reoring/goreplay/pkg/protocol"
+)
+
+// routeTTL is how long the route of a request is remembered for its responses
+const routeTTL = 2 * time.Minute
+
+// Handling of --route option
+type routeRule struct {
+	filter  *expr.Program
+	outputs []string
+}
+
+func (r routeRule) String() string {
+	return fmt.Sprintf("%s => %s", r.filter, strings.Join(r.outputs, ", "))
+}
+
+// RouteRules holds routing rules in order they were specified
+type RouteRules []routeRule
+
+func (r *RouteRules) String() string {
+	return fmt.Sprint(*r)
+}
+
+// Set method to implement flags.Value
+func (r *RouteRules) Set(value string) error {
+	i := strings.LastIndex(value, "=>")
+	if i == -1 {
+		return errors.New("need both expression and outputs, separated by `=>` (ex. host.startsWith(\"api.\") => http://api.staging)")
+	}
+
+	filter, err := expr.Compile(strings.TrimSpace(value[:i]))
+	if err != nil {
+		return err
+	}
+
+	rule := routeRule{filter: filter}
+	for _, out := range strings.Split(value[i+2:], ",") {
+		if out = strings.TrimSpace(out); out != "" {
+			rule.outputs = append(rule.outputs, out)
+		}
+	}
+	if len(rule.outputs) == 0 {
+		return errors.New("route should have at least one output")
+	}
+
+	*r = append(*r, rule)
+	return nil
+}
+
+// Outputs returns addresses of outputs referenced by the rules
+func (r RouteRules) Outputs() []string {
+	var outputs []string
+	for _, rule := range r {
+		outputs = append(outputs, rule.outputs...)
+	}
+	return outputs
+}
+
+type routedRequest struct {
+	route     int
+	createdAt int64
+}
+
+// Router sends messages to outputs based on routing rules.
+// Rules are evaluated in order and the first matching one wins, responses follow the route of their request.
+// Outputs not mentioned in any rule keep receiving all messages.
+type Router struct {
+	rules    RouteRules
+	targets  [][]PluginWriter // outputs of each rule, including the unrouted ones
+	unrouted []PluginWriter
+
+	mu              sync.Mutex
+	requests        map[string]routedRequest
+	lastCleanupTime int64
+}
+
+// NewRouter resolves outputs of routing rules. Outputs are referenced by the address they were registered with:
+// URL of --output-http, path of --output-file, or "stdout", "null" and "kafka" for outputs without address.
+// It returns nil if there are no rules, and an error if a rule refers to an unknown output.
+func NewRouter(rules RouteRules, outputs []PluginWriter, names map[PluginWriter]string) (*Router, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	r := &Router{
+		rules:    rules,
+		targets:  make([][]PluginWriter, len(rules)),
+		requests: make(map[string]routedRequest),
+	}
+
+	routed := make(map[PluginWriter]bool)
+	for i, rule := range rules {
+		for _, name := range rule.outputs {
+			found := false
+			for _, out := range outputs {
+				if names[out] == name {
+					r.targets[i] = append(r.targets[i], out)
+					routed[out] = true
+					found = true
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("[ROUTER] route %q refers to unknown output %q", rule, name)
+			}
+		}
+	}
+
+	for _, out := range outputs {
+		if !routed[out] {
+			r.unrouted = append(r.unrouted, out)
+		}
+	}
+	for i := range r.targets {
+		r.targets[i] = append(r.targets[i], r.unrouted...)
+	}
+
+	return r, nil
+}
+
+// Route returns outputs which should receive the message. Rules are evaluated without holding the lock, so
+// inputs route their messages in parallel.
+func (r *Router) Route(meta [][]byte, data []byte) []PluginWriter {
+	id := byteutils.SliceToString(meta[1])
+	now := time.Now().UnixNano()
+
+	if meta[0][0] != protocol.RequestPayload {
+		r.mu.Lock()
+		r.cleanup(now)
+		req, ok := r.requests[id]
+		r.mu.Unlock()
+		if ok {
+			return r.outputs(req.route)
+		}
+		// Request was never seen, route response by its own content
+		return r.outputs(r.match(meta, data))
+	}
+
+	route := r.match(meta, data)
+	r.mu.Lock()
+	r.cleanup(now)
+	r.requests[string(meta[1])] = routedRequest{route: route, createdAt: now}
+	r.mu.Unlock()
+	Debug(3, fmt.Sprintf("[ROUTER] request %s routed to %d", id, route))
+
+	return r.outputs(route)
+}
+
+func (r *Router) match(meta [][]byte, data []byte) int {
+	env := newMessageEnv(meta, data)
+	for i, rule := range r.rules {
+		if rule.filter.Match(env) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (r *Router) outputs(route int) []PluginWriter {
+	if route == -1 {
+		return r.unrouted
+	}
+	return r.targets[route]
+}
+
+// cleanup forgets routes of requests which are unlikely to get more responses, r.mu should be held
+func (r *Router) cleanup(now int64) {
+	if now-r.lastCleanupTime < int64(routeTTL/2) {
+		return
+	}
+	for id, req := range r.requests {
+		if now-req.createdAt > int64(routeTTL) {
+			delete(r.requests, id)
+		}
+	}
+	r.lastCleanupTime = now
+}
@@ -0,0 +1,172 @@
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/reoring/goreplay/pkg/protocol"
+)
+
+func TestRouteRules(t *testing.T) {
+	rules := RouteRules{}
+	if err := rules.Set(`host.startsWith("api.") => http://a, http://b`); err != nil {
+		t.Fatal(err)
+	}
+	if len(rules[0].outputs) != 2 || rules[0].outputs[1] != "http://b" {
+		t.Error("Should parse all outputs", rules[0].outputs)
+	}
+
+	for _, value := range []string{`host == "a"`, `host == "a" =>`, `host == => http://a`} {
+		if err := rules.Set(value); err == nil {
+			t.Errorf("%q should not be valid", value)
+		}
+	}
+}
+
+func TestRouter(t *testing.T) {
+	a, b, c, all := NewTestOutput(nil), NewTestOutput(nil), NewTestOutput(nil), NewTestOutput(nil)
+	outputs := []PluginWriter{a, b, c, all}
+	names := map[PluginWriter]string{a: "http://a", b: "http://b", c: "requests.gor", all: "stdout"}
+
+	rules := RouteRules{}
+	rules.Set(`host.matches("^api\\.")  => http://a`)
+	rules.Set(`path.startsWith("/admin") => http://b`)
+	rules.Set(`type == "request" => requests.gor`)
+
+	router, err := NewRouter(rules, outputs, names)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	route := func(payloadType byte, id, payload string) []PluginWriter {
+		meta := protocol.PayloadMeta(protocol.PayloadHeader(payloadType, []byte(id), time.Now().UnixNano(), -1))
+		return router.Route(meta, []byte(payload))
+	}
+	same := func(got []PluginWriter, expected ...PluginWriter) bool {
+		if len(got) != len(expected) {
+			return false
+		}
+		for i := range got {
+			if got[i] != expected[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	if out := route(protocol.RequestPayload, "1", "GET /admin HTTP/1.1\r\nHost: api.example.com\r\n\r\n"); !same(out, a, all) {
+		t.Error("First matching route should win", out)
+	}
+	if out := route(protocol.RequestPayload, "2", "GET /admin HTTP/1.1\r\nHost: www.example.com\r\n\r\n"); !same(out, b, all) {
+		t.Error("Should be routed by path", out)
+	}
+	if out := route(protocol.RequestPayload, "3", "GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"); !same(out, c, all) {
+		t.Error("Should use fallback route", out)
+	}
+
+	if out := route(protocol.ResponsePayload, "2", "HTTP/1.1 200 OK\r\n\r\n"); !same(out, b, all) {
+		t.Error("Response should follow its request", out)
+	}
+	if out := route(protocol.ReplayedResponsePayload, "1", "HTTP/1.1 200 OK\r\n\r\n"); !same(out, a, all) {
+		t.Error("Replayed response should follow its request", out)
+	}
+	if out := route(protocol.ResponsePayload, "4", "HTTP/1.1 200 OK\r\n\r\n"); !same(out, all) {
+		t.Error("Unknown response should be routed by its content", out)
+	}
+
+	rules.Set(`true => http://unknown`)
+	if _, err := NewRouter(rules, outputs, names); err == nil {
+		t.Error("Should reject routes to unknown outputs")
+	}
+	plugins := &InOutPlugins{Inputs: []PluginReader{NewTestInput()}, Outputs: outputs, OutputNames: names}
+	if err := NewEmitterWithSettings(&AppSettings{Routes: rules}).Start(plugins); err == nil {
+		t.Error("Emitter should not start with routes to unknown outputs")
+	}
+}
+
+func TestRouterParallel(t *testing.T) {
+	a, all := NewTestOutput(nil), NewTestOutput(nil)
+	names := map[PluginWriter]string{a: "http://a", all: "stdout"}
+	rules := RouteRules{}
+	rules.Set(`path.matches("^/api/[0-9]+$") => http://a`)
+	router, err := NewRouter(rules, []PluginWriter{a, all}, names)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				id := []byte(fmt.Sprintf("%d-%d", i, j))
+				path := "/api/" + strconv.Itoa(j)
+				if j%2 == 1 {
+					path = "/other"
+				}
+				meta := protocol.PayloadMeta(protocol.PayloadHeader(protocol.RequestPayload, id, time.Now().UnixNano(), -1))
+				request := router.Route(meta, []byte("GET "+path+" HTTP/1.1\r\n\r\n"))
+				meta = protocol.PayloadMeta(protocol.PayloadHeader(protocol.ResponsePayload, id, time.Now().UnixNano(), 1))
+				if response := router.Route(meta, []byte("HTTP/1.1 200 OK\r\n\r\n")); len(response) != len(request) || (j%2 == 0) != (len(request) == 2) {
+					t.Errorf("%s: response should follow its request, got %v and %v", id, request, response)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestEmitterRoutes(t *testing.T) {
+	wg := new(sync.WaitGroup)
+
+	var mu sync.Mutex
+	received := make(map[string][]string)
+	newOutput := func(name string) PluginWriter {
+		return NewTestOutput(func(msg *Message) {
+			mu.Lock()
+			received[name] = append(received[name], string(msg.Meta[0:1])+" "+string(protocol.PayloadMeta(msg.Meta)[1]))
+			mu.Unlock()
+			wg.Done()
+		})
+	}
+
+	input := NewTestInput()
+	input.SetSkipHeader(true)
+	tenantA, tenantB := newOutput("a"), newOutput("b")
+
+	plugins := &InOutPlugins{
+		Inputs:      []PluginReader{input},
+		Outputs:     []PluginWriter{tenantA, tenantB},
+		OutputNames: map[PluginWriter]string{tenantA: "http://a.staging", tenantB: "http://b.staging"},
+	}
+	plugins.All = append(plugins.All, input, tenantA, tenantB)
+
+	Settings.Routes = RouteRules{}
+	Settings.Routes.Set(`host == "a.example.com" => http://a.staging`)
+	Settings.Routes.Set(`host == "b.example.com" => http://b.staging`)
+
+	emitter := NewEmitter()
+	go emitter.Start(plugins, Settings.Middleware...)
+
+	// request to tenant A and its response, request to tenant B, and request to unknown tenant which is dropped
+	wg.Add(3)
+	input.EmitBytes(append(protocol.PayloadHeader(protocol.RequestPayload, []byte("1"), 1, -1), "GET / HTTP/1.1\r\nHost: a.example.com\r\n\r\n"...))
+	input.EmitBytes(append(protocol.PayloadHeader(protocol.RequestPayload, []byte("2"), 1, -1), "GET / HTTP/1.1\r\nHost: c.example.com\r\n\r\n"...))
+	input.EmitBytes(append(protocol.PayloadHeader(protocol.ResponsePayload, []byte("1"), 2, 1), "HTTP/1.1 200 OK\r\n\r\n"...))
+	input.EmitBytes(append(protocol.PayloadHeader(protocol.RequestPayload, []byte("3"), 3, -1), "GET / HTTP/1.1\r\nHost: b.example.com\r\n\r\n"...))
+
+	wg.Wait()
+	emitter.Close()
+	Settings.Routes = nil
+
+	if got := received["a"]; len(got) != 2 || got[0] != "1 1" || got[1] != "2 1" {
+		t.Error("Tenant A should receive request and response", got)
+	}
+	if got := received["b"]; len(got) != 1 || got[0] != "1 3" {
+		t.Error("Tenant B should receive only its request", got)
+	}
+}
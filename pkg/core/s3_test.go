@@ -19,7 +19,10 @@ func TestS3Output(t *testing.T) {
 	rnd := rand.Int63()
 	path := fmt.Sprintf("s3://test-gor/%d/requests.gz", rnd)
 
-	output := NewS3Output(path, &FileOutputConfig{queueLimit: 2})
+	output, err := NewS3Output(path, &FileOutputConfig{queueLimit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	svc := s3.New(output.session)
 
@@ -63,7 +66,10 @@ func TestS3OutputQueueLimit(t *testing.T) {
 	rnd := rand.Int63()
 	path := fmt.Sprintf("s3://test-gor/%d/requests.gz", rnd)
 
-	output := NewS3Output(path, &FileOutputConfig{queueLimit: 100})
+	output, err := NewS3Output(path, &FileOutputConfig{queueLimit: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
 	output.closeCh = make(chan struct{}, 3)
 
 	svc := s3.New(output.session)
@@ -110,7 +116,10 @@ func TestInputFileFromS3(t *testing.T) {
 	rnd := rand.Int63()
 	path := fmt.Sprintf("s3://test-gor-eu/%d/requests.gz", rnd)
 
-	output := NewS3Output(path, &FileOutputConfig{queueLimit: 5000})
+	output, err := NewS3Output(path, &FileOutputConfig{queueLimit: 5000})
+	if err != nil {
+		t.Fatal(err)
+	}
 	output.closeCh = make(chan struct{}, 10)
 
 	for i := 0; i <= 20000; i++ {
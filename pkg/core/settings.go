@@ -6,6 +6,7 @@ import (
 	"github.com/reoring/goreplay/pkg/kafka"
 	"github.com/reoring/goreplay/pkg/version"
 	"os"
+	"strings"
 	"sync"
 	"time"
 )
@@ -26,15 +27,48 @@ func (h *MultiOption) Set(value string) error {
 	return nil
 }
 
+// MetaFieldsOption collects key=value fields added to meta of all messages
+type MetaFieldsOption [][2]string
+
+func (m *MetaFieldsOption) String() string {
+	fields := make([]string, len(*m))
+	for i, f := range *m {
+		fields[i] = f[0] + "=" + f[1]
+	}
+	return strings.Join(fields, " ")
+}
+
+// Set method to implement flags.Value
+func (m *MetaFieldsOption) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i <= 0 || strings.ContainsAny(value[:i], " \t\r\n") {
+		return fmt.Errorf("expected key=value, got %q", value)
+	}
+	*m = append(*m, [2]string{value[:i], value[i+1:]})
+	return nil
+}
+
 // AppSettings is the struct of main configuration
 type AppSettings struct {
-	Verbose   int           `json:"verbose"`
-	Stats     bool          `json:"stats"`
-	ExitAfter time.Duration `json:"exit-after"`
-
-	SplitOutput          bool   `json:"split-output"`
-	RecognizeTCPSessions bool   `json:"recognize-tcp-sessions"`
-	Pprof                string `json:"http-pprof"`
+	Config          string        `json:"config"`
+	Verbose         int           `json:"verbose"`
+	Stats           bool          `json:"stats"`
+	ExitAfter       time.Duration `json:"exit-after"`
+	ShutdownTimeout time.Duration `json:"shutdown-timeout"`
+
+	SplitOutput          bool             `json:"split-output"`
+	RecognizeTCPSessions bool             `json:"recognize-tcp-sessions"`
+	Routes               RouteRules       `json:"route"`
+	MetaFields           MetaFieldsOption `json:"meta-field"`
+	Pprof                string           `json:"http-pprof"`
+	HTTPControl          string           `json:"http-control"`
+	HTTPControlToken     string           `json:"http-control-token"`
+
+	OutputQueueConfig OutputQueueConfig
+	LoadTestConfig    LoadTestConfig
+	LatencyStats      LatencyStatsConfig
+	LatencyRegression LatencyRegressionConfig
+	Redact            RedactConfig
 
 	InputDummy   MultiOption `json:"input-dummy"`
 	OutputDummy  MultiOption
@@ -45,20 +79,30 @@ type AppSettings struct {
 	InputTCPConfig  TCPInputConfig
 	OutputTCP       MultiOption `json:"output-tcp"`
 	OutputTCPConfig TCPOutputConfig
-	OutputTCPStats  bool `json:"output-tcp-stats"`
 
 	InputFile        MultiOption   `json:"input-file"`
 	InputFileLoop    bool          `json:"input-file-loop"`
 	InputFileReadDepth int           `json:"input-file-read-depth"`
 	InputFileDryRun    bool          `json:"input-file-dry-run"`
 	InputFileMaxWait time.Duration `json:"input-file-max-wait"`
+	InputFileStartAt FileTime      `json:"input-file-start-at"`
+	InputFileEndAt   FileTime      `json:"input-file-end-at"`
+
+	InputAccessLog       MultiOption `json:"input-accesslog"`
+	InputAccessLogConfig AccessLogInputConfig
+	FileEncryptionKeys     MultiOption `json:"file-encryption-key"`
+	FileEncryptionDataKeys bool        `json:"file-encryption-data-keys"`
 	OutputFile       MultiOption   `json:"output-file"`
 	OutputFileConfig FileOutputConfig
 
+	OutputParquet       MultiOption `json:"output-parquet"`
+	OutputParquetConfig ParquetOutputConfig
+
 	InputRAW MultiOption `json:"input_raw"`
 	RAWInputConfig
 
-	Middleware string `json:"middleware"`
+	Middleware       MultiOption `json:"middleware"`
+	MiddlewareConfig MiddlewareConfig
 
 	InputHTTP    MultiOption
 	OutputHTTP   MultiOption `json:"output-http"`
@@ -87,145 +131,288 @@ func usage() {
 
 func init() {
 	flag.Usage = usage
-	flag.StringVar(&Settings.Pprof, "http-pprof", "", "Enable profiling. Starts  http server on specified port, exposing special /debug/pprof endpoint. Example: `:8181`")
-	flag.IntVar(&Settings.Verbose, "verbose", 0, "set the level of verbosity, if greater than zero then it will turn on debug output")
-	flag.BoolVar(&Settings.Stats, "stats", false, "Turn on queue stats output")
+	registerFlags(flag.CommandLine, &Settings)
+}
+
+// registerFlags binds command line flags to the settings
+func registerFlags(fs *flag.FlagSet, s *AppSettings) {
+	fs.StringVar(&s.Config, "config", "", "Read flags from a file, one per line (`--http-allow-url /api`), lines starting with # are ignored. Command line flags are applied after the file. On SIGHUP the file is read again and filters, rewrites, rate limits and routes are replaced without restarting inputs")
+	fs.StringVar(&s.Pprof, "http-pprof", "", "Enable profiling. Starts  http server on specified port, exposing special /debug/pprof endpoint and /debug/vars stats. Example: `:8181`")
+	fs.StringVar(&s.HTTPControl, "http-control", "", "Serve the /control/ API for changing replay at runtime on the address. Addresses without host, like :8182, listen on localhost only")
+	fs.StringVar(&s.HTTPControlToken, "http-control-token", "", "Token the control API requires in the Authorization: Bearer header. Required to serve it on other addresses than localhost")
+	fs.IntVar(&s.Verbose, "verbose", 0, "set the level of verbosity, if greater than zero then it will turn on debug output")
+	fs.BoolVar(&s.Stats, "stats", false, "Turn on queue stats output")
 
 	if DEMO == "" {
-		flag.DurationVar(&Settings.ExitAfter, "exit-after", 0, "exit after specified duration")
+		fs.DurationVar(&s.ExitAfter, "exit-after", 0, "exit after specified duration")
 	} else {
-		Settings.ExitAfter = 5 * time.Minute
+		s.ExitAfter = 5 * time.Minute
 	}
-
-	flag.BoolVar(&Settings.SplitOutput, "split-output", false, "By default each output gets same traffic. If set to `true` it splits traffic equally among all outputs.")
-	flag.BoolVar(&Settings.RecognizeTCPSessions, "recognize-tcp-sessions", false, "[PRO] If turned on http output will create separate worker for each TCP session. Splitting output will session based as well.")
-
-	flag.Var(&Settings.InputDummy, "input-dummy", "Used for testing outputs. Emits 'Get /' request every 1s")
-	flag.BoolVar(&Settings.OutputStdout, "output-stdout", false, "Used for testing inputs. Just prints to console data coming from inputs.")
-	flag.BoolVar(&Settings.OutputNull, "output-null", false, "Used for testing inputs. Drops all requests.")
-
-	flag.Var(&Settings.InputTCP, "input-tcp", "Used for internal communication between Gor instances. Example: \n\t# Receive requests from other Gor instances on 28020 port, and redirect output to staging\n\tgor --input-tcp :28020 --output-http staging.com")
-	flag.BoolVar(&Settings.InputTCPConfig.Secure, "input-tcp-secure", false, "Turn on TLS security. Do not forget to specify certificate and key files.")
-	flag.StringVar(&Settings.InputTCPConfig.CertificatePath, "input-tcp-certificate", "", "Path to PEM encoded certificate file. Used when TLS turned on.")
-	flag.StringVar(&Settings.InputTCPConfig.KeyPath, "input-tcp-certificate-key", "", "Path to PEM encoded certificate key file. Used when TLS turned on.")
-
-	flag.Var(&Settings.OutputTCP, "output-tcp", "Used for internal communication between Gor instances. Example: \n\t# Listen for requests on 80 port and forward them to other Gor instance on 28020 port\n\tgor --input-raw :80 --output-tcp replay.local:28020")
-	flag.BoolVar(&Settings.OutputTCPConfig.Secure, "output-tcp-secure", false, "Use TLS secure connection. --input-file on another end should have TLS turned on as well.")
-	flag.BoolVar(&Settings.OutputTCPConfig.SkipVerify, "output-tcp-skip-verify", false, "Don't verify hostname on TLS secure connection.")
-	flag.BoolVar(&Settings.OutputTCPConfig.Sticky, "output-tcp-sticky", false, "Use Sticky connection. Request/Response with same ID will be sent to the same connection.")
-	flag.IntVar(&Settings.OutputTCPConfig.Workers, "output-tcp-workers", 10, "Number of parallel tcp connections, default is 10")
-	flag.BoolVar(&Settings.OutputTCPStats, "output-tcp-stats", false, "Report TCP output queue stats to console every 5 seconds.")
-
-	flag.Var(&Settings.InputFile, "input-file", "Read requests from file: \n\tgor --input-file ./requests.gor --output-http staging.com")
-	flag.BoolVar(&Settings.InputFileLoop, "input-file-loop", false, "Loop input files, useful for performance testing.")
-	flag.IntVar(&Settings.InputFileReadDepth, "input-file-read-depth", 100, "GoReplay tries to read and cache multiple records, in advance. In parallel it also perform sorting of requests, if they came out of order. Since it needs hold this buffer in memory, bigger values can cause worse performance")
-	flag.BoolVar(&Settings.InputFileDryRun, "input-file-dry-run", false, "Simulate reading from the data source without replaying it. You will get information about expected replay time, number of found records etc.")
-	flag.DurationVar(&Settings.InputFileMaxWait, "input-file-max-wait", 0, "Set the maximum time between requests. Can help in situations when you have too long periods between request, and you want to skip them. Example: --input-raw-max-wait 1s")
-
-	flag.Var(&Settings.OutputFile, "output-file", "Write incoming requests to file: \n\tgor --input-raw :80 --output-file ./requests.gor")
-	flag.DurationVar(&Settings.OutputFileConfig.FlushInterval, "output-file-flush-interval", time.Second, "Interval for forcing buffer flush to the file, default: 1s.")
-	flag.BoolVar(&Settings.OutputFileConfig.Append, "output-file-append", false, "The flushed chunk is appended to existence file or not. ")
-	flag.Var(&Settings.OutputFileConfig.SizeLimit, "output-file-size-limit", "Size of each chunk. Default: 32mb")
-	flag.IntVar(&Settings.OutputFileConfig.QueueLimit, "output-file-queue-limit", 256, "The length of the chunk queue. Default: 256")
-	flag.Var(&Settings.OutputFileConfig.OutputFileMaxSize, "output-file-max-size-limit", "Max size of output file, Default: 1TB")
-
-	flag.StringVar(&Settings.OutputFileConfig.BufferPath, "output-file-buffer", "/tmp", "The path for temporary storing current buffer: \n\tgor --input-raw :80 --output-file s3://mybucket/logs/%Y-%m-%d.gz --output-file-buffer /mnt/logs")
-
-	flag.BoolVar(&Settings.PrettifyHTTP, "prettify-http", false, "If enabled, will automatically decode requests and responses with: Content-Encoding: gzip and Transfer-Encoding: chunked. Useful for debugging, in conjunction with --output-stdout")
+	fs.DurationVar(&s.ShutdownTimeout, "shutdown-timeout", 10*time.Second, "On exit or SIGTERM, inputs are stopped first and outputs are given this time to send queued and in-flight messages. Set to 0 to exit immediately")
+
+	fs.BoolVar(&s.SplitOutput, "split-output", false, "By default each output gets same traffic. If set to `true` it splits traffic equally among all outputs.")
+	fs.Var(&s.Routes, "route", "Send messages matching an expression only to the given outputs, referenced by their address. Rules are evaluated in order, the first matching one wins, and responses follow their request. Outputs not used in any route receive everything:\n\t gor --input-raw :80 --output-http http://api.staging --output-http http://admin.staging --output-file other.gor --route 'host.startsWith(\"api.\") => http://api.staging' --route 'path.startsWith(\"/admin\") => http://admin.staging' --route 'true => other.gor'")
+	fs.IntVar(&s.OutputQueueConfig.Size, "output-queue-size", 0, "Size of the queue of each output. With a queue every output is written from its own goroutine, so a slow output does not stall the others. By default outputs are written synchronously")
+	fs.Var(&s.OutputQueueConfig.Policies, "output-queue-policy", "What to do when an output queue is full: block, drop-newest, drop-oldest or spill (to disk). Applies to all outputs, or to a single one when prefixed by its address:\n\t gor --input-raw :80 --output-http http://staging --output-file requests.gor --output-queue-size 1000 --output-queue-policy drop-oldest --output-queue-policy requests.gor=spill")
+	fs.StringVar(&s.OutputQueueConfig.SpillDir, "output-queue-spill-dir", "", "Directory for messages spilled by the `spill` queue policy. Defaults to the system temporary directory")
+	fs.Var(&s.MetaFields, "meta-field", "Add a key=value field to meta of all messages, like the environment of the capture. Fields are kept by files, middleware and other outputs, and can be used by --filter and --route as meta[\"key\"]:\n\t gor --input-raw :80 --output-file requests.gor --meta-field env=prod --meta-field dc=eu-1")
+	fs.BoolVar(&s.RecognizeTCPSessions, "recognize-tcp-sessions", false, "[PRO] If turned on http output will create separate worker for each TCP session. Splitting output will session based as well.")
+
+	fs.Var(&s.InputDummy, "input-dummy", "Used for testing outputs. Emits 'Get /' request every 1s")
+	fs.BoolVar(&s.OutputStdout, "output-stdout", false, "Used for testing inputs. Just prints to console data coming from inputs.")
+	fs.BoolVar(&s.OutputNull, "output-null", false, "Used for testing inputs. Drops all requests.")
+
+	fs.Var(&s.InputTCP, "input-tcp", "Used for internal communication between Gor instances. Example: \n\t# Receive requests from other Gor instances on 28020 port, and redirect output to staging\n\tgor --input-tcp :28020 --output-http staging.com")
+	fs.BoolVar(&s.InputTCPConfig.Secure, "input-tcp-secure", false, "Turn on TLS security. Do not forget to specify certificate and key files.")
+	fs.StringVar(&s.InputTCPConfig.CertificatePath, "input-tcp-certificate", "", "Path to PEM encoded certificate file. Used when TLS turned on.")
+	fs.StringVar(&s.InputTCPConfig.KeyPath, "input-tcp-certificate-key", "", "Path to PEM encoded certificate key file. Used when TLS turned on.")
+
+	fs.Var(&s.OutputTCP, "output-tcp", "Used for internal communication between Gor instances. Example: \n\t# Listen for requests on 80 port and forward them to other Gor instance on 28020 port\n\tgor --input-raw :80 --output-tcp replay.local:28020")
+	fs.BoolVar(&s.OutputTCPConfig.Secure, "output-tcp-secure", false, "Use TLS secure connection. --input-file on another end should have TLS turned on as well.")
+	fs.BoolVar(&s.OutputTCPConfig.SkipVerify, "output-tcp-skip-verify", false, "Don't verify hostname on TLS secure connection.")
+	fs.BoolVar(&s.OutputTCPConfig.Sticky, "output-tcp-sticky", false, "Use Sticky connection. Request/Response with same ID will be sent to the same connection.")
+	fs.IntVar(&s.OutputTCPConfig.Workers, "output-tcp-workers", 10, "Number of parallel tcp connections, default is 10")
+	fs.BoolVar(&s.OutputTCPConfig.Stats, "output-tcp-stats", false, "Report TCP output queue stats to console every 5 seconds.")
+
+	fs.Var(&s.InputFile, "input-file", "Read requests from file: \n\tgor --input-file ./requests.gor --output-http staging.com")
+	fs.BoolVar(&s.InputFileLoop, "input-file-loop", false, "Loop input files, useful for performance testing.")
+	fs.IntVar(&s.InputFileReadDepth, "input-file-read-depth", 100, "GoReplay tries to read and cache multiple records, in advance. In parallel it also perform sorting of requests, if they came out of order. Since it needs hold this buffer in memory, bigger values can cause worse performance")
+	fs.BoolVar(&s.InputFileDryRun, "input-file-dry-run", false, "Simulate reading from the data source without replaying it. You will get information about expected replay time, number of found records etc.")
+	fs.DurationVar(&s.InputFileMaxWait, "input-file-max-wait", 0, "Set the maximum time between requests. Can help in situations when you have too long periods between request, and you want to skip them. Example: --input-raw-max-wait 1s")
+	fs.Var(&s.InputFileStartAt, "input-file-start-at", "Replay requests recorded since the given time: RFC3339 time, unix nanoseconds, time of day on the day of the first request, or time since the first request. Files with time index are read from that position:\n\tgor --input-file 'requests_*.gor' --input-file-start-at 14:00 --input-file-end-at 14:15 --output-http staging.com")
+	fs.Var(&s.InputFileEndAt, "input-file-end-at", "Replay requests recorded until the given time, same formats as --input-file-start-at, like +15m")
+
+	fs.Var(&s.InputAccessLog, "input-accesslog", "Read requests from access logs, replayed with the timing of the log like --input-file, and with the same --input-file-* options. Requests have the method, URL, host and headers found in the log, without bodies:\n\tgor --input-accesslog '/var/log/nginx/access.log*' --output-http staging.com --http-allow-method GET --http-allow-method HEAD")
+	fs.StringVar(&s.InputAccessLogConfig.Format, "input-accesslog-format", "combined", "Format of access logs: combined (nginx and Apache), common, alb, elb, cloudfront, or a custom format with nginx variables, where $http_<name> variables are headers:\n\tgor --input-accesslog access.log --input-accesslog-format '$remote_addr [$time_iso8601] \"$request\" $status \"$http_user_agent\" $host' --output-http staging.com")
+
+	fs.Var(&s.OutputFile, "output-file", "Write incoming requests to file: \n\tgor --input-raw :80 --output-file ./requests.gor")
+	fs.DurationVar(&s.OutputFileConfig.FlushInterval, "output-file-flush-interval", time.Second, "Interval for forcing buffer flush to the file, default: 1s.")
+	fs.BoolVar(&s.OutputFileConfig.Append, "output-file-append", false, "The flushed chunk is appended to existence file or not. ")
+	fs.Var(&s.OutputFileConfig.SizeLimit, "output-file-size-limit", "Size of each chunk. Default: 32mb")
+	fs.IntVar(&s.OutputFileConfig.QueueLimit, "output-file-queue-limit", 256, "The length of the chunk queue. Default: 256")
+	fs.Var(&s.OutputFileConfig.OutputFileMaxSize, "output-file-max-size-limit", "Max size of output file, Default: 1TB")
+	fs.StringVar(&s.OutputFileConfig.Compression, "output-file-compression", "", "Compress files with gzip, zstd or lz4, by default it's chosen by extension: .gz, .zst or .lz4. zstd and lz4 files are flushed in independent frames, so they are readable if Gor crashes:\n\tgor --input-raw :80 --output-file requests.gor.zst")
+	fs.IntVar(&s.OutputFileConfig.CompressionLevel, "output-file-compression-level", 0, "Compression level: 1-9 for gzip, 1-22 for zstd, 0 for fastest lz4 and higher values for better lz4 compression. Default level of the compression if 0.")
+	fs.BoolVar(&s.OutputFileConfig.Index, "output-file-index", false, "Write a time index next to each file, with .idx extension, so --input-file-start-at can seek to a position without reading the file from the start.")
+	fs.Var(&s.FileEncryptionKeys, "file-encryption-key", "AES-256 key of recorded files: a file path, or env:NAME for an environment variable, holding 32 bytes as hex, base64 or raw bytes. Files and S3 output are encrypted by the first key, --input-file decrypts files encrypted by any of the keys:\n\tgor --input-raw :80 --output-file requests.gor --file-encryption-key env:GOR_KEY")
+	fs.BoolVar(&s.FileEncryptionDataKeys, "file-encryption-data-keys", false, "Encrypt each file by a random data key, which is stored in the file encrypted by --file-encryption-key.")
+	fs.StringVar(&s.OutputFileConfig.Format, "output-file-format", "", "Format of written files: v1, payloads separated by a special line, v2, length framed records with checksums and a header describing the capture, or jsonl, a JSON object per message. Default: jsonl for files with .jsonl extension, v1 otherwise. --input-file reads all of them.")
+
+	fs.StringVar(&s.OutputFileConfig.BufferPath, "output-file-buffer", "/tmp", "The path for temporary storing current buffer: \n\tgor --input-raw :80 --output-file s3://mybucket/logs/%Y-%m-%d.gz --output-file-buffer /mnt/logs")
+
+	fs.Var(&s.OutputParquet, "output-parquet", "Write a row per request to Parquet files, with the method, host, path, query, status, sizes and latencies of the request, its response and the replayed response. Files are numbered, and rolled when the name changes or by size:\n\tgor --input-raw :80 --input-raw-track-response --output-parquet 'requests-%Y-%m-%d.parquet'")
+	fs.Var(&s.OutputParquetConfig.Headers, "output-parquet-header", "Store a request header as a column, named request_header_ followed by the header in lower case:\n\tgor --input-raw :80 --output-parquet requests.parquet --output-parquet-header User-Agent")
+	fs.Var(&s.OutputParquetConfig.ResponseHeaders, "output-parquet-response-header", "Store a response header as a column, named response_header_ followed by the header in lower case:\n\tgor --input-raw :80 --input-raw-track-response --output-parquet requests.parquet --output-parquet-response-header Content-Type")
+	fs.BoolVar(&s.OutputParquetConfig.Bodies, "output-parquet-bodies", false, "Store request and response bodies in request_body and response_body columns.")
+	fs.StringVar(&s.OutputParquetConfig.Compression, "output-parquet-compression", "snappy", "Compression of Parquet pages: snappy, gzip, zstd or none.")
+	fs.Var(&s.OutputParquetConfig.SizeLimit, "output-parquet-size-limit", "Size of each Parquet file, the next file is started once it is reached. Default: 256mb")
+	fs.IntVar(&s.OutputParquetConfig.RowGroupSize, "output-parquet-row-group-size", 10000, "Number of rows of each row group.")
+	fs.DurationVar(&s.OutputParquetConfig.ResponseTimeout, "output-parquet-response-timeout", 5*time.Second, "How long a request waits for its response and replayed response before its row is written.")
+
+	fs.BoolVar(&s.PrettifyHTTP, "prettify-http", false, "If enabled, will automatically decode requests and responses with: Content-Encoding: gzip and Transfer-Encoding: chunked. Useful for debugging, in conjunction with --output-stdout")
 
 	// input raw flags
-	flag.Var(&Settings.InputRAW, "input-raw", "Capture traffic from given port (use RAW sockets and require *sudo* access):\n\t# Capture traffic from 8080 port\n\tgor --input-raw :8080 --output-http staging.com")
-	flag.BoolVar(&Settings.TrackResponse, "input-raw-track-response", false, "If turned on Gor will track responses in addition to requests, and they will be available to middleware and file output.")
-	flag.Var(&Settings.Engine, "input-raw-engine", "Intercept traffic using `libpcap` (default), `raw_socket` or `pcap_file`")
-	flag.Var(&Settings.Protocol, "input-raw-protocol", "Specify application protocol of intercepted traffic. Possible values: http, binary")
-	flag.StringVar(&Settings.RealIPHeader, "input-raw-realip-header", "", "If not blank, injects header with given name and real IP value to the request payload. Usually this header should be named: X-Real-IP")
-	flag.DurationVar(&Settings.Expire, "input-raw-expire", time.Second*2, "How much it should wait for the last TCP packet, till consider that TCP message complete.")
-	flag.StringVar(&Settings.BPFFilter, "input-raw-bpf-filter", "", "BPF filter to write custom expressions. Can be useful in case of non standard network interfaces like tunneling or SPAN port. Example: --input-raw-bpf-filter 'dst port 80'")
-	flag.StringVar(&Settings.TimestampType, "input-raw-timestamp-type", "", "Possible values: PCAP_TSTAMP_HOST, PCAP_TSTAMP_HOST_LOWPREC, PCAP_TSTAMP_HOST_HIPREC, PCAP_TSTAMP_ADAPTER, PCAP_TSTAMP_ADAPTER_UNSYNCED. This values not supported on all systems, GoReplay will tell you available values of you put wrong one.")
-	flag.Var(&Settings.CopyBufferSize, "copy-buffer-size", "Set the buffer size for an individual request (default 5MB)")
-	flag.BoolVar(&Settings.Snaplen, "input-raw-override-snaplen", false, "Override the capture snaplen to be 64k. Required for some Virtualized environments")
-	flag.DurationVar(&Settings.BufferTimeout, "input-raw-buffer-timeout", 0, "set the pcap timeout. for immediate mode don't set this flag")
-	flag.Var(&Settings.BufferSize, "input-raw-buffer-size", "Controls size of the OS buffer which holds packets until they dispatched. Default value depends by system: in Linux around 2MB. If you see big package drop, increase this value.")
-	flag.BoolVar(&Settings.Promiscuous, "input-raw-promisc", false, "enable promiscuous mode")
-	flag.BoolVar(&Settings.Monitor, "input-raw-monitor", false, "enable RF monitor mode")
-	flag.BoolVar(&Settings.Stats, "input-raw-stats", false, "enable stats generator on raw TCP messages")
-	flag.BoolVar(&Settings.AllowIncomplete, "input-raw-allow-incomplete", false, "If turned on Gor will record HTTP messages with missing packets")
-
-	flag.StringVar(&Settings.Middleware, "middleware", "", "Used for modifying traffic using external command")
-
-	flag.Var(&Settings.OutputHTTP, "output-http", "Forwards incoming requests to given http address.\n\t# Redirect all incoming requests to staging.com address \n\tgor --input-raw :80 --output-http http://staging.com")
+	fs.Var(&s.InputRAW, "input-raw", "Capture traffic from given port (use RAW sockets and require *sudo* access):\n\t# Capture traffic from 8080 port\n\tgor --input-raw :8080 --output-http staging.com")
+	fs.BoolVar(&s.TrackResponse, "input-raw-track-response", false, "If turned on Gor will track responses in addition to requests, and they will be available to middleware and file output.")
+	fs.Var(&s.Engine, "input-raw-engine", "Intercept traffic using `libpcap` (default), `raw_socket` or `pcap_file`")
+	fs.Var(&s.Protocol, "input-raw-protocol", "Specify application protocol of intercepted traffic. Possible values: http, binary")
+	fs.StringVar(&s.RealIPHeader, "input-raw-realip-header", "", "If not blank, injects header with given name and real IP value to the request payload. Usually this header should be named: X-Real-IP")
+	fs.DurationVar(&s.Expire, "input-raw-expire", time.Second*2, "How much it should wait for the last TCP packet, till consider that TCP message complete.")
+	fs.StringVar(&s.BPFFilter, "input-raw-bpf-filter", "", "BPF filter to write custom expressions. Can be useful in case of non standard network interfaces like tunneling or SPAN port. Example: --input-raw-bpf-filter 'dst port 80'")
+	fs.StringVar(&s.TimestampType, "input-raw-timestamp-type", "", "Possible values: PCAP_TSTAMP_HOST, PCAP_TSTAMP_HOST_LOWPREC, PCAP_TSTAMP_HOST_HIPREC, PCAP_TSTAMP_ADAPTER, PCAP_TSTAMP_ADAPTER_UNSYNCED. This values not supported on all systems, GoReplay will tell you available values of you put wrong one.")
+	fs.Var(&s.CopyBufferSize, "copy-buffer-size", "Set the buffer size for an individual request (default 5MB)")
+	fs.BoolVar(&s.Snaplen, "input-raw-override-snaplen", false, "Override the capture snaplen to be 64k. Required for some Virtualized environments")
+	fs.DurationVar(&s.BufferTimeout, "input-raw-buffer-timeout", 0, "set the pcap timeout. for immediate mode don't set this flag")
+	fs.Var(&s.BufferSize, "input-raw-buffer-size", "Controls size of the OS buffer which holds packets until they dispatched. Default value depends by system: in Linux around 2MB. If you see big package drop, increase this value.")
+	fs.BoolVar(&s.Promiscuous, "input-raw-promisc", false, "enable promiscuous mode")
+	fs.BoolVar(&s.Monitor, "input-raw-monitor", false, "enable RF monitor mode")
+	fs.BoolVar(&s.Stats, "input-raw-stats", false, "enable stats generator on raw TCP messages")
+	fs.BoolVar(&s.Meta, "input-raw-meta", false, "Add source and destination addresses, connection, interface, and flags of truncated, timed out or incomplete messages to meta as key=value fields, like src=10.0.0.1:5432. They are kept by files, middleware and other outputs, and can be used by --filter and --route as meta[\"src\"]")
+	fs.BoolVar(&s.AllowIncomplete, "input-raw-allow-incomplete", false, "If turned on Gor will record HTTP messages with missing packets")
+
+	fs.Var(&s.Middleware, "middleware", "Used for modifying traffic using external command. Can be specified multiple times, commands are chained in order:\n\tgor --input-raw :80 --middleware ./auth.py --middleware ./scrub.sh --output-http staging.com")
+	fs.StringVar(&s.MiddlewareConfig.Protocol, "middleware-protocol", "hex", "Middleware communication protocol: `hex` (one hex encoded message per line), `binary` (length-prefixed meta and body) or `auto` (middleware opts into binary by printing the handshake line)")
+	fs.DurationVar(&s.MiddlewareConfig.HandshakeTimeout, "middleware-handshake-timeout", time.Second, "How long to wait for the middleware handshake when --middleware-protocol is `auto`, before falling back to hex.")
+	fs.IntVar(&s.MiddlewareConfig.QueueLen, "middleware-queue-len", 1000, "Number of messages which can wait for the middleware. When the queue is full, reading from inputs is paused.")
+	fs.DurationVar(&s.MiddlewareConfig.Timeout, "middleware-timeout", 0, "How long the middleware has to answer a message, after that --middleware-timeout-action applies. By default messages wait forever.")
+	fs.StringVar(&s.MiddlewareConfig.TimeoutAction, "middleware-timeout-action", "drop", "What to do with messages not answered in time or sent while the middleware is restarting: `drop` them or `pass` them through unmodified.")
+	fs.IntVar(&s.MiddlewareConfig.MaxRestarts, "middleware-max-restarts", -1, "How many times an exited middleware is restarted, 0 disables restarts. Default: unlimited")
+	fs.DurationVar(&s.MiddlewareConfig.RestartBackoff, "middleware-restart-backoff", 100*time.Millisecond, "Delay before the first middleware restart, doubled on every consecutive restart.")
+	fs.DurationVar(&s.MiddlewareConfig.RestartMaxBackoff, "middleware-restart-max-backoff", 30*time.Second, "Maximum delay between middleware restarts.")
+
+	fs.Var(&s.OutputHTTP, "output-http", "Forwards incoming requests to given http address.\n\t# Redirect all incoming requests to staging.com address \n\tgor --input-raw :80 --output-http http://staging.com")
 
 	/* outputHTTPConfig */
-	flag.Var(&Settings.OutputHTTPConfig.BufferSize, "output-http-response-buffer", "HTTP response buffer size, all data after this size will be discarded.")
-	flag.IntVar(&Settings.OutputHTTPConfig.WorkersMin, "output-http-workers-min", 0, "Gor uses dynamic worker scaling. Enter a number to set a minimum number of workers. default = 1.")
-	flag.IntVar(&Settings.OutputHTTPConfig.WorkersMax, "output-http-workers", 0, "Gor uses dynamic worker scaling. Enter a number to set a maximum number of workers. default = 0 = unlimited.")
-	flag.IntVar(&Settings.OutputHTTPConfig.QueueLen, "output-http-queue-len", 1000, "Number of requests that can be queued for output, if all workers are busy. default = 1000")
-	flag.BoolVar(&Settings.OutputHTTPConfig.SkipVerify, "output-http-skip-verify", false, "Don't verify hostname on TLS secure connection.")
-	flag.DurationVar(&Settings.OutputHTTPConfig.WorkerTimeout, "output-http-worker-timeout", 2*time.Second, "Duration to rollback idle workers.")
-
-	flag.IntVar(&Settings.OutputHTTPConfig.RedirectLimit, "output-http-redirects", 0, "Enable how often redirects should be followed.")
-	flag.DurationVar(&Settings.OutputHTTPConfig.Timeout, "output-http-timeout", 5*time.Second, "Specify HTTP request/response timeout. By default 5s. Example: --output-http-timeout 30s")
-	flag.BoolVar(&Settings.OutputHTTPConfig.TrackResponses, "output-http-track-response", false, "If turned on, HTTP output responses will be set to all outputs like stdout, file and etc.")
-
-	flag.BoolVar(&Settings.OutputHTTPConfig.Stats, "output-http-stats", false, "Report http output queue stats to console every N milliseconds. See output-http-stats-ms")
-	flag.IntVar(&Settings.OutputHTTPConfig.StatsMs, "output-http-stats-ms", 5000, "Report http output queue stats to console every N milliseconds. default: 5000")
-	flag.BoolVar(&Settings.OutputHTTPConfig.OriginalHost, "http-original-host", false, "Normally gor replaces the Host http header with the host supplied with --output-http.  This option disables that behavior, preserving the original Host header.")
-	flag.StringVar(&Settings.OutputHTTPConfig.ElasticSearch, "output-http-elasticsearch", "", "Send request and response stats to ElasticSearch:\n\tgor --input-raw :8080 --output-http staging.com --output-http-elasticsearch 'es_host:api_port/index_name'")
+	fs.Var(&s.OutputHTTPConfig.BufferSize, "output-http-response-buffer", "HTTP response buffer size, all data after this size will be discarded.")
+	fs.IntVar(&s.OutputHTTPConfig.WorkersMin, "output-http-workers-min", 0, "Gor uses dynamic worker scaling. Enter a number to set a minimum number of workers. default = 1.")
+	fs.IntVar(&s.OutputHTTPConfig.WorkersMax, "output-http-workers", 0, "Gor uses dynamic worker scaling. Enter a number to set a maximum number of workers. default = 0 = unlimited.")
+	fs.IntVar(&s.OutputHTTPConfig.QueueLen, "output-http-queue-len", 1000, "Number of requests that can be queued for output, if all workers are busy. default = 1000")
+	fs.BoolVar(&s.OutputHTTPConfig.SkipVerify, "output-http-skip-verify", false, "Don't verify hostname on TLS secure connection.")
+	fs.DurationVar(&s.OutputHTTPConfig.WorkerTimeout, "output-http-worker-timeout", 2*time.Second, "Duration to rollback idle workers.")
+
+	fs.IntVar(&s.OutputHTTPConfig.RedirectLimit, "output-http-redirects", 0, "Enable how often redirects should be followed.")
+	fs.DurationVar(&s.OutputHTTPConfig.Timeout, "output-http-timeout", 5*time.Second, "Specify HTTP request/response timeout. By default 5s. Example: --output-http-timeout 30s")
+	fs.BoolVar(&s.OutputHTTPConfig.TrackResponses, "output-http-track-response", false, "If turned on, HTTP output responses will be set to all outputs like stdout, file and etc.")
+
+	fs.BoolVar(&s.OutputHTTPConfig.Stats, "output-http-stats", false, "Report http output queue stats to console every N milliseconds. See output-http-stats-ms")
+	fs.IntVar(&s.OutputHTTPConfig.StatsMs, "output-http-stats-ms", 5000, "Report http output queue stats to console every N milliseconds. default: 5000")
+	fs.BoolVar(&s.OutputHTTPConfig.OriginalHost, "http-original-host", false, "Normally gor replaces the Host http header with the host supplied with --output-http.  This option disables that behavior, preserving the original Host header.")
+	fs.StringVar(&s.OutputHTTPConfig.ElasticSearch, "output-http-elasticsearch", "", "Send request and response stats to ElasticSearch:\n\tgor --input-raw :8080 --output-http staging.com --output-http-elasticsearch 'es_host:api_port/index_name'")
+
+	fs.BoolVar(&s.OutputHTTPConfig.Adaptive.Enabled, "output-http-adaptive", false, "Adapt the rate of replayed requests to health of the target: halve it when latency or error rate exceed the bounds, and raise it back step by step. Requests above the rate are dropped.")
+	fs.DurationVar(&s.OutputHTTPConfig.Adaptive.MaxLatency, "output-http-adaptive-max-latency", time.Second, "Maximum 95th percentile of response time for the target to be healthy.")
+	fs.Float64Var(&s.OutputHTTPConfig.Adaptive.MaxErrorRate, "output-http-adaptive-max-error-rate", 0.05, "Maximum share of timeouts, connection errors and 5xx responses for the target to be healthy.")
+	fs.IntVar(&s.OutputHTTPConfig.Adaptive.MinRate, "output-http-adaptive-min-rate", 1, "Requests per second which are admitted however unhealthy the target is.")
+	fs.IntVar(&s.OutputHTTPConfig.Adaptive.MaxRate, "output-http-adaptive-max-rate", 0, "Maximum requests per second, and the initial rate. Default: 0 = unlimited.")
+	fs.IntVar(&s.OutputHTTPConfig.Adaptive.Step, "output-http-adaptive-step", 10, "Requests per second added to the rate after each healthy interval.")
+	fs.DurationVar(&s.OutputHTTPConfig.Adaptive.Interval, "output-http-adaptive-interval", time.Second, "How often health of the target is evaluated.")
 	/* outputHTTPConfig */
 
-	flag.Var(&Settings.OutputBinary, "output-binary", "Forwards incoming binary payloads to given address.\n\t# Redirect all incoming requests to staging.com address \n\tgor --input-raw :80 --input-raw-protocol binary --output-binary staging.com:80")
+	fs.BoolVar(&s.LatencyStats.Enabled, "latency-stats", false, "Report 50th, 90th, 99th and 99.9th percentiles of replayed requests latency, by method and route. Routes are learned from paths, replacing ids by `{id}`, or set by --latency-route.")
+	fs.DurationVar(&s.LatencyStats.Interval, "latency-stats-interval", 10*time.Second, "How often latency of the last interval is reported, 0 reports only at the end of replay.")
+	fs.Var(&s.LatencyStats.Routes, "latency-route", "A route paths are grouped by in latency stats, `{name}` matches any path segment:\n\tgor --input-file requests.gor --output-http staging.com --latency-stats --latency-route '/users/{id}/orders/{order}'")
+	fs.StringVar(&s.LatencyStats.File, "latency-stats-file", "", "Write latency stats to the file at the end of replay.")
+	fs.StringVar(&s.LatencyStats.Format, "latency-stats-format", "", "Format of --latency-stats-file: json or csv. Default: csv for files with .csv extension, json otherwise.")
+
+	fs.BoolVar(&s.LatencyRegression.Enabled, "latency-regression", false, "Compare latency of replayed requests with the original one by method and route, and report endpoints which got slower at the end. Requires original responses, from --input-raw-track-response or a file recorded with it. Turns on --output-http-track-response:\n\tgor --input-raw :80 --input-raw-track-response --output-http staging.com --latency-regression --latency-regression-file regressions.json")
+	fs.Float64Var(&s.LatencyRegression.Threshold, "latency-regression-threshold", 0.2, "An endpoint regressed if its replayed p95 latency exceeds the original one by more than this share.")
+	fs.IntVar(&s.LatencyRegression.MinCount, "latency-regression-min-count", 20, "Minimum number of compared requests for an endpoint to be flagged as regressed.")
+	fs.StringVar(&s.LatencyRegression.File, "latency-regression-file", "", "Write the latency regression report to the file as JSON.")
+
+	fs.Var(&s.LoadTestConfig.Profile, "load-profile", "Replay recorded traffic amplified by factors changing over time, and report latency and errors of each phase. Holds are `Nx:duration`, ramps are `Ax-Bx:duration`. Gor exits once the profile is over:\n\tgor --input-file requests.gor --output-http staging.com --load-profile '1x:5m,1x-4x:10m,4x:10m,10x:30s'")
+	fs.StringVar(&s.LoadTestConfig.Amplify, "load-amplify", "time", "How traffic is amplified in load test mode: `time` replays files faster, `fanout` sends each request several times with unique ids.")
+	fs.StringVar(&s.LoadTestConfig.Report, "load-report", "", "Write the load test report to the file as JSON.")
+
+	fs.Var(&s.OutputBinary, "output-binary", "Forwards incoming binary payloads to given address.\n\t# Redirect all incoming requests to staging.com address \n\tgor --input-raw :80 --input-raw-protocol binary --output-binary staging.com:80")
 
 	/* outputBinaryConfig */
-	flag.Var(&Settings.OutputBinaryConfig.BufferSize, "output-tcp-response-buffer", "TCP response buffer size, all data after this size will be discarded.")
-	flag.IntVar(&Settings.OutputBinaryConfig.Workers, "output-binary-workers", 0, "Gor uses dynamic worker scaling by default.  Enter a number to run a set number of workers.")
-	flag.DurationVar(&Settings.OutputBinaryConfig.Timeout, "output-binary-timeout", 0, "Specify HTTP request/response timeout. By default 5s. Example: --output-binary-timeout 30s")
-	flag.BoolVar(&Settings.OutputBinaryConfig.TrackResponses, "output-binary-track-response", false, "If turned on, Binary output responses will be set to all outputs like stdout, file and etc.")
+	fs.Var(&s.OutputBinaryConfig.BufferSize, "output-tcp-response-buffer", "TCP response buffer size, all data after this size will be discarded.")
+	fs.IntVar(&s.OutputBinaryConfig.Workers, "output-binary-workers", 0, "Gor uses dynamic worker scaling by default.  Enter a number to run a set number of workers.")
+	fs.DurationVar(&s.OutputBinaryConfig.Timeout, "output-binary-timeout", 0, "Specify HTTP request/response timeout. By default 5s. Example: --output-binary-timeout 30s")
+	fs.BoolVar(&s.OutputBinaryConfig.TrackResponses, "output-binary-track-response", false, "If turned on, Binary output responses will be set to all outputs like stdout, file and etc.")
 
-	flag.BoolVar(&Settings.OutputBinaryConfig.Debug, "output-binary-debug", false, "Enables binary debug output.")
+	fs.BoolVar(&s.OutputBinaryConfig.Debug, "output-binary-debug", false, "Enables binary debug output.")
 	/* outputBinaryConfig */
 
-	flag.StringVar(&Settings.OutputKafkaConfig.Host, "output-kafka-host", "", "Read request and response stats from Kafka:\n\tgor --input-raw :8080 --output-kafka-host '192.168.0.1:9092,192.168.0.2:9092'")
-	flag.StringVar(&Settings.OutputKafkaConfig.Topic, "output-kafka-topic", "", "Read request and response stats from Kafka:\n\tgor --input-raw :8080 --output-kafka-topic 'kafka-log'")
-	flag.BoolVar(&Settings.OutputKafkaConfig.UseJSON, "output-kafka-json-format", false, "If turned on, it will serialize messages from GoReplay text format to JSON.")
-
-	flag.StringVar(&Settings.InputKafkaConfig.Host, "input-kafka-host", "", "Send request and response stats to Kafka:\n\tgor --output-stdout --input-kafka-host '192.168.0.1:9092,192.168.0.2:9092'")
-	flag.StringVar(&Settings.InputKafkaConfig.Topic, "input-kafka-topic", "", "Send request and response stats to Kafka:\n\tgor --output-stdout --input-kafka-topic 'kafka-log'")
-	flag.BoolVar(&Settings.InputKafkaConfig.UseJSON, "input-kafka-json-format", false, "If turned on, it will assume that messages coming in JSON format rather than  GoReplay text format.")
-
-	flag.StringVar(&Settings.KafkaTLSConfig.CACert, "kafka-tls-ca-cert", "", "CA certificate for Kafka TLS Config:\n\tgor  --input-raw :3000 --output-kafka-host '192.168.0.1:9092' --output-kafka-topic 'topic' --kafka-tls-ca-cert cacert.cer.pem --kafka-tls-client-cert client.cer.pem --kafka-tls-client-key client.key.pem")
-	flag.StringVar(&Settings.KafkaTLSConfig.ClientCert, "kafka-tls-client-cert", "", "Client certificate for Kafka TLS Config (mandatory with to kafka-tls-ca-cert and kafka-tls-client-key)")
-	flag.StringVar(&Settings.KafkaTLSConfig.ClientKey, "kafka-tls-client-key", "", "Client Key for Kafka TLS Config (mandatory with to kafka-tls-client-cert and kafka-tls-client-key)")
-
-	flag.Var(&Settings.ModifierConfig.Headers, "http-set-header", "Inject additional headers to http request:\n\tgor --input-raw :8080 --output-http staging.com --http-set-header 'User-Agent: Gor'")
-	flag.Var(&Settings.ModifierConfig.HeaderRewrite, "http-rewrite-header", "Rewrite the request header based on a mapping:\n\tgor --input-raw :8080 --output-http staging.com --http-rewrite-header Host: (.*).example.com,$1.beta.example.com")
-	flag.Var(&Settings.ModifierConfig.Params, "http-set-param", "Set request url param, if param already exists it will be overwritten:\n\tgor --input-raw :8080 --output-http staging.com --http-set-param api_key=1")
-	flag.Var(&Settings.ModifierConfig.Methods, "http-allow-method", "Whitelist of HTTP methods to replay. Anything else will be dropped:\n\tgor --input-raw :8080 --output-http staging.com --http-allow-method GET --http-allow-method OPTIONS")
-	flag.Var(&Settings.ModifierConfig.URLRegexp, "http-allow-url", "A regexp to match requests against. Filter get matched against full url with domain. Anything else will be dropped:\n\t gor --input-raw :8080 --output-http staging.com --http-allow-url ^www.")
-	flag.Var(&Settings.ModifierConfig.URLNegativeRegexp, "http-disallow-url", "A regexp to match requests against. Filter get matched against full url with domain. Anything else will be forwarded:\n\t gor --input-raw :8080 --output-http staging.com --http-disallow-url ^www.")
-	flag.Var(&Settings.ModifierConfig.URLRewrite, "http-rewrite-url", "Rewrite the request url based on a mapping:\n\tgor --input-raw :8080 --output-http staging.com --http-rewrite-url /v1/user/([^\\/]+)/ping:/v2/user/$1/ping")
-	flag.Var(&Settings.ModifierConfig.HeaderFilters, "http-allow-header", "A regexp to match a specific header against. Requests with non-matching headers will be dropped:\n\t gor --input-raw :8080 --output-http staging.com --http-allow-header api-version:^v1")
-	flag.Var(&Settings.ModifierConfig.HeaderNegativeFilters, "http-disallow-header", "A regexp to match a specific header against. Requests with matching headers will be dropped:\n\t gor --input-raw :8080 --output-http staging.com --http-disallow-header \"User-Agent: Replayed by Gor\"")
-	flag.Var(&Settings.ModifierConfig.HeaderBasicAuthFilters, "http-basic-auth-filter", "A regexp to match the decoded basic auth string against. Requests with non-matching headers will be dropped:\n\t gor --input-raw :8080 --output-http staging.com --http-basic-auth-filter \"^customer[0-9].*\"")
-	flag.Var(&Settings.ModifierConfig.HeaderHashFilters, "http-header-limiter", "Takes a fraction of requests, consistently taking or rejecting a request based on the FNV32-1A hash of a specific header:\n\t gor --input-raw :8080 --output-http staging.com --http-header-limiter user-id:25%")
-	flag.Var(&Settings.ModifierConfig.ParamHashFilters, "http-param-limiter", "Takes a fraction of requests, consistently taking or rejecting a request based on the FNV32-1A hash of a specific GET param:\n\t gor --input-raw :8080 --output-http staging.com --http-param-limiter user_id:25%")
+	fs.StringVar(&s.OutputKafkaConfig.Host, "output-kafka-host", "", "Read request and response stats from Kafka:\n\tgor --input-raw :8080 --output-kafka-host '192.168.0.1:9092,192.168.0.2:9092'")
+	fs.StringVar(&s.OutputKafkaConfig.Topic, "output-kafka-topic", "", "Read request and response stats from Kafka:\n\tgor --input-raw :8080 --output-kafka-topic 'kafka-log'")
+	fs.BoolVar(&s.OutputKafkaConfig.UseJSON, "output-kafka-json-format", false, "If turned on, it will serialize messages from GoReplay text format to JSON.")
+
+	fs.StringVar(&s.InputKafkaConfig.Host, "input-kafka-host", "", "Send request and response stats to Kafka:\n\tgor --output-stdout --input-kafka-host '192.168.0.1:9092,192.168.0.2:9092'")
+	fs.StringVar(&s.InputKafkaConfig.Topic, "input-kafka-topic", "", "Send request and response stats to Kafka:\n\tgor --output-stdout --input-kafka-topic 'kafka-log'")
+	fs.BoolVar(&s.InputKafkaConfig.UseJSON, "input-kafka-json-format", false, "If turned on, it will assume that messages coming in JSON format rather than  GoReplay text format.")
+
+	fs.StringVar(&s.KafkaTLSConfig.CACert, "kafka-tls-ca-cert", "", "CA certificate for Kafka TLS Config:\n\tgor  --input-raw :3000 --output-kafka-host '192.168.0.1:9092' --output-kafka-topic 'topic' --kafka-tls-ca-cert cacert.cer.pem --kafka-tls-client-cert client.cer.pem --kafka-tls-client-key client.key.pem")
+	fs.StringVar(&s.KafkaTLSConfig.ClientCert, "kafka-tls-client-cert", "", "Client certificate for Kafka TLS Config (mandatory with to kafka-tls-ca-cert and kafka-tls-client-key)")
+	fs.StringVar(&s.KafkaTLSConfig.ClientKey, "kafka-tls-client-key", "", "Client Key for Kafka TLS Config (mandatory with to kafka-tls-client-cert and kafka-tls-client-key)")
+
+	fs.Var(&s.ModifierConfig.Headers, "http-set-header", "Inject additional headers to http request:\n\tgor --input-raw :8080 --output-http staging.com --http-set-header 'User-Agent: Gor'")
+	fs.Var(&s.ModifierConfig.HeaderRewrite, "http-rewrite-header", "Rewrite the request header based on a mapping:\n\tgor --input-raw :8080 --output-http staging.com --http-rewrite-header Host: (.*).example.com,$1.beta.example.com")
+	fs.Var(&s.ModifierConfig.Params, "http-set-param", "Set request url param, if param already exists it will be overwritten:\n\tgor --input-raw :8080 --output-http staging.com --http-set-param api_key=1")
+	fs.Var(&s.ModifierConfig.Methods, "http-allow-method", "Whitelist of HTTP methods to replay. Anything else will be dropped:\n\tgor --input-raw :8080 --output-http staging.com --http-allow-method GET --http-allow-method OPTIONS")
+	fs.Var(&s.ModifierConfig.URLRegexp, "http-allow-url", "A regexp to match requests against. Filter get matched against full url with domain. Anything else will be dropped:\n\t gor --input-raw :8080 --output-http staging.com --http-allow-url ^www.")
+	fs.Var(&s.ModifierConfig.URLNegativeRegexp, "http-disallow-url", "A regexp to match requests against. Filter get matched against full url with domain. Anything else will be forwarded:\n\t gor --input-raw :8080 --output-http staging.com --http-disallow-url ^www.")
+	fs.Var(&s.ModifierConfig.URLRewrite, "http-rewrite-url", "Rewrite the request url based on a mapping:\n\tgor --input-raw :8080 --output-http staging.com --http-rewrite-url /v1/user/([^\\/]+)/ping:/v2/user/$1/ping")
+	fs.Var(&s.ModifierConfig.HeaderFilters, "http-allow-header", "A regexp to match a specific header against. Requests with non-matching headers will be dropped:\n\t gor --input-raw :8080 --output-http staging.com --http-allow-header api-version:^v1")
+	fs.Var(&s.ModifierConfig.HeaderNegativeFilters, "http-disallow-header", "A regexp to match a specific header against. Requests with matching headers will be dropped:\n\t gor --input-raw :8080 --output-http staging.com --http-disallow-header \"User-Agent: Replayed by Gor\"")
+	fs.Var(&s.ModifierConfig.HeaderBasicAuthFilters, "http-basic-auth-filter", "A regexp to match the decoded basic auth string against. Requests with non-matching headers will be dropped:\n\t gor --input-raw :8080 --output-http staging.com --http-basic-auth-filter \"^customer[0-9].*\"")
+	fs.Var(&s.ModifierConfig.HeaderHashFilters, "http-header-limiter", "Takes a fraction of requests, consistently taking or rejecting a request based on the FNV32-1A hash of a specific header:\n\t gor --input-raw :8080 --output-http staging.com --http-header-limiter user-id:25%")
+	fs.Var(&s.ModifierConfig.ParamHashFilters, "http-param-limiter", "Takes a fraction of requests, consistently taking or rejecting a request based on the FNV32-1A hash of a specific GET param:\n\t gor --input-raw :8080 --output-http staging.com --http-param-limiter user_id:25%")
+
+	fs.Var(&s.ModifierConfig.Filters, "filter", "An expression requests should match, anything else will be dropped. Can be specified multiple times, all expressions should match. See docs/Request-filtering.md for the syntax:\n\t gor --input-raw :8080 --output-http staging.com --filter 'method == \"POST\" && path.startsWith(\"/orders\") && size(body) > 1kb || method == \"DELETE\"'")
+	fs.Var(&s.ModifierConfig.ResponseFilters, "filter-response", "An expression responses and replayed responses should match, anything else will be dropped:\n\t gor --input-raw :8080 --input-raw-track-response --output-file errors.gor --filter-response 'status >= 500 || latency > 1s'")
+
+	fs.Var(&s.ModifierConfig.JSONSet, "http-set-json", "Set a field of JSON request bodies, creating it if needed. Value is used as JSON if valid, as a string otherwise:\n\t gor --input-raw :8080 --output-http staging.com --http-set-json 'user.tenant=staging'")
+	fs.Var(&s.ModifierConfig.JSONDelete, "http-delete-json", "Remove a field from JSON request bodies. Use numbers for array indexes and `*` to match any key or index:\n\t gor --input-raw :8080 --output-http staging.com --http-delete-json 'card.number'")
+	fs.Var(&s.ModifierConfig.FormSet, "http-set-form", "Set a field of form encoded request bodies, adding it if missing:\n\t gor --input-raw :8080 --output-http staging.com --http-set-form 'tenant=staging'")
+	fs.Var(&s.ModifierConfig.FormDelete, "http-delete-form", "Remove a field from form encoded request bodies:\n\t gor --input-raw :8080 --output-http staging.com --http-delete-form 'password'")
+	fs.Var(&s.ModifierConfig.XMLSet, "http-set-xml", "Set the text of matching elements (or an attribute using `@name`) of XML/SOAP request bodies. Namespace prefixes are ignored, `//` matches at any depth:\n\t gor --input-raw :8080 --output-http staging.com --http-set-xml '/Envelope/Body/Login/tenant=staging'")
+	fs.Var(&s.ModifierConfig.XMLDelete, "http-delete-xml", "Remove matching elements or attributes from XML/SOAP request bodies:\n\t gor --input-raw :8080 --output-http staging.com --http-delete-xml '//CardNumber'")
+
+	fs.Var(&s.Redact.Patterns, "redact", "Replace personal data in requests and responses as inputs read them, before middleware, rewrites and filters: card, email, phone, jwt, or a custom name=regexp pattern, only the first group is replaced if the pattern has groups:\n\t gor --input-raw :8080 --output-file requests.gor --redact card --redact email --redact 'user=user_id=(\\w+)'")
+	fs.Var(&s.Redact.Headers, "redact-header", "Replace the value of the header in requests and responses:\n\t gor --input-raw :8080 --output-file requests.gor --redact-header Authorization --redact-header Cookie")
+	fs.Var(&s.Redact.JSONFields, "redact-json", "Replace a field of JSON request and response bodies, with paths as in --http-set-json. Objects and arrays are replaced entirely:\n\t gor --input-raw :8080 --output-file requests.gor --redact-json 'user.email' --redact-json 'items.*.card'")
+	fs.StringVar(&s.Redact.Mode, "redact-mode", "mask", "How values are replaced: mask replaces letters and digits with *, hash replaces them with a pseudonym derived from the value by HMAC with --redact-key, so the same value always gets the same pseudonym")
+	fs.StringVar(&s.Redact.Key, "redact-key", "", "HMAC key of --redact-mode hash: a file path, or env:NAME for an environment variable")
 
 	// default values, using for tests
-	Settings.OutputFileConfig.SizeLimit = 33554432
-	Settings.OutputFileConfig.OutputFileMaxSize = 1099511627776
-	Settings.CopyBufferSize = 5242880
+	s.OutputFileConfig.SizeLimit = 33554432
+	s.OutputFileConfig.OutputFileMaxSize = 1099511627776
+	s.CopyBufferSize = 5242880
+
+}
 
+// CheckSettings sets defaults of the settings and validates them
+func CheckSettings() error {
+	return checkSettings(&Settings)
 }
 
-func CheckSettings() {
-	if Settings.OutputFileConfig.SizeLimit < 1 {
-		Settings.OutputFileConfig.SizeLimit.Set("32mb")
+func checkSettings(s *AppSettings) error {
+	if s.OutputFileConfig.SizeLimit < 1 {
+		s.OutputFileConfig.SizeLimit.Set("32mb")
+	}
+	if s.OutputFileConfig.OutputFileMaxSize < 1 {
+		s.OutputFileConfig.OutputFileMaxSize.Set("1tb")
+	}
+	if s.OutputParquetConfig.SizeLimit < 1 {
+		s.OutputParquetConfig.SizeLimit.Set("256mb")
+	}
+	if s.CopyBufferSize < 1 {
+		s.CopyBufferSize.Set("5mb")
+	}
+	// recorded traffic is repeated as long as the load profile lasts
+	if len(s.LoadTestConfig.Profile) > 0 {
+		s.InputFileLoop = true
+	}
+
+	if _, err := CreateHTTPModifier(&s.ModifierConfig); err != nil {
+		return err
+	}
+	for _, options := range s.OutputHTTP {
+		address, _ := extractLimitOptions(options)
+		if _, err := parseHTTPOutputURL(address); err != nil {
+			return fmt.Errorf("invalid HTTP output address: %v", err)
+		}
+	}
+	if err := checkLimits(s); err != nil {
+		return err
+	}
+	for _, options := range s.OutputFile {
+		path, _ := extractLimitOptions(options)
+		if err := checkFileOutputConfig(path, &s.OutputFileConfig); err != nil {
+			return fmt.Errorf("invalid file output %q: %v", path, err)
+		}
 	}
-	if Settings.OutputFileConfig.OutputFileMaxSize < 1 {
-		Settings.OutputFileConfig.OutputFileMaxSize.Set("1tb")
+	if len(s.InputAccessLog) > 0 {
+		if _, err := newAccessLogFormat(s.InputAccessLogConfig.Format); err != nil {
+			return fmt.Errorf("invalid access log format: %v", err)
+		}
 	}
-	if Settings.CopyBufferSize < 1 {
-		Settings.CopyBufferSize.Set("5mb")
+	if len(s.OutputParquet) > 0 {
+		config := s.OutputParquetConfig
+		if _, err := newParquetOutput("", &config); err != nil {
+			return fmt.Errorf("invalid parquet output: %v", err)
+		}
 	}
+	if len(s.LoadTestConfig.Profile) > 0 {
+		if _, err := CreateLoadTest(s.LoadTestConfig, RealClock{}); err != nil {
+			return err
+		}
+	}
+	if _, err := NewRedactor(&s.Redact); err != nil {
+		return fmt.Errorf("can't redact: %v", err)
+	}
+	if err := checkLatencyStatsFormat(s.LatencyStats.Format); err != nil {
+		return err
+	}
+	if s.HTTPControl != "" {
+		address, err := controlAddress(s.HTTPControl, s.HTTPControlToken)
+		if err != nil {
+			return err
+		}
+		s.HTTPControl = address
+	}
+	return nil
 }
 
 var previousDebugTime = time.Now()
@@ -0,0 +1,594 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/reoring/goreplay/pkg/protocol"
+)
+
+// Time index is a sidecar file of a recorded file, which maps time to byte offsets, so replay can start in the
+// middle of the file. Records are grouped in segments spanning about a second, compressed files start a new
+// frame (a member in gzip) for each segment, so decompression can start at its offset. The index is a text file:
+//
+//	# gor time index: offset size first last records
+//	0 18271 1622541600000000000 1622541600998000000 120
+//
+// where offset and size are the byte range of the segment in the file, first and last are the smallest and
+// largest timestamps of its records.
+const timeIndexSuffix = ".idx"
+
+const timeIndexHeader = "# gor time index: offset size first last records\n"
+
+// records with timestamps within this span from the first record of the segment are put in the same segment
+const timeIndexSpan = time.Second
+
+// TimeIndexEntry describes a segment of a recorded file
+type TimeIndexEntry struct {
+	Offset  int64
+	Size    int64
+	First   int64 // smallest timestamp
+	Last    int64 // largest timestamp
+	Records int64
+}
+
+// TimeIndex maps time to segments of a recorded file
+type TimeIndex struct {
+	Entries  []TimeIndexEntry
+	fileSize int64
+}
+
+// withoutTimeIndexes removes index files from paths matching a pattern of recorded files
+func withoutTimeIndexes(paths []string) []string {
+	files := paths[:0]
+	for _, p := range paths {
+		if !strings.HasSuffix(p, timeIndexSuffix) {
+			files = append(files, p)
+		}
+	}
+	return files
+}
+
+// First returns the smallest timestamp in the index
+func (idx *TimeIndex) First() int64 {
+	first := int64(math.MaxInt64)
+	for _, e := range idx.Entries {
+		if e.First < first {
+			first = e.First
+		}
+	}
+	return first
+}
+
+// Last returns the largest timestamp in the index
+func (idx *TimeIndex) Last() int64 {
+	last := int64(math.MinInt64)
+	for _, e := range idx.Entries {
+		if e.Last > last {
+			last = e.Last
+		}
+	}
+	return last
+}
+
+// Records returns the number of indexed records
+func (idx *TimeIndex) Records() (n int64) {
+	for _, e := range idx.Entries {
+		n += e.Records
+	}
+	return
+}
+
+// seek returns the byte range of the file which holds records from start to end, limit is -1 if records
+// up to the end of the file are needed, ok is false if the range is empty. Records outside of the range
+// can still be in it. Data after the last segment isn't indexed yet, and is always read.
+func (idx *TimeIndex) seek(start, end int64) (offset, limit int64, ok bool) {
+	if n := len(idx.Entries); n > 0 {
+		offset = idx.Entries[n-1].Offset + idx.Entries[n-1].Size
+	}
+	for _, e := range idx.Entries {
+		if e.Last >= start {
+			offset = e.Offset
+			break
+		}
+	}
+
+	limit = -1
+	for _, e := range idx.Entries {
+		if e.Offset >= offset && e.First > end {
+			limit = e.Offset
+			break
+		}
+	}
+
+	if limit != -1 && limit <= offset || offset >= idx.fileSize {
+		return offset, limit, false
+	}
+	return offset, limit, true
+}
+
+// readTimeIndex reads the index of the recorded file. Segments beyond the end of the file, which can be
+// written while the file is still being flushed, are dropped.
+func readTimeIndex(path string) (*TimeIndex, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path + timeIndexSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	idx := &TimeIndex{fileSize: stat.Size()}
+	for n, line := range strings.Split(string(data), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var e TimeIndexEntry
+		if _, err := fmt.Sscanf(line, "%d %d %d %d %d", &e.Offset, &e.Size, &e.First, &e.Last, &e.Records); err != nil {
+			return nil, fmt.Errorf("%s%s:%d: %v", path, timeIndexSuffix, n+1, err)
+		}
+		if e.Offset+e.Size > idx.fileSize {
+			break
+		}
+		idx.Entries = append(idx.Entries, e)
+	}
+	return idx, nil
+}
+
+// timeIndexBuilder groups records in segments
+type timeIndexBuilder struct {
+	segment TimeIndexEntry
+	start   int64 // timestamp of the first record of the segment
+	started bool
+}
+
+// full tells if the record with the timestamp should start a new segment
+func (b *timeIndexBuilder) full(timestamp int64) bool {
+	return b.started && timestamp-b.start >= int64(timeIndexSpan)
+}
+
+// add adds a record at the offset to the current segment, or starts a new one
+func (b *timeIndexBuilder) add(offset, timestamp int64) {
+	if !b.started {
+		b.segment = TimeIndexEntry{Offset: offset, First: timestamp, Last: timestamp}
+		b.start = timestamp
+		b.started = true
+	}
+	if timestamp < b.segment.First {
+		b.segment.First = timestamp
+	}
+	if timestamp > b.segment.Last {
+		b.segment.Last = timestamp
+	}
+	b.segment.Records++
+}
+
+// finish ends the current segment at the offset, returns false if it has no records
+func (b *timeIndexBuilder) finish(end int64) (TimeIndexEntry, bool) {
+	if !b.started {
+		return TimeIndexEntry{}, false
+	}
+	b.started = false
+	b.segment.Size = end - b.segment.Offset
+	return b.segment, true
+}
+
+func writeTimeIndexEntry(w io.Writer, e TimeIndexEntry) error {
+	_, err := fmt.Fprintf(w, "%d %d %d %d %d\n", e.Offset, e.Size, e.First, e.Last, e.Records)
+	return err
+}
+
+// timeIndexWriter writes the index of a file while it's recorded, a line per finished segment
+type timeIndexWriter struct {
+	timeIndexBuilder
+	file *os.File
+}
+
+func createTimeIndexWriter(path string) (*timeIndexWriter, error) {
+	file, err := os.OpenFile(path+timeIndexSuffix, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = file.WriteString(timeIndexHeader); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &timeIndexWriter{file: file}, nil
+}
+
+// finish writes the current segment ending at the offset
+func (w *timeIndexWriter) finish(end int64) error {
+	if e, ok := w.timeIndexBuilder.finish(end); ok {
+		return writeTimeIndexEntry(w.file, e)
+	}
+	return nil
+}
+
+// Close writes the last segment ending at the offset, and closes the index
+func (w *timeIndexWriter) Close(end int64) error {
+	err := w.finish(end)
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// metaTimestamp returns the timestamp field of payload meta
+func metaTimestamp(meta []byte) (int64, bool) {
+	fields := protocol.PayloadMeta(meta)
+	if len(fields) < 3 {
+		return 0, false
+	}
+	timestamp, err := strconv.ParseInt(string(fields[2]), 10, 64)
+	return timestamp, err == nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// BuildTimeIndex reads the recorded file, and writes its time index. Plain files are split in segments by
+// time, compressed files by compressed frames. Files compressed by other tools are usually a single frame,
+// so they can only be skipped as a whole.
+func BuildTimeIndex(path string) (*TimeIndex, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	counter := &countingReader{r: file}
+	r := bufio.NewReaderSize(counter, fileReaderSize)
+
+	if isEncrypted(r) {
+		return nil, fmt.Errorf("%s: encrypted files can only be indexed while they are written, with --output-file-index", path)
+	}
+
+	var entries []TimeIndexEntry
+	if c := detectCompression(path, r); c == gzipCompression {
+		entries, err = indexFrames(&gzipMembers{counter: counter, r: r})
+	} else if c != nil {
+		entries, err = indexFrames(&compressedFrames{compression: c, r: r})
+	} else {
+		entries, err = indexSegments(r)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	idx := &TimeIndex{Entries: entries, fileSize: stat.Size()}
+
+	var buf bytes.Buffer
+	buf.WriteString(timeIndexHeader)
+	for _, e := range entries {
+		writeTimeIndexEntry(&buf, e)
+	}
+	return idx, ioutil.WriteFile(path+timeIndexSuffix, buf.Bytes(), 0660)
+}
+
+func indexSegments(r *bufio.Reader) ([]TimeIndexEntry, error) {
+	var entries []TimeIndexEntry
+	var b timeIndexBuilder
+	end, err := scanRecords(r, nil, 0, func(offset, timestamp int64) bool {
+		if b.full(timestamp) {
+			if e, ok := b.finish(offset); ok {
+				entries = append(entries, e)
+			}
+		}
+		b.add(offset, timestamp)
+		return true
+	})
+	if e, ok := b.finish(end); ok {
+		entries = append(entries, e)
+	}
+	return entries, err
+}
+
+// frameIterator iterates over frames of a compressed file, which can be decompressed on their own
+type frameIterator interface {
+	// next returns offset and decompressed data of the next frame, or the end of file and io.EOF
+	next() (int64, io.Reader, error)
+}
+
+type gzipMembers struct {
+	counter *countingReader
+	r       *bufio.Reader
+	gz      *gzip.Reader
+}
+
+func (g *gzipMembers) next() (int64, io.Reader, error) {
+	// gzip reads members through bufio.Reader without buffering it again, so the offset of each member is known
+	offset := g.counter.n - int64(g.r.Buffered())
+	var err error
+	if g.gz == nil {
+		g.gz, err = gzip.NewReader(g.r)
+	} else {
+		err = g.gz.Reset(g.r)
+	}
+	if err != nil {
+		return offset, nil, err
+	}
+	g.gz.Multistream(false)
+	return offset, g.gz, nil
+}
+
+type compressedFrames struct {
+	compression *fileCompression
+	r           *bufio.Reader
+	offset      int64
+}
+
+func (f *compressedFrames) next() (int64, io.Reader, error) {
+	offset := f.offset
+	frame, err := f.compression.readFrame(f.r)
+	if err != nil {
+		return offset, nil, err
+	}
+	f.offset += int64(len(frame))
+	data, err := f.compression.decodeFrame(frame)
+	if err != nil {
+		return offset, nil, err
+	}
+	return offset, bytes.NewReader(data), nil
+}
+
+// indexFrames splits frames in segments by time, reading can only start at the start of a frame
+func indexFrames(frames frameIterator) ([]TimeIndexEntry, error) {
+	var entries []TimeIndexEntry
+	var b timeIndexBuilder
+	var format *fileFormat
+	var end int64
+	for {
+		offset, data, err := frames.next()
+		if err == io.EOF {
+			end = offset
+			break
+		}
+
+		var timestamps []int64
+		if err == nil {
+			r := bufio.NewReaderSize(data, fileReaderSize)
+			if format == nil {
+				f := detectFileFormat(r)
+				format = &f
+			}
+			_, err = scanRecords(r, format, 0, func(_, timestamp int64) bool {
+				timestamps = append(timestamps, timestamp)
+				return true
+			})
+		}
+		if err == io.ErrUnexpectedEOF {
+			// the last frame is still being written
+			Debug(1, fmt.Sprintf("[INPUT-FILE] compressed frame at offset %d is truncated", offset))
+			end = offset
+			break
+		}
+		if err != nil {
+			return entries, err
+		}
+
+		if len(timestamps) > 0 && b.full(timestamps[0]) {
+			if e, ok := b.finish(offset); ok {
+				entries = append(entries, e)
+			}
+		}
+		for _, timestamp := range timestamps {
+			b.add(offset, timestamp)
+		}
+	}
+
+	if e, ok := b.finish(end); ok {
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// scanRecords calls fn with offset and timestamp of each record until it returns false, and returns the
+// offset where reading stopped. The format is detected if it's nil, the header of version 2 files is skipped. Reading stops
+// at a truncated record, corrupted records are skipped.
+func scanRecords(r *bufio.Reader, format *fileFormat, offset int64, fn func(offset, timestamp int64) bool) (int64, error) {
+	if format == nil {
+		f := detectFileFormat(r)
+		format = &f
+	}
+
+	if *format == fileFormatJSONL {
+		for {
+			line, err := r.ReadBytes('\n')
+			if timestamp, ok := jsonlTimestamp(line); ok && !fn(offset, timestamp) {
+				return offset, nil
+			}
+			offset += int64(len(line))
+			if err == io.EOF {
+				return offset, nil
+			}
+			if err != nil {
+				return offset, err
+			}
+		}
+	}
+
+	if *format == fileFormatV1 {
+		separator := []byte(protocol.PayloadSeparator)[1:]
+		recordStart := true
+		for {
+			line, err := r.ReadBytes('\n')
+			if recordStart && len(line) > 0 {
+				if timestamp, ok := metaTimestamp(line); ok && !fn(offset, timestamp) {
+					return offset, nil
+				}
+				recordStart = false
+			}
+			offset += int64(len(line))
+			if bytes.Equal(line, separator) {
+				recordStart = true
+			}
+			if err == io.EOF {
+				return offset, nil
+			}
+			if err != nil {
+				return offset, err
+			}
+		}
+	}
+
+	if isFileFormatV2(r) {
+		r.Discard(len(fileFormatMagic))
+		header, err := readFrame(r)
+		if err != nil {
+			return offset, fmt.Errorf("file header: %w", err)
+		}
+		offset += int64(len(fileFormatMagic) + 8 + len(header))
+	}
+	for {
+		record, err := readFrame(r)
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil && !errors.Is(err, errCorruptedRecord) {
+			if err != errTruncatedFile {
+				return offset, err
+			}
+			Debug(1, fmt.Sprintf("[INPUT-FILE] %v at offset %d", err, offset))
+			return offset, nil
+		}
+		var corrupted *corruptedFrameError
+		if errors.As(err, &corrupted) {
+			// the corrupted frame is skipped up to the next valid one
+			offset += int64(corrupted.skipped)
+			continue
+		}
+		if err == nil {
+			if timestamp, ok := recordTimestamp(record); ok && !fn(offset, timestamp) {
+				return offset, nil
+			}
+		}
+		offset += int64(8 + len(record))
+	}
+}
+
+// recordTimestamp returns the timestamp of a version 2 record
+func recordTimestamp(record []byte) (int64, bool) {
+	if len(record) == 0 {
+		return 0, false
+	}
+	idLen, n := binary.Uvarint(record[1:])
+	if n <= 0 || uint64(len(record)-1-n) < idLen {
+		return 0, false
+	}
+	timestamp, n := binary.Varint(record[1+n+int(idLen):])
+	return timestamp, n > 0
+}
+
+// FileTime is a point in time of recorded traffic: RFC3339 time, unix nanoseconds, time of day like `14:00`
+// on the day of the first recorded request in local time, or time since the first recorded request like `+10m`
+type FileTime struct {
+	value    string
+	kind     fileTimeKind
+	absolute int64
+	offset   time.Duration
+}
+
+type fileTimeKind int
+
+const (
+	fileTimeUnset fileTimeKind = iota
+	fileTimeAbsolute
+	fileTimeOfDay
+	fileTimeRelative
+)
+
+// Set parses the time
+func (t *FileTime) Set(value string) error {
+	*t = FileTime{value: value}
+	if value == "" {
+		return nil
+	}
+
+	if strings.HasPrefix(value, "+") {
+		d, err := time.ParseDuration(value[1:])
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid time %q, relative time should be a duration like +10m", value)
+		}
+		t.kind, t.offset = fileTimeRelative, d
+		return nil
+	}
+
+	for _, layout := range []string{"15:04:05", "15:04"} {
+		if clock, err := time.Parse(layout, value); err == nil {
+			t.kind = fileTimeOfDay
+			t.offset = time.Duration(clock.Hour())*time.Hour + time.Duration(clock.Minute())*time.Minute + time.Duration(clock.Second())*time.Second
+			return nil
+		}
+	}
+
+	ts, err := parseControlTimestamp(value)
+	if err != nil {
+		return fmt.Errorf("invalid time %q, expected RFC3339 time, unix nanoseconds, time of day like 14:00 or relative time like +10m", value)
+	}
+	t.kind, t.absolute = fileTimeAbsolute, ts
+	return nil
+}
+
+func (t *FileTime) String() string {
+	return t.value
+}
+
+// IsSet tells if the time is given
+func (t FileTime) IsSet() bool {
+	return t.kind != fileTimeUnset
+}
+
+// relative tells if the time depends on the first recorded request
+func (t FileTime) relative() bool {
+	return t.kind == fileTimeOfDay || t.kind == fileTimeRelative
+}
+
+// resolve returns the timestamp, origin is the timestamp of the first recorded request
+func (t FileTime) resolve(origin int64) int64 {
+	switch t.kind {
+	case fileTimeAbsolute:
+		return t.absolute
+	case fileTimeRelative:
+		return origin + int64(t.offset)
+	case fileTimeOfDay:
+		first := time.Unix(0, origin)
+		day := time.Date(first.Year(), first.Month(), first.Day(), 0, 0, 0, 0, time.Local)
+		return day.Add(t.offset).UnixNano()
+	}
+	return 0
+}
@@ -0,0 +1,137 @@
+package core
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTimeIndex(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor-index")
+	defer os.RemoveAll(dir)
+
+	start := time.Date(2021, 6, 1, 14, 0, 0, 0, time.UTC).UnixNano()
+	for _, name := range []string{"v1.gor", "v2.gor", "v1.gor.gz", "v2.gor.gz", "v1.gor.zst", "v2.gor.zst", "v1.gor.lz4", "v2.gor.lz4"} {
+		path := filepath.Join(dir, name)
+		format := name[:2]
+		output := newTestFileOutput(t, path, &FileOutputConfig{Format: format, Append: true, Index: true, FlushInterval: time.Minute})
+		for k := 0; k < 20; k++ {
+			ts := start + int64(k)*int64(300*time.Millisecond)
+			output.PluginWrite(&Message{Meta: []byte(fmt.Sprintf("1 %d %d -1\n", k, ts)), Data: []byte("GET / HTTP/1.1\r\n\r\n")})
+		}
+		output.Close()
+
+		written, err := readTimeIndex(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(written.Entries) != 5 || written.Records() != 20 || written.First() != start || written.Last() != start+19*int64(300*time.Millisecond) {
+			t.Errorf("%s: wrong index %+v", name, written.Entries)
+		}
+		built, err := BuildTimeIndex(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(built.Entries, written.Entries) {
+			t.Errorf("%s: built index %+v, written %+v", name, built.Entries, written.Entries)
+		}
+
+		var from, to FileTime
+		from.Set("+2s")
+		to.Set("2021-06-01T14:00:04Z")
+		input := NewFileInputWithRange(path, false, 100, time.Millisecond, false, RealClock{}, from, to)
+		var ids []string
+		for {
+			msg, err := input.PluginRead()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, string(msg.Meta[2:4]))
+		}
+		input.Close()
+
+		// 1.8s to 2.1s is the first segment read, and it's filtered by time
+		if !reflect.DeepEqual(ids, []string{"7 ", "8 ", "9 ", "10", "11", "12", "13"}) {
+			t.Errorf("%s: expected requests from 2s to 4s, got %q", name, ids)
+		}
+		if input.stats.Get("seek_bytes").(*expvar.Int).Value() == 0 {
+			t.Errorf("%s: should seek using the index", name)
+		}
+		input.stats.Init()
+	}
+
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 16 {
+		t.Errorf("Expected files and indexes, got %v", files)
+	}
+}
+
+func TestTimeIndexSeek(t *testing.T) {
+	index := &TimeIndex{fileSize: 400, Entries: []TimeIndexEntry{
+		{Offset: 0, Size: 100, First: 10, Last: 19},
+		{Offset: 100, Size: 100, First: 20, Last: 29},
+		{Offset: 200, Size: 100, First: 30, Last: 39},
+	}}
+
+	tests := []struct {
+		start, end    int64
+		offset, limit int64
+		ok            bool
+	}{
+		{0, 100, 0, -1, true},
+		{20, 100, 100, -1, true},
+		{25, 30, 100, -1, true},
+		{25, 29, 100, 200, true},
+		{45, 100, 300, -1, true}, // not indexed yet
+		{0, 5, 0, 0, false},
+	}
+	for _, tt := range tests {
+		offset, limit, ok := index.seek(tt.start, tt.end)
+		if offset != tt.offset || limit != tt.limit || ok != tt.ok {
+			t.Errorf("%d-%d: expected %d %d %v, got %d %d %v", tt.start, tt.end, tt.offset, tt.limit, tt.ok, offset, limit, ok)
+		}
+	}
+
+	index.fileSize = 300
+	if _, _, ok := index.seek(45, 100); ok {
+		t.Error("Range after the end of file should be empty")
+	}
+}
+
+func TestFileTime(t *testing.T) {
+	origin := time.Date(2021, 6, 1, 13, 55, 10, 0, time.Local).UnixNano()
+	tests := []struct {
+		value    string
+		expected time.Time
+	}{
+		{"2021-06-01T14:00:00Z", time.Date(2021, 6, 1, 14, 0, 0, 0, time.UTC)},
+		{"1622556000000000000", time.Date(2021, 6, 1, 14, 0, 0, 0, time.UTC)},
+		{"14:00", time.Date(2021, 6, 1, 14, 0, 0, 0, time.Local)},
+		{"14:15:30", time.Date(2021, 6, 1, 14, 15, 30, 0, time.Local)},
+		{"+10m", time.Date(2021, 6, 1, 14, 5, 10, 0, time.Local)},
+	}
+	for _, tt := range tests {
+		var ft FileTime
+		if err := ft.Set(tt.value); err != nil {
+			t.Fatal(err)
+		}
+		if ts := ft.resolve(origin); ts != tt.expected.UnixNano() {
+			t.Errorf("%s: expected %s, got %s", tt.value, tt.expected, time.Unix(0, ts))
+		}
+	}
+
+	var ft FileTime
+	for _, value := range []string{"yesterday", "+5", "-10m", "25:00"} {
+		if err := ft.Set(value); err == nil {
+			t.Errorf("%s: expected error", value)
+		}
+	}
+}
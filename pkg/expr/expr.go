@@ -0,0 +1,558 @@
+// Package expr implements a small CEL-like expression language used for filtering and routing rules.
+//
+// Expressions are made of literals (strings, numbers, booleans, `null` and lists), identifiers provided by an Env,
+// member and index access (`json.user.id`, `headers["X-Id"]`), function and method calls
+// (`size(body)`, `path.startsWith("/api")`) and the usual operators:
+//
+//	||  &&  !  ==  !=  <  <=  >  >=  in  +  -  *  /  %  ?:
+//
+// Numbers may have size (`1kb`, `5mb`) or duration (`250ms`, `2s`) suffixes, converted to bytes and nanoseconds.
+package expr
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"regexp"
+	"strings"
+)
+
+// Map is implemented by values which support member and index access, and the `in` operator
+type Map interface {
+	Get(key string) (interface{}, bool)
+}
+
+// Func is a function which can be provided by an Env
+type Func func(args ...interface{}) (interface{}, error)
+
+// Env resolves identifiers used in an expression
+type Env interface {
+	Lookup(name string) (interface{}, bool)
+}
+
+// Vars is the simplest Env, backed by a map
+type Vars map[string]interface{}
+
+// Lookup implements Env
+func (v Vars) Lookup(name string) (interface{}, bool) {
+	val, ok := v[name]
+	return val, ok
+}
+
+// Program is a compiled expression
+type Program struct {
+	src  string
+	root node
+}
+
+// Compile parses an expression
+func Compile(src string) (*Program, error) {
+	p := &parser{lexer: newLexer(src)}
+	p.next()
+	root, err := p.parseExpr()
+	if err == nil {
+		err = p.lexer.err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("expr %q: %s", src, err)
+	}
+	if p.tok.kind != tokEOF {
+		return nil, fmt.Errorf("expr %q: unexpected %s at %d", src, p.tok, p.tok.pos)
+	}
+	return &Program{src: src, root: root}, nil
+}
+
+// MustCompile is like Compile but panics if the expression can't be parsed
+func MustCompile(src string) *Program {
+	p, err := Compile(src)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// Eval evaluates the expression
+func (p *Program) Eval(env Env) (interface{}, error) {
+	return p.root.eval(env)
+}
+
+// Match evaluates the expression and reports whether the result is true.
+// Evaluation errors, like comparing values of different types, are treated as false.
+func (p *Program) Match(env Env) bool {
+	v, err := p.root.eval(env)
+	if err != nil {
+		return false
+	}
+	b, ok := v.(bool)
+	return ok && b
+}
+
+func (p *Program) String() string {
+	return p.src
+}
+
+// Quote returns a string literal for s, which can be safely used to build expressions
+func Quote(s string) string {
+	return fmt.Sprintf("%q", s)
+}
+
+//
+// Evaluation
+//
+
+type node interface {
+	eval(env Env) (interface{}, error)
+}
+
+type literal struct {
+	value interface{}
+}
+
+func (n *literal) eval(Env) (interface{}, error) {
+	return n.value, nil
+}
+
+type ident struct {
+	name string
+}
+
+func (n *ident) eval(env Env) (interface{}, error) {
+	if env != nil {
+		if v, ok := env.Lookup(n.name); ok {
+			return v, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown identifier %q", n.name)
+}
+
+type list struct {
+	items []node
+}
+
+func (n *list) eval(env Env) (interface{}, error) {
+	values := make([]interface{}, len(n.items))
+	for i, item := range n.items {
+		v, err := item.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+type member struct {
+	target node
+	name   string
+}
+
+func (n *member) eval(env Env) (interface{}, error) {
+	target, err := n.target.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	v, _ := index(target, n.name)
+	return v, nil
+}
+
+type indexNode struct {
+	target node
+	key    node
+}
+
+func (n *indexNode) eval(env Env) (interface{}, error) {
+	target, err := n.target.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	key, err := n.key.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	v, _ := index(target, key)
+	return v, nil
+}
+
+// index returns a map value by key, or a list element by position. Missing values are nil.
+func index(target, key interface{}) (interface{}, bool) {
+	switch t := target.(type) {
+	case Map:
+		if k, ok := key.(string); ok {
+			return t.Get(k)
+		}
+	case map[string]interface{}:
+		if k, ok := key.(string); ok {
+			v, ok := t[k]
+			return v, ok
+		}
+	case []interface{}:
+		var i int
+		switch k := key.(type) {
+		case float64:
+			i = int(k)
+		case string:
+			if _, err := fmt.Sscanf(k, "%d", &i); err != nil {
+				return nil, false
+			}
+		default:
+			return nil, false
+		}
+		if i >= 0 && i < len(t) {
+			return t[i], true
+		}
+	}
+	return nil, false
+}
+
+type unary struct {
+	op      string
+	operand node
+}
+
+func (n *unary) eval(env Env) (interface{}, error) {
+	v, err := n.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "!":
+		b, ok := v.(bool)
+		if !ok {
+			return nil, fmt.Errorf("can't negate %T", v)
+		}
+		return !b, nil
+	case "-":
+		f, ok := v.(float64)
+		if !ok {
+			return nil, fmt.Errorf("can't negate %T", v)
+		}
+		return -f, nil
+	}
+	return nil, fmt.Errorf("unknown operator %q", n.op)
+}
+
+type logical struct {
+	op          string
+	left, right node
+}
+
+func (n *logical) eval(env Env) (interface{}, error) {
+	l, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	lb, ok := l.(bool)
+	if !ok {
+		return nil, fmt.Errorf("%q expects booleans, got %T", n.op, l)
+	}
+	if n.op == "||" && lb || n.op == "&&" && !lb {
+		return lb, nil
+	}
+	r, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	rb, ok := r.(bool)
+	if !ok {
+		return nil, fmt.Errorf("%q expects booleans, got %T", n.op, r)
+	}
+	return rb, nil
+}
+
+type conditional struct {
+	cond, then, otherwise node
+}
+
+func (n *conditional) eval(env Env) (interface{}, error) {
+	c, err := n.cond.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if b, ok := c.(bool); ok && b {
+		return n.then.eval(env)
+	}
+	return n.otherwise.eval(env)
+}
+
+type binary struct {
+	op          string
+	left, right node
+}
+
+func (n *binary) eval(env Env) (interface{}, error) {
+	l, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	r, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==":
+		return equal(l, r), nil
+	case "!=":
+		return !equal(l, r), nil
+	case "in":
+		return contains(r, l)
+	case "<", "<=", ">", ">=":
+		c, err := compare(l, r)
+		if err != nil {
+			return nil, err
+		}
+		switch n.op {
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		default:
+			return c >= 0, nil
+		}
+	case "+":
+		if ls, ok := l.(string); ok {
+			if rs, ok := r.(string); ok {
+				return ls + rs, nil
+			}
+		}
+	}
+
+	lf, lok := l.(float64)
+	rf, rok := r.(float64)
+	if !lok || !rok {
+		return nil, fmt.Errorf("%q expects numbers, got %T and %T", n.op, l, r)
+	}
+	switch n.op {
+	case "+":
+		return lf + rf, nil
+	case "-":
+		return lf - rf, nil
+	case "*":
+		return lf * rf, nil
+	case "/":
+		if rf == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return lf / rf, nil
+	case "%":
+		if rf == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return math.Mod(lf, rf), nil
+	}
+	return nil, fmt.Errorf("unknown operator %q", n.op)
+}
+
+func equal(l, r interface{}) bool {
+	switch lv := l.(type) {
+	case nil:
+		return r == nil
+	case string, float64, bool:
+		return l == r
+	case []interface{}:
+		rv, ok := r.([]interface{})
+		if !ok || len(lv) != len(rv) {
+			return false
+		}
+		for i := range lv {
+			if !equal(lv[i], rv[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func compare(l, r interface{}) (int, error) {
+	switch lv := l.(type) {
+	case float64:
+		if rv, ok := r.(float64); ok {
+			switch {
+			case lv < rv:
+				return -1, nil
+			case lv > rv:
+				return 1, nil
+			}
+			return 0, nil
+		}
+	case string:
+		if rv, ok := r.(string); ok {
+			return strings.Compare(lv, rv), nil
+		}
+	}
+	return 0, fmt.Errorf("can't compare %T and %T", l, r)
+}
+
+func contains(collection, item interface{}) (interface{}, error) {
+	switch c := collection.(type) {
+	case []interface{}:
+		for _, v := range c {
+			if equal(v, item) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case Map, map[string]interface{}:
+		_, ok := index(c, item)
+		return ok, nil
+	case nil:
+		return false, nil
+	}
+	return nil, fmt.Errorf("`in` expects a list or a map, got %T", collection)
+}
+
+type call struct {
+	name    string
+	target  node // receiver of a method call, nil for functions
+	args    []node
+	pattern *regexp.Regexp // literal pattern of matches, compiled once
+}
+
+func (n *call) eval(env Env) (interface{}, error) {
+	args := make([]interface{}, 0, len(n.args)+1)
+	if n.target != nil {
+		v, err := n.target.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, v)
+	}
+	for _, a := range n.args {
+		v, err := a.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, v)
+	}
+
+	if n.pattern != nil {
+		s, _, err := twoStrings("matches", args)
+		if err != nil {
+			return nil, err
+		}
+		return n.pattern.MatchString(s), nil
+	}
+	if n.target == nil && env != nil {
+		if v, ok := env.Lookup(n.name); ok {
+			if f, ok := v.(Func); ok {
+				return f(args...)
+			}
+			if f, ok := v.(func(...interface{}) (interface{}, error)); ok {
+				return f(args...)
+			}
+		}
+	}
+	if f, ok := builtins[n.name]; ok {
+		return f(args...)
+	}
+	return nil, fmt.Errorf("unknown function %q", n.name)
+}
+
+//
+// Built-in functions, methods receive their target as the first argument
+//
+
+var builtins = map[string]Func{
+	"size": func(args ...interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("size expects 1 argument")
+		}
+		switch v := args[0].(type) {
+		case string:
+			return float64(len(v)), nil
+		case []interface{}:
+			return float64(len(v)), nil
+		case map[string]interface{}:
+			return float64(len(v)), nil
+		case nil:
+			return float64(0), nil
+		}
+		return nil, fmt.Errorf("size: unsupported %T", args[0])
+	},
+	"lower":      stringFunc("lower", strings.ToLower),
+	"upper":      stringFunc("upper", strings.ToUpper),
+	"trim":       stringFunc("trim", strings.TrimSpace),
+	"startsWith": stringPredicate("startsWith", strings.HasPrefix),
+	"endsWith":   stringPredicate("endsWith", strings.HasSuffix),
+	"contains":   stringPredicate("contains", strings.Contains),
+	// patterns computed at runtime are compiled on each call, traffic can have any number of them
+	"matches": func(args ...interface{}) (interface{}, error) {
+		s, pattern, err := twoStrings("matches", args)
+		if err != nil {
+			return nil, err
+		}
+		r, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		return r.MatchString(s), nil
+	},
+	// hash returns FNV-1a 32 bit hash of the string, useful for consistent sampling: hash(header("User-Id")) % 100 < 25
+	"hash": func(args ...interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("hash expects 1 argument")
+		}
+		s, ok := args[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("hash expects a string, got %T", args[0])
+		}
+		h := fnv.New32a()
+		h.Write([]byte(s))
+		return float64(h.Sum32()), nil
+	},
+	"string": func(args ...interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("string expects 1 argument")
+		}
+		switch v := args[0].(type) {
+		case string:
+			return v, nil
+		case nil:
+			return "", nil
+		case float64:
+			return strings.TrimSuffix(fmt.Sprintf("%f", v), ".000000"), nil
+		}
+		return fmt.Sprint(args[0]), nil
+	},
+}
+
+func stringFunc(name string, f func(string) string) Func {
+	return func(args ...interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("%s expects 1 argument", name)
+		}
+		s, ok := args[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("%s expects a string, got %T", name, args[0])
+		}
+		return f(s), nil
+	}
+}
+
+func stringPredicate(name string, f func(string, string) bool) Func {
+	return func(args ...interface{}) (interface{}, error) {
+		s, sub, err := twoStrings(name, args)
+		if err != nil {
+			return nil, err
+		}
+		return f(s, sub), nil
+	}
+}
+
+func twoStrings(name string, args []interface{}) (string, string, error) {
+	if len(args) != 2 {
+		return "", "", fmt.Errorf("%s expects 2 arguments", name)
+	}
+	a, ok := args[0].(string)
+	if !ok && args[0] != nil {
+		return "", "", fmt.Errorf("%s expects a string, got %T", name, args[0])
+	}
+	b, ok := args[1].(string)
+	if !ok {
+		return "", "", fmt.Errorf("%s expects a string, got %T", name, args[1])
+	}
+	return a, b, nil
+}
@@ -0,0 +1,128 @@
+package expr
+
+import (
+	"testing"
+)
+
+func TestEval(t *testing.T) {
+	env := Vars{
+		"method":  "POST",
+		"path":    "/api/users",
+		"status":  float64(503),
+		"latency": float64(1500e6),
+		"headers": map[string]interface{}{"Content-Type": "application/json"},
+		"json": map[string]interface{}{
+			"user":  map[string]interface{}{"id": float64(42), "roles": []interface{}{"admin", "dev"}},
+			"empty": nil,
+		},
+		"header": Func(func(args ...interface{}) (interface{}, error) {
+			return "value-" + args[0].(string), nil
+		}),
+	}
+
+	tests := []struct {
+		expr   string
+		result interface{}
+	}{
+		{`true`, true},
+		{`method == "POST"`, true},
+		{`method == 'POST' && path.startsWith("/api")`, true},
+		{`method in ["GET", "HEAD"]`, false},
+		{`!(method in ["GET", "HEAD"])`, true},
+		{`status >= 500 && status < 600`, true},
+		{`latency > 1s`, true},
+		{`latency > 2s || false`, false},
+		{`size("abc") + 1 == 4`, true},
+		{`1kb == 1024`, true},
+		{`250ms`, float64(250e6)},
+		{`10 % 3 * 2 - 1`, float64(1)},
+		{`"a" + "b"`, "ab"},
+		{`json.user.id == 42`, true},
+		{`json.user.roles[1]`, "dev"},
+		{`"admin" in json.user.roles`, true},
+		{`"user" in json`, true},
+		{`"missing" in json`, false},
+		{`json.missing.field == null`, true},
+		{`headers["Content-Type"].contains("json")`, true},
+		{`path.matches("^/api/[a-z]+$")`, true},
+		{`path.matches("^/api/" + "users$")`, true},
+		{`header("X").matches(header("X"))`, true},
+		{`lower(method)`, "post"},
+		{`header("X")`, "value-X"},
+		{`hash("user-2") % 100`, float64(57)},
+		{`status == 503 ? "bad" : "good"`, "bad"},
+		{`"it\"s" == 'it"s'`, true},
+		{`'it\'s'`, "it's"},
+	}
+
+	for _, tc := range tests {
+		p, err := Compile(tc.expr)
+		if err != nil {
+			t.Errorf("%s: %v", tc.expr, err)
+			continue
+		}
+		v, err := p.Eval(env)
+		if err != nil {
+			t.Errorf("%s: %v", tc.expr, err)
+			continue
+		}
+		if !equal(v, tc.result) {
+			t.Errorf("%s: expected %#v, got %#v", tc.expr, tc.result, v)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	env := Vars{"status": float64(200), "method": "GET"}
+
+	if !MustCompile(`status == 200`).Match(env) {
+		t.Error("Should match")
+	}
+	// Type mismatch errors are treated as false
+	if MustCompile(`method > 1`).Match(env) {
+		t.Error("Should not match")
+	}
+	if MustCompile(`unknown == 1`).Match(env) {
+		t.Error("Should not match")
+	}
+	// Non boolean results never match
+	if MustCompile(`method`).Match(env) {
+		t.Error("Should not match")
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, src := range []string{
+		``,
+		`method ==`,
+		`(method == "GET"`,
+		`"unterminated`,
+		`10xb`,
+		`path.matches("[")`,
+		`method # 1`,
+		`[1, 2`,
+		`a ? b`,
+	} {
+		if _, err := Compile(src); err == nil {
+			t.Errorf("%q: expected compilation error", src)
+		}
+	}
+}
+
+func TestRuntimePattern(t *testing.T) {
+	env := Vars{"path": "/api", "pattern": "["}
+	if _, err := MustCompile(`path.matches(pattern)`).Eval(env); err == nil {
+		t.Error("Expected error for invalid pattern computed at runtime")
+	}
+	if p := MustCompile(`path.matches("^/a")`); p.root.(*call).pattern == nil {
+		t.Error("Literal pattern should be compiled once")
+	}
+}
+
+func TestQuote(t *testing.T) {
+	s := `a "quoted" \ string`
+	v, err := MustCompile(Quote(s)).Eval(nil)
+	if err != nil || v != s {
+		t.Errorf("Expected %q, got %q: %v", s, v, err)
+	}
+}
@@ -0,0 +1,384 @@
+package expr
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokOp
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	value interface{}
+	pos   int
+}
+
+func (t token) String() string {
+	if t.kind == tokEOF {
+		return "end of expression"
+	}
+	return strconv.Quote(t.text)
+}
+
+var unitMultipliers = map[string]float64{
+	"ns": 1,
+	"us": 1e3,
+	"ms": 1e6,
+	"s":  1e9,
+	"m":  60e9,
+	"h":  3600e9,
+	"b":  1,
+	"kb": 1 << 10,
+	"mb": 1 << 20,
+	"gb": 1 << 30,
+}
+
+// operators sorted so that longer ones are matched first
+var operators = []string{"||", "&&", "==", "!=", "<=", ">=", "!", "<", ">", "+", "-", "*", "/", "%", "(", ")", "[", "]", ".", ",", "?", ":"}
+
+type lexer struct {
+	src string
+	pos int
+	err error
+}
+
+func newLexer(src string) *lexer {
+	return &lexer{src: src}
+}
+
+func (l *lexer) next() token {
+	for l.pos < len(l.src) && strings.IndexByte(" \t\r\n", l.src[l.pos]) != -1 {
+		l.pos++
+	}
+	start := l.pos
+	if l.pos >= len(l.src) {
+		return token{kind: tokEOF, pos: start}
+	}
+
+	c := l.src[l.pos]
+	switch {
+	case c == '"' || c == '\'':
+		return l.string(c)
+	case c >= '0' && c <= '9':
+		return l.number()
+	case c == '_' || unicode.IsLetter(rune(c)):
+		for l.pos < len(l.src) {
+			r, n := utf8.DecodeRuneInString(l.src[l.pos:])
+			if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+				break
+			}
+			l.pos += n
+		}
+		return token{kind: tokIdent, text: l.src[start:l.pos], pos: start}
+	}
+
+	for _, op := range operators {
+		if strings.HasPrefix(l.src[l.pos:], op) {
+			l.pos += len(op)
+			return token{kind: tokOp, text: op, pos: start}
+		}
+	}
+	l.err = fmt.Errorf("unexpected character %q at %d", c, start)
+	return token{kind: tokEOF, pos: start}
+}
+
+func (l *lexer) string(quote byte) token {
+	start := l.pos
+	l.pos++
+	for l.pos < len(l.src) {
+		switch l.src[l.pos] {
+		case '\\':
+			l.pos += 2
+			continue
+		case quote:
+			l.pos++
+			raw := l.src[start:l.pos]
+			if quote == '\'' {
+				// Re-quote single quoted strings so they can be unescaped by strconv
+				raw = `"` + strings.ReplaceAll(strings.ReplaceAll(raw[1:len(raw)-1], `\'`, `'`), `"`, `\"`) + `"`
+			}
+			s, err := strconv.Unquote(raw)
+			if err != nil {
+				l.err = fmt.Errorf("invalid string %s at %d", l.src[start:l.pos], start)
+				return token{kind: tokEOF, pos: start}
+			}
+			return token{kind: tokString, text: l.src[start:l.pos], value: s, pos: start}
+		}
+		l.pos++
+	}
+	l.err = fmt.Errorf("unterminated string at %d", start)
+	return token{kind: tokEOF, pos: start}
+}
+
+func (l *lexer) number() token {
+	start := l.pos
+	for l.pos < len(l.src) && (l.src[l.pos] >= '0' && l.src[l.pos] <= '9' || l.src[l.pos] == '.') {
+		l.pos++
+	}
+	f, err := strconv.ParseFloat(l.src[start:l.pos], 64)
+	if err != nil {
+		l.err = fmt.Errorf("invalid number %q at %d", l.src[start:l.pos], start)
+		return token{kind: tokEOF, pos: start}
+	}
+
+	unitStart := l.pos
+	for l.pos < len(l.src) && unicode.IsLetter(rune(l.src[l.pos])) {
+		l.pos++
+	}
+	if unit := strings.ToLower(l.src[unitStart:l.pos]); unit != "" {
+		m, ok := unitMultipliers[unit]
+		if !ok {
+			l.err = fmt.Errorf("unknown unit %q at %d", unit, unitStart)
+			return token{kind: tokEOF, pos: start}
+		}
+		f *= m
+	}
+	return token{kind: tokNumber, text: l.src[start:l.pos], value: f, pos: start}
+}
+
+// parser is a recursive descent parser, precedence from lowest to highest:
+//
+//	?:   ||   &&   == != < <= > >= in   + -   * / %   ! -   . [] ()
+type parser struct {
+	lexer *lexer
+	tok   token
+}
+
+func (p *parser) next() {
+	p.tok = p.lexer.next()
+}
+
+func (p *parser) is(op string) bool {
+	return p.tok.kind == tokOp && p.tok.text == op
+}
+
+func (p *parser) expect(op string) error {
+	if p.lexer.err != nil {
+		return p.lexer.err
+	}
+	if !p.is(op) {
+		return fmt.Errorf("expected %q, got %s at %d", op, p.tok, p.tok.pos)
+	}
+	p.next()
+	return nil
+}
+
+func (p *parser) parseExpr() (node, error) {
+	cond, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	if !p.is("?") {
+		return cond, nil
+	}
+	p.next()
+	then, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	otherwise, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	return &conditional{cond, then, otherwise}, nil
+}
+
+var precedence = []map[string]bool{
+	{"||": true},
+	{"&&": true},
+	{"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true, "in": true},
+	{"+": true, "-": true},
+	{"*": true, "/": true, "%": true},
+}
+
+func (p *parser) binaryOp(level int) (string, bool) {
+	switch p.tok.kind {
+	case tokOp:
+		return p.tok.text, precedence[level][p.tok.text]
+	case tokIdent:
+		return p.tok.text, p.tok.text == "in" && precedence[level]["in"]
+	}
+	return "", false
+}
+
+func (p *parser) parseBinary(level int) (node, error) {
+	if level == len(precedence) {
+		return p.parseUnary()
+	}
+	left, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.binaryOp(level)
+		if !ok {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		if op == "||" || op == "&&" {
+			left = &logical{op, left, right}
+		} else {
+			left = &binary{op, left, right}
+		}
+	}
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.is("!") || p.is("-") {
+		op := p.tok.text
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unary{op, operand}, nil
+	}
+	return p.parsePostfix()
+}
+
+func (p *parser) parsePostfix() (node, error) {
+	n, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.is("."):
+			p.next()
+			if p.tok.kind != tokIdent {
+				return nil, fmt.Errorf("expected field name, got %s at %d", p.tok, p.tok.pos)
+			}
+			name := p.tok.text
+			p.next()
+			if p.is("(") {
+				args, err := p.parseArgs(")")
+				if err != nil {
+					return nil, err
+				}
+				pattern, err := literalPattern(name, args)
+				if err != nil {
+					return nil, err
+				}
+				n = &call{name: name, target: n, args: args, pattern: pattern}
+			} else {
+				n = &member{n, name}
+			}
+		case p.is("["):
+			p.next()
+			key, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			n = &indexNode{n, key}
+		default:
+			return n, nil
+		}
+	}
+}
+
+// parseArgs parses a comma separated list of expressions, current token is the opening bracket
+func (p *parser) parseArgs(closing string) ([]node, error) {
+	p.next()
+	var args []node
+	for !p.is(closing) {
+		if len(args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	p.next()
+	return args, nil
+}
+
+// literalPattern compiles the regular expression passed to matches as a literal, it returns nil for
+// patterns computed at runtime
+func literalPattern(name string, args []node) (*regexp.Regexp, error) {
+	if name != "matches" || len(args) != 1 {
+		return nil, nil
+	}
+	if lit, ok := args[0].(*literal); ok {
+		if s, ok := lit.value.(string); ok {
+			return regexp.Compile(s)
+		}
+	}
+	return nil, nil
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	if p.lexer.err != nil {
+		return nil, p.lexer.err
+	}
+	tok := p.tok
+	switch tok.kind {
+	case tokNumber, tokString:
+		p.next()
+		return &literal{tok.value}, nil
+	case tokIdent:
+		p.next()
+		switch tok.text {
+		case "true":
+			return &literal{true}, nil
+		case "false":
+			return &literal{false}, nil
+		case "null":
+			return &literal{nil}, nil
+		}
+		if p.is("(") {
+			args, err := p.parseArgs(")")
+			if err != nil {
+				return nil, err
+			}
+			return &call{name: tok.text, args: args}, nil
+		}
+		return &ident{tok.text}, nil
+	case tokOp:
+		switch tok.text {
+		case "(":
+			p.next()
+			n, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return n, nil
+		case "[":
+			items, err := p.parseArgs("]")
+			if err != nil {
+				return nil, err
+			}
+			return &list{items}, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected %s at %d", tok, tok.pos)
+}
@@ -0,0 +1,205 @@
+// Package goreplay allows to embed traffic capture and replay into Go programs.
+//
+// A Pipeline copies messages from inputs to outputs, applying filters, rewrites and routing rules
+// the same way the gor command does:
+//
+//	in, err := goreplay.NewFileInput("requests.gor", goreplay.FileInputConfig{})
+//	if err != nil {
+//		return err
+//	}
+//	out, err := goreplay.NewHTTPOutput("http://staging.local", goreplay.HTTPOutputConfig{})
+//	if err != nil {
+//		return err
+//	}
+//	p, err := goreplay.New(
+//		goreplay.WithInput(in),
+//		goreplay.WithOutput(out),
+//		goreplay.WithFilter(`method == "GET"`),
+//	)
+//	if err != nil {
+//		return err
+//	}
+//	return p.Run(ctx)
+//
+// Addresses of built-in plugins can have a limit suffix like in command line options, `staging.local|10%`,
+// and are used to refer to plugins in routing rules and the control API.
+// Inputs and outputs can be implemented by the program as well, see Input and Output.
+package goreplay
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/reoring/goreplay/pkg/core"
+)
+
+// Message is a request or a response. Meta holds type, id, timestamp and latency, see the protocol package.
+type Message = core.Message
+
+// Input is a source of messages. Read blocks until a message is available, returns io.EOF once the input
+// is exhausted, and ctx.Err() if ctx is done first. Inputs implementing io.Closer are closed when the pipeline stops.
+type Input interface {
+	Read(ctx context.Context) (*Message, error)
+}
+
+// Output receives messages. Outputs implementing io.Closer are closed when the pipeline stops.
+type Output interface {
+	Write(ctx context.Context, msg *Message) error
+}
+
+// InputFunc allows to use a function as an Input
+type InputFunc func(ctx context.Context) (*Message, error)
+
+// Read calls f(ctx)
+func (f InputFunc) Read(ctx context.Context) (*Message, error) {
+	return f(ctx)
+}
+
+// OutputFunc allows to use a function as an Output
+type OutputFunc func(ctx context.Context, msg *Message) error
+
+// Write calls f(ctx, msg)
+func (f OutputFunc) Write(ctx context.Context, msg *Message) error {
+	return f(ctx, msg)
+}
+
+// pluginInput exposes a built-in input plugin as Input
+type pluginInput struct {
+	plugin  core.PluginReader
+	address string
+
+	mu      sync.Mutex
+	pending chan readResult // read which was interrupted by ctx, its result is returned by the next Read
+}
+
+type readResult struct {
+	msg *Message
+	err error
+}
+
+func (i *pluginInput) Read(ctx context.Context) (*Message, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.pending == nil {
+		i.pending = make(chan readResult, 1)
+		go func(pending chan readResult) {
+			for {
+				msg, err := i.plugin.PluginRead()
+				if err == core.ErrorStopped {
+					err = io.EOF
+				}
+				// limited inputs return nil messages
+				if msg != nil || err != nil {
+					pending <- readResult{msg, err}
+					return
+				}
+			}
+		}(i.pending)
+	}
+
+	select {
+	case r := <-i.pending:
+		i.pending = nil
+		return r.msg, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (i *pluginInput) Close() error {
+	return closePlugin(i.plugin)
+}
+
+// pluginOutput exposes a built-in output plugin as Output
+type pluginOutput struct {
+	plugin  core.PluginWriter
+	address string
+}
+
+func (o *pluginOutput) Write(ctx context.Context, msg *Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, err := o.plugin.PluginWrite(msg)
+	return err
+}
+
+func (o *pluginOutput) Close() error {
+	return closePlugin(o.plugin)
+}
+
+func closePlugin(plugin interface{}) error {
+	if c, ok := plugin.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// inputPlugin runs Input as a plugin of the emitter
+type inputPlugin struct {
+	input  Input
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newInputPlugin(input Input) *inputPlugin {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &inputPlugin{input: input, ctx: ctx, cancel: cancel}
+}
+
+func (i *inputPlugin) PluginRead() (*Message, error) {
+	msg, err := i.input.Read(i.ctx)
+	if err != nil && i.ctx.Err() != nil {
+		return nil, core.ErrorStopped
+	}
+	return msg, err
+}
+
+func (i *inputPlugin) Close() error {
+	i.cancel()
+	return closePlugin(i.input)
+}
+
+func (i *inputPlugin) String() string {
+	return "Input: " + describe(i.input)
+}
+
+// outputPlugin runs Output as a plugin of the emitter
+type outputPlugin struct {
+	output Output
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newOutputPlugin(output Output) *outputPlugin {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &outputPlugin{output: output, ctx: ctx, cancel: cancel}
+}
+
+func (o *outputPlugin) PluginWrite(msg *Message) (int, error) {
+	if err := o.output.Write(o.ctx, msg); err != nil {
+		if o.ctx.Err() != nil {
+			return 0, io.ErrClosedPipe
+		}
+		return 0, err
+	}
+	return len(msg.Meta) + len(msg.Data), nil
+}
+
+func (o *outputPlugin) Close() error {
+	o.cancel()
+	return closePlugin(o.output)
+}
+
+func (o *outputPlugin) String() string {
+	return "Output: " + describe(o.output)
+}
+
+func describe(plugin interface{}) string {
+	if s, ok := plugin.(interface{ String() string }); ok {
+		return s.String()
+	}
+	return "custom"
+}
@@ -0,0 +1,110 @@
+package goreplaytest
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Clock is a deterministic goreplay.Clock, its time moves only with Advance.
+// Pass it in goreplay.FileInputConfig to replay recorded timing without waiting:
+//
+//	clock := goreplaytest.NewClock(time.Now())
+//	in, _ := goreplay.NewFileInput("requests.gor", goreplay.FileInputConfig{Clock: clock})
+//	...
+//	clock.BlockUntil(1, time.Second) // the input waits for the next request
+//	clock.Advance(time.Minute)
+type Clock struct {
+	mu      sync.Mutex
+	now     time.Time
+	timers  []*fakeTimer
+	changed chan struct{} // closed and replaced when timers are added
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+// NewClock creates a clock showing the time
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now, changed: make(chan struct{})}
+}
+
+// Now returns the current time of the clock
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// After returns a channel receiving the time once the clock is advanced by d
+func (c *Clock) After(d time.Duration) (<-chan time.Time, func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &fakeTimer{at: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- c.now
+		return t.c, func() {}
+	}
+	c.timers = append(c.timers, t)
+	close(c.changed)
+	c.changed = make(chan struct{})
+
+	return t.c, func() { c.stop(t) }
+}
+
+func (c *Clock) stop(t *fakeTimer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, timer := range c.timers {
+		if timer == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return
+		}
+	}
+}
+
+// Advance moves the clock forward, firing timers which are due
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+		} else {
+			t.c <- c.now
+		}
+	}
+	c.timers = pending
+}
+
+// Timers returns the number of timers waiting for the clock
+func (c *Clock) Timers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// BlockUntil waits until at least n timers are waiting for the clock, so that Advance affects them
+func (c *Clock) BlockUntil(n int, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	for {
+		c.mu.Lock()
+		count, changed := len(c.timers), c.changed
+		c.mu.Unlock()
+
+		if count >= n {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return fmt.Errorf("%d timers are waiting, expected %d", count, n)
+		}
+	}
+}
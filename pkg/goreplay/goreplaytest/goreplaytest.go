@@ -0,0 +1,265 @@
+// Package goreplaytest provides utilities for testing goreplay pipelines: scripted inputs built from
+// literal HTTP messages, outputs capturing what they received, a deterministic clock for the file input,
+// and a fake HTTP upstream recording what the HTTP output sent.
+//
+//	in := goreplaytest.NewRequestInput(
+//		"GET /users HTTP/1.1\nHost: example.org\n\n",
+//		"POST /users HTTP/1.1\nHost: example.org\nContent-Length: 2\n\n{}",
+//	)
+//	out := goreplaytest.NewOutput()
+//	p, _ := goreplay.New(goreplay.WithInput(in), goreplay.WithOutput(out), goreplay.WithFilter(`method == "GET"`))
+//	p.Run(context.Background())
+//
+//	out.AssertCount(t, 1)
+//	out.AssertRequest(t, 0, "GET", "/users")
+package goreplaytest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/reoring/goreplay/pkg/goreplay"
+	"github.com/reoring/goreplay/pkg/protocol"
+	"github.com/reoring/goreplay/proto"
+)
+
+// Request creates a request message from a literal HTTP message. Line endings of the head are converted
+// to CRLF, so messages can be written with "\n". The message gets a random id and the current time.
+func Request(raw string) *goreplay.Message {
+	return RequestAt(raw, time.Now())
+}
+
+// RequestAt is Request with the given timestamp, which is used by outputs like the file output
+func RequestAt(raw string, ts time.Time) *goreplay.Message {
+	return &goreplay.Message{
+		Meta: protocol.PayloadHeader(protocol.RequestPayload, protocol.Uuid(), ts.UnixNano(), -1),
+		Data: normalize(raw),
+	}
+}
+
+// Response creates a response to the request from a literal HTTP message
+func Response(req *goreplay.Message, raw string) *goreplay.Message {
+	return &goreplay.Message{
+		Meta: protocol.PayloadHeader(protocol.ResponsePayload, protocol.PayloadID(req.Meta), time.Now().UnixNano(), 0),
+		Data: normalize(raw),
+	}
+}
+
+// normalize converts line endings of the HTTP head to CRLF, the body is kept as is
+func normalize(raw string) []byte {
+	if strings.Contains(raw, "\r\n\r\n") {
+		return []byte(raw)
+	}
+	head, body := raw, ""
+	if i := strings.Index(raw, "\n\n"); i != -1 {
+		head, body = raw[:i+1], raw[i+2:]
+	}
+	head = strings.Replace(strings.Replace(head, "\r\n", "\n", -1), "\n", "\r\n", -1)
+	if !strings.HasSuffix(head, "\r\n") {
+		head += "\r\n"
+	}
+	return []byte(head + "\r\n" + body)
+}
+
+// Input returns scripted messages, and then io.EOF
+type Input struct {
+	mu       sync.Mutex
+	messages []*goreplay.Message
+	read     int
+}
+
+// NewInput creates an input returning the messages
+func NewInput(messages ...*goreplay.Message) *Input {
+	return &Input{messages: messages}
+}
+
+// NewRequestInput creates an input returning requests from literal HTTP messages, see Request
+func NewRequestInput(requests ...string) *Input {
+	i := new(Input)
+	for _, raw := range requests {
+		i.messages = append(i.messages, Request(raw))
+	}
+	return i
+}
+
+// Read returns the next message, or io.EOF if all of them were read
+func (i *Input) Read(ctx context.Context) (*goreplay.Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.read == len(i.messages) {
+		return nil, io.EOF
+	}
+	msg := i.messages[i.read]
+	i.read++
+	return msg, nil
+}
+
+// Consumed returns the number of messages read
+func (i *Input) Consumed() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.read
+}
+
+func (i *Input) String() string {
+	return "Scripted input"
+}
+
+// Output captures written messages
+type Output struct {
+	mu       sync.Mutex
+	messages []*goreplay.Message
+	written  chan struct{} // closed and replaced on each write
+	closed   bool
+}
+
+// NewOutput creates a capturing output
+func NewOutput() *Output {
+	return &Output{written: make(chan struct{})}
+}
+
+// Write captures a copy of the message
+func (o *Output) Write(ctx context.Context, msg *goreplay.Message) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.messages = append(o.messages, &goreplay.Message{
+		Meta: append([]byte(nil), msg.Meta...),
+		Data: append([]byte(nil), msg.Data...),
+	})
+	close(o.written)
+	o.written = make(chan struct{})
+	return nil
+}
+
+// Close marks the output as closed
+func (o *Output) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.closed = true
+	return nil
+}
+
+// Closed tells if the pipeline closed the output
+func (o *Output) Closed() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.closed
+}
+
+// Messages returns all captured messages
+func (o *Output) Messages() []*goreplay.Message {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]*goreplay.Message(nil), o.messages...)
+}
+
+// Requests returns captured requests
+func (o *Output) Requests() []*goreplay.Message {
+	var requests []*goreplay.Message
+	for _, msg := range o.Messages() {
+		if protocol.IsRequestPayload(msg.Meta) {
+			requests = append(requests, msg)
+		}
+	}
+	return requests
+}
+
+// Wait blocks until at least n messages are captured, or the timeout is reached
+func (o *Output) Wait(n int, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	for {
+		o.mu.Lock()
+		count, written := len(o.messages), o.written
+		o.mu.Unlock()
+
+		if count >= n {
+			return nil
+		}
+		select {
+		case <-written:
+		case <-deadline:
+			return fmt.Errorf("captured %d messages, expected %d", count, n)
+		}
+	}
+}
+
+func (o *Output) String() string {
+	return "Capture output"
+}
+
+// AssertCount checks the number of captured messages
+func (o *Output) AssertCount(t testing.TB, n int) {
+	t.Helper()
+	if messages := o.Messages(); len(messages) != n {
+		t.Errorf("expected %d messages, captured %d: %s", n, len(messages), describe(messages))
+	}
+}
+
+// AssertRequest checks method and path of the i-th captured message
+func (o *Output) AssertRequest(t testing.TB, i int, method, path string) {
+	t.Helper()
+	msg := o.message(t, i)
+	if msg == nil {
+		return
+	}
+	if m, p := proto.Method(msg.Data), proto.Path(msg.Data); string(m) != method || string(p) != path {
+		t.Errorf("message %d: expected %s %s, got %s %s", i, method, path, m, p)
+	}
+}
+
+// AssertHeader checks a header of the i-th captured message
+func (o *Output) AssertHeader(t testing.TB, i int, name, value string) {
+	t.Helper()
+	msg := o.message(t, i)
+	if msg == nil {
+		return
+	}
+	if v := proto.Header(msg.Data, []byte(name)); string(v) != value {
+		t.Errorf("message %d: expected header %s: %q, got %q", i, name, value, v)
+	}
+}
+
+// AssertBody checks the body of the i-th captured message
+func (o *Output) AssertBody(t testing.TB, i int, body string) {
+	t.Helper()
+	msg := o.message(t, i)
+	if msg == nil {
+		return
+	}
+	if b := proto.Body(msg.Data); !bytes.Equal(b, []byte(body)) {
+		t.Errorf("message %d: expected body %q, got %q", i, body, b)
+	}
+}
+
+func (o *Output) message(t testing.TB, i int) *goreplay.Message {
+	t.Helper()
+	messages := o.Messages()
+	if i >= len(messages) {
+		t.Errorf("message %d was not captured, captured %d: %s", i, len(messages), describe(messages))
+		return nil
+	}
+	return messages[i]
+}
+
+func describe(messages []*goreplay.Message) string {
+	lines := make([]string, len(messages))
+	for i, msg := range messages {
+		line := msg.Data
+		if n := bytes.IndexByte(line, '\r'); n != -1 {
+			line = line[:n]
+		}
+		lines[i] = fmt.Sprintf("%q", line)
+	}
+	return "[" + strings.Join(lines, ", ") + "]"
+}
@@ -0,0 +1,187 @@
+package goreplaytest
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/reoring/goreplay/pkg/goreplay"
+	"github.com/reoring/goreplay/pkg/protocol"
+)
+
+func TestRequest(t *testing.T) {
+	msg := Request("POST /users HTTP/1.1\nHost: example.org\nContent-Length: 3\n\na\nb")
+	if string(msg.Data) != "POST /users HTTP/1.1\r\nHost: example.org\r\nContent-Length: 3\r\n\r\na\nb" {
+		t.Errorf("Should convert line endings of the head, got %q", msg.Data)
+	}
+	if !protocol.IsRequestPayload(msg.Meta) {
+		t.Error("Should be a request")
+	}
+
+	resp := Response(msg, "HTTP/1.1 200 OK\n\n")
+	if string(protocol.PayloadID(resp.Meta)) != string(protocol.PayloadID(msg.Meta)) || protocol.IsRequestPayload(resp.Meta) {
+		t.Error("Should be a response to the request", string(resp.Meta))
+	}
+	if string(resp.Data) != "HTTP/1.1 200 OK\r\n\r\n" {
+		t.Errorf("Unexpected response %q", resp.Data)
+	}
+}
+
+func TestInputOutput(t *testing.T) {
+	in := NewRequestInput(
+		"GET /users HTTP/1.1\nHost: example.org\n\n",
+		"POST /users HTTP/1.1\nHost: example.org\nContent-Length: 2\n\n{}",
+		"GET /health HTTP/1.1\nHost: example.org\n\n",
+	)
+	out := NewOutput()
+	p, err := goreplay.New(
+		goreplay.WithInput(in),
+		goreplay.WithOutput(out),
+		goreplay.WithFilter(`path == "/users"`),
+		goreplay.WithFlags("--http-set-header", "X-Replayed: 1"),
+		goreplay.WithOutputQueue(0, ""),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if in.Consumed() != 3 {
+		t.Error("Should read all messages", in.Consumed())
+	}
+	out.AssertCount(t, 2)
+	out.AssertRequest(t, 0, "GET", "/users")
+	out.AssertRequest(t, 1, "POST", "/users")
+	out.AssertHeader(t, 1, "X-Replayed", "1")
+	out.AssertBody(t, 1, "{}")
+	if !out.Closed() {
+		t.Error("Should be closed")
+	}
+}
+
+func TestClock(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewClock(start)
+
+	c, _ := clock.After(time.Minute)
+	_, stop := clock.After(time.Hour)
+	stop()
+	if clock.Timers() != 1 {
+		t.Error("Stopped timer should be removed", clock.Timers())
+	}
+
+	clock.Advance(30 * time.Second)
+	select {
+	case <-c:
+		t.Error("Timer should not fire yet")
+	default:
+	}
+
+	clock.Advance(30 * time.Second)
+	select {
+	case now := <-c:
+		if !now.Equal(start.Add(time.Minute)) {
+			t.Error("Should receive current time", now)
+		}
+	default:
+		t.Error("Timer should fire")
+	}
+	if err := clock.BlockUntil(1, 10*time.Millisecond); err == nil {
+		t.Error("No timers should be waiting")
+	}
+}
+
+func TestFileInputClock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goreplaytest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// requests recorded an hour apart
+	start := time.Now().Add(-24 * time.Hour)
+	path := filepath.Join(dir, "requests.gor")
+	f, _ := os.Create(path)
+	for i, raw := range []string{"GET /1 HTTP/1.1\n\n", "GET /2 HTTP/1.1\n\n"} {
+		msg := RequestAt(raw, start.Add(time.Duration(i)*time.Hour))
+		f.Write(msg.Meta)
+		f.Write(msg.Data)
+		f.Write([]byte(protocol.PayloadSeparator))
+	}
+	f.Close()
+
+	clock := NewClock(start)
+	in, err := goreplay.NewFileInput(path, goreplay.FileInputConfig{Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := NewOutput()
+	p, err := goreplay.New(goreplay.WithInput(in), goreplay.WithOutput(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- p.Run(context.Background()) }()
+
+	if err := out.Wait(1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := clock.BlockUntil(1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(59 * time.Minute)
+	if out.Wait(2, 50*time.Millisecond) == nil {
+		t.Error("Second request should wait for the clock")
+	}
+	clock.Advance(time.Minute)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Should replay all requests")
+	}
+	out.AssertCount(t, 2)
+	out.AssertRequest(t, 1, "GET", "/2")
+}
+
+func TestUpstream(t *testing.T) {
+	upstream := NewUpstream()
+	defer upstream.Close()
+	upstream.Respond(201, "created")
+
+	in := NewRequestInput(
+		"POST /users?id=1 HTTP/1.1\nHost: example.org\nContent-Length: 2\n\n{}",
+		"GET /users HTTP/1.1\nHost: example.org\n\n",
+	)
+	out, err := goreplay.NewHTTPOutput(upstream.URL, goreplay.HTTPOutputConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := goreplay.New(goreplay.WithInput(in), goreplay.WithOutput(out), goreplay.WithOutputQueue(0, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	upstream.AssertCount(t, 2)
+	requests := upstream.Requests()
+	// HTTP output sends requests concurrently
+	for _, r := range requests {
+		if r.Method == "POST" && (r.Path != "/users?id=1" || string(r.Body) != "{}") {
+			t.Error("Should record the request", r)
+		}
+	}
+	if err := upstream.Wait(3, 10*time.Millisecond); err == nil {
+		t.Error("Should time out")
+	}
+}
@@ -0,0 +1,127 @@
+package goreplaytest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// RecordedRequest is a request received by Upstream
+type RecordedRequest struct {
+	Method string
+	Path   string // path with the query string
+	Host   string
+	Header http.Header
+	Body   []byte
+}
+
+// Upstream is a local HTTP server recording requests, to be used as the address of the HTTP output
+type Upstream struct {
+	URL string
+
+	mu       sync.Mutex
+	server   *httptest.Server
+	requests []RecordedRequest
+	received chan struct{} // closed and replaced on each request
+	handler  http.Handler
+}
+
+// NewUpstream starts a server responding with 200 OK and an empty body
+func NewUpstream() *Upstream {
+	u := &Upstream{received: make(chan struct{})}
+	u.server = httptest.NewServer(http.HandlerFunc(u.serveHTTP))
+	u.URL = u.server.URL
+	return u
+}
+
+// Handle makes the upstream respond with the handler, after the request is recorded
+func (u *Upstream) Handle(handler http.Handler) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.handler = handler
+}
+
+// Respond makes the upstream respond with the status and body
+func (u *Upstream) Respond(status int, body string) {
+	u.Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+}
+
+func (u *Upstream) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	u.mu.Lock()
+	u.requests = append(u.requests, RecordedRequest{
+		Method: r.Method,
+		Path:   r.URL.RequestURI(),
+		Host:   r.Host,
+		Header: r.Header.Clone(),
+		Body:   body,
+	})
+	close(u.received)
+	u.received = make(chan struct{})
+	handler := u.handler
+	u.mu.Unlock()
+
+	if handler != nil {
+		handler.ServeHTTP(w, r)
+	}
+}
+
+// Requests returns received requests
+func (u *Upstream) Requests() []RecordedRequest {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]RecordedRequest(nil), u.requests...)
+}
+
+// Wait blocks until at least n requests are received, or the timeout is reached
+func (u *Upstream) Wait(n int, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	for {
+		u.mu.Lock()
+		count, received := len(u.requests), u.received
+		u.mu.Unlock()
+
+		if count >= n {
+			return nil
+		}
+		select {
+		case <-received:
+		case <-deadline:
+			return fmt.Errorf("received %d requests, expected %d", count, n)
+		}
+	}
+}
+
+// AssertCount checks the number of received requests
+func (u *Upstream) AssertCount(t testing.TB, n int) {
+	t.Helper()
+	if requests := u.Requests(); len(requests) != n {
+		t.Errorf("expected %d requests, received %d", n, len(requests))
+	}
+}
+
+// AssertRequest checks method and path of the i-th received request
+func (u *Upstream) AssertRequest(t testing.TB, i int, method, path string) {
+	t.Helper()
+	requests := u.Requests()
+	if i >= len(requests) {
+		t.Errorf("request %d was not received, received %d", i, len(requests))
+		return
+	}
+	if r := requests[i]; r.Method != method || r.Path != path {
+		t.Errorf("request %d: expected %s %s, got %s %s", i, method, path, r.Method, r.Path)
+	}
+}
+
+// Close shuts down the server
+func (u *Upstream) Close() {
+	u.server.Close()
+}
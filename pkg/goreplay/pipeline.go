@@ -0,0 +1,340 @@
+package goreplay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/reoring/goreplay/pkg/core"
+)
+
+// Option configures a Pipeline
+type Option func(*Pipeline) error
+
+type namedInput struct {
+	name  string
+	input Input
+}
+
+type namedOutput struct {
+	name   string
+	output Output
+}
+
+// Pipeline copies messages from inputs to outputs
+type Pipeline struct {
+	flags           []string
+	inputs          []namedInput
+	outputs         []namedOutput
+	filters         []string
+	responseFilters []string
+	routes          []string
+	middleware      []string
+	splitOutput     bool
+	queue           *core.OutputQueueConfig
+	shutdownTimeout *time.Duration
+
+	settings *core.AppSettings
+	emitter  *core.Emitter
+	started  int32
+}
+
+// New creates a pipeline, it requires at least one input and one output
+func New(opts ...Option) (*Pipeline, error) {
+	p := new(Pipeline)
+	for _, opt := range opts {
+		if err := opt(p); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(p.inputs) == 0 || len(p.outputs) == 0 {
+		return nil, errors.New("required at least 1 input and 1 output")
+	}
+
+	if err := p.checkLimits(); err != nil {
+		return nil, err
+	}
+
+	settings, err := p.buildSettings()
+	if err != nil {
+		return nil, err
+	}
+	p.settings = settings
+	p.emitter = core.NewEmitterWithSettings(settings)
+
+	return p, nil
+}
+
+// checkLimits validates limit suffixes of plugin names, which are applied only once the pipeline runs
+func (p *Pipeline) checkLimits() error {
+	for _, in := range p.inputs {
+		if _, limit := splitAddress(in.name); limit != "" {
+			var plugin interface{} = in.input
+			if pi, ok := in.input.(*pluginInput); ok {
+				plugin = pi.plugin
+			}
+			if err := core.CheckLimit(plugin, limit); err != nil {
+				return err
+			}
+		}
+	}
+	for _, out := range p.outputs {
+		if _, limit := splitAddress(out.name); limit != "" {
+			var plugin interface{} = out.output
+			if po, ok := out.output.(*pluginOutput); ok {
+				plugin = po.plugin
+			}
+			if err := core.CheckLimit(plugin, limit); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *Pipeline) buildSettings() (*core.AppSettings, error) {
+	s, err := core.ParseSettings(p.flags)
+	if err != nil {
+		return nil, err
+	}
+	if s.Config != "" || len(s.InputRAW)+len(s.InputTCP)+len(s.InputFile)+len(s.InputHTTP)+len(s.InputDummy) > 0 ||
+		len(s.OutputHTTP)+len(s.OutputTCP)+len(s.OutputFile)+len(s.OutputBinary) > 0 || s.OutputStdout || s.OutputNull {
+		return nil, errors.New("flags can't define inputs, outputs or config file, use WithInput and WithOutput")
+	}
+	// settings are per pipeline, these ones apply to the whole process
+	if s.Verbose != 0 || s.Stats || s.Pprof != "" || s.HTTPControl != "" {
+		return nil, errors.New("flags can't set --verbose, --stats, --http-pprof or --http-control, they apply to the whole program")
+	}
+
+	for _, f := range p.filters {
+		if err := s.ModifierConfig.Filters.Set(f); err != nil {
+			return nil, fmt.Errorf("filter %q: %v", f, err)
+		}
+	}
+	for _, f := range p.responseFilters {
+		if err := s.ModifierConfig.ResponseFilters.Set(f); err != nil {
+			return nil, fmt.Errorf("response filter %q: %v", f, err)
+		}
+	}
+	for _, r := range p.routes {
+		if err := s.Routes.Set(r); err != nil {
+			return nil, fmt.Errorf("route %q: %v", r, err)
+		}
+	}
+
+	names := make(map[string]bool)
+	for _, out := range p.outputs {
+		path, _ := splitAddress(out.name)
+		names[path] = true
+	}
+	for _, name := range s.Routes.Outputs() {
+		if !names[name] {
+			return nil, fmt.Errorf("route refers to unknown output %q", name)
+		}
+	}
+
+	s.Middleware = append(s.Middleware, p.middleware...)
+	if p.splitOutput {
+		s.SplitOutput = true
+	}
+	if p.queue != nil {
+		s.OutputQueueConfig = *p.queue
+	}
+	if p.shutdownTimeout != nil {
+		s.ShutdownTimeout = *p.shutdownTimeout
+	}
+
+	return s, nil
+}
+
+// WithInput adds an input. Built-in inputs are referred to by their address, others have no name.
+func WithInput(in Input) Option {
+	return WithNamedInput("", in)
+}
+
+// WithNamedInput adds an input with a name, used in the control API
+func WithNamedInput(name string, in Input) Option {
+	return func(p *Pipeline) error {
+		if in == nil {
+			return errors.New("nil input")
+		}
+		if pi, ok := in.(*pluginInput); ok && name == "" {
+			name = pi.address
+		}
+		p.inputs = append(p.inputs, namedInput{name, in})
+		return nil
+	}
+}
+
+// WithOutput adds an output. Built-in outputs are referred to by their address, others have no name.
+func WithOutput(out Output) Option {
+	return WithNamedOutput("", out)
+}
+
+// WithNamedOutput adds an output with a name, used in routing rules and the control API
+func WithNamedOutput(name string, out Output) Option {
+	return func(p *Pipeline) error {
+		if out == nil {
+			return errors.New("nil output")
+		}
+		if po, ok := out.(*pluginOutput); ok && name == "" {
+			name = po.address
+		}
+		p.outputs = append(p.outputs, namedOutput{name, out})
+		return nil
+	}
+}
+
+// WithFilter drops requests not matching the expression, like --filter
+func WithFilter(expression string) Option {
+	return func(p *Pipeline) error {
+		p.filters = append(p.filters, expression)
+		return nil
+	}
+}
+
+// WithResponseFilter drops responses not matching the expression, like --filter-response
+func WithResponseFilter(expression string) Option {
+	return func(p *Pipeline) error {
+		p.responseFilters = append(p.responseFilters, expression)
+		return nil
+	}
+}
+
+// WithRoute sends messages matching the expression only to the given outputs, like --route
+func WithRoute(expression string, outputs ...string) Option {
+	return func(p *Pipeline) error {
+		p.routes = append(p.routes, expression+" => "+strings.Join(outputs, ", "))
+		return nil
+	}
+}
+
+// WithMiddleware passes messages through the command, like --middleware
+func WithMiddleware(command string) Option {
+	return func(p *Pipeline) error {
+		p.middleware = append(p.middleware, command)
+		return nil
+	}
+}
+
+// WithSplitOutput splits traffic among outputs instead of sending everything to each one, like --split-output
+func WithSplitOutput() Option {
+	return func(p *Pipeline) error {
+		p.splitOutput = true
+		return nil
+	}
+}
+
+// WithOutputQueue changes queues of outputs, like --output-queue-size and --output-queue-policy.
+// Size 0 makes writes to outputs synchronous.
+func WithOutputQueue(size int, policy string) Option {
+	return func(p *Pipeline) error {
+		config := core.OutputQueueConfig{Size: size}
+		if policy != "" {
+			if err := config.Policies.Set(policy); err != nil {
+				return err
+			}
+		}
+		p.queue = &config
+		return nil
+	}
+}
+
+// WithShutdownTimeout sets how long outputs are given to write queued messages when the pipeline stops, 10s by default
+func WithShutdownTimeout(timeout time.Duration) Option {
+	return func(p *Pipeline) error {
+		p.shutdownTimeout = &timeout
+		return nil
+	}
+}
+
+// WithFlags applies command line flags of gor, like `--http-allow-url /api` or `--http-set-header`,
+// except the ones defining inputs and outputs. Options above take precedence.
+func WithFlags(args ...string) Option {
+	return func(p *Pipeline) error {
+		p.flags = append(p.flags, args...)
+		return nil
+	}
+}
+
+// ShutdownError is returned by Run if outputs did not write all messages within the shutdown timeout
+type ShutdownError struct {
+	Discarded map[string]int // number of discarded messages by output
+}
+
+func (e *ShutdownError) Error() string {
+	var outputs []string
+	for name, n := range e.Discarded {
+		outputs = append(outputs, fmt.Sprintf("%s: %d", name, n))
+	}
+	sort.Strings(outputs)
+	return "shutdown timeout reached, discarded messages: " + strings.Join(outputs, ", ")
+}
+
+// Run copies messages until all inputs are exhausted or ctx is done, and then stops gracefully:
+// inputs are closed first, and outputs are given the shutdown timeout to write queued messages.
+// It returns ctx.Err() if stopped by ctx, the error of an input or output which failed to copy a message,
+// and *ShutdownError if some messages were discarded.
+// A pipeline can run only once.
+func (p *Pipeline) Run(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&p.started, 0, 1) {
+		return errors.New("pipeline can run only once")
+	}
+
+	plugins := new(core.InOutPlugins)
+	for _, in := range p.inputs {
+		var plugin core.PluginReader
+		if pi, ok := in.input.(*pluginInput); ok {
+			plugin = pi.plugin
+		} else {
+			plugin = newInputPlugin(in.input)
+		}
+		if err := plugins.AddInput(plugin, in.name); err != nil {
+			return err
+		}
+	}
+	for _, out := range p.outputs {
+		var plugin core.PluginWriter
+		if po, ok := out.output.(*pluginOutput); ok {
+			plugin = po.plugin
+		} else {
+			plugin = newOutputPlugin(out.output)
+		}
+		if err := plugins.AddOutput(plugin, out.name); err != nil {
+			return err
+		}
+	}
+
+	if err := p.emitter.Start(plugins, p.settings.Middleware...); err != nil {
+		return err
+	}
+
+	var err error
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-p.emitter.InputsFinished():
+	case <-p.emitter.Failed():
+	}
+	if err == nil {
+		err = p.emitter.Err()
+	}
+
+	discarded := p.emitter.Shutdown(p.settings.ShutdownTimeout)
+	if err == nil && len(discarded) > 0 {
+		err = &ShutdownError{Discarded: discarded}
+	}
+	return err
+}
+
+// ControlHandler returns handler of the control API, to be mounted at /control/ of the program's HTTP server.
+// It allows to pause file inputs, change their speed, disable outputs and read state of plugins while running.
+func (p *Pipeline) ControlHandler() http.Handler {
+	return core.NewControlAPI(p.emitter, nil)
+}
@@ -0,0 +1,249 @@
+package goreplay
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/reoring/goreplay/pkg/protocol"
+	"github.com/reoring/goreplay/proto"
+)
+
+func request(method string) *Message {
+	return &Message{
+		Meta: protocol.PayloadHeader(protocol.RequestPayload, protocol.Uuid(), time.Now().UnixNano(), -1),
+		Data: []byte(method + " / HTTP/1.1\r\nHost: example.org\r\n\r\n"),
+	}
+}
+
+// sliceInput returns the messages and then io.EOF
+func sliceInput(msgs ...*Message) Input {
+	var mu sync.Mutex
+	return InputFunc(func(ctx context.Context) (*Message, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(msgs) == 0 {
+			return nil, io.EOF
+		}
+		msg := msgs[0]
+		msgs = msgs[1:]
+		return msg, nil
+	})
+}
+
+type captureOutput struct {
+	mu      sync.Mutex
+	methods []string
+	closed  bool
+}
+
+func (o *captureOutput) Write(ctx context.Context, msg *Message) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.methods = append(o.methods, string(proto.Method(msg.Data)))
+	return nil
+}
+
+func (o *captureOutput) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.closed = true
+	return nil
+}
+
+func TestPipelineRun(t *testing.T) {
+	out := new(captureOutput)
+	p, err := New(
+		WithInput(sliceInput(request("GET"), request("POST"), request("GET"))),
+		WithOutput(out),
+		WithFilter(`method == "GET"`),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(out.methods) != 2 || out.methods[0] != "GET" || out.methods[1] != "GET" {
+		t.Error("Should write filtered requests", out.methods)
+	}
+	if !out.closed {
+		t.Error("Should close outputs")
+	}
+	if err := p.Run(context.Background()); err == nil {
+		t.Error("Should run only once")
+	}
+}
+
+func TestPipelineRoutes(t *testing.T) {
+	api, other := new(captureOutput), new(captureOutput)
+	p, err := New(
+		WithInput(sliceInput(request("GET"), request("POST"))),
+		WithNamedOutput("api", api),
+		WithNamedOutput("other", other),
+		WithRoute(`method == "POST"`, "api"),
+		WithRoute("true", "other"),
+		WithOutputQueue(0, ""),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(api.methods) != 1 || api.methods[0] != "POST" || len(other.methods) != 1 || other.methods[0] != "GET" {
+		t.Error("Should route requests", api.methods, other.methods)
+	}
+}
+
+func TestPipelineContext(t *testing.T) {
+	// input which never ends
+	in := InputFunc(func(ctx context.Context) (*Message, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	p, err := New(WithInput(in), WithOutput(new(captureOutput)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error)
+	go func() { done <- p.Run(ctx) }()
+
+	select {
+	case err := <-done:
+		if err != context.DeadlineExceeded {
+			t.Error("Should return context error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Should stop when context is done")
+	}
+}
+
+func TestPipelineOutputError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goreplay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := NewFileOutput(filepath.Join(dir, "requests.gor"), FileOutputConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the file can't be created anymore
+	os.RemoveAll(dir)
+
+	p, err := New(
+		WithInput(InputFunc(func(ctx context.Context) (*Message, error) {
+			return request("GET"), nil
+		})),
+		WithOutput(out),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.Run(ctx); err == nil || err == context.DeadlineExceeded {
+		t.Error("Should stop on output error", err)
+	}
+}
+
+func TestPipelineFileToHTTP(t *testing.T) {
+	var received int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&received, 1)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "goreplay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "requests.gor")
+	f, _ := os.Create(path)
+	for i := 0; i < 5; i++ {
+		msg := request("GET")
+		f.Write(msg.Meta)
+		f.Write(msg.Data)
+		f.Write([]byte(protocol.PayloadSeparator))
+	}
+	f.Close()
+
+	in, err := NewFileInput(path+"|1000%", FileInputConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := NewHTTPOutput(server.URL, HTTPOutputConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := New(WithInput(in), WithOutput(out), WithFlags("--http-set-header", "X-Replayed: 1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&received); n != 5 {
+		t.Error("Should replay all requests before returning", n)
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	out := new(captureOutput)
+	tests := map[string][]Option{
+		"no inputs":      {WithOutput(out)},
+		"bad filter":     {WithInput(sliceInput()), WithOutput(out), WithFilter("method ==")},
+		"unknown route":  {WithInput(sliceInput()), WithNamedOutput("api", out), WithRoute("true", "staging")},
+		"plugin flags":   {WithInput(sliceInput()), WithOutput(out), WithFlags("--output-stdout")},
+		"unknown flag":   {WithInput(sliceInput()), WithOutput(out), WithFlags("--unknown")},
+		"process flags":  {WithInput(sliceInput()), WithOutput(out), WithFlags("--verbose", "1")},
+		"bad policy":     {WithInput(sliceInput()), WithOutput(out), WithOutputQueue(10, "never")},
+		"missing output": {WithInput(sliceInput()), WithOutput(nil)},
+		"invalid limit":  {WithInput(sliceInput()), WithNamedOutput("custom|10,inflight=2", out)},
+	}
+	for name, opts := range tests {
+		if _, err := New(opts...); err == nil {
+			t.Error("Should fail:", name)
+		}
+	}
+
+	if _, err := NewFileInput("/nonexistent/*.gor", FileInputConfig{}); err == nil {
+		t.Error("Should fail on missing files")
+	}
+	if _, err := NewTCPInput("localhost:-1", TCPInputConfig{}); err == nil {
+		t.Error("Should fail on invalid address")
+	}
+	if _, err := NewTCPOutput("localhost", TCPOutputConfig{}); err == nil {
+		t.Error("Should fail on address without port")
+	}
+	if _, err := NewFileOutput("/nonexistent/requests.gor", FileOutputConfig{}); err == nil {
+		t.Error("Should fail on missing directory")
+	}
+	if _, err := NewFileOutput(filepath.Join(os.TempDir(), "requests.gor"), FileOutputConfig{Format: "v3"}); err == nil {
+		t.Error("Should fail on unknown format")
+	}
+	for _, address := range []string{"localhost:abc", "ftp://staging", "http://"} {
+		if _, err := NewHTTPOutput(address, HTTPOutputConfig{}); err == nil {
+			t.Error("Should fail on invalid address", address)
+		}
+	}
+}
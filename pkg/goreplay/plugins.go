@@ -0,0 +1,150 @@
+package goreplay
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/reoring/goreplay/pkg/core"
+)
+
+// Configuration of built-in plugins, zero values are replaced by defaults of the corresponding command line options
+type (
+	RAWInputConfig   = core.RAWInputConfig
+	TCPInputConfig   = core.TCPInputConfig
+	TCPOutputConfig  = core.TCPOutputConfig
+	HTTPOutputConfig = core.HTTPOutputConfig
+	FileOutputConfig = core.FileOutputConfig
+)
+
+// Clock is a source of time for the file input, see goreplaytest.Clock
+type Clock = core.Clock
+
+// FileInputConfig holds configuration of the file input
+type FileInputConfig struct {
+	Loop      bool          // start from the first file once the last one is replayed
+	ReadDepth int           // number of records read in advance and sorted, 100 by default
+	MaxWait   time.Duration // maximum time between requests, unlimited by default
+	Clock     Clock         // used to wait between requests, system time by default
+}
+
+// NewRAWInput starts capturing traffic on the address, like --input-raw
+func NewRAWInput(address string, config RAWInputConfig) (Input, error) {
+	path, _ := splitAddress(address)
+	if config.Expire == 0 {
+		config.Expire = 2 * time.Second
+	}
+	if config.CopyBufferSize == 0 {
+		config.CopyBufferSize = 5 << 20
+	}
+
+	plugin, err := core.CreateRAWInput(path, config)
+	if err != nil {
+		return nil, err
+	}
+	return &pluginInput{plugin: plugin, address: address}, nil
+}
+
+// NewTCPInput starts listening for messages from the TCP output of another instance, like --input-tcp
+func NewTCPInput(address string, config TCPInputConfig) (Input, error) {
+	path, _ := splitAddress(address)
+	plugin, err := core.CreateTCPInput(path, &config)
+	if err != nil {
+		return nil, err
+	}
+	return &pluginInput{plugin: plugin, address: address}, nil
+}
+
+// NewFileInput reads messages from files matching the path, like --input-file
+func NewFileInput(path string, config FileInputConfig) (Input, error) {
+	p, _ := splitAddress(path)
+	if !strings.HasPrefix(p, "s3://") {
+		matches, err := filepath.Glob(p)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no files match %q", p)
+		}
+	}
+	if config.ReadDepth <= 0 {
+		config.ReadDepth = 100
+	}
+
+	if config.Clock == nil {
+		config.Clock = core.RealClock{}
+	}
+
+	plugin := core.NewFileInputWithClock(p, config.Loop, config.ReadDepth, config.MaxWait, false, config.Clock)
+	return &pluginInput{plugin: plugin, address: path}, nil
+}
+
+// NewHTTPOutput replays requests to the address, like --output-http
+func NewHTTPOutput(address string, config HTTPOutputConfig) (Output, error) {
+	path, _ := splitAddress(address)
+	if path == "" {
+		return nil, errors.New("empty HTTP output address")
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 5 * time.Second
+	}
+
+	plugin, err := core.CreateHTTPOutput(path, &config)
+	if err != nil {
+		return nil, err
+	}
+	return &pluginOutput{plugin: plugin, address: address}, nil
+}
+
+// NewTCPOutput sends messages to the TCP input of another instance, like --output-tcp
+func NewTCPOutput(address string, config TCPOutputConfig) (Output, error) {
+	path, _ := splitAddress(address)
+	if _, _, err := net.SplitHostPort(path); err != nil {
+		return nil, err
+	}
+	if config.Workers <= 0 {
+		config.Workers = 10
+	}
+
+	plugin := core.NewTCPOutput(path, &config)
+	return &pluginOutput{plugin: plugin, address: address}, nil
+}
+
+// NewFileOutput writes messages to the file, like --output-file. Path can have date and time variables.
+func NewFileOutput(path string, config FileOutputConfig) (Output, error) {
+	p, _ := splitAddress(path)
+	if strings.HasPrefix(p, "s3://") {
+		return nil, errors.New("S3 paths are not supported")
+	}
+	if info, err := os.Stat(filepath.Dir(p)); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", filepath.Dir(p))
+	}
+	if config.FlushInterval == 0 {
+		config.FlushInterval = time.Second
+	}
+	if config.SizeLimit == 0 {
+		config.SizeLimit = 32 << 20
+	}
+	if config.QueueLimit == 0 {
+		config.QueueLimit = 256
+	}
+
+	plugin, err := core.NewFileOutput(p, &config)
+	if err != nil {
+		return nil, err
+	}
+	return &pluginOutput{plugin: plugin, address: path}, nil
+}
+
+func splitAddress(address string) (path, limit string) {
+	if i := strings.Index(address, "|"); i != -1 {
+		return address[:i], address[i+1:]
+	}
+	return address, ""
+}
@@ -8,8 +8,10 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"sort"
 
 	"github.com/Shopify/sarama"
+	"github.com/reoring/goreplay/pkg/protocol"
 	"github.com/reoring/goreplay/proto"
 )
 
@@ -49,6 +51,7 @@ type KafkaMessage struct {
 	ReqMethod  string            `json:"Req_Method"`
 	ReqBody    string            `json:"Req_Body,omitempty"`
 	ReqHeaders map[string]string `json:"Req_Headers,omitempty"`
+	ReqMeta    map[string]string `json:"Req_Meta,omitempty"`
 }
 
 // NewTLSConfig loads TLS certificates
@@ -102,7 +105,21 @@ func NewKafkaConfig(tlsConfig *KafkaTLSConfig) *sarama.Config {
 func (m KafkaMessage) Dump() ([]byte, error) {
 	var b bytes.Buffer
 
-	b.WriteString(fmt.Sprintf("%s %s %s\n", m.ReqType, m.ReqID, m.ReqTs))
+	if len(m.ReqMeta) == 0 {
+		b.WriteString(fmt.Sprintf("%s %s %s\n", m.ReqType, m.ReqID, m.ReqTs))
+	} else {
+		// meta fields go after the latency, which isn't stored
+		header := []byte(fmt.Sprintf("%s %s %s -1\n", m.ReqType, m.ReqID, m.ReqTs))
+		keys := make([]string, 0, len(m.ReqMeta))
+		for key := range m.ReqMeta {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			header = protocol.AppendMetaField(header, key, m.ReqMeta[key])
+		}
+		b.Write(header)
+	}
 	b.WriteString(fmt.Sprintf("%s %s HTTP/1.1", m.ReqMethod, m.ReqURL))
 	b.Write(proto.CRLF)
 	for key, value := range m.ReqHeaders {
@@ -0,0 +1,415 @@
+// Package parquet writes and reads Apache Parquet files with flat schemas, so recorded traffic can be
+// queried by DuckDB, Spark and other data tools.
+//
+// Each row group has a single data page per column, with PLAIN encoded values and RLE encoded definition
+// levels of optional columns. Pages can be compressed by snappy, gzip or zstd. Read supports only files
+// written this way.
+package parquet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/reoring/goreplay/pkg/version"
+)
+
+const magic = "PAR1"
+
+// Type is the type of column values
+type Type int
+
+// Column types and their values in rows
+const (
+	Int32     Type = iota // int32
+	Int64                 // int64
+	String                // string
+	Bytes                 // []byte
+	Timestamp             // time.Time, stored as microseconds since the epoch in UTC
+)
+
+// physical types, repetition types, converted types and encodings of parquet.thrift
+const (
+	typeInt32     = 1
+	typeInt64     = 2
+	typeByteArray = 6
+
+	repetitionRequired = 0
+	repetitionOptional = 1
+
+	convertedUTF8            = 0
+	convertedTimestampMicros = 10
+
+	encodingPlain = 0
+	encodingRLE   = 3
+
+	pageData = 0
+)
+
+// Column describes a column of the schema
+type Column struct {
+	Name     string
+	Type     Type
+	Optional bool // values can be nil
+}
+
+func (c Column) physicalType() int32 {
+	switch c.Type {
+	case Int32:
+		return typeInt32
+	case Int64, Timestamp:
+		return typeInt64
+	}
+	return typeByteArray
+}
+
+// Codec is the compression of pages
+type Codec int32
+
+// Supported codecs, values are the ones of parquet.thrift
+const (
+	Uncompressed Codec = 0
+	Snappy       Codec = 1
+	Gzip         Codec = 2
+	Zstd         Codec = 6
+)
+
+// ParseCodec returns the codec by name: none, snappy, gzip or zstd
+func ParseCodec(name string) (Codec, error) {
+	switch name {
+	case "none", "":
+		return Uncompressed, nil
+	case "snappy":
+		return Snappy, nil
+	case "gzip":
+		return Gzip, nil
+	case "zstd":
+		return Zstd, nil
+	}
+	return 0, fmt.Errorf("unknown compression %q, expected snappy, gzip, zstd or none", name)
+}
+
+var zstdEncoder, _ = zstd.NewWriter(nil)
+var zstdDecoder, _ = zstd.NewReader(nil)
+
+func (c Codec) compress(data []byte) ([]byte, error) {
+	switch c {
+	case Uncompressed:
+		return data, nil
+	case Snappy:
+		return snappy.Encode(nil, data), nil
+	case Gzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		w.Write(data)
+		err := w.Close()
+		return buf.Bytes(), err
+	case Zstd:
+		return zstdEncoder.EncodeAll(data, nil), nil
+	}
+	return nil, fmt.Errorf("unsupported codec %d", c)
+}
+
+func (c Codec) decompress(data []byte) ([]byte, error) {
+	switch c {
+	case Uncompressed:
+		return data, nil
+	case Snappy:
+		return snappy.Decode(nil, data)
+	case Gzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	case Zstd:
+		return zstdDecoder.DecodeAll(data, nil)
+	}
+	return nil, fmt.Errorf("unsupported codec %d", c)
+}
+
+type columnBuffer struct {
+	levels []byte // definition levels of optional columns, 0 for nil values
+	values []byte // PLAIN encoded values
+}
+
+type columnChunk struct {
+	offset       int64
+	uncompressed int64
+	compressed   int64
+}
+
+type rowGroup struct {
+	rows   int64
+	size   int64
+	chunks []columnChunk
+}
+
+// Writer writes rows to a parquet file. Rows are buffered and written as a row group by Flush, the file
+// is complete once the footer is written by Close.
+type Writer struct {
+	w       io.Writer
+	offset  int64
+	columns []Column
+	codec   Codec
+	buffers []columnBuffer
+	rows    int64 // rows buffered for the next row group
+	groups  []rowGroup
+}
+
+// NewWriter writes the header of the file
+func NewWriter(w io.Writer, columns []Column, codec Codec) (*Writer, error) {
+	if _, err := codec.compress(nil); err != nil {
+		return nil, err
+	}
+	pw := &Writer{w: w, columns: columns, codec: codec, buffers: make([]columnBuffer, len(columns))}
+	return pw, pw.write([]byte(magic))
+}
+
+func (w *Writer) write(data []byte) error {
+	n, err := w.w.Write(data)
+	w.offset += int64(n)
+	return err
+}
+
+// Write buffers the row, values should be in order of columns, with types of their columns
+func (w *Writer) Write(row []interface{}) error {
+	if len(row) != len(w.columns) {
+		return fmt.Errorf("expected %d values, got %d", len(w.columns), len(row))
+	}
+	for i, c := range w.columns {
+		if row[i] == nil && !c.Optional {
+			return fmt.Errorf("column %s is required", c.Name)
+		}
+		if row[i] != nil && !validValue(c.Type, row[i]) {
+			return fmt.Errorf("column %s: unexpected value type %T", c.Name, row[i])
+		}
+	}
+
+	for i, c := range w.columns {
+		b := &w.buffers[i]
+		if c.Optional {
+			if row[i] == nil {
+				b.levels = append(b.levels, 0)
+				continue
+			}
+			b.levels = append(b.levels, 1)
+		}
+		b.values = appendPlain(b.values, row[i])
+	}
+	w.rows++
+	return nil
+}
+
+func validValue(t Type, v interface{}) bool {
+	switch v.(type) {
+	case int32:
+		return t == Int32
+	case int64:
+		return t == Int64
+	case string:
+		return t == String
+	case []byte:
+		return t == Bytes
+	case time.Time:
+		return t == Timestamp
+	}
+	return false
+}
+
+func appendPlain(buf []byte, v interface{}) []byte {
+	var b [8]byte
+	switch v := v.(type) {
+	case int32:
+		binary.LittleEndian.PutUint32(b[:], uint32(v))
+		return append(buf, b[:4]...)
+	case int64:
+		binary.LittleEndian.PutUint64(b[:], uint64(v))
+		return append(buf, b[:]...)
+	case time.Time:
+		binary.LittleEndian.PutUint64(b[:], uint64(v.UnixNano()/1000))
+		return append(buf, b[:]...)
+	case string:
+		binary.LittleEndian.PutUint32(b[:], uint32(len(v)))
+		return append(append(buf, b[:4]...), v...)
+	case []byte:
+		binary.LittleEndian.PutUint32(b[:], uint32(len(v)))
+		return append(append(buf, b[:4]...), v...)
+	}
+	return buf
+}
+
+// appendLevels appends definition levels encoded as runs of the RLE/bit-packing hybrid with bit width 1,
+// prefixed by their length
+func appendLevels(buf []byte, levels []byte) []byte {
+	start := len(buf)
+	buf = append(buf, 0, 0, 0, 0)
+	var v [binary.MaxVarintLen64]byte
+	for i := 0; i < len(levels); {
+		j := i
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+		buf = append(buf, v[:binary.PutUvarint(v[:], uint64(j-i)<<1)]...)
+		buf = append(buf, levels[i])
+		i = j
+	}
+	binary.LittleEndian.PutUint32(buf[start:], uint32(len(buf)-start-4))
+	return buf
+}
+
+// Buffered returns the number of rows which aren't written yet
+func (w *Writer) Buffered() int64 {
+	return w.rows
+}
+
+// Size returns the size of the file with buffered rows, before compression
+func (w *Writer) Size() int64 {
+	size := w.offset
+	for _, b := range w.buffers {
+		size += int64(len(b.levels) + len(b.values))
+	}
+	return size
+}
+
+// Flush writes buffered rows as a row group
+func (w *Writer) Flush() error {
+	if w.rows == 0 {
+		return nil
+	}
+	group := rowGroup{rows: w.rows}
+	for i, c := range w.columns {
+		b := &w.buffers[i]
+		var page []byte
+		if c.Optional {
+			page = appendLevels(page, b.levels)
+		}
+		page = append(page, b.values...)
+		compressed, err := w.codec.compress(page)
+		if err != nil {
+			return err
+		}
+
+		h := newCompactWriter()
+		h.i32(1, pageData)
+		h.i32(2, int32(len(page)))
+		h.i32(3, int32(len(compressed)))
+		h.beginStruct(5)
+		h.i32(1, int32(w.rows))
+		h.i32(2, encodingPlain)
+		h.i32(3, encodingRLE)
+		h.i32(4, encodingRLE)
+		h.endStruct()
+		header := h.bytes()
+
+		chunk := columnChunk{offset: w.offset, uncompressed: int64(len(header) + len(page)), compressed: int64(len(header) + len(compressed))}
+		if err = w.write(header); err != nil {
+			return err
+		}
+		if err = w.write(compressed); err != nil {
+			return err
+		}
+		group.chunks = append(group.chunks, chunk)
+		group.size += chunk.uncompressed
+
+		b.levels, b.values = b.levels[:0], b.values[:0]
+	}
+	w.groups = append(w.groups, group)
+	w.rows = 0
+	return nil
+}
+
+// Close writes buffered rows and the footer, the underlying writer isn't closed
+func (w *Writer) Close() error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	footer := w.footer()
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(len(footer)))
+	footer = append(append(footer, length[:]...), magic...)
+	return w.write(footer)
+}
+
+// footer encodes FileMetaData
+func (w *Writer) footer() []byte {
+	var rows int64
+	for _, g := range w.groups {
+		rows += g.rows
+	}
+
+	m := newCompactWriter()
+	m.i32(1, 1)
+	m.list(2, thriftStruct, len(w.columns)+1)
+	m.beginStruct(0)
+	m.string(4, "schema")
+	m.i32(5, int32(len(w.columns)))
+	m.endStruct()
+	for _, c := range w.columns {
+		m.beginStruct(0)
+		m.i32(1, c.physicalType())
+		if c.Optional {
+			m.i32(3, repetitionOptional)
+		} else {
+			m.i32(3, repetitionRequired)
+		}
+		m.string(4, c.Name)
+		switch c.Type {
+		case String:
+			m.i32(6, convertedUTF8)
+			m.beginStruct(10) // LogicalType
+			m.beginStruct(1)  // STRING
+			m.endStruct()
+			m.endStruct()
+		case Timestamp:
+			m.i32(6, convertedTimestampMicros)
+			m.beginStruct(10) // LogicalType
+			m.beginStruct(8)  // TIMESTAMP
+			m.bool(1, true)   // isAdjustedToUTC
+			m.beginStruct(2)  // unit
+			m.beginStruct(2)  // MICROS
+			m.endStruct()
+			m.endStruct()
+			m.endStruct()
+			m.endStruct()
+		}
+		m.endStruct()
+	}
+	m.i64(3, rows)
+
+	m.list(4, thriftStruct, len(w.groups))
+	for _, g := range w.groups {
+		m.beginStruct(0)
+		m.list(1, thriftStruct, len(g.chunks))
+		for i, chunk := range g.chunks {
+			c := w.columns[i]
+			m.beginStruct(0)
+			m.i64(2, chunk.offset)
+			m.beginStruct(3) // ColumnMetaData
+			m.i32(1, c.physicalType())
+			m.list(2, thriftI32, 2)
+			m.varint(encodingPlain)
+			m.varint(encodingRLE)
+			m.list(3, thriftBinary, 1)
+			m.binary([]byte(c.Name))
+			m.i32(4, int32(w.codec))
+			m.i64(5, g.rows)
+			m.i64(6, chunk.uncompressed)
+			m.i64(7, chunk.compressed)
+			m.i64(9, chunk.offset)
+			m.endStruct()
+			m.endStruct()
+		}
+		m.i64(2, g.size)
+		m.i64(3, g.rows)
+		m.endStruct()
+	}
+	m.string(6, "gor "+version.VERSION)
+	return m.bytes()
+}
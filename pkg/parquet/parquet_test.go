@@ -0,0 +1,132 @@
+package parquet
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testColumns() []Column {
+	columns := []Column{
+		{Name: "id", Type: String},
+		{Name: "timestamp", Type: Timestamp},
+		{Name: "status", Type: Int32, Optional: true},
+		{Name: "size", Type: Int64, Optional: true},
+		{Name: "body", Type: Bytes, Optional: true},
+	}
+	// more than 15 columns use the long form of thrift lists
+	for i := 0; i < 12; i++ {
+		columns = append(columns, Column{Name: fmt.Sprintf("header_%d", i), Type: String, Optional: true})
+	}
+	return columns
+}
+
+func testRow(columns []Column, i int) []interface{} {
+	row := make([]interface{}, len(columns))
+	row[0] = fmt.Sprintf("id%d", i)
+	row[1] = time.Unix(1622556000, int64(i)*1000).UTC()
+	if i%3 != 0 {
+		row[2] = int32(200 + i%5)
+	}
+	if i%7 != 0 {
+		row[3] = int64(i) << 33
+	}
+	if i%2 == 0 {
+		row[4] = []byte{byte(i), 0, 0xff}
+	}
+	for j := 5; j < len(columns); j++ {
+		if i%(j+1) == 0 {
+			row[j] = fmt.Sprintf("value %d", i)
+		}
+	}
+	return row
+}
+
+func TestWriteRead(t *testing.T) {
+	for _, name := range []string{"none", "snappy", "gzip", "zstd"} {
+		codec, err := ParseCodec(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		columns := testColumns()
+		var buf bytes.Buffer
+		w, err := NewWriter(&buf, columns, codec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			if err := w.Write(testRow(columns, i)); err != nil {
+				t.Fatal(err)
+			}
+			if i == 99 {
+				if w.Buffered() != 100 {
+					t.Errorf("%s: expected 100 buffered rows, got %d", name, w.Buffered())
+				}
+				w.Flush()
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(buf.Bytes(), []byte("PAR1")) || !bytes.HasSuffix(buf.Bytes(), []byte("PAR1")) {
+			t.Fatalf("%s: file should start and end with magic", name)
+		}
+
+		f, err := Read(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(f.Columns, columns) {
+			t.Errorf("%s: expected columns %v, got %v", name, columns, f.Columns)
+		}
+		if len(f.Rows) != 1000 {
+			t.Fatalf("%s: expected 1000 rows, got %d", name, len(f.Rows))
+		}
+		for i, row := range f.Rows {
+			if expected := testRow(columns, i); !reflect.DeepEqual(row, expected) {
+				t.Fatalf("%s: expected row %v, got %v", name, expected, row)
+			}
+		}
+	}
+}
+
+func TestWriteInvalid(t *testing.T) {
+	w, _ := NewWriter(&bytes.Buffer{}, []Column{{Name: "id", Type: String}, {Name: "status", Type: Int32, Optional: true}}, Snappy)
+	if err := w.Write([]interface{}{nil, int32(1)}); err == nil {
+		t.Error("Should reject nil values of required columns")
+	}
+	if err := w.Write([]interface{}{"a", 1}); err == nil {
+		t.Error("Should reject values of other types")
+	}
+	if err := w.Write([]interface{}{"a"}); err == nil {
+		t.Error("Should reject rows with missing values")
+	}
+	if _, err := ParseCodec("brotli"); err == nil {
+		t.Error("Should reject unknown codecs")
+	}
+	if _, err := Read(bytes.NewReader([]byte("PAR1\x00\x00\x00\x00PAR1")), 12); err == nil {
+		t.Error("Should reject invalid files")
+	}
+}
+
+func TestThriftCompact(t *testing.T) {
+	w := newCompactWriter()
+	w.i32(1, 1)
+	w.i64(20, -2)
+	w.list(21, thriftBinary, 1)
+	w.binary([]byte("a"))
+	expected := []byte{0x15, 0x02, 0x06, 0x28, 0x03, 0x19, 0x18, 0x01, 'a', 0x00}
+	if data := w.bytes(); !bytes.Equal(data, expected) {
+		t.Errorf("Expected %x, got %x", expected, data)
+	}
+
+	s, err := (&compactReader{data: expected}).readStruct()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.int(1) != 1 || s.int(20) != -2 || len(s.list(21)) != 1 {
+		t.Errorf("Unexpected fields %v", s)
+	}
+}
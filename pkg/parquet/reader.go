@@ -0,0 +1,219 @@
+package parquet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+var errInvalidFile = errors.New("not a parquet file")
+
+// File is a parquet file read by Read
+type File struct {
+	Columns   []Column
+	Rows      [][]interface{}
+	CreatedBy string
+}
+
+// Read reads a file written by Writer, with values of the same types as they were written
+func Read(r io.ReaderAt, size int64) (*File, error) {
+	if size < 12 {
+		return nil, errInvalidFile
+	}
+	tail := make([]byte, 8)
+	if _, err := r.ReadAt(tail, size-8); err != nil {
+		return nil, err
+	}
+	length := int64(binary.LittleEndian.Uint32(tail))
+	if string(tail[4:]) != magic || length > size-12 {
+		return nil, errInvalidFile
+	}
+	footer := make([]byte, length)
+	if _, err := r.ReadAt(footer, size-8-length); err != nil {
+		return nil, err
+	}
+	meta, err := (&compactReader{data: footer}).readStruct()
+	if err != nil {
+		return nil, fmt.Errorf("footer: %v", err)
+	}
+
+	f := &File{CreatedBy: string(meta.bytes(6))}
+	schema := meta.list(2)
+	if len(schema) == 0 {
+		return nil, fmt.Errorf("footer: no schema")
+	}
+	for _, e := range schema[1:] {
+		el, _ := e.(thriftFields)
+		c := Column{Name: string(el.bytes(4)), Optional: el.int(3) == repetitionOptional}
+		switch el.int(1) {
+		case typeInt32:
+			c.Type = Int32
+		case typeInt64:
+			c.Type = Int64
+			if _, ok := el[6]; ok && el.int(6) == convertedTimestampMicros {
+				c.Type = Timestamp
+			}
+		case typeByteArray:
+			c.Type = Bytes
+			if _, ok := el[6]; ok && el.int(6) == convertedUTF8 {
+				c.Type = String
+			}
+		default:
+			return nil, fmt.Errorf("column %s: unsupported type %d", c.Name, el.int(1))
+		}
+		f.Columns = append(f.Columns, c)
+	}
+
+	for _, g := range meta.list(4) {
+		group, _ := g.(thriftFields)
+		chunks := group.list(1)
+		if len(chunks) != len(f.Columns) {
+			return nil, fmt.Errorf("row group has %d columns, expected %d", len(chunks), len(f.Columns))
+		}
+		rows := make([][]interface{}, group.int(3))
+		for i := range rows {
+			rows[i] = make([]interface{}, len(f.Columns))
+		}
+		for i, c := range chunks {
+			chunk, _ := c.(thriftFields)
+			if err := readColumnChunk(r, f.Columns[i], chunk.structure(3), rows, i); err != nil {
+				return nil, fmt.Errorf("column %s: %v", f.Columns[i].Name, err)
+			}
+		}
+		f.Rows = append(f.Rows, rows...)
+	}
+	return f, nil
+}
+
+func readColumnChunk(r io.ReaderAt, c Column, meta thriftFields, rows [][]interface{}, column int) error {
+	data := make([]byte, meta.int(7))
+	if _, err := r.ReadAt(data, meta.int(9)); err != nil {
+		return err
+	}
+	codec := Codec(meta.int(4))
+
+	row := 0
+	for len(data) > 0 {
+		cr := &compactReader{data: data}
+		header, err := cr.readStruct()
+		if err != nil {
+			return fmt.Errorf("page header: %v", err)
+		}
+		size := header.int(3)
+		if size > int64(len(data)-cr.pos) {
+			return io.ErrUnexpectedEOF
+		}
+		page, err := codec.decompress(data[cr.pos : cr.pos+int(size)])
+		if err != nil {
+			return err
+		}
+		data = data[cr.pos+int(size):]
+		if header.int(1) != pageData {
+			return fmt.Errorf("unsupported page type %d", header.int(1))
+		}
+		if dh := header.structure(5); dh.int(2) != encodingPlain {
+			return fmt.Errorf("unsupported encoding %d", dh.int(2))
+		}
+
+		n := int(header.structure(5).int(1))
+		if row+n > len(rows) {
+			return fmt.Errorf("too many values")
+		}
+		levels := make([]byte, n)
+		for i := range levels {
+			levels[i] = 1
+		}
+		if c.Optional {
+			if page, err = readLevels(page, levels); err != nil {
+				return err
+			}
+		}
+		for i := 0; i < n; i++ {
+			if levels[i] == 0 {
+				row++
+				continue
+			}
+			if rows[row][column], page, err = readPlain(c.Type, page); err != nil {
+				return err
+			}
+			row++
+		}
+	}
+	return nil
+}
+
+// readLevels decodes definition levels with bit width 1, and returns the rest of the page
+func readLevels(page []byte, levels []byte) ([]byte, error) {
+	if len(page) < 4 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	length := int(binary.LittleEndian.Uint32(page))
+	if length > len(page)-4 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	data, rest := page[4:4+length], page[4+length:]
+
+	for i := 0; i < len(levels); {
+		header, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		data = data[n:]
+		if header&1 == 0 {
+			// run of the same value
+			count := int(header >> 1)
+			if len(data) < 1 || i+count > len(levels) {
+				return nil, io.ErrUnexpectedEOF
+			}
+			for ; count > 0; count-- {
+				levels[i] = data[0]
+				i++
+			}
+			data = data[1:]
+			continue
+		}
+		// bit packed groups of 8 values
+		groups := int(header >> 1)
+		if len(data) < groups {
+			return nil, io.ErrUnexpectedEOF
+		}
+		for b := 0; b < groups*8 && i < len(levels); b++ {
+			levels[i] = data[b/8] >> (b % 8) & 1
+			i++
+		}
+		data = data[groups:]
+	}
+	return rest, nil
+}
+
+func readPlain(t Type, page []byte) (interface{}, []byte, error) {
+	switch t {
+	case Int32:
+		if len(page) < 4 {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		return int32(binary.LittleEndian.Uint32(page)), page[4:], nil
+	case Int64, Timestamp:
+		if len(page) < 8 {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		v := int64(binary.LittleEndian.Uint64(page))
+		if t == Timestamp {
+			return time.Unix(0, v*1000).UTC(), page[8:], nil
+		}
+		return v, page[8:], nil
+	}
+	if len(page) < 4 {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	n := int(binary.LittleEndian.Uint32(page))
+	if n > len(page)-4 {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	if t == String {
+		return string(page[4 : 4+n]), page[4+n:], nil
+	}
+	return append([]byte{}, page[4:4+n]...), page[4+n:], nil
+}
@@ -0,0 +1,244 @@
+package parquet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Parquet metadata is encoded by the thrift compact protocol. Only the types used by parquet.thrift
+// are supported.
+const (
+	thriftTrue   = 1
+	thriftFalse  = 2
+	thriftByte   = 3
+	thriftI16    = 4
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftDouble = 7
+	thriftBinary = 8
+	thriftList   = 9
+	thriftSet    = 10
+	thriftStruct = 12
+)
+
+// compactWriter encodes a thrift struct, fields should be written in order of their ids
+type compactWriter struct {
+	buf  []byte
+	last []int16 // id of the last field of each open struct
+}
+
+func newCompactWriter() *compactWriter {
+	return &compactWriter{last: []int16{0}}
+}
+
+// bytes ends the top level struct and returns the encoded data
+func (w *compactWriter) bytes() []byte {
+	return append(w.buf, 0)
+}
+
+func (w *compactWriter) field(id int16, typ byte) {
+	last := &w.last[len(w.last)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		w.buf = append(w.buf, byte(delta)<<4|typ)
+	} else {
+		w.buf = append(w.buf, typ)
+		w.varint(int64(id))
+	}
+	*last = id
+}
+
+func (w *compactWriter) uvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	w.buf = append(w.buf, b[:binary.PutUvarint(b[:], v)]...)
+}
+
+// varint appends the zigzag encoded value
+func (w *compactWriter) varint(v int64) {
+	w.uvarint(uint64(v<<1) ^ uint64(v>>63))
+}
+
+func (w *compactWriter) binary(v []byte) {
+	w.uvarint(uint64(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+func (w *compactWriter) i32(id int16, v int32) {
+	w.field(id, thriftI32)
+	w.varint(int64(v))
+}
+
+func (w *compactWriter) i64(id int16, v int64) {
+	w.field(id, thriftI64)
+	w.varint(v)
+}
+
+func (w *compactWriter) string(id int16, v string) {
+	w.field(id, thriftBinary)
+	w.binary([]byte(v))
+}
+
+func (w *compactWriter) bool(id int16, v bool) {
+	if v {
+		w.field(id, thriftTrue)
+	} else {
+		w.field(id, thriftFalse)
+	}
+}
+
+// beginStruct starts a struct field, or a struct element of a list if id is 0
+func (w *compactWriter) beginStruct(id int16) {
+	if id != 0 {
+		w.field(id, thriftStruct)
+	}
+	w.last = append(w.last, 0)
+}
+
+func (w *compactWriter) endStruct() {
+	w.buf = append(w.buf, 0)
+	w.last = w.last[:len(w.last)-1]
+}
+
+// list starts a list field of n elements, which are written next
+func (w *compactWriter) list(id int16, elem byte, n int) {
+	w.field(id, thriftList)
+	if n < 15 {
+		w.buf = append(w.buf, byte(n)<<4|elem)
+	} else {
+		w.buf = append(w.buf, 0xf0|elem)
+		w.uvarint(uint64(n))
+	}
+}
+
+// thriftFields are fields of a decoded struct by their ids, values are int64, bool, []byte (doubles are left undecoded),
+// []interface{} and thriftFields
+type thriftFields map[int16]interface{}
+
+func (s thriftFields) int(id int16) int64 {
+	v, _ := s[id].(int64)
+	return v
+}
+
+func (s thriftFields) bytes(id int16) []byte {
+	v, _ := s[id].([]byte)
+	return v
+}
+
+func (s thriftFields) structure(id int16) thriftFields {
+	v, _ := s[id].(thriftFields)
+	return v
+}
+
+func (s thriftFields) list(id int16) []interface{} {
+	v, _ := s[id].([]interface{})
+	return v
+}
+
+var errThrift = errors.New("invalid thrift data")
+
+// compactReader decodes thrift structs
+type compactReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *compactReader) byte() (byte, error) {
+	if r.pos >= len(r.data) {
+		return 0, errThrift
+	}
+	r.pos++
+	return r.data[r.pos-1], nil
+}
+
+func (r *compactReader) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(r.data[r.pos:])
+	if n <= 0 {
+		return 0, errThrift
+	}
+	r.pos += n
+	return v, nil
+}
+
+func (r *compactReader) varint() (int64, error) {
+	v, err := r.uvarint()
+	return int64(v>>1) ^ -int64(v&1), err
+}
+
+func (r *compactReader) readStruct() (thriftFields, error) {
+	s := make(thriftFields)
+	var last int16
+	for {
+		b, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		if b == 0 {
+			return s, nil
+		}
+		typ := b & 0x0f
+		id := last + int16(b>>4)
+		if b>>4 == 0 {
+			v, err := r.varint()
+			if err != nil {
+				return nil, err
+			}
+			id = int16(v)
+		}
+		last = id
+
+		if typ == thriftTrue || typ == thriftFalse {
+			s[id] = typ == thriftTrue
+			continue
+		}
+		if s[id], err = r.readValue(typ); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (r *compactReader) readValue(typ byte) (interface{}, error) {
+	switch typ {
+	case thriftTrue, thriftFalse, thriftByte:
+		b, err := r.byte()
+		return int64(b), err
+	case thriftI16, thriftI32, thriftI64:
+		return r.varint()
+	case thriftDouble:
+		if r.pos+8 > len(r.data) {
+			return nil, errThrift
+		}
+		r.pos += 8
+		return r.data[r.pos-8 : r.pos], nil
+	case thriftBinary:
+		n, err := r.uvarint()
+		if err != nil || uint64(len(r.data)-r.pos) < n {
+			return nil, errThrift
+		}
+		r.pos += int(n)
+		return r.data[r.pos-int(n) : r.pos], nil
+	case thriftList, thriftSet:
+		b, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		n := uint64(b >> 4)
+		if n == 15 {
+			if n, err = r.uvarint(); err != nil {
+				return nil, err
+			}
+		}
+		if n > uint64(len(r.data)) {
+			return nil, errThrift
+		}
+		list := make([]interface{}, n)
+		for i := range list {
+			if list[i], err = r.readValue(b & 0x0f); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	case thriftStruct:
+		return r.readStruct()
+	}
+	return nil, fmt.Errorf("unsupported thrift type %d", typ)
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
+	"strings"
 )
 
 // These constants help to indicate the type of payload
@@ -53,6 +54,100 @@ func PayloadHeader(payloadType byte, uuid []byte, timing int64, latency int64) (
 	return []byte(fmt.Sprintf("%c %s %d %d\n", payloadType, uuid, timing, latency))
 }
 
+// Meta fields are optional `key=value` fields of the payload header after type, id, timestamp and latency,
+// like source address or tags. Readers which split the header by spaces see them as extra fields, so
+// values are escaped: `%`, spaces and line breaks are percent-encoded.
+//
+// Example:
+//  1 f45590522cd1838b4a0d5c5aab80b77929dea3b3 13923489726487326 -1 src=10.0.0.1:5432 env=prod%20eu\n
+
+var metaEscaper = strings.NewReplacer("%", "%25", " ", "%20", "\n", "%0A", "\r", "%0D", "\t", "%09")
+var metaUnescaper = strings.NewReplacer("%25", "%", "%20", " ", "%0A", "\n", "%0D", "\r", "%09", "\t")
+
+// AppendMetaField adds the key=value field to the payload header, or to the meta line of the payload.
+// Keys should not contain spaces or `=`. A new slice is returned.
+func AppendMetaField(header []byte, key, value string) []byte {
+	end := bytes.IndexByte(header, '\n')
+	if end < 0 {
+		end = len(header)
+	}
+	field := " " + key + "=" + metaEscaper.Replace(value)
+	out := make([]byte, 0, len(header)+len(field))
+	out = append(out, header[:end]...)
+	out = append(out, field...)
+	return append(out, header[end:]...)
+}
+
+// SetMetaField replaces the value of the meta field, or adds it if it's missing. A new slice is returned.
+func SetMetaField(header []byte, key, value string) []byte {
+	end := bytes.IndexByte(header, '\n')
+	if end < 0 {
+		end = len(header)
+	}
+	fields := bytes.Split(header[:end], []byte{' '})
+	for i := 4; i < len(fields); i++ {
+		if k, _, ok := splitMetaField(fields[i]); ok && k == key {
+			fields[i] = []byte(key + "=" + metaEscaper.Replace(value))
+			out := bytes.Join(fields, []byte{' '})
+			return append(out, header[end:]...)
+		}
+	}
+	return AppendMetaField(header, key, value)
+}
+
+// MetaField returns the value of the meta field, meta is the split header returned by PayloadMeta
+func MetaField(meta [][]byte, key string) (string, bool) {
+	for i := 4; i < len(meta); i++ {
+		if k, v, ok := splitMetaField(meta[i]); ok && k == key {
+			return metaUnescaper.Replace(v), true
+		}
+	}
+	return "", false
+}
+
+// MetaFields returns all meta fields of the split header, nil if there are none
+func MetaFields(meta [][]byte) map[string]string {
+	var fields map[string]string
+	for i := 4; i < len(meta); i++ {
+		if k, v, ok := splitMetaField(meta[i]); ok {
+			if fields == nil {
+				fields = make(map[string]string)
+			}
+			fields[k] = metaUnescaper.Replace(v)
+		}
+	}
+	return fields
+}
+
+// CopyMetaFields adds meta fields of the src header to the dst header, like fields of a request to its
+// replayed response. A new slice is returned.
+func CopyMetaFields(dst, src []byte) []byte {
+	meta := PayloadMeta(src)
+	if len(meta) <= 4 {
+		return dst
+	}
+	end := bytes.IndexByte(dst, '\n')
+	if end < 0 {
+		end = len(dst)
+	}
+	out := append([]byte{}, dst[:end]...)
+	for _, f := range meta[4:] {
+		if _, _, ok := splitMetaField(f); ok {
+			out = append(out, ' ')
+			out = append(out, f...)
+		}
+	}
+	return append(out, dst[end:]...)
+}
+
+func splitMetaField(field []byte) (key, value string, ok bool) {
+	i := bytes.IndexByte(field, '=')
+	if i <= 0 {
+		return "", "", false
+	}
+	return string(field[:i]), string(field[i+1:]), true
+}
+
 func PayloadBody(payload []byte) []byte {
 	headerSize := bytes.IndexByte(payload, '\n')
 	return payload[headerSize+1:]
@@ -56,6 +56,9 @@ type Stats struct {
 	End       time.Time // last packet's timestamp
 	SrcAddr   string
 	DstAddr   string
+	SrcPort   uint16
+	DstPort   uint16
+	Iface     string // interface the message was captured on
 	Direction Dir
 	TimedOut  bool // timeout before getting the whole message
 	Truncated bool // last packet truncated due to max message size
@@ -222,6 +225,7 @@ type MessageParser struct {
 	close          chan struct{} // to signal that we are able to close
 	ports          []uint16
 	ips            []net.IP
+	Iface          string // name of the captured interface, set to messages
 }
 
 // NewMessageParser returns a new instance of message parser
@@ -363,6 +367,9 @@ func (parser *MessageParser) processPacket(pckt *Packet) {
 	m.Direction = pckt.Direction
 	m.SrcAddr = pckt.SrcIP.String()
 	m.DstAddr = pckt.DstIP.String()
+	m.SrcPort = pckt.SrcPort
+	m.DstPort = pckt.DstPort
+	m.Iface = parser.Iface
 
 	parser.m[mIDX][mID] = m
 